@@ -0,0 +1,142 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
+)
+
+// ackRequestKey is the envelope metadata key that asks the remote peer
+// to acknowledge the message in the envelope once it handled it
+const ackRequestKey = "comm.ack"
+
+// ackKey identifies an awaited acknowledgement by the remote peer
+// it's awaited from and the nonce of the message it acknowledges
+type ackKey struct {
+	pkiID string
+	nonce uint64
+}
+
+// SendWithAck sends a message to a remote peer, and asks it to acknowledge the message.
+// The remote peer acknowledges the message once it handed it to its subscribers, and not
+// if it dropped the message, e.g. as a duplicate. Returns once the acknowledgement arrives,
+// the context expires or the connection is closed
+func (c *commImpl) SendWithAck(ctx context.Context, msg *proto.SignedGossipMessage, peer *RemotePeer) error {
+	if c.isStopping() {
+		return ErrStopping
+	}
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return err
+	}
+	conn, err := c.connStore.getConnection(peer)
+	if isStoppingErr(err) || isObserverModeErr(err) {
+		return err
+	}
+	if err != nil {
+		c.logger.Warning("Failed obtaining connection for", peer, "reason:", err)
+		c.disconnect(peer.PKIID, SendError)
+		return err
+	}
+	env, err := conn.getCodec().Encode(msg)
+	if err != nil {
+		return err
+	}
+	env.Metadata = map[string]string{ackRequestKey: ""}
+
+	key := ackKey{pkiID: string(conn.pkiID), nonce: msg.Nonce}
+	acked := make(chan struct{}, 1)
+	c.lock.Lock()
+	c.pendingAcks[key] = acked
+	c.lock.Unlock()
+	defer func() {
+		c.lock.Lock()
+		delete(c.pendingAcks, key)
+		c.lock.Unlock()
+	}()
+
+	conn.markActive()
+	if err := conn.sendEnvelopeSync(ctx, env); err != nil {
+		if err != ctx.Err() {
+			c.logger.Warning(peer, "isn't responsive:", err)
+			c.connStore.recordError(peer.PKIID, err)
+			c.disconnect(peer.PKIID, SendError)
+		}
+		return err
+	}
+
+	select {
+	case <-acked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-conn.closed:
+		return errors.New("Connection closed before the message was acknowledged")
+	}
+}
+
+// takeAckRequest returns whether the remote peer asked to acknowledge the message
+// in the given envelope, and removes the request so it isn't forwarded along with it
+func takeAckRequest(env *proto.Envelope) bool {
+	if _, requested := env.GetMetadata()[ackRequestKey]; !requested {
+		return false
+	}
+	delete(env.Metadata, ackRequestKey)
+	return true
+}
+
+// acknowledge acknowledges the given message to the remote peer it was received from
+func (c *commImpl) acknowledge(msg *ReceivedMessageImpl) {
+	if msg.conn == nil {
+		return
+	}
+	msg.conn.send(createAckMsg(msg.GetGossipMessage().Nonce), func(error) {}, HighPriority)
+}
+
+// handleAck resolves the awaited acknowledgement if the given message
+// is an acknowledgement, and returns whether it was one
+func (c *commImpl) handleAck(msg *ReceivedMessageImpl) bool {
+	m := msg.GetGossipMessage()
+	if m == nil || m.GossipMessage == nil || m.GetAck() == nil {
+		return false
+	}
+	var sender common.PKIidType
+	if info := msg.GetConnectionInfo(); info != nil {
+		sender = info.ID
+	}
+	c.lock.RLock()
+	acked, exists := c.pendingAcks[ackKey{pkiID: string(sender), nonce: m.GetAck().Nonce}]
+	c.lock.RUnlock()
+	if exists {
+		select {
+		case acked <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// createAckMsg creates an acknowledgement of the message with the given nonce
+func createAckMsg(nonce uint64) *proto.SignedGossipMessage {
+	return (&proto.GossipMessage{
+		Tag:     proto.GossipMessage_EMPTY,
+		Content: &proto.GossipMessage_Ack{Ack: &proto.Ack{Nonce: nonce}},
+	}).NoopSign()
+}
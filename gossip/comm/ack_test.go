@@ -0,0 +1,113 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+func TestSendWithAck(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	comm2.(*commImpl).dedup = newMsgDedup(10)
+
+	m1 := comm1.Accept(acceptAll)
+	m2 := comm2.Accept(acceptAll)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	msg := createGossipMsg()
+	assert.NoError(t, comm1.SendWithAck(ctx, msg, peer2))
+	// The message was handled by the time it's acknowledged,
+	// and the request to acknowledge it isn't handed along with it
+	select {
+	case received := <-m2:
+		assert.Equal(t, msg.Nonce, received.GetGossipMessage().Nonce)
+		assert.Empty(t, received.GetSourceEnvelope().Metadata)
+	default:
+		t.Fatal("Message was acknowledged before it was received")
+	}
+
+	// Acknowledgements aren't published, so the messages sent after
+	// them over the same connections are the next ones to be published
+	expectNext := func(msgs <-chan proto.ReceivedMessage, expected *proto.SignedGossipMessage) {
+		select {
+		case received := <-msgs:
+			assert.Equal(t, expected.Nonce, received.GetGossipMessage().Nonce)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "Didn't receive a message")
+		}
+	}
+	next1, next2 := createGossipMsg(), createGossipMsg()
+	comm2.Send(next1, peer1)
+	comm1.Send(next2, peer2)
+	expectNext(m1, next1)
+	expectNext(m2, next2)
+	assert.Empty(t, comm1.(*commImpl).pendingAcks)
+
+	// A message the remote peer drops as a duplicate isn't acknowledged
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, comm1.SendWithAck(ctx, msg, peer2))
+	assert.Empty(t, comm1.(*commImpl).pendingAcks)
+
+	// Nor is a message while the remote peer doesn't handle messages
+	comm2.(*commImpl).Pause()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, comm1.SendWithAck(ctx, createGossipMsg(), peer2))
+	assert.Empty(t, comm1.(*commImpl).pendingAcks)
+}
+
+func TestAckMsg(t *testing.T) {
+	t.Parallel()
+	inst := &commImpl{lock: &sync.RWMutex{}, pendingAcks: make(map[ackKey]chan struct{})}
+	ack := createAckMsg(42)
+	assert.Equal(t, uint64(42), ack.GetAck().Nonce)
+
+	// Messages that aren't acknowledgements aren't handled
+	assert.False(t, inst.handleAck(&ReceivedMessageImpl{SignedGossipMessage: createGossipMsg()}))
+	assert.False(t, inst.handleAck(&ReceivedMessageImpl{SignedGossipMessage: createHeartbeatMsg()}))
+
+	// Acknowledgements resolve the acknowledgement awaited from their sender only
+	acked := make(chan struct{}, 1)
+	inst.pendingAcks[ackKey{pkiID: "peer1", nonce: 42}] = acked
+	assert.True(t, inst.handleAck(&ReceivedMessageImpl{SignedGossipMessage: ack, connInfo: &proto.ConnectionInfo{ID: common.PKIidType("peer2")}}))
+	assert.Len(t, acked, 0)
+	assert.True(t, inst.handleAck(&ReceivedMessageImpl{SignedGossipMessage: ack, connInfo: &proto.ConnectionInfo{ID: common.PKIidType("peer1")}}))
+	assert.Len(t, acked, 1)
+}
+
+func TestTakeAckRequest(t *testing.T) {
+	t.Parallel()
+	assert.False(t, takeAckRequest(nil))
+	assert.False(t, takeAckRequest(&proto.Envelope{}))
+
+	env := &proto.Envelope{Metadata: map[string]string{ackRequestKey: "", "trace-id": "1"}}
+	assert.True(t, takeAckRequest(env))
+	assert.Equal(t, map[string]string{"trace-id": "1"}, env.Metadata)
+	assert.False(t, takeAckRequest(env))
+}
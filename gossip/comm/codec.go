@@ -0,0 +1,43 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	proto "github.com/hyperledger/fabric/protos/gossip"
+)
+
+// MessageCodec converts gossip messages to the envelopes that are
+// sent over streams, and envelopes received from streams back to messages
+type MessageCodec interface {
+	// Encode returns the envelope the given message is sent in
+	Encode(msg *proto.SignedGossipMessage) (*proto.Envelope, error)
+	// Decode returns the message the given envelope carries
+	Decode(env *proto.Envelope) (*proto.SignedGossipMessage, error)
+}
+
+// defaultCodec sends messages in the envelopes they were signed into
+var defaultCodec MessageCodec = &envelopeCodec{}
+
+type envelopeCodec struct{}
+
+func (*envelopeCodec) Encode(msg *proto.SignedGossipMessage) (*proto.Envelope, error) {
+	return msg.Envelope, nil
+}
+
+func (*envelopeCodec) Decode(env *proto.Envelope) (*proto.SignedGossipMessage, error) {
+	return env.ToGossipMessage()
+}
@@ -18,10 +18,13 @@ package comm
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/hyperledger/fabric/gossip/api"
 	"github.com/hyperledger/fabric/gossip/common"
 	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
 )
 
 // Comm is an object that enables to communicate with other peers
@@ -31,9 +34,65 @@ type Comm interface {
 	// GetPKIid returns this instance's PKI id
 	GetPKIid() common.PKIidType
 
+	// SelfIdentity returns a copy of this instance's identity
+	SelfIdentity() api.PeerIdentityType
+
 	// Send sends a message to remote peers
 	Send(msg *proto.SignedGossipMessage, peers ...*RemotePeer)
 
+	// SendWithPriority sends a message to remote peers with the given priority.
+	// High priority messages are sent before normal priority messages,
+	// and are buffered separately from them
+	SendWithPriority(msg *proto.SignedGossipMessage, priority Priority, peers ...*RemotePeer)
+
+	// SendWithCallback sends a message to remote peers, and invokes the
+	// given callback once per peer with the fate of the message
+	SendWithCallback(msg *proto.SignedGossipMessage, cb SendCallback, peers ...*RemotePeer)
+
+	// SendWithDeadline sends a message to remote peers, unless it's still
+	// buffered when the given deadline passes, in which case it's dropped
+	SendWithDeadline(msg *proto.SignedGossipMessage, deadline time.Time, peers ...*RemotePeer)
+
+	// SendWithContext sends a message to remote peers, and propagates the trace
+	// context of the given context to them, if a trace propagator is set
+	SendWithContext(ctx context.Context, msg *proto.SignedGossipMessage, peers ...*RemotePeer)
+
+	// SendToSubset sends a message to k randomly selected peers out of the candidates,
+	// preferring peers that there is already a connection to
+	SendToSubset(msg *proto.SignedGossipMessage, k int, candidates []*RemotePeer)
+
+	// SendRaw sends an already signed and serialized envelope to remote peers,
+	// sharing it among all of them. The envelope must not be modified afterwards
+	SendRaw(env *proto.Envelope, peers ...*RemotePeer)
+
+	// Forward sends the envelope a message was received in to remote peers as is,
+	// skipping the peer the message was received from
+	Forward(received proto.ReceivedMessage, peers ...*RemotePeer)
+
+	// SendByPKIID sends a message to remote peers over the connections that already
+	// exist to them. Peers that there is no connection to are skipped
+	SendByPKIID(msg *proto.SignedGossipMessage, pkiIDs ...common.PKIidType)
+
+	// SendSync sends a message to a remote peer, bypassing the send buffer,
+	// and returns once the message was written to the stream or the context expired
+	SendSync(ctx context.Context, msg *proto.SignedGossipMessage, peer *RemotePeer) error
+
+	// SendWithAck sends a message to a remote peer, and returns once the remote peer
+	// acknowledged handling it, or the context expired
+	SendWithAck(ctx context.Context, msg *proto.SignedGossipMessage, peer *RemotePeer) error
+
+	// WaitForConnection blocks until a connection to the given remote peer
+	// is established, or until the context expires
+	WaitForConnection(ctx context.Context, peer *RemotePeer) error
+
+	// Flush blocks until the messages buffered for sending to the given
+	// remote peer were written to its stream, or the context expired
+	Flush(ctx context.Context, peer *RemotePeer) error
+
+	// Connect starts establishing a connection to the given remote peer,
+	// and returns a handle of the connection
+	Connect(peer *RemotePeer) (ConnHandle, error)
+
 	// Probe probes a remote node and returns nil if its responsive,
 	// and an error if it's not.
 	Probe(peer *RemotePeer) error
@@ -42,16 +101,48 @@ type Comm interface {
 	// (its identity, nil) on success and (nil, error)
 	Handshake(peer *RemotePeer) (api.PeerIdentityType, error)
 
+	// HandshakeCached behaves like Handshake, but if the PKI-ID of the peer
+	// listening on the remote endpoint is already known, the identity
+	// is returned without performing a handshake
+	HandshakeCached(peer *RemotePeer) (api.PeerIdentityType, error)
+
+	// ResolvePKIID returns the PKI-ID of the peer that was recently found
+	// to be listening on the given endpoint, and whether it was found
+	ResolvePKIID(endpoint string) (common.PKIidType, bool)
+
 	// Accept returns a dedicated read-only channel for messages sent by other nodes that match a certain predicate.
 	// Each message from the channel can be used to send a reply back to the sender
 	Accept(common.MessageAcceptor) <-chan proto.ReceivedMessage
 
+	// AcceptBuffered behaves like Accept, but the returned channel
+	// buffers up to the given number of messages
+	AcceptBuffered(acceptor common.MessageAcceptor, size int) <-chan proto.ReceivedMessage
+
+	// AcceptWithConnInfo behaves like Accept, but the predicate is given the received message
+	// along with the information about the connection it was received from
+	AcceptWithConnInfo(ConnMessageAcceptor) <-chan proto.ReceivedMessage
+
+	// AcceptWithReplay behaves like Accept, but the returned channel first receives
+	// the matching messages out of the last n messages that were received
+	AcceptWithReplay(acceptor common.MessageAcceptor, n int) <-chan proto.ReceivedMessage
+
 	// PresumedDead returns a read-only channel for node endpoints that are suspected to be offline
 	PresumedDead() <-chan common.PKIidType
 
 	// CloseConn closes a connection to a certain endpoint
 	CloseConn(peer *RemotePeer)
 
+	// CloseConnGracefully stops sending new messages to a certain endpoint, waits up to the
+	// given timeout for the messages that are already buffered to be sent, and closes the connection
+	CloseConnGracefully(peer *RemotePeer, timeout time.Duration)
+
+	// CloseConnSync closes a connection to a certain endpoint, and waits until the
+	// connection stopped being serviced and was removed
+	CloseConnSync(peer *RemotePeer) error
+
+	// CloseConnSyncWithContext behaves like CloseConnSync, but stops waiting once the context expires
+	CloseConnSyncWithContext(ctx context.Context, peer *RemotePeer) error
+
 	// Stop stops the module
 	Stop()
 }
@@ -60,9 +151,331 @@ type Comm interface {
 type RemotePeer struct {
 	Endpoint string
 	PKIID    common.PKIidType
+	// DialOpts are used in addition to the dial options of the comm
+	// instance when dialing the peer, and override them where they conflict
+	DialOpts []grpc.DialOption
 }
 
 // String converts a RemotePeer to a string
 func (p *RemotePeer) String() string {
 	return fmt.Sprintf("%s, PKIid:%v", p.Endpoint, p.PKIID)
 }
+
+// ConnMessageAcceptor is a predicate that is used to determine in which
+// received messages a subscriber is interested in, based on the message
+// and on the connection it was received from
+type ConnMessageAcceptor func(msg proto.ReceivedMessage) bool
+
+// EndpointResolver translates the endpoint of a remote peer
+// into an address that can be dialed
+type EndpointResolver func(endpoint string) (string, error)
+
+// OrgClassifier returns the organization of a peer with the given identity
+type OrgClassifier func(identity api.PeerIdentityType) string
+
+// TracePropagator carries trace context between peers in the metadata of envelopes
+type TracePropagator interface {
+	// Inject returns the trace metadata carried by the given context
+	Inject(ctx context.Context) map[string]string
+	// Extract returns a context derived from the given context,
+	// that carries the trace of the given metadata
+	Extract(ctx context.Context, md map[string]string) context.Context
+}
+
+// SendCallback is given the fate of a message sent to a remote peer,
+// which is nil if the message was written to the stream of the peer
+type SendCallback func(peer *RemotePeer, err error)
+
+// UndeliveredHandler is given the envelopes that were sent to a remote
+// peer but weren't delivered, because writing to its stream failed
+type UndeliveredHandler func(pkiID common.PKIidType, envelopes []*proto.Envelope)
+
+// PeerWeight returns the relative weight of a remote peer when selecting
+// a subset of peers to send to. Peers with a non-positive weight aren't selected
+type PeerWeight func(peer *RemotePeer) float64
+
+// SecurityStatus describes the security configuration of a comm instance
+type SecurityStatus struct {
+	// HandshakeSkipped is whether verification of the handshake
+	// signatures of remote peers is skipped for all remote peers
+	HandshakeSkipped bool
+	// HandshakeSkipPredicate is whether a predicate is set that
+	// may skip verification of the handshake for some remote peers
+	HandshakeSkipPredicate bool
+	// TLSEnabled is whether connections are secured with TLS
+	TLSEnabled bool
+	// MutualVerification is whether the TLS certificate chains of
+	// remote peers are verified against trusted roots
+	MutualVerification bool
+}
+
+// SkipHandshakePredicate decides whether verification of the TLS-bound
+// signature of a remote peer at the given address should be skipped
+type SkipHandshakePredicate func(remoteAddr string) bool
+
+// OverloadPredicate decides whether the node is too loaded to accept new
+// streams from remote peers, e.g. because it's approaching its memory limit
+type OverloadPredicate func() bool
+
+// Priority denotes the priority in which a message is sent to remote peers
+type Priority int
+
+const (
+	// NormalPriority is the priority messages are sent with by default
+	NormalPriority Priority = iota
+	// HighPriority messages are sent before normal priority messages
+	HighPriority
+)
+
+// OverflowPolicy denotes what is done with a message that
+// is sent while the send buffer of a connection is full
+type OverflowPolicy int
+
+const (
+	// DropOnOverflow drops the message, and is the default policy
+	DropOnOverflow OverflowPolicy = iota
+	// BlockOnOverflow waits for space in the send buffer for as long as it takes
+	BlockOnOverflow
+	// BlockWithTimeoutOnOverflow waits for space in the send buffer up to
+	// the send block timeout, and then drops the message
+	BlockWithTimeoutOnOverflow
+)
+
+// DuplicateConnPolicy denotes what is done when a remote peer that is already
+// connected to this peer connects to it again from a different host,
+// e.g. because it was restarted on a new address
+type DuplicateConnPolicy int
+
+const (
+	// RejectNewConnection rejects the new connection, and is the default policy
+	RejectNewConnection DuplicateConnPolicy = iota
+	// ReplaceOldConnection closes the existing connection, and keeps the new connection instead
+	ReplaceOldConnection
+)
+
+// ConnectionState denotes whether a connection to a remote peer
+// has been established or closed
+type ConnectionState int
+
+const (
+	// ConnectionEstablished means a connection to the remote peer was established
+	ConnectionEstablished ConnectionState = iota
+	// ConnectionClosed means the connection to the remote peer was closed
+	ConnectionClosed
+)
+
+// ConnectionDirection denotes which side initiated a connection
+type ConnectionDirection int
+
+const (
+	// Outbound connections are initiated by this peer
+	Outbound ConnectionDirection = iota
+	// Inbound connections are initiated by the remote peer
+	Inbound
+)
+
+// String returns a textual representation of the ConnectionDirection
+func (d ConnectionDirection) String() string {
+	if d == Inbound {
+		return "inbound"
+	}
+	return "outbound"
+}
+
+// ConnHandle is a handle of a connection to a remote peer
+type ConnHandle interface {
+	// Ready returns a channel that is closed once the connection is established
+	// and can be used, or once establishing it failed, which Err tells apart
+	Ready() <-chan struct{}
+
+	// Err returns the reason establishing the connection failed, once Ready
+	// is closed. It returns nil if the connection was established
+	Err() error
+
+	// ConnectionInfo returns the authenticated info of the remote
+	// peer, or nil if the connection wasn't established (yet)
+	ConnectionInfo() *proto.ConnectionInfo
+
+	// Close closes the connection, or closes it once it's
+	// established if it wasn't established yet
+	Close()
+}
+
+// ConnectedPeer is a remote peer this peer is connected to
+type ConnectedPeer struct {
+	PKIID common.PKIidType
+	// Direction is which side initiated the connection to the remote peer
+	Direction ConnectionDirection
+}
+
+// ConnectErrorKind classifies why a connection to a remote peer couldn't be established
+type ConnectErrorKind int
+
+const (
+	// ConnectDialFailed means the remote endpoint couldn't be dialed
+	ConnectDialFailed ConnectErrorKind = iota
+	// ConnectPingFailed means the remote endpoint was dialed, but didn't
+	// respond to a ping or didn't accept a gossip stream
+	ConnectPingFailed
+	// ConnectAuthFailed means the handshake with the remote peer failed
+	ConnectAuthFailed
+	// ConnectPKIIDMismatch means the remote peer authenticated with
+	// a PKI-ID other than the expected one
+	ConnectPKIIDMismatch
+	// ConnectStopping means the comm instance is stopping
+	ConnectStopping
+	// ConnectHandshakeTimeout means the remote peer didn't send
+	// its connection message in time during the handshake
+	ConnectHandshakeTimeout
+	// ConnectObserverMode means the comm instance is in observer
+	// mode, and doesn't initiate connections to remote peers
+	ConnectObserverMode
+)
+
+// String returns a textual representation of the ConnectErrorKind
+func (k ConnectErrorKind) String() string {
+	switch k {
+	case ConnectDialFailed:
+		return "DialFailed"
+	case ConnectPingFailed:
+		return "PingFailed"
+	case ConnectAuthFailed:
+		return "AuthFailed"
+	case ConnectPKIIDMismatch:
+		return "PKIIDMismatch"
+	case ConnectStopping:
+		return "Stopping"
+	case ConnectHandshakeTimeout:
+		return "HandshakeTimeout"
+	case ConnectObserverMode:
+		return "ObserverMode"
+	}
+	return fmt.Sprintf("ConnectErrorKind(%d)", int(k))
+}
+
+// ConnectError is returned when a connection to a remote peer couldn't be established
+type ConnectError struct {
+	Kind     ConnectErrorKind
+	Endpoint string
+	// Err is the underlying error
+	Err error
+}
+
+// Error returns a textual representation of the ConnectError
+func (e *ConnectError) Error() string {
+	return fmt.Sprintf("%s connecting to %s: %v", e.Kind, e.Endpoint, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *ConnectError) Unwrap() error {
+	return e.Err
+}
+
+// CloseReason denotes why a connection to a remote peer was closed
+type CloseReason int
+
+const (
+	// LocalStop means the connection was closed by this peer
+	LocalStop CloseReason = iota
+	// RemoteEOF means the remote peer closed the connection
+	RemoteEOF
+	// AuthFailure means the identity of the remote peer was rejected
+	AuthFailure
+	// SendError means sending a message to the remote peer failed
+	SendError
+	// IdleEvict means the connection was closed because it was idle
+	IdleEvict
+	// HeartbeatTimeout means nothing was received from the remote peer
+	// within the alive timeout
+	HeartbeatTimeout
+	// HealthCheckFailure means the remote peer didn't respond to a health check
+	HealthCheckFailure
+	// ConnectionReplaced means the remote peer connected again,
+	// and the new connection replaced the existing one
+	ConnectionReplaced
+)
+
+// String returns a textual representation of the CloseReason
+func (r CloseReason) String() string {
+	switch r {
+	case LocalStop:
+		return "LocalStop"
+	case RemoteEOF:
+		return "RemoteEOF"
+	case AuthFailure:
+		return "AuthFailure"
+	case SendError:
+		return "SendError"
+	case IdleEvict:
+		return "IdleEvict"
+	case HeartbeatTimeout:
+		return "HeartbeatTimeout"
+	case HealthCheckFailure:
+		return "HealthCheckFailure"
+	case ConnectionReplaced:
+		return "ConnectionReplaced"
+	}
+	return fmt.Sprintf("CloseReason(%d)", int(r))
+}
+
+// ConnEventKind denotes the kind of a connection event
+type ConnEventKind int
+
+const (
+	// HandshakeStarted means a handshake with a remote peer has started
+	HandshakeStarted ConnEventKind = iota
+	// IdentityReceived means a remote peer has sent its identity during the handshake
+	IdentityReceived
+	// AuthSucceeded means a remote peer was authenticated
+	AuthSucceeded
+	// AuthFailed means a remote peer failed to authenticate
+	AuthFailed
+	// ConnOpened means a connection to a remote peer was established
+	ConnOpened
+	// ConnClosed means a connection to a remote peer was closed
+	ConnClosed
+	// IdentityChanged means a remote peer presented an identity different from
+	// the one previously associated with its PKI-ID
+	IdentityChanged
+)
+
+// String returns a textual representation of the ConnEventKind
+func (k ConnEventKind) String() string {
+	switch k {
+	case HandshakeStarted:
+		return "HandshakeStarted"
+	case IdentityReceived:
+		return "IdentityReceived"
+	case AuthSucceeded:
+		return "AuthSucceeded"
+	case AuthFailed:
+		return "AuthFailed"
+	case ConnOpened:
+		return "ConnOpened"
+	case ConnClosed:
+		return "ConnClosed"
+	case IdentityChanged:
+		return "IdentityChanged"
+	}
+	return fmt.Sprintf("ConnEventKind(%d)", int(k))
+}
+
+// ConnEvent is an event in the lifecycle of a connection to a remote peer
+type ConnEvent struct {
+	// Time is the time the event occurred at
+	Time time.Time
+	// Kind is the kind of the event
+	Kind ConnEventKind
+	// RemoteAddress is the address of the remote peer, if it's known
+	RemoteAddress string
+	// PKIID is the PKI-ID of the remote peer, if it's known
+	PKIID common.PKIidType
+	// Reason is the reason a connection was closed, only meaningful for ConnClosed events
+	Reason CloseReason
+	// Err is the error that caused the event, if any
+	Err error
+}
+
+// ConnectionStateCallback is invoked whenever a connection to a remote peer
+// is established or closed. The reason is only meaningful for closed connections
+type ConnectionStateCallback func(pkiID common.PKIidType, state ConnectionState, reason CloseReason)
@@ -19,14 +19,20 @@ package comm
 import (
 	"bytes"
 	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"math/rand"
 	"net"
 	"os"
 	"reflect"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/hyperledger/fabric/gossip/api"
 	"github.com/hyperledger/fabric/gossip/common"
@@ -37,88 +43,336 @@ import (
 	"github.com/spf13/viper"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 	"google.golang.org/grpc/peer"
 )
 
 const (
-	defDialTimeout  = time.Second * time.Duration(3)
-	defConnTimeout  = time.Second * time.Duration(2)
-	defRecvBuffSize = 20
-	defSendBuffSize = 20
-	sendOverflowErr = "Send buffer overflow"
+	defDialTimeout          = time.Second * time.Duration(3)
+	defConnTimeout          = time.Second * time.Duration(2)
+	defMaxHandshakeSize     = 64 * 1024
+	defRecvBuffSize         = 20
+	defSendBuffSize         = 20
+	defPrioritySendBuffSize = 20
+	defRevalidationInterval = time.Duration(0)
+	defPKIidCacheTTL        = time.Minute
+	defHeartbeatInterval    = time.Duration(0)
+	defAliveTimeout         = time.Duration(0)
+	defIdleTimeout          = time.Duration(0)
+	defListenBacklog        = 0
+	defSendTimeout          = time.Second * time.Duration(20)
+	defHealthSweepInterval  = time.Duration(0)
+	defStopGrace            = time.Second * time.Duration(3)
+	defRecvDedupWindow      = 0
+	defReplayBuffSize       = 0
+	defEventsBuffSize       = 100
+	defWarmupConcurrency    = 10
+	defAcceptBuffSize       = 10
+	defProbeAttempts        = 1
+	probeRetryInterval      = time.Millisecond * time.Duration(100)
+	defRecvBacklogThreshold = 0
+	throttlePollInterval    = time.Millisecond * time.Duration(10)
+	defSendBlockTimeout     = time.Second * time.Duration(1)
+	defMaxConcurrentStreams = 0
+	defStreamAdmitTimeout   = time.Millisecond * time.Duration(500)
+	defMaxConcurrentSends   = 10000
+	defMaxConnections       = 0
+	defMaxConcurrentDials   = 0
+	defDeadThreshold        = 1
+	defDeadDebounce         = time.Duration(0)
+	dialQueuePollInterval   = time.Millisecond * time.Duration(100)
+	defLogSampleRate        = 1
+	connCheckConcurrency    = 10
+	drainPollInterval       = time.Millisecond * time.Duration(10)
+	sendOverflowErr         = "Send buffer overflow"
 )
 
 var errSendOverflow = errors.New(sendOverflowErr)
 
-// SetDialTimeout sets the dial timeout
+var defHighWaterMarks = []float64{0.8, 0.95}
+
+var errSendTimeout = errors.New("Timed out sending to stream")
+
+var errTooManySends = errors.New("Too many sends in progress")
+
+// errTooManyStreams is returned to remote peers whose streams weren't admitted
+// because too many streams are already being serviced. It's retryable
+var errTooManyStreams = grpc.Errorf(codes.Unavailable, "Too many concurrent streams")
+
+// errOverloaded is returned to remote peers whose streams weren't admitted
+// because the node is overloaded. It's retryable
+var errOverloaded = grpc.Errorf(codes.Unavailable, "Overloaded, not accepting new streams")
+
+// ErrObserverMode is returned by operations that would initiate
+// a connection while the comm instance is in observer mode
+var ErrObserverMode = errors.New("comm instance is in observer mode")
+
+// ErrInvalidRemotePeer is returned by operations that are given a remote
+// peer with an empty or malformed endpoint, or without a required PKI-ID
+var ErrInvalidRemotePeer = errors.New("invalid remote peer")
+
+// ErrIdentityExpired is returned when a remote peer presents an
+// X.509 identity that is expired or not yet valid
+var ErrIdentityExpired = errors.New("identity of remote peer is expired or not yet valid")
+
+// ErrStopping is returned by operations that are invoked
+// while the comm instance is stopping or already stopped
+var ErrStopping = errors.New("comm instance is stopping")
+
+// ErrNotConnected is returned by operations on the connection to a
+// remote peer, when there is no connection to it
+var ErrNotConnected = errors.New("not connected to the remote peer")
+
+// ErrHandshakeTimeout is returned when a remote peer doesn't send its
+// connection message in time during the authentication handshake
+var ErrHandshakeTimeout = errors.New("Timed out waiting for connection message")
+
+// isStoppingErr returns whether the given error was returned
+// because the comm instance is stopping
+func isStoppingErr(err error) bool {
+	if connErr, isConnErr := err.(*ConnectError); isConnErr {
+		return connErr.Kind == ConnectStopping
+	}
+	return err == ErrStopping
+}
+
+// isObserverModeErr returns whether the error was caused by the
+// comm instance being in observer mode
+func isObserverModeErr(err error) bool {
+	if connErr, isConnErr := err.(*ConnectError); isConnErr {
+		return connErr.Kind == ConnectObserverMode
+	}
+	return err == ErrObserverMode
+}
+
+// SetDialTimeout sets the dial timeout. It applies to dials that start after it's set
 func SetDialTimeout(timeout time.Duration) {
 	viper.Set("peer.gossip.dialTimeout", timeout)
 }
 
-func (c *commImpl) SetDialOpts(opts ...grpc.DialOption) {
-	if len(opts) == 0 {
-		c.logger.Warning("Given an empty set of grpc.DialOption, aborting")
-		return
+// dialFunc creates a gRPC connection to the given target.
+// It is replaceable via SetDialer in order to simulate dial failures
+type dialFunc func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error)
+
+// dial resolves the given endpoint and creates a gRPC connection to it.
+// The given dial options are used in addition to the dial options of the instance.
+// The dial timeout is read at each dial, unless a dial option overrides it
+func (c *commImpl) dial(endpoint string, extraOpts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	c.lock.RLock()
+	resolver, dialer := c.resolver, c.dialer
+	c.lock.RUnlock()
+	if resolver != nil {
+		address, err := resolver(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("Failed resolving %s, reason: %v", endpoint, err)
+		}
+		endpoint = address
+	}
+	opts := make([]grpc.DialOption, 0, len(c.opts)+len(extraOpts)+2)
+	opts = append(opts, grpc.WithTimeout(util.GetDurationOrDefault("peer.gossip.dialTimeout", defDialTimeout)))
+	opts = append(opts, c.opts...)
+	opts = append(opts, extraOpts...)
+	return dialer(normalizeEndpoint(endpoint), append(opts, grpc.WithBlock())...)
+}
+
+// ReloadTLS replaces the TLS certificate of this instance.
+// Existing connections keep using the certificate they were established with,
+// while new connections use the given certificate. If the gRPC server wasn't
+// created by this instance, only the certificate hash used in handshakes is
+// replaced, and replacing the server's certificate is up to its owner
+func (c *commImpl) ReloadTLS(cert *tls.Certificate) error {
+	if cert == nil || len(cert.Certificate) == 0 {
+		return errors.New("Certificate is empty")
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.selfCertHash = certHashFromRawCert(cert.Certificate[0])
+	if c.tlsCert != nil {
+		c.tlsCert.set(cert)
 	}
-	c.opts = opts
+	return nil
+}
+
+func (c *commImpl) getSelfCertHash() []byte {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.selfCertHash
+}
+
+func (c *commImpl) getTLSRootCAs() *x509.CertPool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tlsRootCAs
 }
 
 // NewCommInstanceWithServer creates a comm instance that creates an underlying gRPC server
 func NewCommInstanceWithServer(port int, idMapper identity.Mapper, peerIdentity api.PeerIdentityType, dialOpts ...grpc.DialOption) (Comm, error) {
+	return newCommInstanceWithServer(port, nil, nil, idMapper, peerIdentity, dialOpts...)
+}
+
+// NewCommInstanceWithConnectionStore creates a comm instance that creates an underlying gRPC server,
+// and manages its connections through the connection store that newStore creates
+func NewCommInstanceWithConnectionStore(port int, newStore ConnectionStoreFactory, idMapper identity.Mapper, peerIdentity api.PeerIdentityType, dialOpts ...grpc.DialOption) (Comm, error) {
+	if newStore == nil {
+		return nil, errors.New("Connection store factory is nil")
+	}
+	return newCommInstanceWithServer(port, nil, newStore, idMapper, peerIdentity, dialOpts...)
+}
+
+// NewCommInstanceWithTLSVerification creates a comm instance that creates an underlying gRPC server,
+// and verifies the TLS certificates of remote peers against the given roots
+func NewCommInstanceWithTLSVerification(port int, roots *x509.CertPool, idMapper identity.Mapper, peerIdentity api.PeerIdentityType, dialOpts ...grpc.DialOption) (Comm, error) {
+	if roots == nil {
+		return nil, errors.New("Roots are nil")
+	}
+	return newCommInstanceWithServer(port, roots, nil, idMapper, peerIdentity, dialOpts...)
+}
+
+func newCommInstanceWithServer(port int, roots *x509.CertPool, newStore ConnectionStoreFactory, idMapper identity.Mapper, peerIdentity api.PeerIdentityType, dialOpts ...grpc.DialOption) (Comm, error) {
 	var ll net.Listener
 	var s *grpc.Server
 	var secOpt grpc.DialOption
 	var certHash []byte
+	var tlsCert *tlsCertificate
+	var stats *statsHub
 
-	if len(dialOpts) == 0 {
-		dialOpts = []grpc.DialOption{grpc.WithTimeout(util.GetDurationOrDefault("peer.gossip.dialTimeout", defDialTimeout))}
+	if viper.GetBool("peer.gossip.grpcStats") {
+		stats = newStatsHub()
 	}
 
 	if port > 0 {
-		s, ll, secOpt, certHash = createGRPCLayer(port)
+		var err error
+		layerOpts := grpcLayerOptionsFromConfig()
+		if stats != nil {
+			layerOpts.stats = stats
+		}
+		s, ll, secOpt, certHash, tlsCert, err = newGRPCLayer(port, roots, layerOpts)
+		if err != nil {
+			return nil, err
+		}
 		dialOpts = append(dialOpts, secOpt)
 	}
 
+	demuxBuffSize := util.GetIntOrDefault("peer.gossip.demuxBuffSize", defDemuxBuffSize)
+	msgPublisher := NewChannelDemultiplexerWithBuffer(demuxBuffSize, viper.GetBool("peer.gossip.demuxDropWhenFull"))
+
 	commInst := &commImpl{
 		selfCertHash:  certHash,
+		tlsCert:       tlsCert,
+		tlsRootCAs:    roots,
 		PKIID:         idMapper.GetPKIidOfCert(peerIdentity),
 		idMapper:      idMapper,
 		logger:        util.GetLogger(util.LoggingCommModule, fmt.Sprintf("%d", port)),
 		peerIdentity:  peerIdentity,
 		opts:          dialOpts,
+		dialer:        grpc.Dial,
+		stats:         stats,
+		codec:         defaultCodec,
 		port:          port,
 		lsnr:          ll,
 		gSrv:          s,
-		msgPublisher:  NewChannelDemultiplexer(),
+		msgPublisher:  msgPublisher,
 		lock:          &sync.RWMutex{},
 		deadEndpoints: make(chan common.PKIidType, 100),
 		stopping:      int32(0),
-		exitChan:      make(chan struct{}, 1),
+		done:          make(chan struct{}),
+		stopped:       make(chan struct{}),
+		ready:         make(chan struct{}),
 		subscriptions: make([]chan proto.ReceivedMessage, 0),
+		closedConns:   make(map[CloseReason]uint64),
+		connWaiters:   make(map[string][]chan struct{}),
+		pendingAcks:   make(map[ackKey]chan struct{}),
+		pkiIDCache:    newPKIidCache(util.GetDurationOrDefault("peer.gossip.pkiIDCacheTTL", defPKIidCacheTTL)),
+		deadPeers: newDeadPeerDebouncer(util.GetIntOrDefault("peer.gossip.deadThreshold", defDeadThreshold),
+			util.GetDurationOrDefault("peer.gossip.deadDebounce", defDeadDebounce)),
+		stopGrace:     util.GetDurationOrDefault("peer.gossip.stopGrace", defStopGrace),
+		probeAttempts: util.GetIntOrDefault("peer.gossip.probeAttempts", defProbeAttempts),
+		logSampleRate: util.GetIntOrDefault("peer.gossip.logSampleRate", defLogSampleRate),
+		recvBacklog:   util.GetIntOrDefault("peer.gossip.recvBacklogThreshold", defRecvBacklogThreshold),
+		recvBuffSize:  util.GetIntOrDefault("peer.gossip.recvBuffSize", defRecvBuffSize),
+		recvBuffSizes: make(map[connTag]int),
+		dedup:         newMsgDedup(util.GetIntOrDefault("peer.gossip.recvDedupWindow", defRecvDedupWindow)),
+		recentMsgs:    newMsgRing(util.GetIntOrDefault("peer.gossip.replayBuffSize", defReplayBuffSize)),
+		events:        make(chan ConnEvent, util.GetIntOrDefault("peer.gossip.eventsBuffSize", defEventsBuffSize)),
+		streamSlots:   newSlots(util.GetIntOrDefault("peer.gossip.maxConcurrentStreams", defMaxConcurrentStreams)),
+		sendSlots:     newSlots(util.GetIntOrDefault("peer.gossip.maxConcurrentSends", defMaxConcurrentSends)),
+		dialSlots:     newSlots(util.GetIntOrDefault("peer.gossip.maxConcurrentDials", defMaxConcurrentDials)),
+		connLatency: map[ConnectionDirection]*latencyHistogram{
+			Outbound: newLatencyHistogram(defLatencyBuckets),
+			Inbound:  newLatencyHistogram(defLatencyBuckets),
+		},
+	}
+	store := newConnStore(commInst, commInst.logger)
+	store.setStateChangeHandler(commInst.onConnStateChange)
+	store.setIdentityReleaser(commInst.idMapper.Release)
+	commInst.connStore = store
+	if newStore != nil {
+		commInst.connStore = newCustomConnStore(store, newStore)
 	}
-	commInst.connStore = newConnStore(commInst, commInst.logger)
 	commInst.idMapper.Put(idMapper.GetPKIidOfCert(peerIdentity), peerIdentity)
 
 	if port > 0 {
+		// Register before serving, so that the server is
+		// ready to handle calls once it starts accepting
+		proto.RegisterGossipServer(s, commInst)
+		if viper.GetBool("peer.gossip.healthCheck") {
+			healthpb.RegisterHealthServer(s, &healthServer{c: commInst})
+		}
 		commInst.stopWG.Add(1)
 		go func() {
 			defer commInst.stopWG.Done()
+			defer atomic.StoreInt32(&commInst.serving, int32(0))
+			atomic.StoreInt32(&commInst.serving, int32(1))
+			close(commInst.ready)
 			s.Serve(ll)
 		}()
-		proto.RegisterGossipServer(s, commInst)
+	} else {
+		// The gRPC server isn't ours, so it's up to its owner to serve it
+		atomic.StoreInt32(&commInst.serving, int32(1))
+		close(commInst.ready)
 	}
 
 	if viper.GetBool("peer.gossip.skipHandshake") {
 		commInst.skipHandshake = true
 	}
 
+	if viper.GetBool("peer.gossip.observerMode") {
+		commInst.observer = true
+	}
+
+	if viper.GetBool("peer.gossip.rejectIdentityChanges") {
+		commInst.rejectIDChanges = true
+	}
+
+	if viper.GetBool("peer.gossip.skipIdentityExpirationCheck") {
+		commInst.skipIDExpiration = true
+	}
+
+	if interval := util.GetDurationOrDefault("peer.gossip.revalidationInterval", defRevalidationInterval); interval > 0 {
+		commInst.stopWG.Add(1)
+		go commInst.periodicallyRevalidate(interval)
+	}
+
+	if interval := util.GetDurationOrDefault("peer.gossip.healthSweepInterval", defHealthSweepInterval); interval > 0 {
+		commInst.startHealthSweep(interval)
+	}
+
+	if interval := util.GetDurationOrDefault("peer.gossip.heartbeatInterval", defHeartbeatInterval); interval > 0 {
+		commInst.stopWG.Add(1)
+		go commInst.periodicallySendHeartbeats(interval, util.GetDurationOrDefault("peer.gossip.aliveTimeout", defAliveTimeout))
+	}
+
+	if idleTimeout := util.GetDurationOrDefault("peer.gossip.idleTimeout", defIdleTimeout); idleTimeout > 0 {
+		commInst.startIdleEviction(idleTimeout)
+	}
+
 	return commInst, nil
 }
 
 // NewCommInstance creates a new comm instance that binds itself to the given gRPC server
 func NewCommInstance(s *grpc.Server, cert *tls.Certificate, idStore identity.Mapper, peerIdentity api.PeerIdentityType, dialOpts ...grpc.DialOption) (Comm, error) {
-	dialOpts = append(dialOpts, grpc.WithTimeout(util.GetDurationOrDefault("peer.gossip.dialTimeout", defDialTimeout)))
 	commInst, err := NewCommInstanceWithServer(-1, idStore, peerIdentity, dialOpts...)
 	if err != nil {
 		return nil, err
@@ -127,10 +381,10 @@ func NewCommInstance(s *grpc.Server, cert *tls.Certificate, idStore identity.Map
 	if cert != nil {
 		inst := commInst.(*commImpl)
 		if len(cert.Certificate) == 0 {
-			inst.logger.Panic("Certificate supplied but certificate chain is empty")
-		} else {
-			inst.selfCertHash = certHashFromRawCert(cert.Certificate[0])
+			inst.Stop()
+			return nil, errors.New("Certificate supplied but certificate chain is empty")
 		}
+		inst.selfCertHash = certHashFromRawCert(cert.Certificate[0])
 	}
 
 	proto.RegisterGossipServer(s, commInst.(*commImpl))
@@ -139,117 +393,647 @@ func NewCommInstance(s *grpc.Server, cert *tls.Certificate, idStore identity.Map
 }
 
 type commImpl struct {
-	skipHandshake bool
-	selfCertHash  []byte
-	peerIdentity  api.PeerIdentityType
-	idMapper      identity.Mapper
-	logger        *logging.Logger
-	opts          []grpc.DialOption
-	connStore     *connectionStore
-	PKIID         []byte
-	port          int
-	deadEndpoints chan common.PKIidType
-	msgPublisher  *ChannelDeMultiplexer
-	lock          *sync.RWMutex
-	lsnr          net.Listener
-	gSrv          *grpc.Server
-	exitChan      chan struct{}
-	stopping      int32
-	stopWG        sync.WaitGroup
-	subscriptions []chan proto.ReceivedMessage
-}
-
-func (c *commImpl) createConnection(endpoint string, expectedPKIID common.PKIidType) (*connection, error) {
-	var err error
-	var cc *grpc.ClientConn
-	var stream proto.Gossip_GossipStreamClient
-	var pkiID common.PKIidType
-	var connInfo *proto.ConnectionInfo
+	droppedEvents     uint64 // accessed atomically, kept first for 64-bit alignment
+	identityChanges   uint64 // accessed atomically, kept first for 64-bit alignment
+	droppedSends      uint64 // accessed atomically, kept first for 64-bit alignment
+	sendPanics        uint64 // accessed atomically, kept first for 64-bit alignment
+	handshakeTimeouts uint64 // accessed atomically, kept first for 64-bit alignment
+	handshakeFailures uint64 // handshakes that failed other than timing out, accessed atomically
+	sentMsgs          uint64 // sends counted to sample their debug logs, only while debug logging is enabled, accessed atomically
+	skipHandshake     bool
+	skipHandshakePred SkipHandshakePredicate
+	overloaded        OverloadPredicate
+	observer          bool // whether connections to remote peers are never initiated
+	rejectIDChanges   bool // whether handshakes that change the identity of a known PKI-ID are rejected
+	skipIDExpiration  bool // whether the validity period of X.509 identities of remote peers isn't checked
+	selfCertHash      []byte
+	tlsCert           *tlsCertificate
+	handshakeSigner   proto.Signer
+	tracer            TracePropagator
+	codec             MessageCodec
+	undelivered       UndeliveredHandler
+	peerWeight        PeerWeight
+	stopGrace         time.Duration
+	probeAttempts     int
+	logSampleRate     int // only 1 in every logSampleRate messages is logged
+	recvBacklog       int // backlog of a subscription that pauses receiving, if positive
+	recvBuffSize      int // size of the receive buffer of connections with no matching tag
+	recvBuffSizes     map[connTag]int
+	dedup             *msgDedup
+	deadPeers         *deadPeerDebouncer // decides when peers that sending to failed are presumed dead
+	resolver          EndpointResolver
+	events            chan ConnEvent
+	recentMsgs        *msgRing
+	activeStreams     int32
+	streamSlots       chan struct{} // bounds the streams serviced concurrently, nil if unbounded
+	sendSlots         chan struct{} // bounds the asynchronous sends in progress, nil if unbounded
+	dialSlots         chan struct{} // bounds the outbound connections being established, nil if unbounded
+	tlsRootCAs        *x509.CertPool
+	peerIdentity      api.PeerIdentityType
+	idMapper          identity.Mapper
+	logger            *logging.Logger
+	opts              []grpc.DialOption
+	dialer            dialFunc
+	stats             *statsHub // nil if gRPC stats are disabled
+	connStore         connStorage
+	PKIID             []byte
+	port              int
+	deadEndpoints     chan common.PKIidType
+	msgPublisher      *ChannelDeMultiplexer
+	lock              *sync.RWMutex
+	lsnr              net.Listener
+	gSrv              *grpc.Server
+	done              chan struct{} // closed once the instance starts stopping
+	stopping          int32
+	serving           int32         // whether the gRPC server is serving. Accessed atomically
+	paused            int32         // whether handling messages received from remote peers is paused. Accessed atomically
+	ready             chan struct{} // closed once the gRPC server starts serving
+	stopWG            sync.WaitGroup
+	stopped           chan struct{} // closed once the instance has stopped
+	subscriptions     []chan proto.ReceivedMessage
+	closedConns       map[CloseReason]uint64
+	connStateCallback ConnectionStateCallback
+	connWaiters       map[string][]chan struct{}
+	pendingAcks       map[ackKey]chan struct{}
+	pkiIDCache        *pkiIDCache
+	connLatency       map[ConnectionDirection]*latencyHistogram
+}
 
+func (c *commImpl) createConnection(endpoint string, expectedPKIID common.PKIidType, dialOpts ...grpc.DialOption) (conn *connection, err error) {
 	c.logger.Debug("Entering", endpoint, expectedPKIID)
 	defer c.logger.Debug("Exiting")
 
 	if c.isStopping() {
-		return nil, errors.New("Stopping")
+		return nil, &ConnectError{Kind: ConnectStopping, Endpoint: endpoint, Err: ErrStopping}
+	}
+	if c.observer {
+		return nil, &ConnectError{Kind: ConnectObserverMode, Endpoint: endpoint, Err: ErrObserverMode}
 	}
-	cc, err = grpc.Dial(endpoint, append(c.opts, grpc.WithBlock())...)
+	if !c.acquireDialSlot() {
+		return nil, &ConnectError{Kind: ConnectStopping, Endpoint: endpoint, Err: ErrStopping}
+	}
+	defer releaseSlot(c.dialSlots)
+	start := time.Now()
+	cc, err := c.dial(endpoint, dialOpts...)
 	if err != nil {
-		return nil, err
+		return nil, &ConnectError{Kind: ConnectDialFailed, Endpoint: endpoint, Err: err}
 	}
+	// From now on, every failure path must close the gRPC connection
+	defer func() {
+		if err != nil {
+			cc.Close()
+		}
+	}()
 
-	cl := proto.NewGossipClient(cc)
+	cl := c.newGossipClient(cc)
 
 	if _, err = cl.Ping(context.Background(), &proto.Empty{}); err != nil {
-		cc.Close()
-		return nil, err
+		return nil, &ConnectError{Kind: ConnectPingFailed, Endpoint: endpoint, Err: err}
 	}
 
-	if stream, err = cl.GossipStream(context.Background()); err == nil {
-		connInfo, err = c.authenticateRemotePeer(stream)
-		if err == nil {
-			pkiID = connInfo.ID
-			if expectedPKIID != nil && !bytes.Equal(pkiID, expectedPKIID) {
-				// PKIID is nil when we don't know the remote PKI id's
-				c.logger.Warning("Remote endpoint claims to be a different peer, expected", expectedPKIID, "but got", pkiID)
-				cc.Close()
-				return nil, errors.New("Authentication failure")
-			}
-			conn := newConnection(cl, cc, stream, nil)
-			conn.pkiID = pkiID
-			conn.info = connInfo
-			conn.logger = c.logger
-
-			h := func(m *proto.SignedGossipMessage) {
-				c.logger.Debug("Got message:", m)
-				c.msgPublisher.DeMultiplex(&ReceivedMessageImpl{
-					conn:                conn,
-					lock:                conn,
-					SignedGossipMessage: m,
-					connInfo:            connInfo,
-				})
-			}
-			conn.handler = h
-			return conn, nil
+	stream, err := cl.GossipStream(c.streamContext(expectedPKIID))
+	if err != nil {
+		return nil, &ConnectError{Kind: ConnectPingFailed, Endpoint: endpoint, Err: err}
+	}
+	defer func() {
+		if err != nil {
+			stream.CloseSend()
 		}
+	}()
+
+	connInfo, err := c.authenticateRemotePeer(stream, expectedPKIID)
+	if err == ErrHandshakeTimeout {
+		return nil, &ConnectError{Kind: ConnectHandshakeTimeout, Endpoint: endpoint, Err: err}
+	}
+	if err != nil {
 		c.logger.Warning("Authentication failed:", err)
+		return nil, &ConnectError{Kind: ConnectAuthFailed, Endpoint: endpoint, Err: err}
+	}
+
+	pkiID := connInfo.ID
+	defer func() {
+		if err != nil {
+			c.idMapper.Release(pkiID)
+		}
+	}()
+	if expectedPKIID != nil && !bytes.Equal(pkiID, expectedPKIID) {
+		// PKIID is nil when we don't know the remote PKI id's
+		c.logger.Warning("Remote endpoint claims to be a different peer, expected", expectedPKIID, "but got", pkiID)
+		return nil, &ConnectError{Kind: ConnectPKIIDMismatch, Endpoint: endpoint, Err: errors.New("Authentication failure")}
+	}
+	c.connLatency[Outbound].observe(time.Since(start))
+
+	c.pkiIDCache.put(endpoint, pkiID, connInfo.Identity)
+
+	conn = newConnection(cl, cc, stream, nil)
+	conn.pkiID = pkiID
+	conn.info = connInfo
+	conn.logger = c.logger
+
+	var received uint64
+	h := func(m *proto.SignedGossipMessage) {
+		if c.shouldLogMessage(&received) {
+			c.logger.Debug("Got message:", m)
+		}
+		c.publish(&ReceivedMessageImpl{
+			conn:                conn,
+			lock:                conn,
+			SignedGossipMessage: m,
+			connInfo:            connInfo,
+			remoteAddr:          endpoint,
+		})
+	}
+	conn.handler = h
+	conn.throttled = c.backlogExceeded
+	conn.paused = c.IsPaused
+	conn.codec = c.getCodec()
+	conn.onUndeliver = c.handleUndelivered
+	conn.recvBuffCap = c.recvBuffCapacity()
+	conn.recvLimit = func() int {
+		return c.recvBuffSizeOf(conn)
+	}
+	return conn, nil
+}
+
+// publish delivers a received message to the subscribers, unless it was
+// recently received over any connection. Heartbeats are never dropped as duplicates
+func (c *commImpl) publish(msg *ReceivedMessageImpl) {
+	if c.handleAck(msg) {
+		return
+	}
+	ackRequested := takeAckRequest(msg.Envelope)
+	heartbeat := msg.GetGossipMessage().GetEmpty() != nil
+	if msg.conn != nil && heartbeat {
+		msg.conn.markHeartbeating()
+	}
+	if msg.conn != nil && !heartbeat {
+		msg.conn.markActive()
+	}
+	if !heartbeat && c.dedup.isDuplicate(msg.Envelope) {
+		c.logger.Debug("Dropping duplicate message", msg.SignedGossipMessage)
+		return
+	}
+	msg.ctx = c.traceContext(msg.Envelope)
+	c.recentMsgs.add(msg)
+	if c.msgPublisher.deMultiplex(msg) && ackRequested {
+		c.acknowledge(msg)
+	}
+}
+
+// Pause stops handing messages received from remote peers to the subscribers,
+// without closing the connections to them. Received messages are buffered,
+// and once the buffers are full, remote peers are pushed back on by the transport.
+// Sending isn't affected
+func (c *commImpl) Pause() {
+	if atomic.CompareAndSwapInt32(&c.paused, int32(0), int32(1)) {
+		c.logger.Info("Pausing handling of received messages")
 	}
-	cc.Close()
-	return nil, err
+}
+
+// Resume resumes handing messages received from remote peers to the subscribers
+func (c *commImpl) Resume() {
+	if !atomic.CompareAndSwapInt32(&c.paused, int32(1), int32(0)) {
+		return
+	}
+	c.logger.Info("Resuming handling of received messages")
+	// Nothing was read while paused, so don't hold it against the remote peers
+	for _, conn := range c.connStore.connections() {
+		conn.touch()
+	}
+}
+
+// IsPaused returns whether handling of messages received from remote peers is paused
+func (c *commImpl) IsPaused() bool {
+	return atomic.LoadInt32(&c.paused) == int32(1)
+}
+
+// SubscriptionBacklog returns the buffer size of the channels messages are published
+// to subscriptions through, and the number of messages waiting in the channel of each
+// subscription, in the order the subscriptions were made
+func (c *commImpl) SubscriptionBacklog() (int, []int) {
+	return c.msgPublisher.BufferSize(), c.msgPublisher.Pending()
+}
+
+// backlogExceeded returns whether the backlog of messages waiting to be
+// consumed by any subscriber reached the configured threshold
+func (c *commImpl) backlogExceeded() bool {
+	if c.recvBacklog <= 0 {
+		return false
+	}
+	for _, pending := range c.msgPublisher.Pending() {
+		if pending >= c.recvBacklog {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldLogMessage returns whether a message should be logged, given the number
+// of messages counted by the given counter. Only 1 in every logSampleRate
+// messages is logged, and only if debug logging is enabled
+func (c *commImpl) shouldLogMessage(counter *uint64) bool {
+	if !c.logger.IsEnabledFor(logging.DEBUG) {
+		return false
+	}
+	if c.logSampleRate <= 1 {
+		return true
+	}
+	return (atomic.AddUint64(counter, 1)-1)%uint64(c.logSampleRate) == 0
 }
 
 func (c *commImpl) Send(msg *proto.SignedGossipMessage, peers ...*RemotePeer) {
-	if c.isStopping() || len(peers) == 0 {
+	c.SendWithPriority(msg, NormalPriority, peers...)
+}
+
+func (c *commImpl) SendWithPriority(msg *proto.SignedGossipMessage, priority Priority, peers ...*RemotePeer) {
+	if c.isStopping() || c.observer || len(peers) == 0 {
+		return
+	}
+
+	if c.shouldLogMessage(&c.sentMsgs) {
+		c.logger.Debug("Entering, sending", msg, "to ", len(peers), "peers")
+	}
+
+	env, err := c.getCodec().Encode(msg)
+	if err != nil {
+		c.logger.Warning("Failed encoding", msg, ":", err)
+		return
+	}
+	for _, peer := range peers {
+		c.goSend(peer, env, priority, time.Time{}, nil)
+	}
+}
+
+// SendWithCallback sends a message to remote peers, and invokes the given callback
+// once per peer with the fate of the message, which is nil once the message was written
+// to the stream of the peer, and the reason otherwise. Callbacks are invoked in
+// their own goroutines, and callbacks that panic are recovered from
+func (c *commImpl) SendWithCallback(msg *proto.SignedGossipMessage, cb SendCallback, peers ...*RemotePeer) {
+	if cb == nil {
+		c.Send(msg, peers...)
+		return
+	}
+	var err error
+	if c.isStopping() {
+		err = ErrStopping
+	} else if c.observer {
+		err = ErrObserverMode
+	}
+	var env *proto.Envelope
+	if err == nil {
+		env, err = c.getCodec().Encode(msg)
+	}
+	for _, peer := range peers {
+		done := c.sendCallback(cb, peer)
+		if err != nil {
+			done(err)
+			continue
+		}
+		c.goSend(peer, env, NormalPriority, time.Time{}, done)
+	}
+}
+
+// sendCallback returns a function that invokes the given callback for the given peer
+// in its own goroutine, and recovers from the callback panicking
+func (c *commImpl) sendCallback(cb SendCallback, peer *RemotePeer) func(error) {
+	return func(err error) {
+		go func() {
+			defer func() {
+				if r := recover(); r != nil {
+					c.logger.Errorf("Send callback for %v panicked: %v\n%s", peer, r, debug.Stack())
+				}
+			}()
+			cb(peer, err)
+		}()
+	}
+}
+
+// SendWithDeadline sends a message to remote peers, unless it's still buffered
+// when the given deadline passes, in which case it's dropped as expired
+func (c *commImpl) SendWithDeadline(msg *proto.SignedGossipMessage, deadline time.Time, peers ...*RemotePeer) {
+	if c.isStopping() || c.observer || len(peers) == 0 {
+		return
+	}
+
+	if c.shouldLogMessage(&c.sentMsgs) {
+		c.logger.Debug("Entering, sending", msg, "to ", len(peers), "peers until", deadline)
+	}
+
+	env, err := c.getCodec().Encode(msg)
+	if err != nil {
+		c.logger.Warning("Failed encoding", msg, ":", err)
+		return
+	}
+	for _, peer := range peers {
+		c.goSend(peer, env, NormalPriority, deadline, nil)
+	}
+}
+
+// SendToSubset sends a message to k randomly selected peers out of the candidates.
+// Peers that there is already a connection to are selected first, to avoid dialing
+// new ones. Selection is uniform, unless a peer weight function is set
+func (c *commImpl) SendToSubset(msg *proto.SignedGossipMessage, k int, candidates []*RemotePeer) {
+	c.Send(msg, c.selectSubset(k, candidates)...)
+}
+
+// selectSubset selects up to k of the candidates, connected ones first
+func (c *commImpl) selectSubset(k int, candidates []*RemotePeer) []*RemotePeer {
+	weight := c.getPeerWeight()
+	var connected, others []*RemotePeer
+	for _, peer := range candidates {
+		if peer == nil || (weight != nil && weight(peer) <= 0) {
+			continue
+		}
+		if c.connStore.hasConnection(peer.PKIID) {
+			connected = append(connected, peer)
+		} else {
+			others = append(others, peer)
+		}
+	}
+	selected := selectRandom(k, connected, weight)
+	return append(selected, selectRandom(k-len(selected), others, weight)...)
+}
+
+// selectRandom selects up to k of the given peers randomly, in proportion
+// to their weight if a weight function is given, and uniformly otherwise
+func selectRandom(k int, peers []*RemotePeer, weight PeerWeight) []*RemotePeer {
+	if k <= 0 {
+		return nil
+	}
+	if k >= len(peers) {
+		return peers
+	}
+	if weight == nil {
+		selected := make([]*RemotePeer, 0, k)
+		for _, i := range rand.Perm(len(peers))[:k] {
+			selected = append(selected, peers[i])
+		}
+		return selected
+	}
+
+	weights := make([]float64, len(peers))
+	var total float64
+	for i, peer := range peers {
+		weights[i] = weight(peer)
+		total += weights[i]
+	}
+	selected := make([]*RemotePeer, 0, k)
+	for len(selected) < k {
+		r := rand.Float64() * total
+		i := 0
+		for ; i < len(peers)-1; i++ {
+			if weights[i] > 0 && r < weights[i] {
+				break
+			}
+			r -= weights[i]
+		}
+		// Skip over peers that were already selected, in case of rounding errors
+		for weights[i] <= 0 {
+			i = (i + 1) % len(peers)
+		}
+		selected = append(selected, peers[i])
+		total -= weights[i]
+		weights[i] = 0
+	}
+	return selected
+}
+
+func (c *commImpl) handleUndelivered(pkiID common.PKIidType, envelopes []*proto.Envelope) {
+	c.lock.RLock()
+	handler := c.undelivered
+	c.lock.RUnlock()
+	if handler != nil {
+		handler(pkiID, envelopes)
+	}
+}
+
+// SendRaw sends the given envelope to remote peers as is, without
+// re-deriving it from a message. All peers are sent the same envelope
+func (c *commImpl) SendRaw(env *proto.Envelope, peers ...*RemotePeer) {
+	if c.isStopping() || c.observer || env == nil || len(peers) == 0 {
 		return
 	}
 
-	c.logger.Debug("Entering, sending", msg, "to ", len(peers), "peers")
+	c.logger.Debug("Entering, sending envelope to", len(peers), "peers")
+
+	// Copy the envelope once, so that modifications of the caller's
+	// envelope don't race with the sending to the peers
+	shared := copyEnvelope(env)
+	for _, peer := range peers {
+		c.goSend(peer, shared, NormalPriority, time.Time{}, nil)
+	}
+}
+
+// copyEnvelope returns a deep copy of the given envelope,
+// which shares no memory with the given envelope
+func copyEnvelope(env *proto.Envelope) *proto.Envelope {
+	copied := &proto.Envelope{
+		Payload:   append([]byte(nil), env.Payload...),
+		Signature: append([]byte(nil), env.Signature...),
+	}
+	if secret := env.SecretEnvelope; secret != nil {
+		copied.SecretEnvelope = &proto.SecretEnvelope{
+			Payload:   append([]byte(nil), secret.Payload...),
+			Signature: append([]byte(nil), secret.Signature...),
+		}
+	}
+	if env.Metadata != nil {
+		copied.Metadata = make(map[string]string, len(env.Metadata))
+		for k, v := range env.Metadata {
+			copied.Metadata[k] = v
+		}
+	}
+	return copied
+}
 
+// Forward sends the envelope the given message was received in to remote peers as is,
+// which preserves its signature and its metadata, such as the trace context, and avoids
+// marshaling it again. The peer the message was received from is skipped
+func (c *commImpl) Forward(received proto.ReceivedMessage, peers ...*RemotePeer) {
+	env := received.GetSourceEnvelope()
+	if env == nil {
+		c.logger.Warning("Received message has no envelope, not forwarding it")
+		return
+	}
+	var sender common.PKIidType
+	if info := received.GetConnectionInfo(); info != nil {
+		sender = info.ID
+	}
+	forwardTo := make([]*RemotePeer, 0, len(peers))
 	for _, peer := range peers {
-		go func(peer *RemotePeer, msg *proto.SignedGossipMessage) {
-			c.sendToEndpoint(peer, msg)
-		}(peer, msg)
+		if peer != nil && len(sender) != 0 && bytes.Equal(peer.PKIID, sender) {
+			c.logger.Debug("Not forwarding message back to", peer)
+			continue
+		}
+		forwardTo = append(forwardTo, peer)
+	}
+	c.SendRaw(env, forwardTo...)
+}
+
+// goSend sends the given envelope to the given peer in the background.
+// If too many sends are in progress, it waits briefly for one of them
+// to finish, and drops the envelope if none does. done, if not nil,
+// is given the fate of the envelope
+func (c *commImpl) goSend(peer *RemotePeer, env *proto.Envelope, priority Priority, deadline time.Time, done func(error)) {
+	m := &msgSending{envelope: env, deadline: deadline, done: done}
+	// Don't wait for a slot, as a broadcast would otherwise wait once per peer
+	if !tryAcquireSlot(c.sendSlots) {
+		atomic.AddUint64(&c.droppedSends, 1)
+		c.logger.Warning("Too many sends in progress, dropping message to", peer)
+		m.resolve(errTooManySends)
+		return
+	}
+	go func() {
+		defer releaseSlot(c.sendSlots)
+		defer c.recoverSend(peer, m)
+		c.sendToEndpoint(peer, m, priority)
+	}()
+}
+
+// recoverSend recovers from a panic in a send of the given message to the given peer,
+// so that a single bad peer doesn't crash the process, and disconnects from that peer
+func (c *commImpl) recoverSend(peer *RemotePeer, m *msgSending) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	atomic.AddUint64(&c.sendPanics, 1)
+	c.logger.Errorf("Sending to %v panicked: %v\n%s", peer, r, debug.Stack())
+	m.resolve(fmt.Errorf("Sending panicked: %v", r))
+	if peer != nil && len(peer.PKIID) != 0 {
+		c.disconnect(peer.PKIID, SendError)
 	}
 }
 
-func (c *commImpl) sendToEndpoint(peer *RemotePeer, msg *proto.SignedGossipMessage) {
+// SendByPKIID sends a message to remote peers over the connections that already
+// exist to them. Peers that there is no connection to are skipped rather than dialed
+func (c *commImpl) SendByPKIID(msg *proto.SignedGossipMessage, pkiIDs ...common.PKIidType) {
+	if c.isStopping() || c.observer || len(pkiIDs) == 0 {
+		return
+	}
+
+	if c.shouldLogMessage(&c.sentMsgs) {
+		c.logger.Debug("Entering, sending", msg, "to ", len(pkiIDs), "peers by PKI-ID")
+	}
+
+	env, err := c.getCodec().Encode(msg)
+	if err != nil {
+		c.logger.Warning("Failed encoding", msg, ":", err)
+		return
+	}
+	for _, pkiID := range pkiIDs {
+		if len(pkiID) == 0 {
+			continue
+		}
+		// Without an endpoint, the message is only sent over an existing connection
+		c.goSend(&RemotePeer{PKIID: pkiID}, env, NormalPriority, time.Time{}, nil)
+	}
+}
+
+func (c *commImpl) sendToEndpoint(peer *RemotePeer, m *msgSending, priority Priority) {
 	if c.isStopping() {
+		m.resolve(ErrStopping)
+		return
+	}
+	if c.observer {
+		m.resolve(ErrObserverMode)
+		return
+	}
+	// A peer whose endpoint isn't known, such as a peer of another organization,
+	// can still be sent to by its PKI-ID over an existing connection, but
+	// there is nothing to dial if no connection to it exists
+	if peer != nil && peer.Endpoint == "" && len(peer.PKIID) != 0 {
+		conn, exists := c.connStore.existingConnection(peer.PKIID)
+		if !exists {
+			m.resolve(ErrInvalidRemotePeer)
+			return
+		}
+		c.enqueue(conn, peer, m, priority)
+		return
+	}
+	if err := c.validateRemotePeer(peer, false); err != nil {
+		m.resolve(err)
 		return
 	}
-	c.logger.Debug("Entering, Sending to", peer.Endpoint, ", msg:", msg)
+	c.logger.Debug("Entering, Sending to", peer.Endpoint)
 	defer c.logger.Debug("Exiting")
-	var err error
 
 	conn, err := c.connStore.getConnection(peer)
 	if err == nil {
-		disConnectOnErr := func(err error) {
-			c.logger.Warning(peer, "isn't responsive:", err)
-			c.disconnect(peer.PKIID)
-		}
-		conn.send(msg, disConnectOnErr)
+		c.enqueue(conn, peer, m, priority)
+		return
+	}
+	m.resolve(err)
+	if isStoppingErr(err) {
 		return
 	}
 	c.logger.Warning("Failed obtaining connection for", peer, "reason:", err)
-	c.disconnect(peer.PKIID)
+	c.disconnect(peer.PKIID, SendError)
+}
+
+func (c *commImpl) enqueue(conn *connection, peer *RemotePeer, m *msgSending, priority Priority) {
+	m.onErr = func(err error) {
+		c.logger.Warning(peer, "isn't responsive:", err)
+		c.connStore.recordError(peer.PKIID, err)
+		c.disconnect(peer.PKIID, SendError)
+	}
+	conn.markActive()
+	conn.enqueue(m, priority)
+}
+
+func (c *commImpl) SendSync(ctx context.Context, msg *proto.SignedGossipMessage, peer *RemotePeer) error {
+	if c.isStopping() {
+		return ErrStopping
+	}
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return err
+	}
+	c.logger.Debug("Entering, sending synchronously to", peer.Endpoint, ", msg:", msg)
+	defer c.logger.Debug("Exiting")
+
+	conn, err := c.connStore.getConnection(peer)
+	if isStoppingErr(err) || isObserverModeErr(err) {
+		return err
+	}
+	if err != nil {
+		c.logger.Warning("Failed obtaining connection for", peer, "reason:", err)
+		c.disconnect(peer.PKIID, SendError)
+		return err
+	}
+	conn.markActive()
+	err = conn.sendSync(ctx, msg)
+	if err != nil && err != ctx.Err() {
+		c.logger.Warning(peer, "isn't responsive:", err)
+		c.connStore.recordError(peer.PKIID, err)
+		c.disconnect(peer.PKIID, SendError)
+	}
+	return err
+}
+
+// validateRemotePeer returns ErrInvalidRemotePeer if the given remote peer has an empty
+// or malformed endpoint, or if it has no PKI-ID although the PKI-ID is required
+func (c *commImpl) validateRemotePeer(peer *RemotePeer, requirePKIID bool) error {
+	var reason string
+	switch {
+	case peer == nil:
+		reason = "remote peer is nil"
+	case strings.TrimSpace(peer.Endpoint) == "":
+		reason = "endpoint is empty"
+	case strings.IndexFunc(peer.Endpoint, unicode.IsSpace) != -1:
+		reason = fmt.Sprintf("endpoint %q contains whitespace", peer.Endpoint)
+	case requirePKIID && len(peer.PKIID) == 0:
+		reason = fmt.Sprintf("PKI-ID of %s is empty", peer.Endpoint)
+	default:
+		return nil
+	}
+	c.logger.Warning("Invalid remote peer:", reason)
+	return ErrInvalidRemotePeer
+}
+
+// IsObserver returns whether this instance is in observer mode, in which it
+// accepts connections and messages from remote peers, but never initiates connections
+func (c *commImpl) IsObserver() bool {
+	return c.observer
 }
 
 func (c *commImpl) isStopping() bool {
@@ -257,79 +1041,174 @@ func (c *commImpl) isStopping() bool {
 }
 
 func (c *commImpl) Probe(remotePeer *RemotePeer) error {
-	endpoint := remotePeer.Endpoint
-	pkiID := remotePeer.PKIID
+	return c.probe(context.Background(), remotePeer)
+}
+
+// probe probes the given peer, and gives up once the given context is done
+func (c *commImpl) probe(ctx context.Context, remotePeer *RemotePeer) error {
 	if c.isStopping() {
-		return errors.New("Stopping")
+		return ErrStopping
+	}
+	if err := c.validateRemotePeer(remotePeer, false); err != nil {
+		return err
 	}
+	endpoint := remotePeer.Endpoint
+	pkiID := remotePeer.PKIID
 	c.logger.Debug("Entering, endpoint:", endpoint, "PKIID:", pkiID)
-	cc, err := grpc.Dial(remotePeer.Endpoint, append(c.opts, grpc.WithBlock())...)
+	dialOpts := remotePeer.DialOpts
+	// The vendored gRPC can't cancel a dial, so bound it by the deadline instead
+	if deadline, hasDeadline := ctx.Deadline(); hasDeadline {
+		dialOpts = append(append([]grpc.DialOption(nil), dialOpts...), grpc.WithTimeout(deadline.Sub(time.Now())))
+	}
+	cc, err := c.dial(remotePeer.Endpoint, dialOpts...)
 	if err != nil {
 		c.logger.Debug("Returning", err)
 		return err
 	}
 	defer cc.Close()
-	cl := proto.NewGossipClient(cc)
-	_, err = cl.Ping(context.Background(), &proto.Empty{})
+	cl := c.newGossipClient(cc)
+	for i := 1; ; i++ {
+		_, err = cl.Ping(ctx, &proto.Empty{})
+		if err == nil || i >= c.probeAttempts {
+			break
+		}
+		c.logger.Debug("Ping attempt", i, "to", endpoint, "failed:", err, ", retrying")
+		select {
+		case <-ctx.Done():
+			c.logger.Debug("Returning", ctx.Err())
+			return ctx.Err()
+		case <-time.After(probeRetryInterval):
+		}
+	}
 	c.logger.Debug("Returning", err)
 	return err
 }
 
 func (c *commImpl) Handshake(remotePeer *RemotePeer) (api.PeerIdentityType, error) {
-	cc, err := grpc.Dial(remotePeer.Endpoint, append(c.opts, grpc.WithBlock())...)
+	if c.isStopping() {
+		return nil, ErrStopping
+	}
+	if err := c.validateRemotePeer(remotePeer, false); err != nil {
+		return nil, err
+	}
+	cc, err := c.dial(remotePeer.Endpoint, remotePeer.DialOpts...)
 	if err != nil {
 		return nil, err
 	}
 	defer cc.Close()
 
-	cl := proto.NewGossipClient(cc)
+	cl := c.newGossipClient(cc)
 	if _, err = cl.Ping(context.Background(), &proto.Empty{}); err != nil {
 		return nil, err
 	}
 
-	stream, err := cl.GossipStream(context.Background())
+	stream, err := cl.GossipStream(c.streamContext(remotePeer.PKIID))
 	if err != nil {
 		return nil, err
 	}
-	connInfo, err := c.authenticateRemotePeer(stream)
+	defer stream.CloseSend()
+	connInfo, err := c.authenticateRemotePeer(stream, remotePeer.PKIID)
 	if err != nil {
 		c.logger.Warning("Authentication failed:", err)
 		return nil, err
 	}
+	// No connection is kept, so nothing holds the identity of the remote peer
+	c.idMapper.Release(connInfo.ID)
 	if len(remotePeer.PKIID) > 0 && !bytes.Equal(connInfo.ID, remotePeer.PKIID) {
 		return nil, errors.New("PKI-ID of remote peer doesn't match expected PKI-ID")
 	}
+	c.pkiIDCache.put(remotePeer.Endpoint, connInfo.ID, connInfo.Identity)
 	return connInfo.Identity, nil
 }
 
+func (c *commImpl) ResolvePKIID(endpoint string) (common.PKIidType, bool) {
+	return c.pkiIDCache.get(endpoint)
+}
+
+func (c *commImpl) HandshakeCached(remotePeer *RemotePeer) (api.PeerIdentityType, error) {
+	if err := c.validateRemotePeer(remotePeer, false); err != nil {
+		return nil, err
+	}
+	pkiID, identity, cached := c.pkiIDCache.lookup(remotePeer.Endpoint)
+	if cached && len(identity) > 0 && (len(remotePeer.PKIID) == 0 || bytes.Equal(pkiID, remotePeer.PKIID)) {
+		return identity, nil
+	}
+	return c.Handshake(remotePeer)
+}
+
 func (c *commImpl) Accept(acceptor common.MessageAcceptor) <-chan proto.ReceivedMessage {
+	return c.subscribe(c.msgPublisher.AddChannel(acceptor), nil, defAcceptBuffSize)
+}
+
+func (c *commImpl) AcceptBuffered(acceptor common.MessageAcceptor, size int) <-chan proto.ReceivedMessage {
+	if size <= 0 {
+		c.logger.Warning("Invalid buffer size", size, ", using", defAcceptBuffSize, "instead")
+		size = defAcceptBuffSize
+	}
+	return c.subscribe(c.msgPublisher.AddChannel(acceptor), nil, size)
+}
+
+func (c *commImpl) AcceptWithReplay(acceptor common.MessageAcceptor, n int) <-chan proto.ReceivedMessage {
+	// Register before looking at the recent messages, so that messages
+	// received in the meantime are either replayed or published to us
 	genericChan := c.msgPublisher.AddChannel(acceptor)
-	specificChan := make(chan proto.ReceivedMessage, 10)
+	var replay []*ReceivedMessageImpl
+	for _, msg := range c.recentMsgs.last(n) {
+		if acceptor(msg) {
+			replay = append(replay, msg)
+		}
+	}
+	return c.subscribe(genericChan, replay, defAcceptBuffSize)
+}
+
+// subscribe forwards the given replayed messages and then the messages published
+// to the given channel into a new channel of the given size, until the instance is stopped
+func (c *commImpl) subscribe(genericChan chan interface{}, replay []*ReceivedMessageImpl, size int) <-chan proto.ReceivedMessage {
+	specificChan := make(chan proto.ReceivedMessage, size)
 
+	c.lock.Lock()
 	if c.isStopping() {
+		c.lock.Unlock()
 		c.logger.Warning("Accept() called but comm module is stopping, returning empty channel")
 		return specificChan
 	}
-
-	c.lock.Lock()
 	c.subscriptions = append(c.subscriptions, specificChan)
+	// Stop closes the channel only after waiting for the goroutine below
+	c.stopWG.Add(1)
 	c.lock.Unlock()
 
 	go func() {
 		defer c.logger.Debug("Exiting Accept() loop")
-		defer func() {
-			recover()
-		}()
-
-		c.stopWG.Add(1)
 		defer c.stopWG.Done()
 
+		replayed := make(map[*ReceivedMessageImpl]struct{}, len(replay))
+		for _, msg := range replay {
+			select {
+			case specificChan <- msg:
+				replayed[msg] = struct{}{}
+			case <-c.done:
+				return
+			}
+		}
+
 		for {
 			select {
-			case msg := <-genericChan:
-				specificChan <- msg.(*ReceivedMessageImpl)
-			case s := <-c.exitChan:
-				c.exitChan <- s
+			case msg, ok := <-genericChan:
+				if !ok {
+					return
+				}
+				m := msg.(*ReceivedMessageImpl)
+				// A replayed message might have been published after we registered
+				if _, wasReplayed := replayed[m]; wasReplayed {
+					delete(replayed, m)
+					continue
+				}
+				select {
+				case specificChan <- m:
+				case <-c.done:
+					return
+				}
+			case <-c.done:
 				return
 			}
 		}
@@ -337,13 +1216,90 @@ func (c *commImpl) Accept(acceptor common.MessageAcceptor) <-chan proto.Received
 	return specificChan
 }
 
+func (c *commImpl) AcceptWithConnInfo(acceptor ConnMessageAcceptor) <-chan proto.ReceivedMessage {
+	return c.Accept(func(o interface{}) bool {
+		msg, isReceivedMsg := o.(proto.ReceivedMessage)
+		return isReceivedMsg && acceptor(msg)
+	})
+}
+
+// MatchingSubscriptions returns the indices of the subscriptions, in the order they
+// were made, whose acceptors accept the given message. The message isn't delivered to them
+func (c *commImpl) MatchingSubscriptions(msg proto.ReceivedMessage) []int {
+	return c.msgPublisher.Matches(msg)
+}
+
+// SubscriptionsMatchingPeer returns the indices of the subscriptions, in the order they were
+// made, whose acceptors accept the given message as if it was received from the given peer.
+// An empty message is used if the message is nil. The message isn't delivered to the
+// subscriptions, and acceptors that try to respond to it are considered not to accept it
+func (c *commImpl) SubscriptionsMatchingPeer(pkiID common.PKIidType, msg *proto.SignedGossipMessage) []int {
+	if msg == nil {
+		msg = (&proto.GossipMessage{
+			Tag:     proto.GossipMessage_EMPTY,
+			Content: &proto.GossipMessage_Empty{Empty: &proto.Empty{}},
+		}).NoopSign()
+	}
+	connInfo := &proto.ConnectionInfo{ID: pkiID}
+	if conn, exists := c.connStore.existingConnection(pkiID); exists && conn.info != nil {
+		connInfo = conn.info
+	} else if identity, err := c.idMapper.Get(pkiID); err == nil {
+		connInfo.Identity = identity
+	}
+	return c.MatchingSubscriptions(&ReceivedMessageImpl{SignedGossipMessage: msg, connInfo: connInfo})
+}
+
 func (c *commImpl) PresumedDead() <-chan common.PKIidType {
 	return c.deadEndpoints
 }
 
 func (c *commImpl) CloseConn(peer *RemotePeer) {
 	c.logger.Debug("Closing connection for", peer)
-	c.connStore.closeConn(peer)
+	c.connStore.closeConn(peer, LocalStop)
+}
+
+// CloseConnGracefully stops sending new messages to the given peer, waits up to
+// the given timeout for the messages already buffered to be sent, and then closes the connection
+func (c *commImpl) CloseConnGracefully(peer *RemotePeer, timeout time.Duration) {
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return
+	}
+	c.logger.Debug("Gracefully closing connection for", peer)
+	if conn, exists := c.connStore.existingConnection(peer.PKIID); exists {
+		if !conn.drain(timeout) {
+			c.logger.Warning("Not all buffered messages were sent to", peer, "before closing the connection")
+		}
+	}
+	c.connStore.closeConn(peer, LocalStop)
+}
+
+// CloseConnSync closes the connection to the given peer, and returns once the
+// go-routine that serviced it has exited and it was removed from the connection store.
+// The go-routine might be handling a received message, so use CloseConnSyncWithContext
+// to bound the wait
+func (c *commImpl) CloseConnSync(peer *RemotePeer) error {
+	return c.CloseConnSyncWithContext(context.Background(), peer)
+}
+
+// CloseConnSyncWithContext behaves like CloseConnSync, but the wait is bounded by
+// the context, and the context's error is returned if it expires first
+func (c *commImpl) CloseConnSyncWithContext(ctx context.Context, peer *RemotePeer) error {
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return err
+	}
+	c.logger.Debug("Closing connection for", peer, "and waiting for it to stop being serviced")
+	conn, exists := c.connStore.existingConnection(peer.PKIID)
+	c.connStore.closeConn(peer, LocalStop)
+	if !exists {
+		return nil
+	}
+	select {
+	case <-conn.serviced:
+		return nil
+	case <-ctx.Done():
+		c.logger.Warning("Connection to", peer, "is still being serviced:", ctx.Err())
+		return ctx.Err()
+	}
 }
 
 func (c *commImpl) emptySubscriptions() {
@@ -355,32 +1311,79 @@ func (c *commImpl) emptySubscriptions() {
 }
 
 func (c *commImpl) Stop() {
-	if c.isStopping() {
+	// Mark the instance as stopping under the lock, so that subscribe
+	// either registers its goroutine before we wait for it, or not at all
+	c.lock.Lock()
+	stopping := atomic.CompareAndSwapInt32(&c.stopping, int32(0), int32(1))
+	c.lock.Unlock()
+	if !stopping {
 		return
 	}
-	atomic.StoreInt32(&c.stopping, int32(1))
 	c.logger.Info("Stopping")
 	defer c.logger.Info("Stopped")
-	if c.gSrv != nil {
-		c.gSrv.Stop()
-	}
 	if c.lsnr != nil {
 		c.lsnr.Close()
 	}
 	c.connStore.shutdown()
 	c.logger.Debug("Shut down connection store, connection count:", c.connStore.connNum())
-	c.exitChan <- struct{}{}
+	// Closing the connections makes the streams of remote peers end,
+	// so give them a chance to end before aborting them
+	if !c.waitForStreams(c.stopGrace) {
+		c.logger.Warning("Streams of remote peers didn't end within", c.stopGrace, ", aborting them")
+	}
+	if c.gSrv != nil {
+		c.gSrv.Stop()
+	}
+	close(c.done)
 	c.msgPublisher.Close()
 	c.logger.Debug("Shut down publisher")
-	c.emptySubscriptions()
-	c.logger.Debug("Closed subscriptions, waiting for goroutines to stop...")
+	c.logger.Debug("Waiting for goroutines to stop...")
 	c.stopWG.Wait()
+	// Only close the subscriptions once nothing forwards messages into them
+	c.emptySubscriptions()
+	c.logger.Debug("Closed subscriptions")
+	close(c.stopped)
+}
+
+// Serving returns whether the gRPC server of this instance is serving.
+// If the gRPC server wasn't created by this instance, it's considered serving
+func (c *commImpl) Serving() bool {
+	return atomic.LoadInt32(&c.serving) == int32(1)
+}
+
+// Ready returns a channel that is closed once the gRPC server
+// of this instance starts serving
+func (c *commImpl) Ready() <-chan struct{} {
+	return c.ready
+}
+
+// Done returns a channel that is closed once the instance has completely stopped
+func (c *commImpl) Done() <-chan struct{} {
+	return c.stopped
+}
+
+// waitForStreams waits until all streams opened by remote peers end,
+// and returns whether they ended within the given timeout
+func (c *commImpl) waitForStreams(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&c.activeStreams) > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return true
 }
 
 func (c *commImpl) GetPKIid() common.PKIidType {
 	return c.PKIID
 }
 
+// SelfIdentity returns a copy of this instance's identity
+func (c *commImpl) SelfIdentity() api.PeerIdentityType {
+	return append(api.PeerIdentityType(nil), c.peerIdentity...)
+}
+
 func extractRemoteAddress(stream stream) string {
 	var remoteAddress string
 	p, ok := peer.FromContext(stream.Context())
@@ -389,23 +1392,56 @@ func extractRemoteAddress(stream stream) string {
 			remoteAddress = address.String()
 		}
 	}
-	return remoteAddress
+	return remoteAddress
+}
+
+// SecurityInfo returns the current security configuration of the instance
+func (c *commImpl) SecurityInfo() SecurityStatus {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	tlsEnabled := c.selfCertHash != nil
+	return SecurityStatus{
+		HandshakeSkipped:       c.skipHandshake,
+		HandshakeSkipPredicate: c.skipHandshakePred != nil,
+		TLSEnabled:             tlsEnabled,
+		MutualVerification:     tlsEnabled && c.tlsRootCAs != nil,
+	}
 }
 
-func (c *commImpl) authenticateRemotePeer(stream stream) (*proto.ConnectionInfo, error) {
-	ctx := stream.Context()
+// authenticateRemotePeer performs the handshake with the remote peer of the given stream,
+// whose PKI-ID is the given target if it's known, which is told to the remote peer.
+// Once the remote peer is authenticated, its identity is put in the identity mapper, and
+// the caller must release the reference this takes, unless a connection that holds it is stored
+func (c *commImpl) authenticateRemotePeer(stream stream, target common.PKIidType) (*proto.ConnectionInfo, error) {
 	remoteAddress := extractRemoteAddress(stream)
+	c.emitEvent(ConnEvent{Kind: HandshakeStarted, RemoteAddress: remoteAddress})
+	connInfo, err := c.exchangeConnectionMsgs(stream, remoteAddress, target)
+	if err == ErrHandshakeTimeout {
+		atomic.AddUint64(&c.handshakeTimeouts, 1)
+	} else if err != nil {
+		atomic.AddUint64(&c.handshakeFailures, 1)
+	}
+	if err != nil {
+		c.emitEvent(ConnEvent{Kind: AuthFailed, RemoteAddress: remoteAddress, Err: err})
+		return nil, err
+	}
+	c.emitEvent(ConnEvent{Kind: AuthSucceeded, RemoteAddress: remoteAddress, PKIID: connInfo.ID})
+	return connInfo, nil
+}
+
+func (c *commImpl) exchangeConnectionMsgs(stream stream, remoteAddress string, target common.PKIidType) (*proto.ConnectionInfo, error) {
+	ctx := stream.Context()
 	remoteCertHash := extractCertificateHashFromContext(ctx)
+	skipHandshake := c.shouldSkipHandshake(remoteAddress)
+	selfCertHash := c.getSelfCertHash()
 	var err error
 	var cMsg *proto.SignedGossipMessage
 	var signer proto.Signer
 
 	// If TLS is detected, sign the hash of our cert to bind our TLS cert
 	// to the gRPC session
-	if remoteCertHash != nil && c.selfCertHash != nil && !c.skipHandshake {
-		signer = func(msg []byte) ([]byte, error) {
-			return c.idMapper.Sign(msg)
-		}
+	if remoteCertHash != nil && selfCertHash != nil && !skipHandshake {
+		signer = c.getHandshakeSigner()
 	} else { // If we don't use TLS, we have no unique text to sign,
 		//  so don't sign anything
 		signer = func(msg []byte) ([]byte, error) {
@@ -413,16 +1449,52 @@ func (c *commImpl) authenticateRemotePeer(stream stream) (*proto.ConnectionInfo,
 		}
 	}
 
-	cMsg = c.createConnectionMsg(c.PKIID, c.selfCertHash, c.peerIdentity, signer)
+	cMsg = c.createConnectionMsg(c.PKIID, target, selfCertHash, c.peerIdentity, signer)
 
-	c.logger.Debug("Sending", cMsg, "to", remoteAddress)
-	stream.Send(cMsg.Envelope)
-	m, err := readWithTimeout(stream, util.GetDurationOrDefault("peer.gossip.connTimeout", defConnTimeout), remoteAddress)
+	codec := c.getCodec()
+	env, err := codec.Encode(cMsg)
 	if err != nil {
-		err := fmt.Errorf("Failed reading messge from %s, reason: %v", remoteAddress, err)
-		c.logger.Warning(err)
+		c.logger.Warning("Failed encoding connection message:", err)
 		return nil, err
 	}
+	c.logger.Debug("Sending", cMsg, "to", remoteAddress, "with nonce", cMsg.Nonce)
+	// Both sides send their connection message before they read the remote one,
+	// so send concurrently with the read; otherwise two connection messages
+	// larger than the flow control window would block each other forever
+	sendErr := make(chan error, 1)
+	go func() {
+		sendErr <- stream.Send(env)
+	}()
+	var m *proto.SignedGossipMessage
+	readErr := make(chan error, 1)
+	go func() {
+		var err error
+		m, err = readWithTimeout(stream, codec, util.GetDurationOrDefault("peer.gossip.connTimeout", defConnTimeout),
+			util.GetIntOrDefault("peer.gossip.maxHandshakeSize", defMaxHandshakeSize))
+		readErr <- err
+	}()
+	for sent, read := false, false; !sent || !read; {
+		select {
+		case err = <-sendErr:
+			if err != nil {
+				err := fmt.Errorf("Failed sending message to %s, reason: %v", remoteAddress, err)
+				c.logger.Warning(err)
+				return nil, err
+			}
+			sent = true
+		case err = <-readErr:
+			if err == ErrHandshakeTimeout {
+				c.logger.Warning("Timed out waiting for connection message from", remoteAddress)
+				return nil, err
+			}
+			if err != nil {
+				err := fmt.Errorf("Failed reading messge from %s, reason: %v", remoteAddress, err)
+				c.logger.Warning(err)
+				return nil, err
+			}
+			read = true
+		}
+	}
 	receivedMsg := m.GetConn()
 	if receivedMsg == nil {
 		c.logger.Warning("Expected connection message but got", receivedMsg)
@@ -434,26 +1506,52 @@ func (c *commImpl) authenticateRemotePeer(stream stream) (*proto.ConnectionInfo,
 		return nil, fmt.Errorf("%s didn't send a pkiID", remoteAddress)
 	}
 
-	c.logger.Debug("Received", receivedMsg, "from", remoteAddress)
-	err = c.idMapper.Put(receivedMsg.PkiId, receivedMsg.Cert)
-	if err != nil {
-		c.logger.Warning("Identity store rejected", remoteAddress, ":", err)
+	if len(receivedMsg.Cert) == 0 {
+		c.logger.Warning(remoteAddress, "didn't send an identity")
+		return nil, fmt.Errorf("%s didn't send an identity", remoteAddress)
+	}
+
+	c.logger.Debug("Received", receivedMsg, "from", remoteAddress, "with nonce", m.Nonce)
+	c.emitEvent(ConnEvent{Kind: IdentityReceived, RemoteAddress: remoteAddress, PKIID: receivedMsg.PkiId})
+
+	// Make sure the remote peer doesn't claim a PKI-ID that isn't derived from its identity
+	if pkiID := c.idMapper.GetPKIidOfCert(receivedMsg.Cert); !bytes.Equal(pkiID, receivedMsg.PkiId) {
+		err = fmt.Errorf("PKI-ID %v sent by %s doesn't match its identity", receivedMsg.PkiId, remoteAddress)
+		c.logger.Warning(err)
 		return nil, err
 	}
 
+	if !c.skipIDExpiration {
+		if err = checkIdentityValidity(receivedMsg.Cert, time.Now()); err != nil {
+			c.logger.Warning("Rejecting", remoteAddress, ":", err)
+			return nil, ErrIdentityExpired
+		}
+	}
+
+	// If we're configured with trusted roots, make sure the TLS certificate
+	// chain of the remote peer is valid before we bind its identity
+	if roots := c.getTLSRootCAs(); roots != nil && remoteCertHash != nil {
+		if err = verifyCertChain(extractCertificateChainFromContext(ctx), roots); err != nil {
+			c.logger.Warning("Failed verifying certificate chain of", remoteAddress, ":", err)
+			return nil, err
+		}
+	}
+
 	connInfo := &proto.ConnectionInfo{
-		ID:       receivedMsg.PkiId,
-		Identity: receivedMsg.Cert,
+		ID:              receivedMsg.PkiId,
+		Identity:        receivedMsg.Cert,
+		TLSCertHash:     remoteCertHash,
+		ProtocolVersion: negotiateProtocolVersion(receivedMsg.ProtocolVersion),
 	}
 
 	// if TLS is enabled and detected, verify remote peer
-	if remoteCertHash != nil && c.selfCertHash != nil && !c.skipHandshake {
+	if remoteCertHash != nil && selfCertHash != nil && !skipHandshake {
 		if !bytes.Equal(remoteCertHash, receivedMsg.Hash) {
 			return nil, fmt.Errorf("Expected %v in remote hash, but got %v", remoteCertHash, receivedMsg.Hash)
 		}
+		// The identity isn't in the identity mapper until the remote peer is authenticated
 		verifier := func(peerIdentity []byte, signature, message []byte) error {
-			pkiID := c.idMapper.GetPKIidOfCert(api.PeerIdentityType(peerIdentity))
-			return c.idMapper.Verify(pkiID, signature, message)
+			return c.idMapper.VerifyWithIdentity(api.PeerIdentityType(peerIdentity), signature, message)
 		}
 		err = m.Verify(receivedMsg.Cert, verifier)
 		if err != nil {
@@ -467,97 +1565,592 @@ func (c *commImpl) authenticateRemotePeer(stream stream) (*proto.ConnectionInfo,
 	}
 
 	// TLS enabled but not detected on other side, and we're not configured to skip handshake verification
-	if remoteCertHash == nil && c.selfCertHash != nil && !c.skipHandshake {
+	if remoteCertHash == nil && selfCertHash != nil && !skipHandshake {
 		err = fmt.Errorf("Remote peer %s didn't send TLS certificate", remoteAddress)
 		c.logger.Warning(err)
 		return nil, err
 	}
 
-	c.logger.Debug("Authenticated", remoteAddress)
+	// A remote peer that knows whom it connects to names it in its connection message,
+	// so a stream that was routed to another peer, e.g. by a server that is shared
+	// by several instances, is rejected
+	if len(receivedMsg.TargetPkiId) != 0 && !bytes.Equal(receivedMsg.TargetPkiId, c.PKIID) {
+		err = fmt.Errorf("%s meant to connect to %v, not to %v", remoteAddress, common.PKIidType(receivedMsg.TargetPkiId), c.PKIID)
+		c.logger.Warning(err)
+		return nil, err
+	}
+
+	prevIdentity, err := c.idMapper.Get(receivedMsg.PkiId)
+	known := err == nil
+	if known && !bytes.Equal(prevIdentity, receivedMsg.Cert) {
+		atomic.AddUint64(&c.identityChanges, 1)
+		c.emitEvent(ConnEvent{Kind: IdentityChanged, RemoteAddress: remoteAddress, PKIID: receivedMsg.PkiId})
+		if c.rejectIDChanges {
+			err = fmt.Errorf("%s presented an identity different from the one known for %v", remoteAddress, receivedMsg.PkiId)
+			c.logger.Warning(err)
+			return nil, err
+		}
+		c.logger.Warning(remoteAddress, "presented an identity different from the one known for", receivedMsg.PkiId, ", replacing it")
+	}
+	// Only identities of authenticated peers are put in the identity mapper
+	err = c.idMapper.Put(receivedMsg.PkiId, receivedMsg.Cert)
+	if err != nil {
+		c.logger.Warning("Identity store rejected", remoteAddress, ":", err)
+		return nil, err
+	}
+
+	c.logger.Debug("Authenticated", remoteAddress, "nonces:", cMsg.Nonce, m.Nonce)
 
 	return connInfo, nil
 }
 
 func (c *commImpl) GossipStream(stream proto.Gossip_GossipStreamServer) error {
+	atomic.AddInt32(&c.activeStreams, 1)
+	defer atomic.AddInt32(&c.activeStreams, -1)
 	if c.isStopping() {
-		return errors.New("Shutting down")
+		return ErrStopping
+	}
+	if c.isOverloaded() {
+		c.logger.Warning("Overloaded, rejecting stream from", extractRemoteAddress(stream))
+		return errOverloaded
 	}
-	connInfo, err := c.authenticateRemotePeer(stream)
+	if !c.admitStream(defStreamAdmitTimeout) {
+		c.logger.Warning("Too many concurrent streams, rejecting stream from", extractRemoteAddress(stream))
+		return errTooManyStreams
+	}
+	defer c.releaseStream()
+	start := time.Now()
+	connInfo, err := c.authenticateRemotePeer(stream, nil)
 	if err != nil {
 		c.logger.Error("Authentication failed:", err)
 		return err
 	}
-	c.logger.Debug("Servicing", extractRemoteAddress(stream))
+	c.connLatency[Inbound].observe(time.Since(start))
+	remoteAddr := extractRemoteAddress(stream)
+	c.logger.Debug("Servicing", remoteAddr)
 
-	conn := c.connStore.onConnected(stream, connInfo)
+	conn, err := c.connStore.onConnected(stream, connInfo)
 
-	// if connStore denied the connection, it means we already have a connection to that peer
-	// so close this stream
+	// The connection store might reject the connection, e.g. because
+	// the remote peer is already connected, so close this stream
 	if conn == nil {
-		return nil
+		c.idMapper.Release(connInfo.ID)
+		if err != nil {
+			c.logger.Warning("Rejected connection from", connInfo.ID, "at", remoteAddr, ":", err)
+		}
+		return err
 	}
 
 	h := func(m *proto.SignedGossipMessage) {
-		c.msgPublisher.DeMultiplex(&ReceivedMessageImpl{
+		c.publish(&ReceivedMessageImpl{
 			conn:                conn,
 			lock:                conn,
 			SignedGossipMessage: m,
 			connInfo:            connInfo,
+			remoteAddr:          remoteAddr,
 		})
 	}
 
 	conn.handler = h
+	conn.throttled = c.backlogExceeded
+	conn.paused = c.IsPaused
+	conn.codec = c.getCodec()
+	conn.onUndeliver = c.handleUndelivered
+	conn.recvBuffCap = c.recvBuffCapacity()
+	conn.recvLimit = func() int {
+		return c.recvBuffSizeOf(conn)
+	}
 
+	closeReason := LocalStop
 	defer func() {
-		c.logger.Debug("Client", extractRemoteAddress(stream), " disconnected")
-		c.connStore.closeByPKIid(connInfo.ID)
-		conn.close()
+		c.logger.Debug("Client", remoteAddr, " disconnected")
+		// The connection might have been replaced by a newer connection of the same peer
+		c.connStore.removeConn(conn, closeReason)
 	}()
 
-	return conn.serviceConnection()
+	err = conn.serviceConnection()
+	if err != nil {
+		closeReason = RemoteEOF
+	}
+	return err
+}
+
+// newSlots returns a semaphore with the given number of slots,
+// or nil if the given maximum isn't positive
+func newSlots(max int) chan struct{} {
+	if max <= 0 {
+		return nil
+	}
+	return make(chan struct{}, max)
+}
+
+// acquireSlot waits up to the given timeout for a slot of the given
+// semaphore, and returns whether it was acquired. A nil semaphore is unbounded
+func acquireSlot(slots chan struct{}, timeout time.Duration) bool {
+	if slots == nil {
+		return true
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// tryAcquireSlot acquires a slot only if one is free, without waiting
+func tryAcquireSlot(slots chan struct{}) bool {
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseSlot(slots chan struct{}) {
+	if slots != nil {
+		<-slots
+	}
+}
+
+// acquireDialSlot waits until an outbound connection can be established without
+// exceeding the maximum concurrent dials, and returns false if the instance is stopping
+func (c *commImpl) acquireDialSlot() bool {
+	for !acquireSlot(c.dialSlots, dialQueuePollInterval) {
+		if c.isStopping() {
+			return false
+		}
+	}
+	return true
+}
+
+// admitStream waits up to the given timeout for a stream to be admitted
+// to be serviced, and returns whether it was admitted
+func (c *commImpl) admitStream(timeout time.Duration) bool {
+	return acquireSlot(c.streamSlots, timeout)
+}
+
+func (c *commImpl) releaseStream() {
+	releaseSlot(c.streamSlots)
 }
 
 func (c *commImpl) Ping(context.Context, *proto.Empty) (*proto.Empty, error) {
 	return &proto.Empty{}, nil
 }
 
-func (c *commImpl) disconnect(pkiID common.PKIidType) {
+// TagConnection attaches the given tags to the connection to the given peer, replacing
+// the values of tags that are already attached. Tags are local labels that only
+// serve diagnostics, and are discarded along with the connection
+func (c *commImpl) TagConnection(pkiID common.PKIidType, tags map[string]string) {
+	conn, exists := c.connStore.existingConnection(pkiID)
+	if !exists {
+		c.logger.Debug("No connection to", pkiID, ", not tagging it")
+		return
+	}
+	conn.tag(tags)
+}
+
+// recvBuffCapacity returns the largest receive buffer size that applies to any connection
+func (c *commImpl) recvBuffCapacity() int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	capacity := c.recvBuffSize
+	for _, size := range c.recvBuffSizes {
+		if size > capacity {
+			capacity = size
+		}
+	}
+	return capacity
+}
+
+// recvBuffSizeOf returns the receive buffer size that applies to the given connection
+func (c *commImpl) recvBuffSizeOf(conn *connection) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if len(c.recvBuffSizes) == 0 {
+		return c.recvBuffSize
+	}
+	size := 0
+	for tag, tagSize := range c.recvBuffSizes {
+		if tagSize > size && conn.hasTag(tag.key, tag.value) {
+			size = tagSize
+		}
+	}
+	if size == 0 {
+		return c.recvBuffSize
+	}
+	return size
+}
+
+// LastError returns the last error that occurred when connecting or sending to the
+// given peer and when it occurred, and whether an error occurred since a connection
+// to the peer was last established
+func (c *commImpl) LastError(pkiID common.PKIidType) (error, time.Time, bool) {
+	return c.connStore.lastError(pkiID)
+}
+
+// IsAuthenticated returns whether the connection to the given peer is
+// mutually authenticated, and whether there is a connection to the peer at all
+func (c *commImpl) IsAuthenticated(pkiID common.PKIidType) (authenticated bool, known bool) {
+	conn, exists := c.connStore.existingConnection(pkiID)
+	if !exists || conn.info == nil {
+		return false, exists
+	}
+	return conn.info.IsAuthenticated(), true
+}
+
+// ResetConnections closes all connections to remote peers without stopping
+// the instance, which keeps accepting connections and messages.
+// Remote peers are notified as presumed dead, like with any other close
+func (c *commImpl) ResetConnections() {
+	if c.isStopping() {
+		return
+	}
+	for _, conn := range c.connStore.connections() {
+		c.disconnect(conn.pkiID, LocalStop)
+	}
+}
+
+// Warmup concurrently establishes connections to the given peers, a bounded number
+// at a time, and returns the error of connecting to each peer in the order of the peers.
+// A nil error means a connection to the peer exists
+func (c *commImpl) Warmup(peers []*RemotePeer) []error {
+	errs := make([]error, len(peers))
+	concurrency := util.GetIntOrDefault("peer.gossip.warmupConcurrency", defWarmupConcurrency)
+	if concurrency < 1 {
+		concurrency = defWarmupConcurrency
+	}
+	slots := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, peer := range peers {
+		if err := c.validateRemotePeer(peer, false); err != nil {
+			errs[i] = err
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func(i int, peer *RemotePeer) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			if _, err := c.connStore.getConnection(peer); err != nil {
+				c.logger.Warning("Failed warming up connection to", peer, ":", err)
+				errs[i] = err
+			}
+		}(i, peer)
+	}
+	wg.Wait()
+	return errs
+}
+
+// CheckConnectivity probes the given peers concurrently, and returns the result of
+// the probe of each peer by its endpoint. Probes that don't complete within the given
+// timeout fail. No connection to the peers is kept once they are probed
+func (c *commImpl) CheckConnectivity(peers []*RemotePeer, timeout time.Duration) map[string]error {
+	results := make(map[string]error, len(peers))
+	var lock sync.Mutex
+	done := make(chan struct{})
+	slots := make(chan struct{}, connCheckConcurrency)
+	var wg sync.WaitGroup
+	// Once the timeout expires or the results are returned, probes that are in
+	// progress are aborted, and probes that haven't started yet never start
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		defer close(done)
+		defer wg.Wait()
+		for _, peer := range peers {
+			if peer == nil {
+				continue
+			}
+			select {
+			case slots <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			wg.Add(1)
+			go func(peer *RemotePeer) {
+				defer wg.Done()
+				defer func() { <-slots }()
+				err := c.probe(ctx, peer)
+				// Probes cut short by the timeout are reported as timed out
+				if ctx.Err() != nil {
+					return
+				}
+				lock.Lock()
+				results[peer.Endpoint] = err
+				lock.Unlock()
+			}(peer)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	checked := make(map[string]error, len(peers))
+	for _, peer := range peers {
+		if peer == nil {
+			continue
+		}
+		err, probed := results[peer.Endpoint]
+		if !probed {
+			err = fmt.Errorf("Probing %s timed out", peer.Endpoint)
+		}
+		checked[peer.Endpoint] = err
+	}
+	return checked
+}
+
+func (c *commImpl) disconnect(pkiID common.PKIidType, reason CloseReason) {
+	if c.isStopping() {
+		return
+	}
+	// Transient send failures don't make the peer presumed dead right away
+	if reason != SendError || c.deadPeers.failed(pkiID, time.Now()) {
+		c.deadEndpoints <- pkiID
+	}
+	c.connStore.closeByPKIid(pkiID, reason)
+}
+
+// ConnectedPeers returns the remote peers this peer is connected
+// to, along with which side initiated each connection
+func (c *commImpl) ConnectedPeers() []ConnectedPeer {
+	connections := c.connStore.connections()
+	peers := make([]ConnectedPeer, 0, len(connections))
+	for _, conn := range connections {
+		peers = append(peers, ConnectedPeer{PKIID: conn.pkiID, Direction: conn.direction})
+	}
+	return peers
+}
+
+func (c *commImpl) WaitForConnection(ctx context.Context, peer *RemotePeer) error {
+	if c.isStopping() {
+		return ErrStopping
+	}
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return err
+	}
+	connected := make(chan struct{}, 1)
+	c.lock.Lock()
+	c.connWaiters[string(peer.PKIID)] = append(c.connWaiters[string(peer.PKIID)], connected)
+	c.lock.Unlock()
+	defer c.removeConnWaiter(peer.PKIID, connected)
+
+	// The connection might have been established before we started waiting for it
+	if c.connStore.hasConnection(peer.PKIID) {
+		return nil
+	}
+
+	select {
+	case <-connected:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Flush blocks until the messages buffered for sending to the given peer were written
+// to its stream, or until the context expires. Unlike closing the connection
+// gracefully, messages keep being accepted for sending while flushing.
+// Returns ErrNotConnected if there is no connection to the peer, and
+// ErrInvalidRemotePeer if the peer is nil, or its endpoint or PKI-ID is invalid
+func (c *commImpl) Flush(ctx context.Context, peer *RemotePeer) error {
+	if c.isStopping() {
+		return ErrStopping
+	}
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return err
+	}
+	conn, exists := c.connStore.existingConnection(peer.PKIID)
+	if !exists {
+		return ErrNotConnected
+	}
+	return conn.flush(ctx)
+}
+
+// Connect starts establishing a connection to the given remote peer, and returns
+// a handle whose Ready channel is closed once the connection can be used.
+// An existing connection to the peer is reused
+func (c *commImpl) Connect(peer *RemotePeer) (ConnHandle, error) {
 	if c.isStopping() {
+		return nil, ErrStopping
+	}
+	if c.observer {
+		return nil, ErrObserverMode
+	}
+	if err := c.validateRemotePeer(peer, true); err != nil {
+		return nil, err
+	}
+	h := &connHandle{ready: make(chan struct{}), store: c.connStore}
+	go func() {
+		conn, err := c.connStore.getConnection(peer)
+		h.established(conn, err)
+	}()
+	return h, nil
+}
+
+type connHandle struct {
+	sync.Mutex
+	ready  chan struct{}
+	store  connStorage
+	conn   *connection
+	err    error
+	closed bool
+}
+
+func (h *connHandle) established(conn *connection, err error) {
+	h.Lock()
+	h.conn, h.err = conn, err
+	if err == nil && h.closed {
+		h.closeConn()
+	}
+	h.Unlock()
+	close(h.ready)
+}
+
+func (h *connHandle) Ready() <-chan struct{} {
+	return h.ready
+}
+
+func (h *connHandle) Err() error {
+	h.Lock()
+	defer h.Unlock()
+	return h.err
+}
+
+func (h *connHandle) ConnectionInfo() *proto.ConnectionInfo {
+	h.Lock()
+	defer h.Unlock()
+	if h.conn == nil {
+		return nil
+	}
+	return h.conn.info
+}
+
+func (h *connHandle) Close() {
+	h.Lock()
+	defer h.Unlock()
+	h.closed = true
+	if h.conn != nil {
+		h.closeConn()
+	}
+}
+
+// closeConn closes the connection of the handle, without closing another connection
+// that already replaced it. Must be called while holding the lock
+func (h *connHandle) closeConn() {
+	h.store.removeConn(h.conn, LocalStop)
+}
+
+func (c *commImpl) removeConnWaiter(pkiID common.PKIidType, waiter chan struct{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	waiters := c.connWaiters[string(pkiID)]
+	for i, w := range waiters {
+		if w == waiter {
+			waiters = append(waiters[:i], waiters[i+1:]...)
+			break
+		}
+	}
+	if len(waiters) == 0 {
+		delete(c.connWaiters, string(pkiID))
 		return
 	}
-	c.deadEndpoints <- pkiID
-	c.connStore.closeByPKIid(pkiID)
+	c.connWaiters[string(pkiID)] = waiters
+}
+
+// Events returns a channel of events in the lifecycle of connections to remote peers.
+// Events that don't fit in the channel because it isn't consumed are dropped
+func (c *commImpl) Events() <-chan ConnEvent {
+	return c.events
+}
+
+func (c *commImpl) emitEvent(event ConnEvent) {
+	event.Time = time.Now()
+	select {
+	case c.events <- event:
+	default:
+		atomic.AddUint64(&c.droppedEvents, 1)
+	}
+}
+
+func (c *commImpl) onConnStateChange(pkiID common.PKIidType, state ConnectionState, reason CloseReason) {
+	c.lock.Lock()
+	if state == ConnectionClosed {
+		c.closedConns[reason]++
+	}
+	cb := c.connStateCallback
+	var waiters []chan struct{}
+	if state == ConnectionEstablished {
+		waiters = c.connWaiters[string(pkiID)]
+		delete(c.connWaiters, string(pkiID))
+	}
+	c.lock.Unlock()
+
+	if state == ConnectionEstablished {
+		c.deadPeers.succeeded(pkiID)
+	}
+
+	for _, waiter := range waiters {
+		waiter <- struct{}{}
+	}
+
+	if state == ConnectionClosed {
+		c.logger.Debug("Connection to", pkiID, "closed, reason:", reason)
+		c.pkiIDCache.invalidate(pkiID)
+		c.emitEvent(ConnEvent{Kind: ConnClosed, PKIID: pkiID, Reason: reason})
+	} else {
+		c.emitEvent(ConnEvent{Kind: ConnOpened, PKIID: pkiID})
+	}
+	if cb != nil {
+		cb(pkiID, state, reason)
+	}
 }
 
-func readWithTimeout(stream interface{}, timeout time.Duration, address string) (*proto.SignedGossipMessage, error) {
+// readWithTimeout reads a message from the given stream, and fails if it isn't read within
+// the given timeout. Messages larger than the given size, if positive, are rejected before
+// they're decoded. The size is only known once gRPC received the message, and the vendored
+// gRPC has no limit of its own, so this doesn't bound the memory gRPC allocates for it
+func readWithTimeout(stream interface{}, codec MessageCodec, timeout time.Duration, maxSize int) (*proto.SignedGossipMessage, error) {
 	incChan := make(chan *proto.SignedGossipMessage, 1)
 	errChan := make(chan error, 1)
 	go func() {
+		var m *proto.Envelope
+		var err error
 		if srvStr, isServerStr := stream.(proto.Gossip_GossipStreamServer); isServerStr {
-			if m, err := srvStr.Recv(); err == nil {
-				msg, err := m.ToGossipMessage()
-				if err != nil {
-					errChan <- err
-					return
-				}
-				incChan <- msg
-			}
+			m, err = srvStr.Recv()
 		} else if clStr, isClientStr := stream.(proto.Gossip_GossipStreamClient); isClientStr {
-			if m, err := clStr.Recv(); err == nil {
-				msg, err := m.ToGossipMessage()
-				if err != nil {
-					errChan <- err
-					return
-				}
-				incChan <- msg
-			}
+			m, err = clStr.Recv()
 		} else {
 			panic(fmt.Errorf("Stream isn't a GossipStreamServer or a GossipStreamClient, but %v. Aborting", reflect.TypeOf(stream)))
 		}
+		if err != nil {
+			errChan <- err
+			return
+		}
+		if size := envelopeSize(m); maxSize > 0 && size > maxSize {
+			errChan <- fmt.Errorf("Message of %d bytes exceeds the maximum handshake message size of %d bytes", size, maxSize)
+			return
+		}
+		msg, err := codec.Decode(m)
+		if err != nil {
+			errChan <- err
+			return
+		}
+		incChan <- msg
 	}()
 	select {
 	case <-time.NewTicker(timeout).C:
-		return nil, fmt.Errorf("Timed out waiting for connection message from %s", address)
+		return nil, ErrHandshakeTimeout
 	case m := <-incChan:
 		return m, nil
 	case err := <-errChan:
@@ -565,15 +2158,19 @@ func readWithTimeout(stream interface{}, timeout time.Duration, address string)
 	}
 }
 
-func (c *commImpl) createConnectionMsg(pkiID common.PKIidType, hash []byte, cert api.PeerIdentityType, signer proto.Signer) *proto.SignedGossipMessage {
+func (c *commImpl) createConnectionMsg(pkiID, target common.PKIidType, hash []byte, cert api.PeerIdentityType, signer proto.Signer) *proto.SignedGossipMessage {
 	m := &proto.GossipMessage{
-		Tag:   proto.GossipMessage_EMPTY,
-		Nonce: 0,
+		Tag: proto.GossipMessage_EMPTY,
+		// The nonce is unique per handshake attempt, in order to be able
+		// to tell apart concurrent handshakes in logs and traces
+		Nonce: util.RandomUInt64(),
 		Content: &proto.GossipMessage_Conn{
 			Conn: &proto.ConnEstablish{
-				Hash:  hash,
-				Cert:  cert,
-				PkiId: pkiID,
+				Hash:            hash,
+				Cert:            cert,
+				PkiId:           pkiID,
+				ProtocolVersion: ProtocolVersion,
+				TargetPkiId:     target,
 			},
 		},
 	}
@@ -584,14 +2181,98 @@ func (c *commImpl) createConnectionMsg(pkiID common.PKIidType, hash []byte, cert
 	return sMsg
 }
 
+// normalizeEndpoint returns the given endpoint in a host:port form that
+// can be dialed, bracketing IPv6 literals that were given without brackets
+func normalizeEndpoint(endpoint string) string {
+	if host, port, err := net.SplitHostPort(endpoint); err == nil {
+		return net.JoinHostPort(host, port)
+	}
+	i := strings.LastIndex(endpoint, ":")
+	if i == -1 {
+		return endpoint
+	}
+	return net.JoinHostPort(endpoint[:i], endpoint[i+1:])
+}
+
 type stream interface {
 	Send(envelope *proto.Envelope) error
 	Recv() (*proto.Envelope, error)
 	grpc.Stream
 }
 
-func createGRPCLayer(port int) (*grpc.Server, net.Listener, grpc.DialOption, []byte) {
+// certOptionsFromConfig returns the options of the certificate that is
+// generated for the gRPC server the comm instance creates
+func certOptionsFromConfig() certOptions {
+	return certOptions{
+		validity:   util.GetDurationOrDefault("peer.gossip.tls.certValidity", 0),
+		keyType:    viper.GetString("peer.gossip.tls.keyType"),
+		keySize:    util.GetIntOrDefault("peer.gossip.tls.keySize", 0),
+		commonName: viper.GetString("peer.gossip.tls.commonName"),
+		altNames:   viper.GetStringSlice("peer.gossip.tls.altNames"),
+	}
+}
+
+// listen creates a TCP listener on the given address. If the backlog
+// is positive, it's used as the size of the queue of pending connections,
+// otherwise the OS default is used
+func listen(address string, backlog int) (net.Listener, error) {
+	if backlog <= 0 {
+		return net.Listen("tcp", address)
+	}
+	return listenWithBacklog(address, backlog)
+}
+
+// alpnProtocols returns the application protocols negotiated via ALPN:
+// "h2", which gRPC requires, followed by the given additional protocols
+func alpnProtocols(additional []string) []string {
+	protos := []string{"h2"}
+	for _, proto := range additional {
+		proto = strings.TrimSpace(proto)
+		if proto == "" || util.IndexInSlice(protos, proto, func(a interface{}, b interface{}) bool {
+			return a.(string) == b.(string)
+		}) != -1 {
+			continue
+		}
+		protos = append(protos, proto)
+	}
+	return protos
+}
+
+// createGRPCLayer creates a gRPC server listening on the given port, and the dial option
+// to connect to other instances with. TLS certificates of remote peers are verified
+// against the given roots, and aren't verified at all if no roots are given.
+// Returns an error if the certificate can't be loaded or the port can't be bound
+func createGRPCLayer(port int, roots *x509.CertPool) (*grpc.Server, net.Listener, grpc.DialOption, []byte, *tlsCertificate, error) {
+	return newGRPCLayer(port, roots, grpcLayerOptionsFromConfig())
+}
+
+// grpcLayerOptions configure the transport of the gRPC server
+// and the dial option that newGRPCLayer creates
+type grpcLayerOptions struct {
+	// alpn are the application protocols negotiated via ALPN
+	// in addition to the one gRPC requires
+	alpn []string
+	// insecure disables TLS, both for the server and for dialing
+	insecure bool
+	// stats is given the events of the streams and RPCs the server serves,
+	// and isn't given any if nil
+	stats StatsHandler
+}
+
+// grpcLayerOptionsFromConfig returns the options of the transport
+// of the gRPC server the comm instance creates
+func grpcLayerOptionsFromConfig() grpcLayerOptions {
+	return grpcLayerOptions{
+		alpn:     viper.GetStringSlice("peer.gossip.tls.alpn"),
+		insecure: viper.GetBool("peer.gossip.tls.disabled"),
+	}
+}
+
+// newGRPCLayer behaves like createGRPCLayer, with the given transport options.
+// If TLS is disabled, no certificate is generated and its hash is nil
+func newGRPCLayer(port int, roots *x509.CertPool, opts grpcLayerOptions) (*grpc.Server, net.Listener, grpc.DialOption, []byte, *tlsCertificate, error) {
 	var returnedCertHash []byte
+	var returnedCert *tlsCertificate
 	var s *grpc.Server
 	var ll net.Listener
 	var err error
@@ -604,40 +2285,65 @@ func createGRPCLayer(port int) (*grpc.Server, net.Listener, grpc.DialOption, []b
 	defer os.Remove(keyFileName)
 	defer os.Remove(certFileName)
 
-	err = generateCertificates(keyFileName, certFileName)
-	if err == nil {
+	if opts.insecure && roots != nil {
+		return nil, nil, nil, nil, nil, errors.New("TLS certificates of remote peers can't be verified while TLS is disabled")
+	}
+
+	if !opts.insecure {
+		if err = generateCertificatesWithOptions(keyFileName, certFileName, certOptionsFromConfig()); err != nil {
+			return nil, nil, nil, nil, nil, fmt.Errorf("Failed generating certificate: %v", err)
+		}
 		cert, err := tls.LoadX509KeyPair(certFileName, keyFileName)
 		if err != nil {
-			panic(err)
+			return nil, nil, nil, nil, nil, fmt.Errorf("Failed loading generated certificate: %v", err)
 		}
 
 		if len(cert.Certificate) == 0 {
-			panic(errors.New("Certificate chain is nil"))
+			return nil, nil, nil, nil, nil, errors.New("Certificate chain is nil")
 		}
 
 		returnedCertHash = certHashFromRawCert(cert.Certificate[0])
+		returnedCert = &tlsCertificate{cert: &cert}
 
+		skipVerify := roots == nil
+		clientAuth := tls.RequestClientCert
+		if !skipVerify {
+			clientAuth = tls.VerifyClientCertIfGiven
+		}
 		tlsConf := &tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			ClientAuth:         tls.RequestClientCert,
-			InsecureSkipVerify: true,
+			GetCertificate:     returnedCert.getCertificate,
+			ClientAuth:         clientAuth,
+			ClientCAs:          roots,
+			InsecureSkipVerify: skipVerify,
 		}
 		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(tlsConf)))
-		ta := credentials.NewTLS(&tls.Config{
-			Certificates:       []tls.Certificate{cert},
-			InsecureSkipVerify: true,
-		})
+		clientConf := &tls.Config{
+			GetClientCertificate: returnedCert.getClientCertificate,
+			RootCAs:              roots,
+			InsecureSkipVerify:   skipVerify,
+		}
+		ta := credentials.NewTLS(clientConf)
+		// NewTLS overwrites the protocols of the configurations it's given with
+		// the ones gRPC requires, so they're extended only afterwards
+		tlsConf.NextProtos = alpnProtocols(opts.alpn)
+		clientConf.NextProtos = alpnProtocols(opts.alpn)
 		dialOpts = grpc.WithTransportCredentials(&authCreds{tlsCreds: ta})
 	} else {
 		dialOpts = grpc.WithInsecure()
 	}
 
-	listenAddress := fmt.Sprintf("%s:%d", "", port)
-	ll, err = net.Listen("tcp", listenAddress)
+	listenAddress := net.JoinHostPort("", strconv.Itoa(port))
+	ll, err = listen(listenAddress, util.GetIntOrDefault("peer.gossip.listenBacklog", defListenBacklog))
 	if err != nil {
-		panic(err)
+		return nil, nil, nil, nil, nil, fmt.Errorf("Failed listening on %s: %v", listenAddress, err)
+	}
+
+	if opts.stats != nil {
+		serverOpts = append(serverOpts,
+			grpc.StreamInterceptor(statsStreamInterceptor(opts.stats)),
+			grpc.UnaryInterceptor(statsUnaryInterceptor(opts.stats)))
 	}
 
 	s = grpc.NewServer(serverOpts...)
-	return s, ll, dialOpts, returnedCertHash
+	return s, ll, dialOpts, returnedCertHash, returnedCert, nil
 }
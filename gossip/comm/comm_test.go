@@ -18,14 +18,22 @@ package comm
 
 import (
 	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/hmac"
+	cryptorand "crypto/rand"
 	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"math/big"
 	"math/rand"
+	"net"
 	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -36,11 +44,13 @@ import (
 	"github.com/hyperledger/fabric/gossip/identity"
 	"github.com/hyperledger/fabric/gossip/util"
 	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/op/go-logging"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
 )
 
 func init() {
@@ -109,6 +119,41 @@ func newCommInstance(port int, sec api.MessageCryptoService) (Comm, error) {
 	return inst, err
 }
 
+// newEphemeralCommInstance creates a comm instance on a port that the OS considers
+// free, and returns it along with the remote peer that other instances reach it by
+func newEphemeralCommInstance(t *testing.T, sec api.MessageCryptoService) (Comm, *RemotePeer) {
+	port := freePort(t)
+	inst, err := newCommInstance(port, sec)
+	if err != nil {
+		t.Fatal("Failed creating a comm instance:", err)
+	}
+	return inst, remotePeer(port)
+}
+
+// freePort returns a port that the OS considers free
+func freePort(t *testing.T) int {
+	ll, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatal("Failed finding a free port:", err)
+	}
+	defer ll.Close()
+	return ll.Addr().(*net.TCPAddr).Port
+}
+
+// waitFor polls the condition until it holds, and fails
+// the test if it doesn't hold within 5 seconds
+func waitFor(t *testing.T, condition func() bool, msg string) bool {
+	deadline := time.Now().Add(time.Second * 5)
+	for !condition() {
+		if time.Now().After(deadline) {
+			assert.Fail(t, msg)
+			return false
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	return true
+}
+
 func handshaker(endpoint string, comm Comm, t *testing.T, sigMutator func([]byte) []byte, pkiIDmutator func([]byte) []byte, mutualTLS bool) <-chan proto.ReceivedMessage {
 	c := &commImpl{}
 	err := generateCertificates("key.pem", "cert.pem")
@@ -150,7 +195,7 @@ func handshaker(endpoint string, comm Comm, t *testing.T, sigMutator func([]byte
 		pkiID = common.PKIidType(pkiIDmutator([]byte(endpoint)))
 	}
 	assert.NoError(t, err, "%v", err)
-	msg := c.createConnectionMsg(pkiID, clientCertHash, []byte(endpoint), func(msg []byte) ([]byte, error) {
+	msg := c.createConnectionMsg(pkiID, nil, clientCertHash, []byte(endpoint), func(msg []byte) ([]byte, error) {
 		if !mutualTLS {
 			return msg, nil
 		}
@@ -170,11 +215,15 @@ func handshaker(endpoint string, comm Comm, t *testing.T, sigMutator func([]byte
 	assert.NoError(t, err, "%v", err)
 	if sigMutator == nil {
 		hash := extractCertificateHashFromContext(stream.Context())
-		expectedMsg := c.createConnectionMsg(common.PKIidType("localhost:9611"), hash, []byte("localhost:9611"), func(msg []byte) ([]byte, error) {
+		signer := func(msg []byte) ([]byte, error) {
 			mac := hmac.New(sha256.New, hmacKey)
 			mac.Write(msg)
 			return mac.Sum(nil), nil
-		})
+		}
+		expectedMsg := c.createConnectionMsg(common.PKIidType("localhost:9611"), nil, hash, []byte("localhost:9611"), signer)
+		// The nonce is random per handshake, so take the one the remote peer sent
+		expectedMsg.Nonce = msg.Nonce
+		expectedMsg.Sign(signer)
 		if mutualTLS {
 			assert.Equal(t, expectedMsg.Envelope.Signature, msg.Envelope.Signature)
 		}
@@ -233,6 +282,9 @@ func TestHandshake(t *testing.T) {
 	acceptChan = handshaker("localhost:9612", comm, t, mutateSig, nil, true)
 	time.Sleep(time.Second)
 	assert.Equal(t, 0, len(acceptChan))
+	// The identity of a peer that failed to authenticate isn't kept
+	_, err := comm.(*commImpl).idMapper.Get(common.PKIidType("localhost:9612"))
+	assert.Error(t, err)
 
 	// negative path, nothing should be read from the channel because the PKIid doesn't match the identity
 	mutatePKIID := func(b []byte) []byte {
@@ -241,6 +293,13 @@ func TestHandshake(t *testing.T) {
 	acceptChan = handshaker("localhost:9613", comm, t, nil, mutatePKIID, true)
 	time.Sleep(time.Second)
 	assert.Equal(t, 0, len(acceptChan))
+	mismatchDetected := false
+	for events := comm.(*commImpl).Events(); len(events) > 0; {
+		if e := <-events; e.Kind == AuthFailed && strings.Contains(e.Err.Error(), "doesn't match its identity") {
+			mismatchDetected = true
+		}
+	}
+	assert.True(t, mismatchDetected, "The handshake should have failed because the PKI-ID doesn't match the identity")
 
 	// Now we test for a handshake without mutual TLS
 	// The first time should fail
@@ -251,7 +310,20 @@ func TestHandshake(t *testing.T) {
 	case <-time.After(time.Second):
 	}
 
-	// And the second time should succeed
+	// A predicate can skip the handshake for specific remote peers
+	comm.(*commImpl).SetSkipHandshakePredicate(func(remoteAddr string) bool {
+		host, _, _ := net.SplitHostPort(remoteAddr)
+		return net.ParseIP(host).IsLoopback()
+	})
+	acceptChan = handshaker("localhost:9616", comm, t, nil, nil, false)
+	select {
+	case <-acceptChan:
+	case <-time.After(time.Second * 10):
+		assert.Fail(t, "skipHandshake predicate should have authorized the authentication")
+	}
+	comm.(*commImpl).SetSkipHandshakePredicate(nil)
+
+	// And with the handshake skipped globally, it should succeed as well
 	comm.(*commImpl).skipHandshake = true
 	acceptChan = handshaker("localhost:9615", comm, t, nil, nil, false)
 	select {
@@ -261,6 +333,18 @@ func TestHandshake(t *testing.T) {
 	}
 }
 
+func TestConnectionMsgNonce(t *testing.T) {
+	t.Parallel()
+	c := &commImpl{}
+	noopSigner := func(msg []byte) ([]byte, error) {
+		return msg, nil
+	}
+	m1 := c.createConnectionMsg(common.PKIidType("pkiID"), nil, nil, api.PeerIdentityType("pkiID"), noopSigner)
+	m2 := c.createConnectionMsg(common.PKIidType("pkiID"), nil, nil, api.PeerIdentityType("pkiID"), noopSigner)
+	assert.NotEqual(t, m1.Nonce, m2.Nonce)
+	assert.NotEqual(t, m1.Envelope.Payload, m2.Envelope.Payload)
+}
+
 func TestBasic(t *testing.T) {
 	t.Parallel()
 	comm1, _ := newCommInstance(2000, naiveSec)
@@ -284,6 +368,57 @@ func TestBasic(t *testing.T) {
 	waitForMessages(t, out, 2, "Didn't receive 2 messages")
 }
 
+func TestSendSync(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10631, naiveSec)
+	comm2, _ := newCommInstance(10632, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	m2 := comm2.Accept(acceptAll)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	msg := createGossipMsg()
+	assert.NoError(t, comm1.SendSync(ctx, msg, remotePeer(10632)))
+	select {
+	case m := <-m2:
+		assert.Equal(t, msg.Nonce, m.GetGossipMessage().Nonce)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message in a timely manner")
+	}
+
+	// Sending to a peer that doesn't exist should fail
+	assert.Error(t, comm1.SendSync(ctx, createGossipMsg(), remotePeer(10633)))
+}
+
+func TestWaitForConnection(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10651, naiveSec)
+	comm2, _ := newCommInstance(10652, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, comm2.WaitForConnection(ctx, remotePeer(10651)))
+
+	waitErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		waitErr <- comm2.WaitForConnection(ctx, remotePeer(10651))
+	}()
+	comm1.Send(createGossipMsg(), remotePeer(10652))
+	assert.NoError(t, <-waitErr)
+
+	// Now that the connection exists, waiting for it should return right away
+	assert.NoError(t, comm2.WaitForConnection(context.Background(), remotePeer(10651)))
+	assert.Empty(t, comm2.(*commImpl).connWaiters)
+
+	// Waiting for an invalid peer fails right away
+	assert.Equal(t, ErrInvalidRemotePeer, comm2.WaitForConnection(context.Background(), nil))
+}
+
 func TestProdConstructor(t *testing.T) {
 	t.Parallel()
 	keyFileName := fmt.Sprintf("key.%d.pem", util.RandomUInt64())
@@ -293,7 +428,8 @@ func TestProdConstructor(t *testing.T) {
 	cert, _ := tls.LoadX509KeyPair(certFileName, keyFileName)
 	os.Remove(keyFileName)
 	os.Remove(certFileName)
-	srv, lsnr, dialOpts, certHash := createGRPCLayer(20000)
+	srv, lsnr, dialOpts, certHash, _, err := createGRPCLayer(20000, nil)
+	assert.NoError(t, err)
 	defer srv.Stop()
 	defer lsnr.Close()
 	comm1, _ := NewCommInstance(srv, &cert, identity.NewIdentityMapper(naiveSec), []byte("localhost:20000"), dialOpts)
@@ -304,7 +440,8 @@ func TestProdConstructor(t *testing.T) {
 	cert, _ = tls.LoadX509KeyPair(certFileName, keyFileName)
 	os.Remove(keyFileName)
 	os.Remove(certFileName)
-	srv, lsnr, dialOpts, certHash = createGRPCLayer(30000)
+	srv, lsnr, dialOpts, certHash, _, err = createGRPCLayer(30000, nil)
+	assert.NoError(t, err)
 	defer srv.Stop()
 	defer lsnr.Close()
 	comm2, _ := NewCommInstance(srv, &cert, identity.NewIdentityMapper(naiveSec), []byte("localhost:30000"), dialOpts)
@@ -341,7 +478,14 @@ func TestGetConnectionInfo(t *testing.T) {
 	case msg := <-m1:
 		assert.Equal(t, comm2.GetPKIid(), msg.GetConnectionInfo().ID)
 		assert.NotNil(t, msg.GetSourceEnvelope())
+		certHash := comm2.(*commImpl).getSelfCertHash()
+		assert.NotNil(t, certHash)
+		assert.Equal(t, certHash, msg.GetConnectionInfo().TLSCertHash)
+		assert.Equal(t, certHash, msg.(*ReceivedMessageImpl).RemoteCertHash())
 	}
+
+	// Sessions that aren't over TLS have no certificate hash
+	assert.Nil(t, (&ReceivedMessageImpl{connInfo: &proto.ConnectionInfo{}}).RemoteCertHash())
 }
 
 func TestCloseConn(t *testing.T) {
@@ -369,7 +513,7 @@ func TestCloseConn(t *testing.T) {
 	assert.NoError(t, err, "%v", err)
 	c := &commImpl{}
 	hash := certHashFromRawCert(tlsCfg.Certificates[0].Certificate[0])
-	connMsg := c.createConnectionMsg(common.PKIidType("pkiID"), hash, api.PeerIdentityType("pkiID"), func(msg []byte) ([]byte, error) {
+	connMsg := c.createConnectionMsg(common.PKIidType("pkiID"), nil, hash, api.PeerIdentityType("pkiID"), func(msg []byte) ([]byte, error) {
 		mac := hmac.New(sha256.New, hmacKey)
 		mac.Write(msg)
 		return mac.Sum(nil), nil
@@ -532,6 +676,65 @@ func TestAccept(t *testing.T) {
 	remainderPredicate(oddResults, 1)
 }
 
+func TestAcceptBuffered(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10971, naiveSec)
+	comm2, _ := newCommInstance(10972, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	m1 := comm1.AcceptBuffered(acceptAll, 50)
+	assert.Equal(t, 50, cap(m1))
+	assert.Equal(t, defAcceptBuffSize, cap(comm2.AcceptBuffered(acceptAll, 0)))
+	assert.Equal(t, defAcceptBuffSize, cap(comm2.Accept(acceptAll)))
+
+	// Messages are buffered without being consumed
+	for i := 0; i < 30; i++ {
+		comm2.Send(createGossipMsg(), remotePeer(10971))
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(m1) < 30 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	assert.Len(t, m1, 30)
+}
+
+func TestAcceptWithConnInfo(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10701, naiveSec)
+	comm2, _ := newCommInstance(10702, naiveSec)
+	comm3, _ := newCommInstance(10703, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	fromComm2 := comm1.AcceptWithConnInfo(func(m proto.ReceivedMessage) bool {
+		return bytes.Equal(m.GetConnectionInfo().ID, comm2.GetPKIid())
+	})
+	all := comm1.Accept(acceptAll)
+
+	comm3.Send(createGossipMsg(), remotePeer(10701))
+	select {
+	case <-all:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message from comm3")
+	}
+	comm2.Send(createGossipMsg(), remotePeer(10701))
+
+	select {
+	case m := <-fromComm2:
+		assert.Equal(t, comm2.GetPKIid(), m.GetConnectionInfo().ID)
+		assert.NotEmpty(t, m.(*ReceivedMessageImpl).RemoteAddress())
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message from comm2")
+	}
+	select {
+	case m := <-fromComm2:
+		assert.Fail(t, "Received an unexpected message", m)
+	case <-time.After(time.Millisecond * 200):
+	}
+}
+
 func TestReConnections(t *testing.T) {
 	t.Parallel()
 	comm1, _ := newCommInstance(3611, naiveSec)
@@ -611,6 +814,60 @@ func TestProbe(t *testing.T) {
 	assert.Equal(t, api.PeerIdentityType("localhost:6612"), id)
 }
 
+func TestProbeAttempts(t *testing.T) {
+	t.Parallel()
+	// The remote peer fails every ping but every third one
+	var pings int32
+	flaky := func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		if atomic.AddInt32(&pings, 1)%3 != 0 {
+			return nil, errors.New("packet loss")
+		}
+		return handler(ctx, req)
+	}
+	srv := grpc.NewServer(grpc.UnaryInterceptor(flaky))
+	lsnr, err := net.Listen("tcp", "localhost:11001")
+	assert.NoError(t, err)
+	comm1, _ := NewCommInstance(srv, nil, identity.NewIdentityMapper(naiveSec), []byte("localhost:11001"))
+	go srv.Serve(lsnr)
+	defer srv.Stop()
+	defer comm1.Stop()
+
+	comm2, _ := NewCommInstanceWithServer(-1, identity.NewIdentityMapper(naiveSec), []byte("localhost:11002"), grpc.WithInsecure(), grpc.WithTimeout(time.Second))
+	defer comm2.Stop()
+
+	assert.Equal(t, 1, comm2.(*commImpl).probeAttempts)
+	assert.Error(t, comm2.Probe(remotePeer(11001)))
+	comm2.(*commImpl).probeAttempts = 3
+	assert.NoError(t, comm2.Probe(remotePeer(11001)))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&pings))
+}
+
+func TestHandshakeCached(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10671, naiveSec)
+	comm2, _ := newCommInstance(10672, naiveSec)
+	defer comm1.Stop()
+
+	_, exists := comm1.ResolvePKIID("localhost:10672")
+	assert.False(t, exists)
+	_, err := comm1.Handshake(remotePeer(10672))
+	assert.NoError(t, err)
+	pkiID, exists := comm1.ResolvePKIID("localhost:10672")
+	assert.True(t, exists)
+	assert.Equal(t, remotePeer(10672).PKIID, pkiID)
+
+	// The remote peer is offline, but its identity is known
+	comm2.Stop()
+	id, err := comm1.HandshakeCached(remotePeer(10672))
+	assert.NoError(t, err)
+	assert.Equal(t, api.PeerIdentityType("localhost:10672"), id)
+	_, err = comm1.Handshake(remotePeer(10672))
+	assert.Error(t, err)
+	// Expecting a different PKI-ID bypasses the cache
+	_, err = comm1.HandshakeCached(&RemotePeer{Endpoint: "localhost:10672", PKIID: common.PKIidType("p")})
+	assert.Error(t, err)
+}
+
 func TestPresumedDead(t *testing.T) {
 	t.Parallel()
 	comm1, _ := newCommInstance(4611, naiveSec)
@@ -636,37 +893,2196 @@ func TestPresumedDead(t *testing.T) {
 	}
 }
 
-func createGossipMsg() *proto.SignedGossipMessage {
-	return (&proto.GossipMessage{
-		Tag:   proto.GossipMessage_EMPTY,
-		Nonce: uint64(rand.Int()),
-		Content: &proto.GossipMessage_DataMsg{
-			DataMsg: &proto.DataMessage{},
-		},
-	}).NoopSign()
+type trackedConn struct {
+	net.Conn
+	closed int32
 }
 
-func remotePeer(port int) *RemotePeer {
-	endpoint := fmt.Sprintf("localhost:%d", port)
-	return &RemotePeer{Endpoint: endpoint, PKIID: []byte(endpoint)}
+func (c *trackedConn) Close() error {
+	atomic.StoreInt32(&c.closed, 1)
+	return c.Conn.Close()
 }
 
-func waitForMessages(t *testing.T, msgChan chan uint64, count int, errMsg string) {
-	c := 0
-	waiting := true
-	ticker := time.NewTicker(time.Duration(10) * time.Second)
-	for waiting {
-		select {
-		case <-msgChan:
-			c++
-			if c == count {
-				waiting = false
+type trackingDialer struct {
+	sync.Mutex
+	conns []*trackedConn
+}
+
+func (d *trackingDialer) dial(addr string, timeout time.Duration) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	d.Lock()
+	defer d.Unlock()
+	tc := &trackedConn{Conn: conn}
+	d.conns = append(d.conns, tc)
+	return tc, nil
+}
+
+func (d *trackingDialer) assertAllClosed(t *testing.T) {
+	d.Lock()
+	defer d.Unlock()
+	assert.NotEmpty(t, d.conns)
+	for _, conn := range d.conns {
+		assert.Equal(t, int32(1), atomic.LoadInt32(&conn.closed), "Connection wasn't closed")
+	}
+}
+
+func TestCreateConnectionClosesOnFailure(t *testing.T) {
+	t.Parallel()
+	sec := &revokingSecProvider{revoked: make(map[string]struct{})}
+	comm1, _ := newCommInstance(10661, sec)
+	comm2, _ := newCommInstance(10662, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	inst := comm1.(*commImpl)
+	dialer := &trackingDialer{}
+	inst.opts = append(inst.opts, grpc.WithDialer(dialer.dial))
+
+	// The remote peer isn't who we expect it to be
+	_, err := inst.createConnection("localhost:10662", common.PKIidType("localhost:10663"))
+	assert.Error(t, err)
+	assert.Equal(t, ConnectPKIIDMismatch, err.(*ConnectError).Kind)
+	dialer.assertAllClosed(t)
+
+	// The identity of the remote peer is rejected
+	dialer = &trackingDialer{}
+	inst.opts = append(inst.opts, grpc.WithDialer(dialer.dial))
+	sec.revoke(api.PeerIdentityType("localhost:10662"))
+	_, err = inst.createConnection("localhost:10662", remotePeer(10662).PKIID)
+	assert.Error(t, err)
+	assert.Equal(t, ConnectAuthFailed, err.(*ConnectError).Kind)
+	dialer.assertAllClosed(t)
+}
+
+func TestPerPeerDialOpts(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10941, naiveSec)
+	comm2, _ := newCommInstance(10942, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	dialer := &trackingDialer{}
+	peer := remotePeer(10942)
+	peer.DialOpts = []grpc.DialOption{grpc.WithDialer(dialer.dial)}
+
+	assert.NoError(t, comm1.Probe(peer))
+	_, err := comm1.Handshake(peer)
+	assert.NoError(t, err)
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer)
+	<-m2
+	dialer.Lock()
+	assert.Len(t, dialer.conns, 3)
+	dialer.Unlock()
+
+	// Peers without dial options are dialed with the options of the instance only
+	assert.NoError(t, comm1.Probe(remotePeer(10942)))
+	dialer.Lock()
+	assert.Len(t, dialer.conns, 3)
+	dialer.Unlock()
+}
+
+func TestNormalizeEndpoint(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, "localhost:7051", normalizeEndpoint("localhost:7051"))
+	assert.Equal(t, "[::1]:7051", normalizeEndpoint("[::1]:7051"))
+	assert.Equal(t, "[::1]:7051", normalizeEndpoint("::1:7051"))
+	assert.Equal(t, "[fe80::1%eth0]:7051", normalizeEndpoint("fe80::1%eth0:7051"))
+	assert.Equal(t, "localhost", normalizeEndpoint("localhost"))
+}
+
+func TestIPv6Endpoints(t *testing.T) {
+	t.Parallel()
+	ll, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 loopback isn't available:", err)
+	}
+	ll.Close()
+
+	comm1, _ := newCommInstance(10621, naiveSec)
+	comm2, _ := newCommInstance(10622, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	assert.NoError(t, comm1.Probe(&RemotePeer{Endpoint: "[::1]:10622"}))
+	assert.NoError(t, comm1.Probe(&RemotePeer{Endpoint: "::1:10622"}))
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), &RemotePeer{Endpoint: "[::1]:10622", PKIID: remotePeer(10622).PKIID})
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message over IPv6 in a timely manner")
+	}
+}
+
+type revokingSecProvider struct {
+	naiveSecProvider
+	sync.RWMutex
+	revoked map[string]struct{}
+}
+
+func (sp *revokingSecProvider) ValidateIdentity(peerIdentity api.PeerIdentityType) error {
+	sp.RLock()
+	defer sp.RUnlock()
+	if _, isRevoked := sp.revoked[string(peerIdentity)]; isRevoked {
+		return fmt.Errorf("%s is revoked", string(peerIdentity))
+	}
+	return nil
+}
+
+func (sp *revokingSecProvider) revoke(peerIdentity api.PeerIdentityType) {
+	sp.Lock()
+	defer sp.Unlock()
+	sp.revoked[string(peerIdentity)] = struct{}{}
+}
+
+func TestErrStopping(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10721, naiveSec)
+	comm1.Stop()
+
+	assert.Equal(t, ErrStopping, comm1.Probe(remotePeer(10722)))
+	_, err := comm1.Handshake(remotePeer(10722))
+	assert.Equal(t, ErrStopping, err)
+	assert.Equal(t, ErrStopping, comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(10722)))
+	assert.Equal(t, ErrStopping, comm1.WaitForConnection(context.Background(), remotePeer(10722)))
+	_, err = comm1.(*commImpl).createConnection("localhost:10722", nil)
+	assert.Equal(t, &ConnectError{Kind: ConnectStopping, Endpoint: "localhost:10722", Err: ErrStopping}, err)
+	assert.True(t, isStoppingErr(err))
+}
+
+func TestDone(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10951, naiveSec)
+	done := comm1.(*commImpl).Done()
+	select {
+	case <-done:
+		assert.Fail(t, "Instance hasn't been stopped yet")
+	default:
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			comm1.Stop()
+		}()
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Instance didn't signal it has stopped")
+	}
+	wg.Wait()
+}
+
+func TestInvalidRemotePeer(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10961, naiveSec)
+	defer comm1.Stop()
+
+	for _, peer := range []*RemotePeer{
+		{Endpoint: "", PKIID: common.PKIidType("peer")},
+		{Endpoint: "  ", PKIID: common.PKIidType("peer")},
+		{Endpoint: "localhost: 10962", PKIID: common.PKIidType("peer")},
+	} {
+		assert.Equal(t, ErrInvalidRemotePeer, comm1.Probe(peer))
+		_, err := comm1.Handshake(peer)
+		assert.Equal(t, ErrInvalidRemotePeer, err)
+		_, err = comm1.HandshakeCached(peer)
+		assert.Equal(t, ErrInvalidRemotePeer, err)
+		assert.Equal(t, ErrInvalidRemotePeer, comm1.SendSync(context.Background(), createGossipMsg(), peer))
+	}
+	assert.Equal(t, ErrInvalidRemotePeer, comm1.Probe(nil))
+	// Closing a connection to an invalid peer is a no-op
+	comm1.CloseConnGracefully(nil, time.Second)
+
+	// The PKI-ID is required by operations keyed by it, but not for probing,
+	// handshaking and sending, as bootstrapping learns it from the handshake
+	comm2, _ := newCommInstance(10962, naiveSec)
+	defer comm2.Stop()
+	peer := &RemotePeer{Endpoint: "localhost:10962"}
+	assert.Equal(t, ErrInvalidRemotePeer, comm1.SendSync(context.Background(), createGossipMsg(), peer))
+	assert.NoError(t, comm1.Probe(peer))
+	_, err := comm1.Handshake(peer)
+	assert.NoError(t, err)
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer)
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Message to a peer without a PKI-ID wasn't delivered")
+	}
+	// A connected peer can be sent to by its PKI-ID alone
+	comm1.Send(createGossipMsg(), &RemotePeer{PKIID: comm2.GetPKIid()})
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Message to a connected peer without an endpoint wasn't delivered")
+	}
+
+	// Sending to invalid peers doesn't presume them dead
+	comm1.Send(createGossipMsg(), &RemotePeer{Endpoint: "localhost: 10963", PKIID: common.PKIidType("peer")})
+	select {
+	case <-comm1.PresumedDead():
+		assert.Fail(t, "Invalid remote peers shouldn't be presumed dead")
+	case <-time.After(time.Millisecond * 500):
+	}
+}
+
+func TestSendByPKIIDWithoutConnection(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10964, naiveSec)
+	defer comm1.Stop()
+
+	var dials uint32
+	comm1.(*commImpl).SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		atomic.AddUint32(&dials, 1)
+		return grpc.Dial(target, opts...)
+	})
+	// A peer known only by its PKI-ID can't be dialed, so sending
+	// to it fails right away if no connection to it exists
+	errs := make(chan error, 1)
+	peer := &RemotePeer{PKIID: common.PKIidType("peer")}
+	comm1.(*commImpl).goSend(peer, createGossipMsg().Envelope, NormalPriority, time.Time{}, func(err error) {
+		errs <- err
+	})
+	select {
+	case err := <-errs:
+		assert.Equal(t, ErrInvalidRemotePeer, err)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Sending to a peer without a connection didn't fail")
+	}
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&dials))
+}
+
+func TestStopWithManySubscribers(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10981, naiveSec)
+	comm2, _ := newCommInstance(10982, naiveSec)
+	defer comm2.Stop()
+
+	var subscriptions []<-chan proto.ReceivedMessage
+	for i := 0; i < 20; i++ {
+		subscriptions = append(subscriptions, comm1.Accept(acceptAll))
+	}
+	// Some subscribers are blocked on delivering messages nobody consumes
+	for i := 0; i < 15; i++ {
+		comm2.Send(createGossipMsg(), remotePeer(10981))
+	}
+	<-subscriptions[0]
+
+	stopped := make(chan struct{})
+	go func() {
+		comm1.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second * 10):
+		assert.Fail(t, "Stop didn't return with many subscribers")
+	}
+}
+
+func TestRecvBacklog(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11011, naiveSec)
+	defer comm1.Stop()
+	inst := comm1.(*commImpl)
+
+	// A subscriber that doesn't consume its messages
+	inst.msgPublisher.AddChannel(acceptAll)
+	for i := 0; i < 5; i++ {
+		inst.msgPublisher.DeMultiplex(createGossipMsg())
+	}
+	// Throttling is disabled by default
+	assert.False(t, inst.backlogExceeded())
+	inst.recvBacklog = 6
+	assert.False(t, inst.backlogExceeded())
+	inst.recvBacklog = 5
+	assert.True(t, inst.backlogExceeded())
+}
+
+func TestServing(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11021, naiveSec)
+	select {
+	case <-comm1.(*commImpl).Ready():
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Server should have started serving")
+	}
+	assert.True(t, comm1.(*commImpl).Serving())
+	assert.NoError(t, comm1.Probe(remotePeer(11021)))
+
+	comm1.Stop()
+	assert.False(t, comm1.(*commImpl).Serving())
+}
+
+func TestListenBacklog(t *testing.T) {
+	t.Parallel()
+	for _, address := range []string{":10731", "127.0.0.1:10732"} {
+		ll, err := listen(address, 5)
+		assert.NoError(t, err)
+		_, port, _ := net.SplitHostPort(address)
+
+		accepted := make(chan struct{})
+		go func() {
+			if conn, err := ll.Accept(); err == nil {
+				conn.Close()
+				accepted <- struct{}{}
 			}
-		case <-ticker.C:
-			waiting = false
+		}()
+
+		conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", port))
+		assert.NoError(t, err)
+		select {
+		case <-accepted:
+		case <-time.After(time.Second * 3):
+			assert.Fail(t, "Listener didn't accept the connection")
 		}
+		conn.Close()
+
+		// The address is still in use
+		_, err = listen(address, 5)
+		assert.Error(t, err)
+		ll.Close()
 	}
-	assert.Equal(t, count, c, errMsg)
+}
+
+func TestResetConnections(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10741, naiveSec)
+	comm2, _ := newCommInstance(10742, naiveSec)
+	comm3, _ := newCommInstance(10743, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(10741))
+	comm3.Send(createGossipMsg(), remotePeer(10741))
+	<-m1
+	<-m1
+	assert.Equal(t, 2, comm1.(*commImpl).connStore.connNum())
+
+	comm1.(*commImpl).ResetConnections()
+	assert.Equal(t, 0, comm1.(*commImpl).connStore.connNum())
+	dead := map[string]struct{}{}
+	for i := 0; i < 2; i++ {
+		select {
+		case pkiID := <-comm1.PresumedDead():
+			dead[string(pkiID)] = struct{}{}
+		case <-time.After(time.Second * 3):
+			assert.Fail(t, "Reset peers should have been presumed dead")
+		}
+	}
+	assert.Contains(t, dead, "localhost:10742")
+	assert.Contains(t, dead, "localhost:10743")
+
+	// The instance and its subscriptions still work after the reset
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10742))
+	select {
+	case msg := <-m2:
+		msg.Respond(createGossipMsg().GossipMessage)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message after resetting the connections")
+	}
+	select {
+	case <-m1:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a response after resetting the connections")
+	}
+}
+
+func TestSendByPKIID(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10751, naiveSec)
+	comm2, _ := newCommInstance(10752, naiveSec)
+	comm3, _ := newCommInstance(10753, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	m2 := comm2.Accept(acceptAll)
+	m3 := comm3.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10752))
+	<-m2
+
+	var dials uint32
+	comm1.(*commImpl).SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		atomic.AddUint32(&dials, 1)
+		return grpc.Dial(target, opts...)
+	})
+
+	// comm1 is connected to comm2 but not to comm3
+	comm1.SendByPKIID(createGossipMsg(), comm2.GetPKIid(), comm3.GetPKIid())
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Connected peer should have received the message")
+	}
+	select {
+	case <-m3:
+		assert.Fail(t, "Peer without a connection shouldn't have received the message")
+	case <-time.After(time.Millisecond * 500):
+	}
+	assert.False(t, comm1.(*commImpl).connStore.hasConnection(comm3.GetPKIid()))
+	assert.Equal(t, uint32(0), atomic.LoadUint32(&dials), "Peer without a connection shouldn't have been dialed")
+}
+
+type failingSendStream struct {
+	proto.Gossip_GossipStreamServer
+	ctx context.Context
+}
+
+func (s *failingSendStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *failingSendStream) Send(envelope *proto.Envelope) error {
+	return errors.New("connection reset")
+}
+
+func (s *failingSendStream) Recv() (*proto.Envelope, error) {
+	<-s.ctx.Done()
+	return nil, s.ctx.Err()
+}
+
+func TestHandshakeSendFailure(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10781, naiveSec)
+	defer comm1.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10782}})
+
+	start := time.Now()
+	_, err := comm1.(*commImpl).authenticateRemotePeer(&failingSendStream{ctx: ctx}, nil)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "127.0.0.1:10782")
+	assert.Contains(t, err.Error(), "connection reset")
+	// The failure is detected without waiting for the remote peer's message
+	assert.True(t, time.Since(start) < util.GetDurationOrDefault("peer.gossip.connTimeout", defConnTimeout))
+}
+
+func TestIsAuthenticated(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10791, naiveSec)
+	comm2, _ := newCommInstance(10792, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	authenticated, known := comm1.(*commImpl).IsAuthenticated(comm2.GetPKIid())
+	assert.False(t, known)
+	assert.False(t, authenticated)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10792))
+	<-m2
+
+	// Both instances use TLS, so the connection is mutually authenticated on both sides
+	authenticated, known = comm1.(*commImpl).IsAuthenticated(comm2.GetPKIid())
+	assert.True(t, known)
+	assert.True(t, authenticated)
+	authenticated, known = comm2.(*commImpl).IsAuthenticated(comm1.GetPKIid())
+	assert.True(t, known)
+	assert.True(t, authenticated)
+}
+
+func TestStopGrace(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10801, naiveSec)
+	comm2, _ := newCommInstance(10802, naiveSec)
+	defer comm2.Stop()
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(10801))
+	<-m1
+
+	// Streams of remote peers end once their connections are closed,
+	// so stopping doesn't wait for the grace period
+	start := time.Now()
+	comm1.Stop()
+	assert.True(t, time.Since(start) < comm1.(*commImpl).stopGrace)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&comm1.(*commImpl).activeStreams))
+
+	// A stream that doesn't end delays stopping by the grace period at most
+	comm3, _ := newCommInstance(10803, naiveSec)
+	comm3.(*commImpl).stopGrace = time.Millisecond * 200
+	atomic.AddInt32(&comm3.(*commImpl).activeStreams, 1)
+	start = time.Now()
+	comm3.Stop()
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= time.Millisecond*200)
+	assert.True(t, elapsed < time.Second*2)
+}
+
+func TestRecvDedup(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10811, naiveSec)
+	comm2, _ := newCommInstance(10812, naiveSec)
+	comm3, _ := newCommInstance(10813, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+	comm1.(*commImpl).dedup = newMsgDedup(10)
+
+	m1 := comm1.Accept(acceptAll)
+	msg := createGossipMsg()
+	comm2.Send(msg, remotePeer(10811))
+	comm3.Send(msg, remotePeer(10811))
+	comm2.Send(createGossipMsg(), remotePeer(10811))
+
+	received := 0
+	timeout := time.After(time.Second)
+	for done := false; !done; {
+		select {
+		case <-m1:
+			received++
+		case <-timeout:
+			done = true
+		}
+	}
+	assert.Equal(t, 2, received)
+	assert.Equal(t, uint64(1), comm1.(*commImpl).DuplicatesDropped())
+
+	// Identical heartbeats from different peers aren't dropped
+	heartbeats := comm1.Accept(func(o interface{}) bool {
+		return o.(proto.ReceivedMessage).GetGossipMessage().GetEmpty() != nil
+	})
+	heartbeat := createHeartbeatMsg()
+	comm2.Send(heartbeat, remotePeer(10811))
+	comm3.Send(heartbeat, remotePeer(10811))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-heartbeats:
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "A heartbeat was dropped as a duplicate")
+		}
+	}
+
+	// Neither are acknowledgements
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	assert.NoError(t, comm2.SendWithAck(ctx, createGossipMsg(), remotePeer(10811)))
+	assert.NoError(t, comm3.SendWithAck(ctx, createGossipMsg(), remotePeer(10811)))
+	assert.Equal(t, uint64(1), comm1.(*commImpl).DuplicatesDropped())
+}
+
+func TestAcceptWithReplay(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10821, naiveSec)
+	comm2, _ := newCommInstance(10822, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	comm1.(*commImpl).recentMsgs = newMsgRing(5)
+
+	all := comm1.Accept(acceptAll)
+	var sent []uint64
+	for i := 0; i < 4; i++ {
+		msg := createGossipMsg()
+		sent = append(sent, msg.Nonce)
+		comm2.Send(msg, remotePeer(10821))
+		<-all
+	}
+
+	// Only the last 3 messages that match are replayed, from the oldest to the newest
+	notFirst := func(o interface{}) bool {
+		return o.(proto.ReceivedMessage).GetGossipMessage().Nonce != sent[0]
+	}
+	replayed := comm1.AcceptWithReplay(notFirst, 3)
+	for _, nonce := range sent[1:] {
+		select {
+		case m := <-replayed:
+			assert.Equal(t, nonce, m.GetGossipMessage().Nonce)
+		case <-time.After(time.Second * 3):
+			assert.Fail(t, "Didn't receive a replayed message")
+		}
+	}
+
+	// Messages received afterwards are delivered as usual
+	msg := createGossipMsg()
+	comm2.Send(msg, remotePeer(10821))
+	select {
+	case m := <-replayed:
+		assert.Equal(t, msg.Nonce, m.GetGossipMessage().Nonce)
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Didn't receive a message after the replayed ones")
+	}
+}
+
+func TestConnEvents(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10851, naiveSec)
+	comm2, _ := newCommInstance(10852, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	nextEvent := func() ConnEvent {
+		select {
+		case e := <-comm1.(*commImpl).Events():
+			return e
+		case <-time.After(time.Second * 3):
+			assert.Fail(t, "Didn't receive an event")
+			return ConnEvent{}
+		}
+	}
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(10851))
+	<-m1
+
+	e := nextEvent()
+	assert.Equal(t, HandshakeStarted, e.Kind)
+	assert.NotEmpty(t, e.RemoteAddress)
+	assert.False(t, e.Time.IsZero())
+	e = nextEvent()
+	assert.Equal(t, IdentityReceived, e.Kind)
+	assert.Equal(t, comm2.GetPKIid(), e.PKIID)
+	e = nextEvent()
+	assert.Equal(t, AuthSucceeded, e.Kind)
+	assert.Equal(t, comm2.GetPKIid(), e.PKIID)
+	e = nextEvent()
+	assert.Equal(t, ConnOpened, e.Kind)
+	assert.Equal(t, comm2.GetPKIid(), e.PKIID)
+
+	comm1.CloseConn(remotePeer(10852))
+	e = nextEvent()
+	assert.Equal(t, ConnClosed, e.Kind)
+	assert.Equal(t, LocalStop, e.Reason)
+
+	// A failed authentication is reported along with its error
+	comm2.(*commImpl).SetHandshakeSigner(func(msg []byte) ([]byte, error) {
+		return []byte("bad signature"), nil
+	})
+	_, err := comm1.Handshake(remotePeer(10852))
+	assert.Error(t, err)
+	for e = nextEvent(); e.Kind != AuthFailed; e = nextEvent() {
+	}
+	assert.Error(t, e.Err)
+
+	// Events that aren't consumed are dropped
+	comm1.(*commImpl).events = make(chan ConnEvent, 1)
+	comm1.(*commImpl).emitEvent(ConnEvent{Kind: ConnOpened})
+	comm1.(*commImpl).emitEvent(ConnEvent{Kind: ConnClosed})
+	assert.Equal(t, uint64(1), comm1.(*commImpl).DroppedEvents())
+}
+
+func TestTLSVerification(t *testing.T) {
+	t.Parallel()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	assert.NoError(t, err)
+	caTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	rawCA, err := x509.CreateCertificate(cryptorand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+	ca, err := x509.ParseCertificate(rawCA)
+	assert.NoError(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	issueCert := func(serial int64) *tls.Certificate {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(serial),
+			NotBefore:    time.Now().Add(-time.Hour),
+			NotAfter:     time.Now().Add(time.Hour),
+			KeyUsage:     x509.KeyUsageDigitalSignature,
+			ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")},
+		}
+		raw, err := x509.CreateCertificate(cryptorand.Reader, template, ca, &key.PublicKey, caKey)
+		assert.NoError(t, err)
+		return &tls.Certificate{Certificate: [][]byte{raw}, PrivateKey: key}
+	}
+
+	_, err = NewCommInstanceWithTLSVerification(10860, nil, identity.NewIdentityMapper(naiveSec), []byte("localhost:10860"))
+	assert.Error(t, err)
+
+	comm1, _ := NewCommInstanceWithTLSVerification(10861, roots, identity.NewIdentityMapper(naiveSec), []byte("localhost:10861"))
+	comm2, _ := NewCommInstanceWithTLSVerification(10862, roots, identity.NewIdentityMapper(naiveSec), []byte("localhost:10862"))
+	comm3, _ := newCommInstance(10863, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	// The generated certificates aren't issued by the roots
+	assert.Error(t, comm1.Probe(remotePeer(10862)))
+
+	assert.NoError(t, comm1.(*commImpl).ReloadTLS(issueCert(2)))
+	assert.NoError(t, comm2.(*commImpl).ReloadTLS(issueCert(3)))
+	assert.NoError(t, comm1.Probe(remotePeer(10862)))
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10862))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message over a verified connection")
+	}
+
+	// A peer without verification still presents a certificate that isn't issued by the roots
+	assert.Error(t, comm3.Probe(remotePeer(10861)))
+
+	assert.Equal(t, SecurityStatus{TLSEnabled: true, MutualVerification: true}, comm1.(*commImpl).SecurityInfo())
+	assert.Equal(t, SecurityStatus{TLSEnabled: true}, comm3.(*commImpl).SecurityInfo())
+}
+
+func TestSecurityInfo(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11061, naiveSec)
+	defer comm1.Stop()
+	inst := comm1.(*commImpl)
+	assert.Equal(t, SecurityStatus{TLSEnabled: true}, inst.SecurityInfo())
+
+	inst.SetSkipHandshakePredicate(func(string) bool { return false })
+	assert.True(t, inst.SecurityInfo().HandshakeSkipPredicate)
+	inst.skipHandshake = true
+	assert.True(t, inst.SecurityInfo().HandshakeSkipped)
+
+	// An instance without a gRPC server of its own isn't aware of TLS
+	comm2, _ := NewCommInstanceWithServer(-1, identity.NewIdentityMapper(naiveSec), []byte("localhost:11062"))
+	defer comm2.Stop()
+	assert.Equal(t, SecurityStatus{}, comm2.(*commImpl).SecurityInfo())
+}
+
+func TestExpiredIdentity(t *testing.T) {
+	t.Parallel()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), cryptorand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour * 2),
+		NotAfter:     time.Now().Add(-time.Hour),
+	}
+	expiredIdentity, err := x509.CreateCertificate(cryptorand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+
+	comm1, _ := NewCommInstanceWithServer(11091, identity.NewIdentityMapper(naiveSec), expiredIdentity)
+	comm2, _ := newCommInstance(11092, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	events := comm2.(*commImpl).Events()
+
+	_, err = comm2.Handshake(&RemotePeer{Endpoint: "localhost:11091"})
+	assert.Error(t, err)
+	authFailure := func() error {
+		for {
+			select {
+			case e := <-events:
+				if e.Kind == AuthFailed {
+					return e.Err
+				}
+			case <-time.After(time.Second * 5):
+				return nil
+			}
+		}
+	}
+	assert.Equal(t, ErrIdentityExpired, authFailure())
+
+	// Once the check is skipped, the expired identity is accepted
+	comm2.(*commImpl).skipIDExpiration = true
+	_, err = comm2.Handshake(&RemotePeer{Endpoint: "localhost:11091"})
+	assert.NoError(t, err)
+}
+
+func TestMaxConcurrentStreams(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10871, naiveSec)
+	comm2, _ := newCommInstance(10872, naiveSec)
+	comm3, _ := newCommInstance(10873, naiveSec)
+	defer comm1.Stop()
+	defer comm3.Stop()
+	comm1.(*commImpl).streamSlots = newSlots(1)
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(10871))
+	<-m1
+
+	// The stream of comm2 occupies the only slot
+	_, err := comm3.Handshake(remotePeer(10871))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Too many concurrent streams")
+
+	// Once the stream of comm2 ends, comm3 is admitted
+	comm2.Stop()
+	_, err = comm3.Handshake(remotePeer(10871))
+	assert.NoError(t, err)
+}
+
+func TestMaxConcurrentSends(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11031, naiveSec)
+	comm2, _ := newCommInstance(11032, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst := comm1.(*commImpl)
+	inst.sendSlots = newSlots(1)
+
+	m2 := comm2.Accept(acceptAll)
+	// Occupy the only slot, so the message is dropped
+	inst.sendSlots <- struct{}{}
+	comm1.Send(createGossipMsg(), remotePeer(11032))
+	assert.Equal(t, uint64(1), inst.DroppedSends())
+	select {
+	case <-m2:
+		assert.Fail(t, "Message should have been dropped")
+	case <-time.After(time.Second):
+	}
+
+	// Sending to many peers while no slot is free doesn't wait for a slot per peer
+	var peers []*RemotePeer
+	for i := 0; i < 20; i++ {
+		peers = append(peers, remotePeer(11032))
+	}
+	start := time.Now()
+	comm1.Send(createGossipMsg(), peers...)
+	assert.True(t, time.Since(start) < time.Millisecond*100, "Send blocked for %v", time.Since(start))
+	assert.Equal(t, uint64(21), inst.DroppedSends())
+
+	// Once the slot is free, messages are sent again
+	<-inst.sendSlots
+	comm1.Send(createGossipMsg(), remotePeer(11032))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message")
+	}
+	assert.Equal(t, uint64(21), inst.DroppedSends())
+}
+
+func TestDialFailures(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11041, naiveSec)
+	comm2, _ := newCommInstance(11042, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst := comm1.(*commImpl)
+
+	var dialed []string
+	inst.SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		dialed = append(dialed, target)
+		return nil, errors.New("connection refused")
+	})
+	err := comm1.Probe(remotePeer(11042))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	_, err = comm1.Handshake(remotePeer(11042))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "connection refused")
+	err = comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(11042))
+	assert.Error(t, err)
+	assert.Equal(t, ConnectDialFailed, err.(*ConnectError).Kind)
+	assert.Equal(t, "localhost:11042", err.(*ConnectError).Endpoint)
+	assert.Equal(t, "DialFailed connecting to localhost:11042: connection refused", err.Error())
+	assert.Equal(t, []string{"localhost:11042", "localhost:11042", "localhost:11042"}, dialed)
+
+	lastErr, when, exists := inst.LastError(remotePeer(11042).PKIID)
+	assert.True(t, exists)
+	assert.Contains(t, lastErr.Error(), "connection refused")
+	assert.False(t, when.After(time.Now()))
+
+	// Once dialing succeeds again, so do the operations
+	inst.SetDialer(nil)
+	assert.NoError(t, comm1.Probe(remotePeer(11042)))
+	assert.NoError(t, comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(11042)))
+	_, _, exists = inst.LastError(remotePeer(11042).PKIID)
+	assert.False(t, exists)
+}
+
+func TestSendWithDeadline(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11051, naiveSec)
+	comm2, _ := newCommInstance(11052, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.SendWithDeadline(createGossipMsg(), time.Now().Add(time.Minute), remotePeer(11052))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message")
+	}
+
+	// A message whose deadline passed is never sent
+	comm1.SendWithDeadline(createGossipMsg(), time.Now().Add(-time.Second), remotePeer(11052))
+	select {
+	case <-m2:
+		assert.Fail(t, "Expired message should have been dropped")
+	case <-time.After(time.Second):
+	}
+	assert.Equal(t, uint64(1), comm1.(*commImpl).ExpiredMessages())
+}
+
+type countingConnStore struct {
+	ConnectionStore
+	created  int32
+	accepted int32
+	removed  int32
+}
+
+func (cs *countingConnStore) GetConnection(peer *RemotePeer) (*Connection, error) {
+	atomic.AddInt32(&cs.created, 1)
+	return cs.ConnectionStore.GetConnection(peer)
+}
+
+func (cs *countingConnStore) OnConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) (*Connection, error) {
+	atomic.AddInt32(&cs.accepted, 1)
+	return cs.ConnectionStore.OnConnected(serverStream, connInfo)
+}
+
+func (cs *countingConnStore) RemoveConn(conn *Connection, reason CloseReason) {
+	atomic.AddInt32(&cs.removed, 1)
+	cs.ConnectionStore.RemoveConn(conn, reason)
+}
+
+func newCountingCommInstance(port int, store **countingConnStore) (Comm, error) {
+	endpoint := fmt.Sprintf("localhost:%d", port)
+	newStore := func(defaultStore ConnectionStore) ConnectionStore {
+		*store = &countingConnStore{ConnectionStore: defaultStore}
+		return *store
+	}
+	return NewCommInstanceWithConnectionStore(port, newStore, identity.NewIdentityMapper(naiveSec), []byte(endpoint))
+}
+
+func TestCustomConnStore(t *testing.T) {
+	t.Parallel()
+	_, err := NewCommInstanceWithConnectionStore(11277, nil, identity.NewIdentityMapper(naiveSec), []byte("localhost:11277"))
+	assert.Error(t, err)
+
+	var store1, store2 *countingConnStore
+	comm1, _ := newCountingCommInstance(11071, &store1)
+	comm2, _ := newCountingCommInstance(11072, &store2)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst1 := comm1.(*commImpl)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(11072))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message")
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store1.created))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store2.accepted))
+	assert.Equal(t, 1, store1.ConnNum())
+
+	// Connection state changes of the custom store are reported
+	closed := make(chan struct{}, 1)
+	inst1.SetConnectionStateCallback(func(pkiID common.PKIidType, state ConnectionState, reason CloseReason) {
+		if state == ConnectionClosed {
+			closed <- struct{}{}
+		}
+	})
+	comm1.CloseConn(remotePeer(11072))
+	select {
+	case <-closed:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Closing of the connection wasn't reported")
+	}
+
+	// The custom store of the remote peer observes the removal of the connection once its stream ends
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&store2.removed) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(&store2.removed))
+	_, exists := store2.ExistingConnection(comm1.GetPKIid())
+	assert.False(t, exists)
+	assert.False(t, comm2.(*commImpl).connStore.hasConnection(comm1.GetPKIid()))
+}
+
+// xorCodec flips the bits of the payloads of envelopes
+type xorCodec struct {
+	decoded int32
+}
+
+func (*xorCodec) flip(env *proto.Envelope) *proto.Envelope {
+	payload := make([]byte, len(env.Payload))
+	for i, b := range env.Payload {
+		payload[i] = ^b
+	}
+	return &proto.Envelope{Payload: payload, Signature: env.Signature, SecretEnvelope: env.SecretEnvelope}
+}
+
+func (c *xorCodec) Encode(msg *proto.SignedGossipMessage) (*proto.Envelope, error) {
+	return c.flip(msg.Envelope), nil
+}
+
+func (c *xorCodec) Decode(env *proto.Envelope) (*proto.SignedGossipMessage, error) {
+	atomic.AddInt32(&c.decoded, 1)
+	return c.flip(env).ToGossipMessage()
+}
+
+func TestPauseResume(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11121, naiveSec)
+	comm2, _ := newCommInstance(11122, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst := comm1.(*commImpl)
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(11121))
+	<-m1
+
+	inst.Pause()
+	assert.True(t, inst.IsPaused())
+	for i := 0; i < 5; i++ {
+		comm2.Send(createGossipMsg(), remotePeer(11121))
+	}
+	select {
+	case <-m1:
+		assert.Fail(t, "Messages shouldn't be handled while paused")
+	case <-time.After(time.Second):
+	}
+
+	// Sending still works, and the connection stays alive
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(11122))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Sending shouldn't be paused")
+	}
+	assert.True(t, inst.connStore.hasConnection(remotePeer(11122).PKIID))
+
+	// Once resumed, the messages received meanwhile are handled
+	inst.Resume()
+	assert.False(t, inst.IsPaused())
+	for i := 0; i < 5; i++ {
+		select {
+		case <-m1:
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "Didn't receive a message after resuming")
+			return
+		}
+	}
+}
+
+func TestLogSampling(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11131, naiveSec)
+	defer comm1.Stop()
+	inst := comm1.(*commImpl)
+	var counter uint64
+
+	// Nothing is logged unless debug logging is enabled
+	logging.SetLevel(logging.INFO, "gossip/comm#11131")
+	assert.False(t, inst.shouldLogMessage(&counter))
+
+	logging.SetLevel(logging.DEBUG, "gossip/comm#11131")
+	assert.True(t, inst.shouldLogMessage(&counter))
+	assert.True(t, inst.shouldLogMessage(&counter))
+
+	inst.logSampleRate = 3
+	var sampled []bool
+	for i := 0; i < 6; i++ {
+		sampled = append(sampled, inst.shouldLogMessage(&counter))
+	}
+	assert.Equal(t, []bool{true, false, false, true, false, false}, sampled)
+}
+
+func TestCheckConnectivity(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11141, naiveSec)
+	comm2, _ := newCommInstance(11142, naiveSec)
+	comm3, _ := newCommInstance(11143, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	// A listener that accepts connections but never responds
+	lsnr, err := net.Listen("tcp", "localhost:11144")
+	assert.NoError(t, err)
+	defer lsnr.Close()
+
+	peers := []*RemotePeer{remotePeer(11142), remotePeer(11143), remotePeer(11144), remotePeer(11145)}
+	results := comm1.(*commImpl).CheckConnectivity(peers, time.Second)
+	assert.Len(t, results, len(peers))
+	assert.NoError(t, results["localhost:11142"])
+	assert.NoError(t, results["localhost:11143"])
+	assert.Error(t, results["localhost:11144"])
+	assert.Error(t, results["localhost:11145"])
+
+	// Probing doesn't leave connections behind
+	assert.Equal(t, 0, comm1.(*commImpl).connStore.connNum())
+
+	// Once the timeout expires, no more peers are dialed
+	comm4, _ := newCommInstance(11278, naiveSec)
+	defer comm4.Stop()
+	inst := comm4.(*commImpl)
+	var dials int32
+	inst.SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		atomic.AddInt32(&dials, 1)
+		time.Sleep(time.Millisecond * 200)
+		return nil, errors.New("unreachable")
+	})
+	peers = nil
+	for i := 0; i < connCheckConcurrency*3; i++ {
+		peers = append(peers, remotePeer(11300+i))
+	}
+	results = inst.CheckConnectivity(peers, time.Millisecond*300)
+	assert.Len(t, results, len(peers))
+	dialed := atomic.LoadInt32(&dials)
+	time.Sleep(time.Millisecond * 500)
+	assert.Equal(t, dialed, atomic.LoadInt32(&dials))
+}
+
+func TestSendPanic(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11146, naiveSec)
+	comm2, _ := newCommInstance(11147, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst := comm1.(*commImpl)
+
+	inst.SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		panic("bad peer")
+	})
+	comm1.Send(createGossipMsg(), remotePeer(11147))
+	deadline := time.Now().Add(time.Second * 5)
+	for inst.SendPanics() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	assert.Equal(t, uint64(1), inst.SendPanics())
+
+	// The instance survives the panic, and keeps sending
+	inst.SetDialer(grpc.Dial)
+	m := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(11147))
+	select {
+	case <-m:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Didn't receive a message after the send panicked")
+	}
+}
+
+func TestSendToSubset(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11151, naiveSec)
+	comm2, _ := newCommInstance(11152, naiveSec)
+	comm3, _ := newCommInstance(11153, naiveSec)
+	comm4, _ := newCommInstance(11154, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+	defer comm4.Stop()
+	inst := comm1.(*commImpl)
+
+	m2 := comm2.Accept(acceptAll)
+	m3 := comm3.Accept(acceptAll)
+	m4 := comm4.Accept(acceptAll)
+	candidates := []*RemotePeer{remotePeer(11152), remotePeer(11153), remotePeer(11154)}
+
+	assert.Len(t, inst.selectSubset(2, candidates), 2)
+	assert.Len(t, inst.selectSubset(5, candidates), 3)
+	assert.Empty(t, inst.selectSubset(0, candidates))
+
+	// Peers that are already connected to are preferred
+	assert.NoError(t, comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(11152)))
+	<-m2
+	for i := 0; i < 10; i++ {
+		selected := inst.selectSubset(1, candidates)
+		assert.Len(t, selected, 1)
+		assert.Equal(t, "localhost:11152", selected[0].Endpoint)
+	}
+	comm1.SendToSubset(createGossipMsg(), 1, candidates)
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Connected peer didn't receive the message")
+	}
+
+	// Peers with a non-positive weight aren't selected
+	inst.SetPeerWeight(func(peer *RemotePeer) float64 {
+		if peer.Endpoint == "localhost:11154" {
+			return 1
+		}
+		return 0
+	})
+	comm1.SendToSubset(createGossipMsg(), 2, candidates)
+	select {
+	case <-m4:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Weighted peer didn't receive the message")
+	}
+	select {
+	case <-m2:
+		t.Fatal("Peer with zero weight received the message")
+	case <-m3:
+		t.Fatal("Peer with zero weight received the message")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	// Weighted selection favors heavier peers among peers that aren't connected to
+	inst.SetPeerWeight(func(peer *RemotePeer) float64 {
+		if peer.Endpoint == "localhost:11153" {
+			return 100
+		}
+		return 1
+	})
+	others := []*RemotePeer{remotePeer(11153), remotePeer(11155), remotePeer(11156)}
+	heavy := 0
+	for i := 0; i < 100; i++ {
+		if inst.selectSubset(1, others)[0].Endpoint == "localhost:11153" {
+			heavy++
+		}
+	}
+	assert.True(t, heavy > 80, "heavier peer selected only %d times", heavy)
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11161, naiveSec)
+	defer comm1.Stop()
+	inst := comm1.(*commImpl)
+	inst.dialSlots = newSlots(2)
+
+	var active, maxActive, dialed int32
+	release := make(chan struct{})
+	inst.SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		n := atomic.AddInt32(&active, 1)
+		for {
+			max := atomic.LoadInt32(&maxActive)
+			if n <= max || atomic.CompareAndSwapInt32(&maxActive, max, n) {
+				break
+			}
+		}
+		<-release
+		atomic.AddInt32(&active, -1)
+		atomic.AddInt32(&dialed, 1)
+		return nil, errors.New("connection refused")
+	})
+
+	for port := 11162; port < 11166; port++ {
+		comm1.Send(createGossipMsg(), remotePeer(port))
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&active) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	// The rest of the dials are queued
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(t, int32(2), atomic.LoadInt32(&active))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&dialed))
+
+	close(release)
+	deadline = time.Now().Add(time.Second * 5)
+	for atomic.LoadInt32(&dialed) < 4 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int32(4), atomic.LoadInt32(&dialed))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&maxActive))
+}
+
+func TestALPN(t *testing.T) {
+	t.Parallel()
+	assert.Equal(t, []string{"h2"}, alpnProtocols(nil))
+	assert.Equal(t, []string{"h2", "gossip/1"}, alpnProtocols([]string{"h2", " gossip/1", "", "gossip/1"}))
+
+	srv, lsnr, dialOpts, _, _, err := newGRPCLayer(11172, nil, grpcLayerOptions{alpn: []string{"gossip/1"}})
+	assert.NoError(t, err)
+	defer srv.Stop()
+	go srv.Serve(lsnr)
+	srv2, lsnr2, defaultDialOpts, _, _, err := newGRPCLayer(11173, nil, grpcLayerOptions{})
+	assert.NoError(t, err)
+	defer srv2.Stop()
+	go srv2.Serve(lsnr2)
+
+	// A proxy that only accepts connections negotiating the configured protocol
+	keyFileName := fmt.Sprintf("key.%d.pem", util.RandomUInt64())
+	certFileName := fmt.Sprintf("cert.%d.pem", util.RandomUInt64())
+	generateCertificates(keyFileName, certFileName)
+	cert, err := tls.LoadX509KeyPair(certFileName, keyFileName)
+	os.Remove(keyFileName)
+	os.Remove(certFileName)
+	assert.NoError(t, err)
+	offered := make(chan []string, 10)
+	proxyConf := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"gossip/1"},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			offered <- hello.SupportedProtos
+			for _, proto := range hello.SupportedProtos {
+				if proto == "gossip/1" {
+					return nil, nil
+				}
+			}
+			return nil, errors.New("gossip/1 wasn't offered")
+		},
+	}
+	proxy, err := net.Listen("tcp", "localhost:11171")
+	assert.NoError(t, err)
+	defer proxy.Close()
+	go func() {
+		for {
+			conn, err := proxy.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tls.Server(conn, proxyConf).Handshake()
+			}()
+		}
+	}()
+
+	// Dialing offers the configured protocol after the one gRPC requires
+	for _, testCase := range []struct {
+		opts     grpc.DialOption
+		expected []string
+	}{
+		{opts: dialOpts, expected: []string{"h2", "gossip/1"}},
+		{opts: defaultDialOpts, expected: []string{"h2"}},
+	} {
+		cc, err := grpc.Dial("localhost:11171", testCase.opts)
+		assert.NoError(t, err)
+		select {
+		case protos := <-offered:
+			assert.Equal(t, testCase.expected, protos)
+		case <-time.After(time.Second * 5):
+			t.Fatal("Proxy wasn't dialed")
+		}
+		cc.Close()
+	}
+
+	// The server negotiates the configured protocol, and still prefers gRPC's
+	negotiate := func(port int, protos ...string) string {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("localhost:%d", port), &tls.Config{
+			InsecureSkipVerify: true,
+			NextProtos:         protos,
+		})
+		if err != nil {
+			return ""
+		}
+		defer conn.Close()
+		return conn.ConnectionState().NegotiatedProtocol
+	}
+	assert.Equal(t, "gossip/1", negotiate(11172, "gossip/1"))
+	assert.Equal(t, "h2", negotiate(11172, "h2", "gossip/1"))
+	assert.Equal(t, "h2", negotiate(11173, "h2", "gossip/1"))
+	assert.Equal(t, "", negotiate(11173, "gossip/1"))
+}
+
+func TestRecvBuffSizeByTag(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11181, naiveSec)
+	comm2, _ := newCommInstance(11182, naiveSec)
+	comm3, _ := newCommInstance(11183, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+	inst := comm1.(*commImpl)
+	inst.SetRecvBuffSize("class", "bulk", 40)
+	inst.SetRecvBuffSize("class", "control", 5)
+	inst.SetRecvBuffSize("class", "control", 0)
+
+	m1 := comm1.Accept(acceptAll)
+	for _, c := range []Comm{comm2, comm3} {
+		assert.NoError(t, c.SendSync(context.Background(), createGossipMsg(), remotePeer(11181)))
+		<-m1
+	}
+	inst.TagConnection(remotePeer(11182).PKIID, map[string]string{"class": "bulk"})
+	inst.TagConnection(remotePeer(11183).PKIID, map[string]string{"class": "control"})
+
+	// Received messages pile up in the receive buffers while paused
+	inst.Pause()
+	for i := 0; i < 50; i++ {
+		assert.NoError(t, comm2.SendSync(context.Background(), createGossipMsg(), remotePeer(11181)))
+		assert.NoError(t, comm3.SendSync(context.Background(), createGossipMsg(), remotePeer(11181)))
+	}
+	bulk, _ := inst.connStore.existingConnection(remotePeer(11182).PKIID)
+	control, _ := inst.connStore.existingConnection(remotePeer(11183).PKIID)
+	deadline := time.Now().Add(time.Second * 5)
+	for (bulk.pendingReceived() < 40 || control.pendingReceived() < 20) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(t, 40, bulk.pendingReceived())
+	// The size set for the control tag was removed, so the configured size applies
+	assert.Equal(t, 20, control.pendingReceived())
+
+	inst.Resume()
+	for i := 0; i < 100; i++ {
+		select {
+		case <-m1:
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "Didn't receive a message after resuming")
+			return
+		}
+	}
+}
+
+func TestForward(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11191, naiveSec)
+	comm2, _ := newCommInstance(11192, naiveSec)
+	comm3, _ := newCommInstance(11193, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	m1 := comm1.Accept(acceptAll)
+	m2 := comm2.Accept(acceptAll)
+	m3 := comm3.Accept(acceptAll)
+	sent := createGossipMsg()
+	sent.Envelope.Metadata = map[string]string{"trace-id": "1"}
+	comm1.SendRaw(sent.Envelope, remotePeer(11192))
+	var received proto.ReceivedMessage
+	select {
+	case received = <-m2:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Didn't receive the message")
+	}
+
+	// The message isn't forwarded back to its sender
+	comm2.Forward(received, remotePeer(11191), remotePeer(11193))
+	select {
+	case forwarded := <-m3:
+		assert.Equal(t, sent.Envelope.Payload, forwarded.GetSourceEnvelope().Payload)
+		assert.Equal(t, sent.Envelope.Signature, forwarded.GetSourceEnvelope().Signature)
+		// The trace context is forwarded along with the envelope
+		assert.Equal(t, sent.Envelope.Metadata, forwarded.GetSourceEnvelope().Metadata)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Didn't receive the forwarded message")
+	}
+	select {
+	case <-m1:
+		t.Fatal("Message was forwarded back to its sender")
+	case <-time.After(time.Millisecond * 500):
+	}
+}
+
+func TestDeadPeerDebounce(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11201, naiveSec)
+	defer comm1.Stop()
+	inst := comm1.(*commImpl)
+	inst.deadPeers = newDeadPeerDebouncer(2, 0)
+	inst.SetDialer(func(target string, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+		return nil, errors.New("connection refused")
+	})
+
+	dead := comm1.PresumedDead()
+	assert.Error(t, comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(11202)))
+	select {
+	case <-dead:
+		t.Fatal("Peer was presumed dead after a single failure")
+	case <-time.After(time.Millisecond * 500):
+	}
+	assert.Error(t, comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(11202)))
+	select {
+	case pkiID := <-dead:
+		assert.Equal(t, remotePeer(11202).PKIID, pkiID)
+	case <-time.After(time.Second * 5):
+		t.Fatal("Peer wasn't presumed dead after consecutive failures")
+	}
+}
+
+func TestInsecureTransport(t *testing.T) {
+	t.Parallel()
+	_, _, _, _, _, err := newGRPCLayer(11220, x509.NewCertPool(), grpcLayerOptions{insecure: true})
+	assert.Error(t, err)
+
+	newInsecureInstance := func(port int) Comm {
+		srv, lsnr, dialOpts, certHash, tlsCert, err := newGRPCLayer(port, nil, grpcLayerOptions{insecure: true})
+		assert.NoError(t, err)
+		assert.Nil(t, certHash)
+		assert.Nil(t, tlsCert)
+		inst, err := NewCommInstance(srv, nil, identity.NewIdentityMapper(naiveSec), []byte(fmt.Sprintf("localhost:%d", port)), dialOpts)
+		assert.NoError(t, err)
+		go srv.Serve(lsnr)
+		return inst
+	}
+	comm1 := newInsecureInstance(11221)
+	comm2 := newInsecureInstance(11222)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	assert.False(t, comm1.(*commImpl).SecurityInfo().TLSEnabled)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(11222))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Didn't receive a message over the insecure transport")
+	}
+
+	// The server doesn't speak TLS
+	_, err = tls.Dial("tcp", "localhost:11222", &tls.Config{InsecureSkipVerify: true})
+	assert.Error(t, err)
+}
+
+// silentGossipServer accepts gossip streams, but never sends anything on them
+type silentGossipServer struct {
+	stop chan struct{}
+}
+
+func (s *silentGossipServer) GossipStream(proto.Gossip_GossipStreamServer) error {
+	<-s.stop
+	return nil
+}
+
+func (s *silentGossipServer) Ping(context.Context, *proto.Empty) (*proto.Empty, error) {
+	return &proto.Empty{}, nil
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11231, naiveSec)
+	defer comm1.Stop()
+	inst := comm1.(*commImpl)
+
+	srv, lsnr, _, _, _, err := newGRPCLayer(11232, nil, grpcLayerOptions{})
+	assert.NoError(t, err)
+	silent := &silentGossipServer{stop: make(chan struct{})}
+	defer close(silent.stop)
+	proto.RegisterGossipServer(srv, silent)
+	go srv.Serve(lsnr)
+	defer srv.Stop()
+
+	// The remote peer never sends its connection message
+	_, err = inst.createConnection("localhost:11232", nil)
+	assert.Error(t, err)
+	assert.Equal(t, ConnectHandshakeTimeout, err.(*ConnectError).Kind)
+	assert.Equal(t, ErrHandshakeTimeout, err.(*ConnectError).Unwrap())
+	assert.Equal(t, uint64(1), inst.HandshakeTimeouts())
+	assert.Equal(t, uint64(0), inst.HandshakeFailures())
+
+	// Handshakes that fail otherwise are counted separately
+	_, err = inst.createConnection("localhost:11231", common.PKIidType("localhost:11232"))
+	assert.Equal(t, ConnectPKIIDMismatch, err.(*ConnectError).Kind)
+	_, err = inst.Handshake(remotePeer(11232))
+	assert.Error(t, err)
+	assert.Equal(t, uint64(2), inst.HandshakeTimeouts())
+}
+
+func TestDialTimeoutChange(t *testing.T) {
+	// Not parallel, as it changes the dial timeout of all instances
+	lsnr, err := net.Listen("tcp", "localhost:11246")
+	assert.NoError(t, err)
+	defer lsnr.Close()
+	// Accept connections, but never complete the TLS handshake
+	go func() {
+		for {
+			conn, err := lsnr.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	comm1, _ := newCommInstance(11245, naiveSec)
+	defer comm1.Stop()
+
+	start := time.Now()
+	_, err = comm1.Handshake(remotePeer(11246))
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) < time.Second)
+
+	// A timeout set after the instance was created applies to later dials
+	SetDialTimeout(time.Millisecond * 1500)
+	defer SetDialTimeout(time.Millisecond * 300)
+	start = time.Now()
+	_, err = comm1.Handshake(remotePeer(11246))
+	assert.Error(t, err)
+	assert.True(t, time.Since(start) >= time.Millisecond*1500)
+}
+
+func TestSelfIdentity(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11247, naiveSec)
+	defer comm1.Stop()
+
+	selfIdentity := comm1.SelfIdentity()
+	assert.Equal(t, api.PeerIdentityType("localhost:11247"), selfIdentity)
+	assert.Equal(t, comm1.GetPKIid(), naiveSec.GetPKIidOfCert(selfIdentity))
+
+	// Mutating the returned identity doesn't affect the instance
+	selfIdentity[0] = 'X'
+	assert.Equal(t, api.PeerIdentityType("localhost:11247"), comm1.SelfIdentity())
+}
+
+func TestMaxHandshakeSize(t *testing.T) {
+	t.Parallel()
+	// PKI-IDs aren't derived from the whole identity, so that only
+	// the connection message of comm2 exceeds the maximum size
+	sec := &versionedSecProvider{}
+	comm1, _ := newCommInstance(11248, sec)
+	defer comm1.Stop()
+	// The identity is sent in the connection message, which makes it exceed the maximum size
+	bigIdentity := append([]byte("localhost:11249#"), make([]byte, defMaxHandshakeSize)...)
+	comm2, _ := NewCommInstanceWithServer(11249, identity.NewIdentityMapper(sec), bigIdentity)
+	defer comm2.Stop()
+	comm3, _ := newCommInstance(11250, sec)
+	defer comm3.Stop()
+
+	// Streams from a peer whose connection message is too large aren't accepted
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(11248))
+	select {
+	case <-m1:
+		assert.Fail(t, "Message from a peer whose connection message is too large was received")
+	case <-time.After(time.Second):
+	}
+
+	_, err := comm1.Handshake(&RemotePeer{Endpoint: "localhost:11249", PKIID: sec.GetPKIidOfCert(bigIdentity)})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "exceeds the maximum handshake message size")
+
+	_, err = comm3.Handshake(remotePeer(11248))
+	assert.NoError(t, err)
+}
+
+func TestSubscriptionsMatchingPeer(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11256, naiveSec)
+	comm2, _ := newCommInstance(11257, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	fromPeer := func(pkiID common.PKIidType) common.MessageAcceptor {
+		return func(o interface{}) bool {
+			return bytes.Equal(o.(proto.ReceivedMessage).GetConnectionInfo().ID, pkiID)
+		}
+	}
+	dataOnly := func(o interface{}) bool {
+		return o.(proto.ReceivedMessage).GetGossipMessage().IsDataMsg()
+	}
+	responder := func(o interface{}) bool {
+		o.(proto.ReceivedMessage).Respond(createGossipMsg().GossipMessage)
+		return true
+	}
+	m1 := comm1.Accept(acceptAll)
+	comm1.Accept(fromPeer(comm2.GetPKIid()))
+	comm1.Accept(dataOnly)
+	comm1.Accept(responder)
+
+	assert.Equal(t, []int{0, 1}, comm1.(*commImpl).SubscriptionsMatchingPeer(comm2.GetPKIid(), nil))
+	assert.Equal(t, []int{0, 1, 2}, comm1.(*commImpl).SubscriptionsMatchingPeer(comm2.GetPKIid(), createGossipMsg()))
+	assert.Equal(t, []int{0}, comm1.(*commImpl).SubscriptionsMatchingPeer(common.PKIidType("unknown"), nil))
+
+	// Nothing was delivered to the subscriptions
+	select {
+	case <-m1:
+		assert.Fail(t, "Synthetic message was delivered")
+	case <-time.After(time.Millisecond * 100):
+	}
+}
+
+func TestConnect(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11263, naiveSec)
+	comm2, _ := newCommInstance(11264, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	h, err := comm1.Connect(remotePeer(11264))
+	assert.NoError(t, err)
+	select {
+	case <-h.Ready():
+	case <-time.After(time.Second * 3):
+		t.Fatal("Connection wasn't established")
+	}
+	assert.NoError(t, h.Err())
+	assert.Equal(t, comm2.GetPKIid(), h.ConnectionInfo().ID)
+	assert.True(t, comm1.(*commImpl).connStore.hasConnection(comm2.GetPKIid()))
+	h.Close()
+	assert.False(t, comm1.(*commImpl).connStore.hasConnection(comm2.GetPKIid()))
+
+	// Failing to establish the connection is reported once the handle is ready
+	h, err = comm1.Connect(remotePeer(11265))
+	assert.NoError(t, err)
+	select {
+	case <-h.Ready():
+	case <-time.After(time.Second * 3):
+		t.Fatal("Establishing the connection didn't fail")
+	}
+	assert.Error(t, h.Err())
+	assert.Nil(t, h.ConnectionInfo())
+
+	// Invalid remote peers are rejected without returning a handle
+	for _, peer := range []*RemotePeer{nil, {Endpoint: "localhost:11264"}, {PKIID: comm2.GetPKIid()}} {
+		h, err = comm1.Connect(peer)
+		assert.Equal(t, ErrInvalidRemotePeer, err)
+		assert.Nil(t, h)
+	}
+
+	comm1.Stop()
+	_, err = comm1.Connect(remotePeer(11264))
+	assert.Equal(t, ErrStopping, err)
+}
+
+func TestSendWithCallback(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11266, naiveSec)
+	comm2, _ := newCommInstance(11267, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	type result struct {
+		endpoint string
+		err      error
+	}
+	results := make(chan result, 10)
+	cb := func(peer *RemotePeer, err error) {
+		results <- result{endpoint: peer.Endpoint, err: err}
+		panic("callbacks that panic are recovered from")
+	}
+	awaitResults := func(n int) map[string]error {
+		errs := make(map[string]error)
+		for i := 0; i < n; i++ {
+			select {
+			case r := <-results:
+				_, exists := errs[r.endpoint]
+				assert.False(t, exists, "Callback was invoked more than once for %s", r.endpoint)
+				errs[r.endpoint] = r.err
+			case <-time.After(time.Second * 5):
+				t.Fatal("Callback wasn't invoked")
+			}
+		}
+		return errs
+	}
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.SendWithCallback(createGossipMsg(), cb, remotePeer(11267), remotePeer(11268))
+	errs := awaitResults(2)
+	assert.NoError(t, errs["localhost:11267"])
+	assert.Error(t, errs["localhost:11268"])
+	<-m2
+
+	comm1.Stop()
+	comm1.SendWithCallback(createGossipMsg(), cb, remotePeer(11267))
+	assert.Equal(t, ErrStopping, awaitResults(1)["localhost:11267"])
+}
+
+func TestFlush(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11269, naiveSec)
+	comm2, _ := newCommInstance(11270, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	assert.Equal(t, ErrNotConnected, comm1.Flush(context.Background(), remotePeer(11270)))
+	assert.Equal(t, ErrInvalidRemotePeer, comm1.Flush(context.Background(), nil))
+
+	m2 := comm2.Accept(acceptAll)
+	for i := 0; i < 10; i++ {
+		comm1.Send(createGossipMsg(), remotePeer(11270))
+	}
+	assert.NoError(t, comm1.(*commImpl).WaitForConnection(context.Background(), remotePeer(11270)))
+	assert.NoError(t, comm1.Flush(context.Background(), remotePeer(11270)))
+	for i := 0; i < 10; i++ {
+		<-m2
+	}
+	conn, _ := comm1.(*commImpl).connStore.existingConnection(remotePeer(11270).PKIID)
+
+	// Flushing a buffer that doesn't drain fails once the context expires
+	atomic.AddInt32(&conn.pending, 1)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, comm1.Flush(ctx, remotePeer(11270)))
+	atomic.AddInt32(&conn.pending, -1)
+}
+
+func TestCloseConnSync(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11273, naiveSec)
+	comm2, _ := newCommInstance(11274, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(11274))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message")
+	}
+
+	inst1 := comm1.(*commImpl)
+	conn, exists := inst1.connStore.existingConnection(remotePeer(11274).PKIID)
+	assert.True(t, exists)
+	assert.NoError(t, comm1.CloseConnSync(remotePeer(11274)))
+	select {
+	case <-conn.serviced:
+	default:
+		assert.Fail(t, "Connection is still being serviced")
+	}
+	assert.Equal(t, 0, inst1.connStore.connNum())
+
+	// Closing a connection that doesn't exist doesn't block
+	assert.NoError(t, comm1.CloseConnSync(remotePeer(11275)))
+	assert.Equal(t, ErrInvalidRemotePeer, comm1.CloseConnSync(nil))
+	assert.Equal(t, ErrInvalidRemotePeer, comm1.CloseConnSyncWithContext(context.Background(), nil))
+
+	// Waiting for a connection whose handling of a message is stuck is bounded by the context
+	comm3, _ := newCommInstance(11281, naiveSec)
+	defer comm3.Stop()
+	stuck := inst1.msgPublisher.AddChannel(acceptAll)
+	for i := 0; i <= inst1.msgPublisher.BufferSize(); i++ {
+		comm3.Send(createGossipMsg(), remotePeer(11273))
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for len(stuck) < cap(stuck) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	// Give the last message time to reach the full channel
+	time.Sleep(time.Millisecond * 200)
+	conn, exists = inst1.connStore.existingConnection(remotePeer(11281).PKIID)
+	assert.True(t, exists)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*500)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, comm1.CloseConnSyncWithContext(ctx, remotePeer(11281)))
+
+	// Once the message is consumed, the connection stops being serviced
+	for len(stuck) > 0 {
+		<-stuck
+	}
+	select {
+	case <-conn.serviced:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Connection is still being serviced")
+	}
+}
+
+func TestReleaseIntroducedIdentities(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10881, naiveSec)
+	comm2, _ := newCommInstance(10882, naiveSec)
+	defer comm1.Stop()
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(10881))
+	<-m1
+
+	idMapper := comm1.(*commImpl).idMapper
+	_, err := idMapper.Get(remotePeer(10882).PKIID)
+	assert.NoError(t, err)
+
+	// Once the connection closes, the identity comm1 introduced is released
+	comm2.Stop()
+	released := func() bool {
+		_, err := idMapper.Get(remotePeer(10882).PKIID)
+		return err != nil
+	}
+	deadline := time.Now().Add(time.Second * 5)
+	for !released() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	assert.True(t, released(), "Identity of a peer with no connection should have been released")
+
+	// The identity of the instance itself is never released
+	_, err = idMapper.Get(comm1.GetPKIid())
+	assert.NoError(t, err)
+
+	// Identities that are also referenced by others aren't released
+	comm3, _ := newCommInstance(11276, naiveSec)
+	pkiID3 := remotePeer(11276).PKIID
+	comm3.Send(createGossipMsg(), remotePeer(10881))
+	<-m1
+	assert.NoError(t, idMapper.Put(pkiID3, api.PeerIdentityType(pkiID3)))
+	comm3.Stop()
+	deadline = time.Now().Add(time.Second * 5)
+	for comm1.(*commImpl).connStore.hasConnection(pkiID3) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 100)
+	}
+	time.Sleep(time.Millisecond * 100)
+	_, err = idMapper.Get(pkiID3)
+	assert.NoError(t, err, "Identity referenced by others shouldn't have been released")
+
+	// Handshakes that don't keep a connection don't keep the identity either
+	comm4, _ := newCommInstance(10883, naiveSec)
+	defer comm4.Stop()
+	_, err = comm1.Handshake(remotePeer(10883))
+	assert.NoError(t, err)
+	_, err = idMapper.Get(remotePeer(10883).PKIID)
+	assert.Error(t, err)
+}
+
+func TestSendRaw(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10891, naiveSec)
+	comm2, _ := newCommInstance(10892, naiveSec)
+	comm3, _ := newCommInstance(10893, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	m2 := comm2.Accept(acceptAll)
+	m3 := comm3.Accept(acceptAll)
+	msg := createGossipMsg()
+	msg.Envelope.Metadata = map[string]string{"trace-id": "1"}
+	comm1.SendRaw(msg.Envelope, remotePeer(10892), remotePeer(10893))
+
+	for _, ch := range []<-chan proto.ReceivedMessage{m2, m3} {
+		select {
+		case m := <-ch:
+			assert.Equal(t, msg.Nonce, m.GetGossipMessage().Nonce)
+			assert.Equal(t, msg.Envelope.Metadata, m.GetSourceEnvelope().Metadata)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "Didn't receive a raw envelope")
+		}
+	}
+}
+
+func TestCopyEnvelope(t *testing.T) {
+	env := &proto.Envelope{
+		Payload:        []byte{1},
+		Signature:      []byte{2},
+		SecretEnvelope: &proto.SecretEnvelope{Payload: []byte{3}, Signature: []byte{4}},
+		Metadata:       map[string]string{"trace-id": "1"},
+	}
+	copied := copyEnvelope(env)
+	assert.Equal(t, env, copied)
+
+	// Modifying the envelope doesn't modify its copy
+	env.Payload[0], env.Signature[0] = 0, 0
+	env.SecretEnvelope.Payload[0], env.SecretEnvelope.Signature[0] = 0, 0
+	env.Metadata["trace-id"] = "2"
+	assert.Equal(t, &proto.Envelope{
+		Payload:        []byte{1},
+		Signature:      []byte{2},
+		SecretEnvelope: &proto.SecretEnvelope{Payload: []byte{3}, Signature: []byte{4}},
+		Metadata:       map[string]string{"trace-id": "1"},
+	}, copied)
+
+	assert.Nil(t, copyEnvelope(&proto.Envelope{Payload: []byte{1}}).SecretEnvelope)
+}
+
+func TestPortInUse(t *testing.T) {
+	t.Parallel()
+	comm1, err := newCommInstance(10901, naiveSec)
+	assert.NoError(t, err)
+	defer comm1.Stop()
+
+	comm2, err := newCommInstance(10901, naiveSec)
+	assert.Nil(t, comm2)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "Failed listening")
+}
+
+func TestObserverMode(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10911, naiveSec)
+	comm2, _ := newCommInstance(10912, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	comm1.(*commImpl).observer = true
+	assert.True(t, comm1.(*commImpl).IsObserver())
+	assert.False(t, comm2.(*commImpl).IsObserver())
+
+	// The observer doesn't connect to remote peers
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10912))
+	select {
+	case <-m2:
+		assert.Fail(t, "An observer shouldn't have sent a message")
+	case <-time.After(time.Second):
+	}
+	err := comm1.SendSync(context.Background(), createGossipMsg(), remotePeer(10912))
+	assert.True(t, isObserverModeErr(err))
+	assert.Equal(t, ConnectObserverMode, err.(*ConnectError).Kind)
+	assert.Equal(t, ErrObserverMode, err.(*ConnectError).Err)
+	assert.Equal(t, 0, comm1.(*commImpl).connStore.connNum())
+	select {
+	case <-comm1.PresumedDead():
+		assert.Fail(t, "An observer shouldn't presume peers dead because it didn't connect to them")
+	default:
+	}
+
+	// But it still accepts connections and messages, and can be probed
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(10911))
+	select {
+	case <-m1:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "An observer should have received a message")
+	}
+	assert.NoError(t, comm1.Probe(remotePeer(10912)))
+
+	// Yet it doesn't send over the connections remote peers created either
+	comm1.SendByPKIID(createGossipMsg(), comm2.GetPKIid())
+	select {
+	case <-m2:
+		assert.Fail(t, "An observer shouldn't have sent a message over an existing connection")
+	case <-time.After(time.Second):
+	}
+}
+
+// versionedSecProvider derives PKI-IDs from the part of
+// identities that precedes their version suffix
+type versionedSecProvider struct {
+	naiveSecProvider
+}
+
+func (*versionedSecProvider) GetPKIidOfCert(peerIdentity api.PeerIdentityType) common.PKIidType {
+	return common.PKIidType(strings.Split(string(peerIdentity), "#")[0])
+}
+
+func TestIdentityChanges(t *testing.T) {
+	t.Parallel()
+	sec := &versionedSecProvider{}
+	newInstance := func(port int, peerIdentity string) Comm {
+		inst, err := NewCommInstanceWithServer(port, identity.NewIdentityMapper(sec), api.PeerIdentityType(peerIdentity))
+		assert.NoError(t, err)
+		return inst
+	}
+	comm1 := newInstance(10921, "localhost:10921")
+	// comm2 and comm3 have the same PKI-ID but different identities
+	comm2 := newInstance(10922, "localhost:10922#v1")
+	comm3 := newInstance(10923, "localhost:10922#v2")
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	// The connection to comm2 holds its identity in the identity mapper of comm1
+	pkiID := common.PKIidType("localhost:10922")
+	h, err := comm1.Connect(&RemotePeer{Endpoint: "localhost:10922", PKIID: pkiID})
+	assert.NoError(t, err)
+	select {
+	case <-h.Ready():
+	case <-time.After(time.Second * 3):
+		t.Fatal("Connection wasn't established")
+	}
+	assert.NoError(t, h.Err())
+	defer h.Close()
+	assert.Equal(t, uint64(0), comm1.(*commImpl).IdentityChanges())
+
+	// The change is tolerated by default, but counted and reported
+	remoteIdentity, err := comm1.Handshake(&RemotePeer{Endpoint: "localhost:10923", PKIID: pkiID})
+	assert.NoError(t, err)
+	assert.Equal(t, api.PeerIdentityType("localhost:10922#v2"), remoteIdentity)
+	assert.Equal(t, uint64(1), comm1.(*commImpl).IdentityChanges())
+	changed := false
+	for len(comm1.(*commImpl).Events()) > 0 {
+		if e := <-comm1.(*commImpl).Events(); e.Kind == IdentityChanged {
+			changed = true
+			assert.Equal(t, pkiID, e.PKIID)
+		}
+	}
+	assert.True(t, changed)
+
+	// In strict mode the handshake is rejected, and the known identity is kept
+	comm1.(*commImpl).rejectIDChanges = true
+	_, err = comm1.Handshake(&RemotePeer{Endpoint: "localhost:10922", PKIID: pkiID})
+	assert.Error(t, err)
+	assert.Equal(t, uint64(2), comm1.(*commImpl).IdentityChanges())
+	remoteIdentity, err = comm1.(*commImpl).idMapper.Get(pkiID)
+	assert.NoError(t, err)
+	assert.Equal(t, api.PeerIdentityType("localhost:10922#v2"), remoteIdentity)
+}
+
+func TestWarmup(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10931, naiveSec)
+	comm2, _ := newCommInstance(10932, naiveSec)
+	comm3, _ := newCommInstance(10933, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	// Nothing listens on the third peer, and the last peer is invalid
+	errs := comm1.(*commImpl).Warmup([]*RemotePeer{remotePeer(10932), remotePeer(10933), remotePeer(10934), nil})
+	assert.Len(t, errs, 4)
+	assert.NoError(t, errs[0])
+	assert.NoError(t, errs[1])
+	assert.Error(t, errs[2])
+	assert.Equal(t, ErrInvalidRemotePeer, errs[3])
+	assert.Equal(t, 2, comm1.(*commImpl).connStore.connNum())
+	assert.True(t, comm1.(*commImpl).connStore.hasConnection(remotePeer(10932).PKIID))
+	assert.True(t, comm1.(*commImpl).connStore.hasConnection(remotePeer(10933).PKIID))
+}
+
+func createGossipMsg() *proto.SignedGossipMessage {
+	return (&proto.GossipMessage{
+		Tag:   proto.GossipMessage_EMPTY,
+		Nonce: uint64(rand.Int()),
+		Content: &proto.GossipMessage_DataMsg{
+			DataMsg: &proto.DataMessage{},
+		},
+	}).NoopSign()
+}
+
+func remotePeer(port int) *RemotePeer {
+	endpoint := fmt.Sprintf("localhost:%d", port)
+	return &RemotePeer{Endpoint: endpoint, PKIID: []byte(endpoint)}
+}
+
+func waitForMessages(t *testing.T, msgChan chan uint64, count int, errMsg string) {
+	c := 0
+	waiting := true
+	ticker := time.NewTicker(time.Duration(10) * time.Second)
+	for waiting {
+		select {
+		case <-msgChan:
+			c++
+			if c == count {
+				waiting = false
+			}
+		case <-ticker.C:
+			waiting = false
+		}
+	}
+	assert.Equal(t, count, c, errMsg)
+}
+
+func TestReloadTLS(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10691, naiveSec)
+	comm2, _ := newCommInstance(10692, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	assert.Error(t, comm1.(*commImpl).ReloadTLS(nil))
+	assert.Error(t, comm1.(*commImpl).ReloadTLS(&tls.Certificate{}))
+
+	err := generateCertificates("reload-key.pem", "reload-cert.pem")
+	assert.NoError(t, err)
+	defer os.Remove("reload-cert.pem")
+	defer os.Remove("reload-key.pem")
+	cert, err := tls.LoadX509KeyPair("reload-cert.pem", "reload-key.pem")
+	assert.NoError(t, err)
+
+	oldHash := comm1.(*commImpl).getSelfCertHash()
+	assert.NoError(t, comm1.(*commImpl).ReloadTLS(&cert))
+	newHash := comm1.(*commImpl).getSelfCertHash()
+	assert.NotEqual(t, oldHash, newHash)
+	assert.Equal(t, certHashFromRawCert(cert.Certificate[0]), newHash)
+
+	// The remote peer verifies that the certificate hash in the handshake matches
+	// the certificate presented over TLS, both when comm1 is the client
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10692))
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message sent after reloading the certificate")
+	}
+
+	// and when comm1 is the server
+	comm3, _ := newCommInstance(10693, naiveSec)
+	defer comm3.Stop()
+	_, err = comm3.Handshake(remotePeer(10691))
+	assert.NoError(t, err)
 }
 
 func TestMain(m *testing.M) {
@@ -18,28 +18,109 @@ package comm
 
 import (
 	"errors"
+	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/hyperledger/fabric/gossip/common"
 	"github.com/hyperledger/fabric/gossip/util"
 	proto "github.com/hyperledger/fabric/protos/gossip"
 	"github.com/op/go-logging"
+	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 )
 
 type handler func(message *proto.SignedGossipMessage)
 
+// errOrgConnLimit is returned when the organization of a remote peer has reached its
+// connection limit. Remote peers are told it's retryable, as connections may close later
+var errOrgConnLimit = grpc.Errorf(codes.ResourceExhausted, "Connection limit of organization reached")
+
+// errDuplicateConn is returned when a remote peer that is already connected
+// from another host connects again, and the duplicate connection policy rejects it
+var errDuplicateConn = grpc.Errorf(codes.AlreadyExists, "Remote peer is already connected from another host")
+
+var errConnClosed = errors.New("Connection closed before the message was sent")
+
+var errMsgExpired = errors.New("Message expired before it was sent")
+
+// maxTrackedErrors bounds the number of remote peers whose last error is retained
+const maxTrackedErrors = 1000
+
 type connFactory interface {
-	createConnection(endpoint string, pkiID common.PKIidType) (*connection, error)
+	createConnection(endpoint string, pkiID common.PKIidType, dialOpts ...grpc.DialOption) (*connection, error)
+}
+
+type connStateHandler func(pkiID common.PKIidType, state ConnectionState, reason CloseReason)
+
+// connTag is a tag of a connection, which is a local label with a key and a value
+type connTag struct {
+	key   string
+	value string
+}
+
+// connStorage holds the connections to remote peers, and decides
+// when connections are created, replaced and closed
+type connStorage interface {
+	// getConnection returns the connection to the given peer, and creates it if it doesn't exist
+	getConnection(peer *RemotePeer) (*connection, error)
+	// onConnected registers a connection that a remote peer initiated. It returns nil if the
+	// connection is rejected, along with the error to end the stream with, if any
+	onConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) (*connection, error)
+	closeConn(peer *RemotePeer, reason CloseReason)
+	closeByPKIid(pkiID common.PKIidType, reason CloseReason)
+	// removeConn closes the given connection, and removes it from the store
+	// unless it was already replaced by another connection to the same peer
+	removeConn(conn *connection, reason CloseReason)
+	existingConnection(pkiID common.PKIidType) (*connection, bool)
+	hasConnection(pkiID common.PKIidType) bool
+	connections() []*connection
+	connNum() int
+	shutdown()
+	// setStateChangeHandler sets a handler that is invoked when
+	// connections are added to or removed from the store
+	setStateChangeHandler(handler connStateHandler)
+	setOverflowPolicy(policy OverflowPolicy)
+	setDuplicateConnPolicy(policy DuplicateConnPolicy)
+	setOrgConnectionLimit(orgOf OrgClassifier, maxPerOrg int)
+	setHighWaterMarks(marks ...float64)
+	// recordError records the given error as the last error that occurred with the given peer
+	recordError(pkiID common.PKIidType, err error)
+	lastError(pkiID common.PKIidType) (error, time.Time, bool)
+	Utilization() float64
+	capacityWarningCount() uint64
+	expiredCount() uint64
+	undeliveredCount() uint64
+	totalStats() ConnectionStats
+	// sendQueueWait returns a histogram of the time messages waited in send buffers
+	sendQueueWait() LatencyHistogram
 }
 
 type connectionStore struct {
+	expiredMsgs      uint64                   // messages dropped because of their deadline, accessed atomically
+	undeliveredMsgs  uint64                   // messages dropped because writing to a stream failed, accessed atomically
 	logger           *logging.Logger          // logger
 	isClosing        bool                     // whether this connection store is shutting down
 	connFactory      connFactory              // creates a connection to remote peer
+	onStateChange    connStateHandler         // invoked when connections are added to or removed from the store
+	releaseIdentity  func(common.PKIidType)   // releases the reference a connection holds to the identity of its remote peer, might be nil
+	totalBytes       *byteCounters            // bytes transferred over all connections of the store
+	queueWait        *latencyHistogram        // time messages waited in the send buffers of all connections
+	overflowPolicy   OverflowPolicy           // overflow policy of the send buffers of connections
+	dupPolicy        DuplicateConnPolicy      // whether connections of peers that moved to a different host replace their old connections
+	sendBlockTimeout time.Duration            // time to wait for space in a full send buffer, if the policy says so
+	orgOf            OrgClassifier            // classifies remote peers into organizations, might be nil
+	maxPerOrg        int                      // maximum number of connections per organization, if positive
+	maxConns         int                      // number of connections utilization is relative to, if positive
+	highWaterMarks   []float64                // utilization levels that are warned about, in ascending order
+	marksCrossed     int                      // number of high-water marks the utilization is at or above
+	capacityWarnings uint64                   // number of times the utilization crossed a high-water mark
 	sync.RWMutex                              // synchronize access to shared variables
 	pki2Conn         map[string]*connection   // mapping between pkiID to connections
+	lastErrors       map[string]*peerError    // last dial or send error of each remote peer
 	destinationLocks map[string]*sync.RWMutex //mapping between pkiIDs and locks,
 	// used to prevent concurrent connection establishment to the same remote endpoint
 }
@@ -48,7 +129,13 @@ func newConnStore(connFactory connFactory, logger *logging.Logger) *connectionSt
 	return &connectionStore{
 		connFactory:      connFactory,
 		isClosing:        false,
+		totalBytes:       &byteCounters{},
+		queueWait:        newLatencyHistogram(defQueueWaitBuckets),
+		sendBlockTimeout: util.GetDurationOrDefault("peer.gossip.sendBlockTimeout", defSendBlockTimeout),
+		maxConns:         util.GetIntOrDefault("peer.gossip.maxConnections", defMaxConnections),
+		highWaterMarks:   defHighWaterMarks,
 		pki2Conn:         make(map[string]*connection),
+		lastErrors:       make(map[string]*peerError),
 		destinationLocks: make(map[string]*sync.RWMutex),
 		logger:           logger,
 	}
@@ -60,7 +147,7 @@ func (cs *connectionStore) getConnection(peer *RemotePeer) (*connection, error)
 	cs.RUnlock()
 
 	if isClosing {
-		return nil, errors.New("Shutting down")
+		return nil, ErrStopping
 	}
 
 	pkiID := peer.PKIID
@@ -85,25 +172,36 @@ func (cs *connectionStore) getConnection(peer *RemotePeer) (*connection, error)
 	}
 	cs.RUnlock()
 
-	createdConnection, err := cs.connFactory.createConnection(endpoint, pkiID)
-
-	destinationLock.Unlock()
+	// Release the destination lock even if creating the connection panics,
+	// so that later connection attempts to the peer don't block forever
+	createdConnection, err := func() (*connection, error) {
+		defer destinationLock.Unlock()
+		return cs.connFactory.createConnection(endpoint, pkiID, peer.DialOpts...)
+	}()
+	if createdConnection != nil {
+		// Whether it's stored or discarded, the connection
+		// releases the identity of the remote peer once it's closed
+		cs.holdIdentity(createdConnection)
+	}
 
 	cs.RLock()
 	isClosing = cs.isClosing
 	cs.RUnlock()
 	if isClosing {
-		return nil, errors.New("ConnStore is closing")
+		if createdConnection != nil {
+			createdConnection.close()
+		}
+		return nil, ErrStopping
 	}
 
 	cs.Lock()
 	delete(cs.destinationLocks, string(pkiID))
-	defer cs.Unlock()
 
 	// check again, maybe someone connected to us during the connection creation?
 	conn, exists = cs.pki2Conn[string(pkiID)]
 
 	if exists {
+		cs.Unlock()
 		if createdConnection != nil {
 			createdConnection.close()
 		}
@@ -112,32 +210,168 @@ func (cs *connectionStore) getConnection(peer *RemotePeer) (*connection, error)
 
 	// no one connected to us AND we failed connecting!
 	if err != nil {
+		cs.Unlock()
+		cs.recordError(pkiID, err)
 		return nil, err
 	}
 
+	if cs.orgSaturated(createdConnection.info) {
+		cs.Unlock()
+		createdConnection.close()
+		cs.recordError(pkiID, errOrgConnLimit)
+		return nil, errOrgConnLimit
+	}
+
 	// at this point in the code, we created a connection to a remote peer
 	conn = createdConnection
+	cs.configure(conn)
 	cs.pki2Conn[string(createdConnection.pkiID)] = conn
+	delete(cs.lastErrors, string(createdConnection.pkiID))
+	cs.checkUtilization()
+	cs.Unlock()
 
 	go conn.serviceConnection()
 
+	cs.notifyStateChange(conn.pkiID, ConnectionEstablished, 0)
 	return conn, nil
 }
 
+func (cs *connectionStore) setStateChangeHandler(handler connStateHandler) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.onStateChange = handler
+}
+
+// setIdentityReleaser sets the function that releases the reference to the identity of
+// the remote peer that authenticating it took. Connections hold the reference until they're closed
+func (cs *connectionStore) setIdentityReleaser(release func(common.PKIidType)) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.releaseIdentity = release
+}
+
+// holdIdentity makes the given connection release the identity
+// of its remote peer once it's closed
+func (cs *connectionStore) holdIdentity(conn *connection) {
+	cs.RLock()
+	release := cs.releaseIdentity
+	cs.RUnlock()
+	if release == nil {
+		return
+	}
+	pkiID := conn.pkiID
+	conn.release = func() {
+		release(pkiID)
+	}
+}
+
+// capacityWarningCount returns the number of times
+// the utilization crossed a high-water mark
+func (cs *connectionStore) capacityWarningCount() uint64 {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.capacityWarnings
+}
+
+// expiredCount returns the number of messages that were dropped
+// because their deadline passed before they were sent
+func (cs *connectionStore) expiredCount() uint64 {
+	return atomic.LoadUint64(&cs.expiredMsgs)
+}
+
+// undeliveredCount returns the number of messages that were
+// dropped because writing to the stream of their connection failed
+func (cs *connectionStore) undeliveredCount() uint64 {
+	return atomic.LoadUint64(&cs.undeliveredMsgs)
+}
+
+// totalStats returns the number of bytes transferred over all
+// connections of the store, including connections that were closed
+func (cs *connectionStore) totalStats() ConnectionStats {
+	return cs.totalBytes.snapshot()
+}
+
+func (cs *connectionStore) sendQueueWait() LatencyHistogram {
+	return cs.queueWait.snapshot()
+}
+
 func (cs *connectionStore) connNum() int {
 	cs.RLock()
 	defer cs.RUnlock()
 	return len(cs.pki2Conn)
 }
 
-func (cs *connectionStore) closeConn(peer *RemotePeer) {
+// Utilization returns the number of connections relative to the
+// configured maximum, or 0 if there is no maximum
+func (cs *connectionStore) Utilization() float64 {
+	cs.RLock()
+	defer cs.RUnlock()
+	return cs.utilization()
+}
+
+// utilization must be called while holding the lock of the store
+func (cs *connectionStore) utilization() float64 {
+	if cs.maxConns <= 0 {
+		return 0
+	}
+	return float64(len(cs.pki2Conn)) / float64(cs.maxConns)
+}
+
+// setHighWaterMarks sets the utilization levels that are warned about
+// once the utilization reaches them
+func (cs *connectionStore) setHighWaterMarks(marks ...float64) {
+	marks = append([]float64(nil), marks...)
+	sort.Float64s(marks)
 	cs.Lock()
 	defer cs.Unlock()
+	cs.highWaterMarks = marks
+	cs.marksCrossed = 0
+	cs.checkUtilization()
+}
 
-	if conn, exists := cs.pki2Conn[string(peer.PKIID)]; exists {
-		conn.close()
-		delete(cs.pki2Conn, string(conn.pkiID))
+// checkUtilization logs a warning if the utilization has reached a high-water
+// mark it wasn't at since it was last below it.
+// Must be called while holding the lock of the store
+func (cs *connectionStore) checkUtilization() {
+	u := cs.utilization()
+	crossed := 0
+	for crossed < len(cs.highWaterMarks) && u >= cs.highWaterMarks[crossed] {
+		crossed++
 	}
+	if crossed > cs.marksCrossed {
+		cs.capacityWarnings++
+		cs.logger.Warningf("Connection utilization is %.0f%% (%d of %d connections), at or above the high-water mark of %.0f%%",
+			u*100, len(cs.pki2Conn), cs.maxConns, cs.highWaterMarks[crossed-1]*100)
+	}
+	cs.marksCrossed = crossed
+}
+
+func (cs *connectionStore) hasConnection(pkiID common.PKIidType) bool {
+	_, exists := cs.existingConnection(pkiID)
+	return exists
+}
+
+// existingConnection returns the connection to the given peer, if it exists
+func (cs *connectionStore) existingConnection(pkiID common.PKIidType) (*connection, bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	conn, exists := cs.pki2Conn[string(pkiID)]
+	return conn, exists
+}
+
+// connections returns a snapshot of all connections in the store
+func (cs *connectionStore) connections() []*connection {
+	cs.RLock()
+	defer cs.RUnlock()
+	connections := make([]*connection, 0, len(cs.pki2Conn))
+	for _, conn := range cs.pki2Conn {
+		connections = append(connections, conn)
+	}
+	return connections
+}
+
+func (cs *connectionStore) closeConn(peer *RemotePeer, reason CloseReason) {
+	cs.closeByPKIid(peer.PKIID, reason)
 }
 
 func (cs *connectionStore) shutdown() {
@@ -155,22 +389,41 @@ func (cs *connectionStore) shutdown() {
 	for _, conn := range connections2Close {
 		wg.Add(1)
 		go func(conn *connection) {
-			cs.closeByPKIid(conn.pkiID)
+			cs.closeByPKIid(conn.pkiID, LocalStop)
 			wg.Done()
 		}(conn)
 	}
 	wg.Wait()
 }
 
-func (cs *connectionStore) onConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) *connection {
+func (cs *connectionStore) onConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) (*connection, error) {
 	cs.Lock()
-	defer cs.Unlock()
-
-	if c, exists := cs.pki2Conn[string(connInfo.Identity)]; exists {
-		c.close()
+	if cs.orgSaturated(connInfo) {
+		cs.Unlock()
+		cs.logger.Warning("Connection limit of the organization of", connInfo.ID, "reached, rejecting its connection")
+		return nil, errOrgConnLimit
+	}
+	var replaced *connection
+	if c, exists := cs.pki2Conn[string(connInfo.ID)]; exists {
+		oldHost, newHost := remoteHost(c.getStream()), remoteHost(serverStream)
+		if oldHost != newHost && cs.dupPolicy == RejectNewConnection {
+			cs.Unlock()
+			return nil, errDuplicateConn
+		}
+		cs.detach(c)
+		replaced = c
 	}
 
-	return cs.registerConn(connInfo, serverStream)
+	conn := cs.registerConn(connInfo, serverStream)
+	cs.checkUtilization()
+	cs.Unlock()
+
+	if replaced != nil {
+		replaced.close()
+		cs.notifyStateChange(replaced.pkiID, ConnectionClosed, ConnectionReplaced)
+	}
+	cs.notifyStateChange(conn.pkiID, ConnectionEstablished, 0)
+	return conn, nil
 }
 
 func (cs *connectionStore) registerConn(connInfo *proto.ConnectionInfo, serverStream proto.Gossip_GossipStreamServer) *connection {
@@ -178,45 +431,233 @@ func (cs *connectionStore) registerConn(connInfo *proto.ConnectionInfo, serverSt
 	conn.pkiID = connInfo.ID
 	conn.info = connInfo
 	conn.logger = cs.logger
+	if cs.releaseIdentity != nil {
+		release := cs.releaseIdentity
+		conn.release = func() {
+			release(connInfo.ID)
+		}
+	}
+	cs.configure(conn)
 	cs.pki2Conn[string(connInfo.ID)] = conn
+	delete(cs.lastErrors, string(connInfo.ID))
 	return conn
 }
 
-func (cs *connectionStore) closeByPKIid(pkiID common.PKIidType) {
+// peerError is the last error that occurred with a remote peer
+type peerError struct {
+	err  error
+	time time.Time
+}
+
+func (cs *connectionStore) recordError(pkiID common.PKIidType, err error) {
 	cs.Lock()
 	defer cs.Unlock()
-	if conn, exists := cs.pki2Conn[string(pkiID)]; exists {
+	cs.lastErrors[string(pkiID)] = &peerError{err: err, time: time.Now()}
+	if len(cs.lastErrors) <= maxTrackedErrors {
+		return
+	}
+	// Forget the peer whose last error is the oldest
+	var oldest string
+	var oldestTime time.Time
+	for id, pErr := range cs.lastErrors {
+		if oldestTime.IsZero() || pErr.time.Before(oldestTime) {
+			oldest, oldestTime = id, pErr.time
+		}
+	}
+	delete(cs.lastErrors, oldest)
+}
+
+// lastError returns the last error that occurred with the given peer and when it occurred,
+// and whether an error occurred since a connection to the peer was last established
+func (cs *connectionStore) lastError(pkiID common.PKIidType) (error, time.Time, bool) {
+	cs.RLock()
+	defer cs.RUnlock()
+	pErr, exists := cs.lastErrors[string(pkiID)]
+	if !exists {
+		return nil, time.Time{}, false
+	}
+	return pErr.err, pErr.time, true
+}
+
+// configure applies the settings of the store to the given connection.
+// Must be called while holding the lock of the store
+func (cs *connectionStore) configure(conn *connection) {
+	conn.totalBytes = cs.totalBytes
+	conn.queueWait = cs.queueWait
+	conn.expired = &cs.expiredMsgs
+	conn.undelivered = &cs.undeliveredMsgs
+	conn.setOverflowPolicy(cs.overflowPolicy, cs.sendBlockTimeout)
+}
+
+// setOrgConnectionLimit sets the maximum number of connections to
+// peers of each organization, as classified by the given classifier
+func (cs *connectionStore) setOrgConnectionLimit(orgOf OrgClassifier, maxPerOrg int) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.orgOf = orgOf
+	cs.maxPerOrg = maxPerOrg
+}
+
+// orgSaturated returns whether a connection with the given info would exceed the
+// connection limit of the organization of the remote peer. A connection that would
+// replace an existing connection to the same peer doesn't count towards the limit.
+// Must be called while holding the lock of the store
+func (cs *connectionStore) orgSaturated(connInfo *proto.ConnectionInfo) bool {
+	if cs.orgOf == nil || cs.maxPerOrg <= 0 || connInfo == nil {
+		return false
+	}
+	org := cs.orgOf(connInfo.Identity)
+	count := 0
+	for pkiID, conn := range cs.pki2Conn {
+		if pkiID == string(connInfo.ID) || conn.info == nil {
+			continue
+		}
+		if cs.orgOf(conn.info.Identity) == org {
+			count++
+		}
+	}
+	return count >= cs.maxPerOrg
+}
+
+// setOverflowPolicy sets the overflow policy of the send buffers
+// of all connections, including connections that are created later
+func (cs *connectionStore) setOverflowPolicy(policy OverflowPolicy) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.overflowPolicy = policy
+	for _, conn := range cs.pki2Conn {
+		conn.setOverflowPolicy(policy, cs.sendBlockTimeout)
+	}
+}
+
+// setDuplicateConnPolicy sets what is done when a remote peer
+// that is already connected connects again from a different host
+func (cs *connectionStore) setDuplicateConnPolicy(policy DuplicateConnPolicy) {
+	cs.Lock()
+	defer cs.Unlock()
+	cs.dupPolicy = policy
+}
+
+// remoteHost returns the host of the remote address of the given stream, if it's known
+func remoteHost(s stream) string {
+	host, _, err := net.SplitHostPort(extractRemoteAddress(s))
+	if err != nil {
+		return ""
+	}
+	return host
+}
+
+func (cs *connectionStore) closeByPKIid(pkiID common.PKIidType, reason CloseReason) {
+	cs.Lock()
+	conn, exists := cs.pki2Conn[string(pkiID)]
+	if exists {
 		conn.close()
 		delete(cs.pki2Conn, string(pkiID))
+		cs.checkUtilization()
+	}
+	cs.Unlock()
+
+	if exists {
+		cs.notifyStateChange(pkiID, ConnectionClosed, reason)
+	}
+}
+
+func (cs *connectionStore) removeConn(conn *connection, reason CloseReason) {
+	cs.Lock()
+	current := cs.detach(conn)
+	if current {
+		cs.checkUtilization()
+	}
+	cs.Unlock()
+	conn.close()
+
+	if current {
+		cs.notifyStateChange(conn.pkiID, ConnectionClosed, reason)
+	}
+}
+
+// detach removes the given connection from the store, unless it was already
+// replaced, and returns whether it was removed. It's called with the lock held
+func (cs *connectionStore) detach(conn *connection) bool {
+	if cs.pki2Conn[string(conn.pkiID)] != conn {
+		return false
+	}
+	delete(cs.pki2Conn, string(conn.pkiID))
+	return true
+}
+
+func (cs *connectionStore) notifyStateChange(pkiID common.PKIidType, state ConnectionState, reason CloseReason) {
+	cs.RLock()
+	onStateChange := cs.onStateChange
+	cs.RUnlock()
+	if onStateChange != nil {
+		onStateChange(pkiID, state, reason)
 	}
 }
 
 func newConnection(cl proto.GossipClient, c *grpc.ClientConn, cs proto.Gossip_GossipStreamClient, ss proto.Gossip_GossipStreamServer) *connection {
 	connection := &connection{
 		outBuff:      make(chan *msgSending, util.GetIntOrDefault("peer.gossip.sendBuffSize", defSendBuffSize)),
+		priorityBuff: make(chan *msgSending, util.GetIntOrDefault("peer.gossip.prioritySendBuffSize", defPrioritySendBuffSize)),
 		cl:           cl,
 		conn:         c,
 		clientStream: cs,
 		serverStream: ss,
 		stopFlag:     int32(0),
 		stopChan:     make(chan struct{}, 1),
+		closed:       make(chan struct{}),
+		serviced:     make(chan struct{}),
+		created:      time.Now(),
+		sendTimeout:  util.GetDurationOrDefault("peer.gossip.sendTimeout", defSendTimeout),
+	}
+	// Only connections accepted from remote peers have a server-side stream
+	if ss != nil {
+		connection.direction = Inbound
 	}
 
 	return connection
 }
 
 type connection struct {
+	lastRecv     int64         // time of the last reception from the stream, in nanoseconds since created. Accessed atomically
+	lastActive   int64         // time of the last message sent or received other than heartbeats and acknowledgements, in nanoseconds since created. Accessed atomically
+	heartbeating int32         // whether a heartbeat was received from the stream, which means the remote peer sends them. Accessed atomically
+	pending      int32         // messages that were buffered and not yet written to the stream. Accessed atomically
+	bytes        byteCounters  // bytes transferred over this connection
+	totalBytes   *byteCounters // bytes transferred over all connections, might be nil
+	expired      *uint64       // messages dropped because of their deadline, might be nil. Accessed atomically
+	undelivered  *uint64       // messages dropped because writing to the stream failed, might be nil. Accessed atomically
+	codec        MessageCodec  // encodes and decodes messages, the default codec if nil
+	created      time.Time     // carries a monotonic clock reading, so durations measured from it aren't affected by clock adjustments
 	info         *proto.ConnectionInfo
 	outBuff      chan *msgSending
+	priorityBuff chan *msgSending                // high priority messages, sent before the messages in outBuff
+	queueWait    *latencyHistogram               // time messages waited in the send buffer, might be nil
 	logger       *logging.Logger                 // logger
 	pkiID        common.PKIidType                // pkiID of the remote endpoint
+	direction    ConnectionDirection             // which side initiated the connection, never changes
 	handler      handler                         // function to invoke upon a message reception
+	throttled    func() bool                     // whether reading from the stream should pause, might be nil
+	paused       func() bool                     // whether handling received messages should pause, might be nil
+	onUndeliver  UndeliveredHandler              // given the messages that weren't delivered, might be nil
+	release      func()                          // releases the identity of the remote peer once closed, might be nil
 	conn         *grpc.ClientConn                // gRPC connection to remote endpoint
 	cl           proto.GossipClient              // gRPC stub of remote endpoint
 	clientStream proto.Gossip_GossipStreamClient // client-side stream to remote endpoint
 	serverStream proto.Gossip_GossipStreamServer // server-side stream to remote endpoint
 	stopFlag     int32                           // indicates whether this connection is in process of stopping
 	stopChan     chan struct{}                   // a method to stop the server-side gRPC call from a different go-routine
+	closed       chan struct{}                   // closed once the connection is closing
+	serviced     chan struct{}                   // closed once serviceConnection returns
+	sendLock     sync.Mutex                      // serializes writes to the stream
+	sendTimeout  time.Duration                   // time to wait for the stream to accept a message
+	draining     bool                            // whether new messages are no longer accepted for sending
+	overflow     OverflowPolicy                  // what to do with messages sent while the send buffer is full
+	blockTimeout time.Duration                   // time to wait for space in the send buffer, if the policy says so
+	tags         map[string]string               // local labels of the connection
+	recvBuff     chan *proto.SignedGossipMessage // received messages waiting to be handled
+	recvBuffCap  int                             // capacity of the receive buffer, the configured size if not positive
+	recvLimit    func() int                      // number of messages the receive buffer may hold, might be nil
 	sync.RWMutex                                 // synchronizes access to shared variables
 }
 
@@ -231,6 +672,12 @@ func (conn *connection) close() {
 	}
 
 	conn.stopChan <- struct{}{}
+	close(conn.closed)
+	if conn.release != nil {
+		conn.release()
+	}
+	// Messages that are still buffered are never sent
+	conn.takeUndelivered(nil, errConnClosed)
 
 	conn.Lock()
 
@@ -249,33 +696,256 @@ func (conn *connection) toDie() bool {
 	return atomic.LoadInt32(&(conn.stopFlag)) == int32(1)
 }
 
-func (conn *connection) send(msg *proto.SignedGossipMessage, onErr func(error)) {
+func (conn *connection) send(msg *proto.SignedGossipMessage, onErr func(error), priority Priority) {
+	env, err := conn.getCodec().Encode(msg)
+	if err != nil {
+		conn.logger.Warning("Failed encoding", msg, ":", err)
+		return
+	}
+	conn.sendEnvelope(env, onErr, priority)
+}
+
+func (conn *connection) getCodec() MessageCodec {
+	if conn.codec == nil {
+		return defaultCodec
+	}
+	return conn.codec
+}
+
+// sendEnvelope buffers the given envelope to be sent on the stream.
+// The envelope is only read, so it can be shared among connections
+func (conn *connection) sendEnvelope(envelope *proto.Envelope, onErr func(error), priority Priority) {
+	conn.sendEnvelopeUntil(envelope, onErr, priority, time.Time{})
+}
+
+// sendEnvelopeUntil behaves like sendEnvelope, but the envelope is dropped instead
+// of being sent if it's still buffered when the given deadline passes.
+// A zero deadline never passes
+func (conn *connection) sendEnvelopeUntil(envelope *proto.Envelope, onErr func(error), priority Priority, deadline time.Time) {
+	conn.enqueue(&msgSending{envelope: envelope, onErr: onErr, deadline: deadline}, priority)
+}
+
+// enqueue buffers the given message for sending
+func (conn *connection) enqueue(m *msgSending, priority Priority) {
+	if conn.toDie() {
+		m.resolve(errConnClosed)
+		return
+	}
 	conn.Lock()
-	defer conn.Unlock()
+	if conn.draining {
+		conn.Unlock()
+		conn.logger.Debug("Connection to", conn.pkiID, "is draining, dropping message")
+		m.resolve(errConnClosed)
+		return
+	}
 
-	if len(conn.outBuff) == util.GetIntOrDefault("peer.gossip.sendBuffSize", defSendBuffSize) {
-		go onErr(errSendOverflow)
+	buff := conn.outBuff
+	if priority == HighPriority {
+		buff = conn.priorityBuff
+	}
+	m.enqueued = time.Now()
+
+	atomic.AddInt32(&conn.pending, 1)
+	select {
+	case buff <- m:
+		conn.Unlock()
+		conn.resolveIfClosed()
 		return
+	default:
+	}
+	policy, timeout := conn.overflow, conn.blockTimeout
+	// Wait for space without holding the lock, as
+	// writing to the stream needs it in order to make space
+	conn.Unlock()
+
+	if policy == DropOnOverflow {
+		atomic.AddInt32(&conn.pending, -1)
+		go m.onErr(errSendOverflow)
+		m.resolve(errSendOverflow)
+		return
+	}
+
+	var expired <-chan time.Time
+	if policy == BlockWithTimeoutOnOverflow {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case buff <- m:
+		conn.resolveIfClosed()
+	case <-expired:
+		atomic.AddInt32(&conn.pending, -1)
+		go m.onErr(errSendOverflow)
+		m.resolve(errSendOverflow)
+	case <-conn.closed:
+		atomic.AddInt32(&conn.pending, -1)
+		m.resolve(errConnClosed)
+	}
+}
+
+// resolveIfClosed resolves the messages that are still buffered if the connection is closed.
+// A message enqueued while the connection closes might be put in the buffer after it was
+// emptied, and would otherwise never be resolved
+func (conn *connection) resolveIfClosed() {
+	if conn.toDie() {
+		conn.takeUndelivered(nil, errConnClosed)
+	}
+}
+
+// tag adds the given tags to the tags of the connection,
+// replacing the values of tags that already exist
+func (conn *connection) tag(tags map[string]string) {
+	conn.Lock()
+	defer conn.Unlock()
+	if conn.tags == nil {
+		conn.tags = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		conn.tags[k] = v
+	}
+}
+
+// hasTag returns whether the connection is tagged with the given key and value
+func (conn *connection) hasTag(key, value string) bool {
+	conn.RLock()
+	defer conn.RUnlock()
+	v, exists := conn.tags[key]
+	return exists && v == value
+}
+
+// getTags returns a copy of the tags of the connection
+func (conn *connection) getTags() map[string]string {
+	conn.RLock()
+	defer conn.RUnlock()
+	if conn.tags == nil {
+		return nil
+	}
+	tags := make(map[string]string, len(conn.tags))
+	for k, v := range conn.tags {
+		tags[k] = v
+	}
+	return tags
+}
+
+func (conn *connection) setOverflowPolicy(policy OverflowPolicy, blockTimeout time.Duration) {
+	conn.Lock()
+	defer conn.Unlock()
+	conn.overflow = policy
+	conn.blockTimeout = blockTimeout
+}
+
+// drain stops accepting new messages for sending, and waits up to the given timeout
+// for the buffered messages to be written to the stream.
+// Returns whether all buffered messages were written
+func (conn *connection) drain(timeout time.Duration) bool {
+	conn.Lock()
+	conn.draining = true
+	conn.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	for atomic.LoadInt32(&conn.pending) > 0 {
+		if conn.toDie() || time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(drainPollInterval)
+	}
+	return true
+}
+
+// flush waits for the buffered messages to be written to the stream, or
+// for the context to expire. Messages keep being accepted for sending
+func (conn *connection) flush(ctx context.Context) error {
+	for atomic.LoadInt32(&conn.pending) > 0 {
+		if conn.toDie() {
+			return errConnClosed
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(drainPollInterval):
+		}
+	}
+	return nil
+}
+
+// sendSync sends the message directly on the stream, bypassing the send buffer,
+// and returns once the stream accepted the message or the context expired
+func (conn *connection) sendSync(ctx context.Context, msg *proto.SignedGossipMessage) error {
+	env, err := conn.getCodec().Encode(msg)
+	if err != nil {
+		return err
+	}
+	return conn.sendEnvelopeSync(ctx, env)
+}
+
+// sendEnvelopeSync behaves like sendSync, but sends the given envelope as is
+func (conn *connection) sendEnvelopeSync(ctx context.Context, env *proto.Envelope) error {
+	if conn.toDie() {
+		return errors.New("Connection is closing")
 	}
+	stream := conn.getStream()
+	if stream == nil {
+		return errors.New("Stream is nil")
+	}
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- conn.sendToStream(stream, env)
+	}()
+	select {
+	case err := <-errChan:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-	m := &msgSending{
-		envelope: msg.Envelope,
-		onErr:    onErr,
+// sendToStream sends the envelope on the stream. Streams can't be given a deadline
+// per message, so if the stream didn't accept the envelope within the send timeout,
+// the connection is closed, which aborts the send, and errSendTimeout is returned
+func (conn *connection) sendToStream(stream stream, envelope *proto.Envelope) error {
+	conn.sendLock.Lock()
+	defer conn.sendLock.Unlock()
+
+	var timedOut int32
+	if conn.sendTimeout > 0 {
+		timer := time.AfterFunc(conn.sendTimeout, func() {
+			atomic.StoreInt32(&timedOut, 1)
+			conn.logger.Warning("Timed out sending to", conn.pkiID, ", closing the connection")
+			conn.close()
+		})
+		defer timer.Stop()
 	}
 
-	conn.outBuff <- m
+	err := stream.Send(envelope)
+	if err == nil {
+		conn.countSent(envelope)
+		return nil
+	}
+	if atomic.LoadInt32(&timedOut) == 1 {
+		return errSendTimeout
+	}
+	return err
 }
 
 func (conn *connection) serviceConnection() error {
+	defer close(conn.serviced)
 	errChan := make(chan error, 1)
-	msgChan := make(chan *proto.SignedGossipMessage, util.GetIntOrDefault("peer.gossip.recvBuffSize", defRecvBuffSize))
-	defer close(msgChan)
+	size := conn.recvBuffCap
+	if size <= 0 {
+		size = util.GetIntOrDefault("peer.gossip.recvBuffSize", defRecvBuffSize)
+	}
+	msgChan := make(chan *proto.SignedGossipMessage, size)
+	conn.Lock()
+	conn.recvBuff = msgChan
+	conn.Unlock()
 
 	// Call stream.Recv() asynchronously in readFromStream(),
 	// and wait for either the Recv() call to end,
 	// or a signal to close the connection, which exits
 	// the method and makes the Recv() call to fail in the
-	// readFromStream() method
+	// readFromStream() method. readFromStream() is the only
+	// sender on msgChan, so it closes msgChan once it stops
 	go conn.readFromStream(errChan, msgChan)
 
 	go conn.writeToStream()
@@ -288,7 +958,22 @@ func (conn *connection) serviceConnection() error {
 			return nil
 		case err := <-errChan:
 			return err
-		case msg := <-msgChan:
+		case msg, ok := <-msgChan:
+			if !ok {
+				// Reading stopped, and the reason was sent before msgChan was closed
+				select {
+				case err := <-errChan:
+					return err
+				default:
+					return nil
+				}
+			}
+			// While paused, received messages pile up in msgChan,
+			// and once it's full reading from the stream blocks
+			conn.waitWhile(conn.paused)
+			if conn.toDie() {
+				return nil
+			}
 			conn.handler(msg)
 		}
 	}
@@ -296,31 +981,81 @@ func (conn *connection) serviceConnection() error {
 }
 
 func (conn *connection) writeToStream() {
+	// Messages that are still buffered once writing stops are never sent
+	defer conn.takeUndelivered(nil, errConnClosed)
 	for !conn.toDie() {
 		stream := conn.getStream()
 		if stream == nil {
 			conn.logger.Error(conn.pkiID, "Stream is nil, aborting!")
 			return
 		}
+		var m *msgSending
+		// Drain high priority messages first, and only then
+		// wait for messages of any priority
 		select {
-		case m := <-conn.outBuff:
-			err := stream.Send(m.envelope)
-			if err != nil {
-				go m.onErr(err)
+		case m = <-conn.priorityBuff:
+		default:
+			select {
+			case m = <-conn.priorityBuff:
+			case m = <-conn.outBuff:
+			case stop := <-conn.stopChan:
+				conn.logger.Debug("Closing writing to stream")
+				conn.stopChan <- stop
 				return
 			}
-		case stop := <-conn.stopChan:
-			conn.logger.Debug("Closing writing to stream")
-			conn.stopChan <- stop
+		}
+		if !m.deadline.IsZero() && time.Now().After(m.deadline) {
+			atomic.AddInt32(&conn.pending, -1)
+			conn.countExpired()
+			conn.logger.Debug("Deadline of message to", conn.pkiID, "passed, dropping it")
+			m.resolve(errMsgExpired)
+			continue
+		}
+		err := conn.sendToStream(stream, m.envelope)
+		atomic.AddInt32(&conn.pending, -1)
+		m.resolve(err)
+		if err == nil && conn.queueWait != nil {
+			conn.queueWait.observe(time.Since(m.enqueued))
+		}
+		if err != nil {
+			undelivered := conn.takeUndelivered(m, err)
+			if conn.undelivered != nil {
+				atomic.AddUint64(conn.undelivered, uint64(len(undelivered)))
+			}
+			conn.logger.Warning("Failed writing to the stream of", conn.pkiID, ",", len(undelivered), "messages weren't delivered:", err)
+			if conn.onUndeliver != nil {
+				go conn.onUndeliver(conn.pkiID, undelivered)
+			}
+			go m.onErr(err)
 			return
 		}
 	}
 }
 
+// takeUndelivered removes the messages that are still buffered, resolves them with
+// the given error and returns their envelopes, preceded by the envelope of the
+// message that failed to be written, if any
+func (conn *connection) takeUndelivered(failed *msgSending, err error) []*proto.Envelope {
+	var envelopes []*proto.Envelope
+	if failed != nil {
+		envelopes = append(envelopes, failed.envelope)
+	}
+	for {
+		var m *msgSending
+		select {
+		case m = <-conn.priorityBuff:
+		case m = <-conn.outBuff:
+		default:
+			return envelopes
+		}
+		atomic.AddInt32(&conn.pending, -1)
+		m.resolve(err)
+		envelopes = append(envelopes, m.envelope)
+	}
+}
+
 func (conn *connection) readFromStream(errChan chan error, msgChan chan *proto.SignedGossipMessage) {
-	defer func() {
-		recover()
-	}() // msgChan might be closed
+	defer close(msgChan)
 	for !conn.toDie() {
 		stream := conn.getStream()
 		if stream == nil {
@@ -328,6 +1063,7 @@ func (conn *connection) readFromStream(errChan chan error, msgChan chan *proto.S
 			errChan <- errors.New("Stream is nil")
 			return
 		}
+		conn.waitWhileThrottled()
 		envelope, err := stream.Recv()
 		if conn.toDie() {
 			conn.logger.Debug(conn.pkiID, "canceling read because closing")
@@ -338,15 +1074,104 @@ func (conn *connection) readFromStream(errChan chan error, msgChan chan *proto.S
 			conn.logger.Debug(conn.pkiID, "Got error, aborting:", err)
 			return
 		}
-		msg, err := envelope.ToGossipMessage()
+		conn.touch()
+		conn.countReceived(envelope)
+		msg, err := conn.getCodec().Decode(envelope)
 		if err != nil {
 			errChan <- err
 			conn.logger.Warning(conn.pkiID, "Got error, aborting:", err)
+			return
 		}
-		msgChan <- msg
+		conn.waitWhile(func() bool {
+			return conn.recvLimit != nil && len(msgChan) >= conn.recvLimit()
+		})
+		// Once the connection is no longer serviced, nothing receives from msgChan
+		select {
+		case msgChan <- msg:
+		case <-conn.serviced:
+			return
+		}
+	}
+}
+
+// pendingReceived returns the number of received messages waiting to be handled
+func (conn *connection) pendingReceived() int {
+	conn.RLock()
+	defer conn.RUnlock()
+	return len(conn.recvBuff)
+}
+
+// waitWhileThrottled pauses reading from the stream as long as the connection
+// is throttled, which makes the flow control of the transport push back on the sender
+func (conn *connection) waitWhileThrottled() {
+	conn.waitWhile(conn.throttled)
+}
+
+// waitWhile waits as long as the given condition holds and the connection isn't closing
+func (conn *connection) waitWhile(cond func() bool) {
+	if cond == nil {
+		return
+	}
+	for cond() && !conn.toDie() {
+		time.Sleep(throttlePollInterval)
+	}
+}
+
+func (conn *connection) countSent(envelope *proto.Envelope) {
+	size := envelopeSize(envelope)
+	conn.bytes.addSent(size)
+	if conn.totalBytes != nil {
+		conn.totalBytes.addSent(size)
+	}
+}
+
+func (conn *connection) countExpired() {
+	if conn.expired != nil {
+		atomic.AddUint64(conn.expired, 1)
+	}
+}
+
+func (conn *connection) countReceived(envelope *proto.Envelope) {
+	size := envelopeSize(envelope)
+	conn.bytes.addReceived(size)
+	if conn.totalBytes != nil {
+		conn.totalBytes.addReceived(size)
 	}
 }
 
+// touch records that a message was received from the stream now
+func (conn *connection) touch() {
+	atomic.StoreInt64(&conn.lastRecv, int64(time.Since(conn.created)))
+}
+
+// lastReceived returns the time a message was last received from the stream.
+// Like the creation time of the connection, it carries a monotonic clock reading
+func (conn *connection) lastReceived() time.Time {
+	return conn.created.Add(time.Duration(atomic.LoadInt64(&conn.lastRecv)))
+}
+
+// markHeartbeating records that a heartbeat was received from the stream
+func (conn *connection) markHeartbeating() {
+	atomic.StoreInt32(&conn.heartbeating, int32(1))
+}
+
+// sendsHeartbeats returns whether a heartbeat was ever received from the stream
+func (conn *connection) sendsHeartbeats() bool {
+	return atomic.LoadInt32(&conn.heartbeating) == int32(1)
+}
+
+// markActive records that a message other than a heartbeat or an
+// acknowledgement was sent or received over the connection now
+func (conn *connection) markActive() {
+	atomic.StoreInt64(&conn.lastActive, int64(time.Since(conn.created)))
+}
+
+// lastActiveTime returns the time a message other than a heartbeat or an acknowledgement
+// was last sent or received over the connection, or its creation time if none was
+func (conn *connection) lastActiveTime() time.Time {
+	return conn.created.Add(time.Duration(atomic.LoadInt64(&conn.lastActive)))
+}
+
 func (conn *connection) getStream() stream {
 	conn.Lock()
 	defer conn.Unlock()
@@ -370,4 +1195,15 @@ func (conn *connection) getStream() stream {
 type msgSending struct {
 	envelope *proto.Envelope
 	onErr    func(error)
+	done     func(error)
+	deadline time.Time // zero if the message doesn't expire
+	enqueued time.Time // when the message was buffered
+}
+
+// resolve gives done the fate of the message once it's sent or dropped, which
+// is nil if it was sent. done might be nil, and otherwise must not block
+func (m *msgSending) resolve(err error) {
+	if m.done != nil {
+		m.done(err)
+	}
 }
@@ -0,0 +1,469 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/util"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/peer"
+)
+
+type recordingStream struct {
+	proto.Gossip_GossipStreamServer
+	sent chan *proto.Envelope
+}
+
+func newRecordingStream() *recordingStream {
+	return &recordingStream{sent: make(chan *proto.Envelope, 100)}
+}
+
+func (s *recordingStream) Send(envelope *proto.Envelope) error {
+	s.sent <- envelope
+	return nil
+}
+
+type blockingStream struct {
+	proto.Gossip_GossipStreamServer
+	unblock chan struct{}
+	aborted <-chan struct{} // aborts blocked sends like a stream that is torn down, might be nil
+}
+
+func (s *blockingStream) Send(envelope *proto.Envelope) error {
+	select {
+	case <-s.unblock:
+		return nil
+	case <-s.aborted:
+		return errors.New("stream was torn down")
+	}
+}
+
+func newTestConnection(stream proto.Gossip_GossipStreamServer) *connection {
+	conn := newConnection(nil, nil, nil, stream)
+	conn.logger = util.GetLogger(util.LoggingCommModule, "test")
+	return conn
+}
+
+func TestPrioritySend(t *testing.T) {
+	t.Parallel()
+	stream := newRecordingStream()
+	conn := newTestConnection(stream)
+	defer conn.close()
+
+	overflowed := make(chan error, 1)
+	onErr := func(err error) {
+		overflowed <- err
+	}
+
+	for i := 0; i < cap(conn.outBuff); i++ {
+		conn.send(createGossipMsg(), onErr, NormalPriority)
+	}
+	conn.send(createGossipMsg(), onErr, NormalPriority)
+	select {
+	case err := <-overflowed:
+		assert.Equal(t, errSendOverflow, err)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Normal priority buffer should have overflowed")
+	}
+
+	// The high priority lane isn't affected by the normal priority lane being full
+	urgentMsg := createGossipMsg()
+	conn.send(urgentMsg, onErr, HighPriority)
+	select {
+	case <-overflowed:
+		assert.Fail(t, "High priority buffer shouldn't have overflowed")
+	case <-time.After(time.Millisecond * 100):
+	}
+
+	go conn.writeToStream()
+	select {
+	case envelope := <-stream.sent:
+		assert.Equal(t, urgentMsg.Envelope, envelope)
+	case <-time.After(time.Second):
+		assert.Fail(t, "Didn't send a message in a timely manner")
+	}
+}
+
+func TestSendTimeout(t *testing.T) {
+	t.Parallel()
+	stream := &blockingStream{unblock: make(chan struct{})}
+	conn := newTestConnection(stream)
+	stream.aborted = conn.closed
+	conn.sendTimeout = time.Millisecond * 100
+	defer conn.close()
+
+	failed := make(chan error, 1)
+	conn.send(createGossipMsg(), func(err error) {
+		failed <- err
+	}, NormalPriority)
+
+	written := make(chan struct{})
+	go func() {
+		conn.writeToStream()
+		close(written)
+	}()
+	select {
+	case err := <-failed:
+		assert.Equal(t, errSendTimeout, err)
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Blocked send should have timed out")
+	}
+	// The send was aborted by closing the connection, so nothing is left blocked on the stream
+	assert.True(t, conn.toDie())
+	select {
+	case <-written:
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Writing to the stream didn't stop")
+	}
+}
+
+func TestDrain(t *testing.T) {
+	t.Parallel()
+	stream := &blockingStream{unblock: make(chan struct{})}
+	conn := newTestConnection(stream)
+	defer conn.close()
+
+	for i := 0; i < 5; i++ {
+		conn.send(createGossipMsg(), func(error) {}, NormalPriority)
+	}
+	go conn.writeToStream()
+
+	// The stream doesn't accept messages, so the buffer can't be drained
+	assert.False(t, conn.drain(time.Millisecond*100))
+
+	// Messages sent while draining are dropped
+	conn.send(createGossipMsg(), func(error) {}, NormalPriority)
+	assert.Equal(t, int32(5), atomic.LoadInt32(&conn.pending))
+
+	close(stream.unblock)
+	assert.True(t, conn.drain(time.Second*3))
+	assert.Len(t, conn.outBuff, 0)
+}
+
+func TestOverflowPolicy(t *testing.T) {
+	t.Parallel()
+	stream := &blockingStream{unblock: make(chan struct{})}
+	conn := newTestConnection(stream)
+	defer conn.close()
+	go conn.writeToStream()
+
+	overflowed := make(chan error, 10)
+	onErr := func(err error) {
+		overflowed <- err
+	}
+	// Fill the send buffer, while the stream holds the first message
+	for i := 0; i <= cap(conn.outBuff); i++ {
+		conn.send(createGossipMsg(), onErr, NormalPriority)
+	}
+	time.Sleep(time.Millisecond * 100)
+
+	// By default, a message that doesn't fit is dropped
+	conn.send(createGossipMsg(), onErr, NormalPriority)
+	assert.Equal(t, errSendOverflow, <-overflowed)
+
+	// The message is dropped once the timeout expires
+	conn.setOverflowPolicy(BlockWithTimeoutOnOverflow, time.Millisecond*200)
+	start := time.Now()
+	conn.send(createGossipMsg(), onErr, NormalPriority)
+	assert.True(t, time.Since(start) >= time.Millisecond*200)
+	assert.Equal(t, errSendOverflow, <-overflowed)
+
+	// The message is buffered once there is space for it
+	conn.setOverflowPolicy(BlockOnOverflow, 0)
+	sent := make(chan struct{})
+	go func() {
+		conn.send(createGossipMsg(), onErr, NormalPriority)
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		assert.Fail(t, "Send should have blocked until there is space in the buffer")
+	case <-time.After(time.Millisecond * 200):
+	}
+	close(stream.unblock)
+	select {
+	case <-sent:
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Send should have been unblocked")
+	}
+	assert.Len(t, overflowed, 0)
+}
+
+type recvCountingStream struct {
+	proto.Gossip_GossipStreamServer
+	received int32
+}
+
+func (s *recvCountingStream) Recv() (*proto.Envelope, error) {
+	atomic.AddInt32(&s.received, 1)
+	return createGossipMsg().Envelope, nil
+}
+
+func TestThrottledReceive(t *testing.T) {
+	t.Parallel()
+	stream := &recvCountingStream{}
+	conn := newTestConnection(stream)
+	defer conn.close()
+	var throttled int32 = 1
+	conn.throttled = func() bool {
+		return atomic.LoadInt32(&throttled) == 1
+	}
+
+	msgChan := make(chan *proto.SignedGossipMessage, 1)
+	go conn.readFromStream(make(chan error, 1), msgChan)
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&stream.received))
+
+	atomic.StoreInt32(&throttled, 0)
+	select {
+	case <-msgChan:
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Reading should have resumed once the connection isn't throttled")
+	}
+}
+
+func TestUtilization(t *testing.T) {
+	cs := newConnStore(nil, util.GetLogger(util.LoggingCommModule, "test"))
+	assert.Equal(t, float64(0), cs.Utilization())
+
+	cs.maxConns = 10
+	cs.setHighWaterMarks(0.5, 0.2)
+	connect := func(i int) {
+		cs.onConnected(newRecordingStream(), &proto.ConnectionInfo{ID: []byte{byte(i)}})
+	}
+	connect(0)
+	assert.Equal(t, 0.1, cs.Utilization())
+	assert.Equal(t, uint64(0), cs.capacityWarnings)
+
+	// Crossing a high-water mark is warned about once
+	connect(1)
+	connect(2)
+	assert.Equal(t, uint64(1), cs.capacityWarnings)
+
+	// Crossing several high-water marks at once is warned about once
+	for i := 3; i < 6; i++ {
+		connect(i)
+	}
+	assert.Equal(t, 0.6, cs.Utilization())
+	assert.Equal(t, uint64(2), cs.capacityWarnings)
+
+	// Dropping below a high-water mark and reaching it again is warned about again
+	cs.closeByPKIid([]byte{5}, LocalStop)
+	cs.closeByPKIid([]byte{4}, LocalStop)
+	assert.Equal(t, uint64(2), cs.capacityWarnings)
+	connect(4)
+	connect(5)
+	assert.Equal(t, uint64(3), cs.capacityWarnings)
+}
+
+func TestSendDeadline(t *testing.T) {
+	t.Parallel()
+	stream := newRecordingStream()
+	conn := newTestConnection(stream)
+	var expired uint64
+	conn.expired = &expired
+	defer conn.close()
+
+	// Buffer the messages before writing to the stream,
+	// so that the deadline of the first passes meanwhile
+	msgs := make([]*proto.SignedGossipMessage, 3)
+	for i := range msgs {
+		msgs[i] = createGossipMsg()
+	}
+	conn.sendEnvelopeUntil(msgs[0].Envelope, func(error) {}, NormalPriority, time.Now().Add(time.Millisecond))
+	conn.sendEnvelopeUntil(msgs[1].Envelope, func(error) {}, NormalPriority, time.Now().Add(time.Hour))
+	conn.send(msgs[2], func(error) {}, NormalPriority)
+	time.Sleep(time.Millisecond * 10)
+	go conn.writeToStream()
+
+	for _, msg := range msgs[1:] {
+		select {
+		case env := <-stream.sent:
+			assert.Equal(t, msg.Envelope, env)
+		case <-time.After(time.Second * 3):
+			assert.Fail(t, "Didn't send a message")
+		}
+	}
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&expired))
+	// The last message is no longer pending only once its write returns
+	for i := 0; i < 100 && atomic.LoadInt32(&conn.pending) > 0; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&conn.pending))
+}
+
+func TestLastErrorsBounded(t *testing.T) {
+	t.Parallel()
+	cs := newConnStore(nil, util.GetLogger(util.LoggingCommModule, "test"))
+	first := common.PKIidType("first")
+	cs.recordError(first, errSendOverflow)
+	err, _, exists := cs.lastError(first)
+	assert.True(t, exists)
+	assert.Equal(t, errSendOverflow, err)
+
+	// Once too many peers have errors, the oldest errors are forgotten
+	for i := 0; i < maxTrackedErrors; i++ {
+		cs.recordError(common.PKIidType(fmt.Sprintf("peer%d", i)), errSendTimeout)
+	}
+	assert.Len(t, cs.lastErrors, maxTrackedErrors)
+	_, _, exists = cs.lastError(first)
+	assert.False(t, exists)
+
+	// Errors are cleared once a connection is established
+	cs.onConnected(newRecordingStream(), &proto.ConnectionInfo{ID: common.PKIidType("peer0")})
+	_, _, exists = cs.lastError(common.PKIidType("peer0"))
+	assert.False(t, exists)
+}
+
+type hostStream struct {
+	*recordingStream
+	host string
+}
+
+func (s *hostStream) Context() context.Context {
+	addr := &net.TCPAddr{IP: net.ParseIP(s.host), Port: 7051}
+	return peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+}
+
+func TestDuplicateConnections(t *testing.T) {
+	t.Parallel()
+	cs := newConnStore(nil, util.GetLogger(util.LoggingCommModule, "test"))
+	var closeReasons []CloseReason
+	cs.setStateChangeHandler(func(pkiID common.PKIidType, state ConnectionState, reason CloseReason) {
+		if state == ConnectionClosed {
+			closeReasons = append(closeReasons, reason)
+		}
+	})
+	connect := func(host string) (*connection, error) {
+		stream := &hostStream{recordingStream: newRecordingStream(), host: host}
+		return cs.onConnected(stream, &proto.ConnectionInfo{ID: common.PKIidType("peer")})
+	}
+
+	first, err := connect("127.0.0.1")
+	assert.NoError(t, err)
+
+	// A connection from another host is rejected by default
+	conn, err := connect("127.0.0.2")
+	assert.Nil(t, conn)
+	assert.Equal(t, errDuplicateConn, err)
+	assert.False(t, first.toDie())
+
+	// A connection from the same host replaces the old connection, which is closed
+	second, err := connect("127.0.0.1")
+	assert.NoError(t, err)
+	assert.True(t, first.toDie())
+	assert.Equal(t, []CloseReason{ConnectionReplaced}, closeReasons)
+
+	// Once the policy says so, a connection from another host replaces the old connection too
+	cs.setDuplicateConnPolicy(ReplaceOldConnection)
+	third, err := connect("127.0.0.2")
+	assert.NoError(t, err)
+	assert.True(t, second.toDie())
+	assert.Equal(t, []CloseReason{ConnectionReplaced, ConnectionReplaced}, closeReasons)
+	current, _ := cs.existingConnection(common.PKIidType("peer"))
+	assert.Equal(t, third, current)
+	assert.Equal(t, 1, cs.connNum())
+}
+
+type failingStream struct {
+	proto.Gossip_GossipStreamServer
+}
+
+func (s *failingStream) Send(envelope *proto.Envelope) error {
+	return errors.New("stream is broken")
+}
+
+func TestUndeliveredMessages(t *testing.T) {
+	t.Parallel()
+	conn := newTestConnection(&failingStream{})
+	var undeliveredCount uint64
+	conn.undelivered = &undeliveredCount
+	undelivered := make(chan []*proto.Envelope, 1)
+	conn.onUndeliver = func(pkiID common.PKIidType, envelopes []*proto.Envelope) {
+		undelivered <- envelopes
+	}
+	defer conn.close()
+
+	msgs := make([]*proto.SignedGossipMessage, 3)
+	failed := make(chan error, len(msgs))
+	for i := range msgs {
+		msgs[i] = createGossipMsg()
+		conn.send(msgs[i], func(err error) {
+			failed <- err
+		}, NormalPriority)
+	}
+	go conn.writeToStream()
+
+	select {
+	case envelopes := <-undelivered:
+		assert.Len(t, envelopes, len(msgs))
+		for i, env := range envelopes {
+			assert.Equal(t, msgs[i].Envelope, env)
+		}
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Undelivered messages weren't handed back")
+	}
+	// Only the message that failed to be written reports the failure
+	assert.Error(t, <-failed)
+	assert.Len(t, failed, 0)
+	assert.Equal(t, uint64(len(msgs)), atomic.LoadUint64(&undeliveredCount))
+	assert.Equal(t, int32(0), atomic.LoadInt32(&conn.pending))
+}
+
+func TestResolveBufferedOnClose(t *testing.T) {
+	t.Parallel()
+	conn := newTestConnection(newRecordingStream())
+	resolved := make(chan error, 3)
+	newMsg := func() *msgSending {
+		return &msgSending{
+			envelope: createGossipMsg().Envelope,
+			onErr:    func(error) {},
+			done: func(err error) {
+				resolved <- err
+			},
+		}
+	}
+
+	// Messages that are still buffered once the connection closes are resolved
+	conn.enqueue(newMsg(), NormalPriority)
+	conn.enqueue(newMsg(), HighPriority)
+	conn.close()
+	assert.Equal(t, errConnClosed, <-resolved)
+	assert.Equal(t, errConnClosed, <-resolved)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&conn.pending))
+
+	// So is a message that is buffered after the connection closed and its buffer was emptied
+	atomic.AddInt32(&conn.pending, 1)
+	conn.outBuff <- newMsg()
+	conn.resolveIfClosed()
+	select {
+	case err := <-resolved:
+		assert.Equal(t, errConnClosed, err)
+	default:
+		assert.Fail(t, "Message buffered after the connection closed wasn't resolved")
+	}
+	assert.Equal(t, int32(0), atomic.LoadInt32(&conn.pending))
+}
@@ -17,18 +17,28 @@ limitations under the License.
 package comm
 
 import (
+	"crypto"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
+	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
 	"net"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
+	pb "github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/common/util"
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/protos/msp"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/peer"
@@ -43,8 +53,30 @@ func writeFile(filename string, keyType string, data []byte) error {
 	return pem.Encode(f, &pem.Block{Type: keyType, Bytes: data})
 }
 
+const (
+	// defCertValidity is how long generated certificates are valid for by default
+	defCertValidity = time.Hour * 24 * 365
+	// certBackdate is how long before their generation certificates become valid,
+	// so that peers whose clocks are slightly behind don't consider them not yet valid
+	certBackdate = time.Minute
+)
+
+// certOptions defines the parameters of generated certificates.
+// Zero values mean the defaults are used
+type certOptions struct {
+	validity   time.Duration // how long the certificate is valid for, one year by default
+	keyType    string        // either "ECDSA" (the default) or "RSA"
+	keySize    int           // the ECDSA curve size (256, 384, 521) or the RSA key size in bits
+	commonName string        // the common name of the subject
+	altNames   []string      // DNS names or IP addresses that are put in the subject alternative names
+}
+
 func generateCertificates(privKeyFile string, certKeyFile string) error {
-	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	return generateCertificatesWithOptions(privKeyFile, certKeyFile, certOptions{})
+}
+
+func generateCertificatesWithOptions(privKeyFile string, certKeyFile string, opts certOptions) error {
+	privateKey, publicKey, err := generateKey(opts.keyType, opts.keySize)
 	if err != nil {
 		return err
 	}
@@ -57,8 +89,23 @@ func generateCertificates(privKeyFile string, certKeyFile string) error {
 		KeyUsage:     x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
 		SerialNumber: sn,
 		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		Subject:      pkix.Name{CommonName: opts.commonName},
+	}
+	validity := opts.validity
+	if validity <= 0 {
+		validity = defCertValidity
 	}
-	rawBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &privateKey.PublicKey, privateKey)
+	now := time.Now()
+	template.NotBefore = now.Add(-certBackdate)
+	template.NotAfter = now.Add(validity)
+	for _, name := range opts.altNames {
+		if ip := net.ParseIP(name); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, name)
+		}
+	}
+	rawBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey, privateKey)
 	if err != nil {
 		return err
 	}
@@ -66,12 +113,50 @@ func generateCertificates(privKeyFile string, certKeyFile string) error {
 	if err != nil {
 		return err
 	}
-	privBytes, err := x509.MarshalECPrivateKey(privateKey)
-	if err != nil {
-		return err
+
+	switch k := privateKey.(type) {
+	case *rsa.PrivateKey:
+		return writeFile(privKeyFile, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(k))
+	case *ecdsa.PrivateKey:
+		privBytes, err := x509.MarshalECPrivateKey(k)
+		if err != nil {
+			return err
+		}
+		return writeFile(privKeyFile, "EC PRIVATE KEY", privBytes)
 	}
-	err = writeFile(privKeyFile, "EC PRIVATE KEY", privBytes)
-	return err
+	return fmt.Errorf("Unsupported private key type: %T", privateKey)
+}
+
+func generateKey(keyType string, keySize int) (crypto.Signer, crypto.PublicKey, error) {
+	switch strings.ToUpper(keyType) {
+	case "", "ECDSA":
+		var curve elliptic.Curve
+		switch keySize {
+		case 0, 256:
+			curve = elliptic.P256()
+		case 384:
+			curve = elliptic.P384()
+		case 521:
+			curve = elliptic.P521()
+		default:
+			return nil, nil, fmt.Errorf("Unsupported ECDSA key size: %d", keySize)
+		}
+		privateKey, err := ecdsa.GenerateKey(curve, rand.Reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, &privateKey.PublicKey, nil
+	case "RSA":
+		if keySize == 0 {
+			keySize = 2048
+		}
+		privateKey, err := rsa.GenerateKey(rand.Reader, keySize)
+		if err != nil {
+			return nil, nil, err
+		}
+		return privateKey, &privateKey.PublicKey, nil
+	}
+	return nil, nil, fmt.Errorf("Unsupported key type: %s", keyType)
 }
 
 func certHashFromRawCert(rawCert []byte) []byte {
@@ -83,6 +168,17 @@ func certHashFromRawCert(rawCert []byte) []byte {
 
 // ExtractCertificateHash extracts the hash of the certificate from the stream
 func extractCertificateHashFromContext(ctx context.Context) []byte {
+	certs := extractCertificateChainFromContext(ctx)
+	if len(certs) == 0 {
+		return nil
+	}
+	raw := certs[0].Raw
+	return certHashFromRawCert(raw)
+}
+
+// extractCertificateChainFromContext extracts the certificate chain
+// the remote peer presented in the TLS handshake, leaf first
+func extractCertificateChainFromContext(ctx context.Context) []*x509.Certificate {
 	pr, extracted := peer.FromContext(ctx)
 	if !extracted {
 		return nil
@@ -97,12 +193,88 @@ func extractCertificateHashFromContext(ctx context.Context) []byte {
 	if !isTLSConn {
 		return nil
 	}
-	certs := tlsInfo.State.PeerCertificates
+	return tlsInfo.State.PeerCertificates
+}
+
+// verifyCertChain verifies that the leaf of the given chain (the first certificate)
+// chains up to one of the given roots, using the rest of the chain as intermediates
+func verifyCertChain(certs []*x509.Certificate, roots *x509.CertPool) error {
 	if len(certs) == 0 {
+		return errors.New("No certificate was presented")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	})
+	return err
+}
+
+// identityCertificate returns the X.509 certificate of the given identity, which is
+// either a serialized MSP identity, a PEM encoded certificate or a DER encoded certificate.
+// Returns nil if the identity isn't an X.509 certificate
+func identityCertificate(identity api.PeerIdentityType) *x509.Certificate {
+	raw := []byte(identity)
+	sID := &msp.SerializedIdentity{}
+	if err := pb.Unmarshal(raw, sID); err == nil && len(sID.IdBytes) > 0 {
+		raw = sID.IdBytes
+	}
+	if block, _ := pem.Decode(raw); block != nil {
+		raw = block.Bytes
+	}
+	cert, err := x509.ParseCertificate(raw)
+	if err != nil {
 		return nil
 	}
-	raw := certs[0].Raw
-	return certHashFromRawCert(raw)
+	return cert
+}
+
+// checkIdentityValidity returns an error if the given identity is an X.509
+// certificate whose validity period doesn't contain the given time.
+// Identities that aren't X.509 certificates aren't checked
+func checkIdentityValidity(identity api.PeerIdentityType, now time.Time) error {
+	cert := identityCertificate(identity)
+	if cert == nil {
+		return nil
+	}
+	if now.Before(cert.NotBefore) {
+		return fmt.Errorf("identity is valid only from %v", cert.NotBefore)
+	}
+	if now.After(cert.NotAfter) {
+		return fmt.Errorf("identity expired at %v", cert.NotAfter)
+	}
+	return nil
+}
+
+// tlsCertificate holds a TLS certificate that can be replaced at runtime.
+// New TLS sessions use the certificate held at the time of the handshake
+type tlsCertificate struct {
+	sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (c *tlsCertificate) get() *tls.Certificate {
+	c.RLock()
+	defer c.RUnlock()
+	return c.cert
+}
+
+func (c *tlsCertificate) set(cert *tls.Certificate) {
+	c.Lock()
+	defer c.Unlock()
+	c.cert = cert
+}
+
+func (c *tlsCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.get(), nil
+}
+
+func (c *tlsCertificate) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.get(), nil
 }
 
 type authCreds struct {
@@ -17,16 +17,24 @@ limitations under the License.
 package comm
 
 import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"fmt"
+	"math/big"
 	"net"
 	"os"
 	"sync"
 	"testing"
 	"time"
 
+	pb "github.com/golang/protobuf/proto"
 	"github.com/hyperledger/fabric/gossip/util"
 	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/hyperledger/fabric/protos/msp"
 	"github.com/stretchr/testify/assert"
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
@@ -131,3 +139,117 @@ func TestCertificateExtraction(t *testing.T) {
 	assert.Equal(t, clientSideCertHash, srv.selfCertHash, "Server self hash isn't equal to client side hash")
 	assert.Equal(t, clientCertHash, srv.remoteCertHash, "Server side and client hash aren't equal")
 }
+
+func TestVerifyCertChain(t *testing.T) {
+	createCert := func(parent *x509.Certificate, parentKey *ecdsa.PrivateKey, isCA bool) (*x509.Certificate, *ecdsa.PrivateKey) {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber:          big.NewInt(time.Now().UnixNano()),
+			NotBefore:             time.Now().Add(-time.Hour),
+			NotAfter:              time.Now().Add(time.Hour),
+			KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+			IsCA:                  isCA,
+			BasicConstraintsValid: true,
+		}
+		if parent == nil {
+			parent, parentKey = template, key
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+		assert.NoError(t, err)
+		cert, err := x509.ParseCertificate(raw)
+		assert.NoError(t, err)
+		return cert, key
+	}
+
+	root, rootKey := createCert(nil, nil, true)
+	intermediate, intermediateKey := createCert(root, rootKey, true)
+	leaf, _ := createCert(intermediate, intermediateKey, false)
+	otherRoot, _ := createCert(nil, nil, true)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(root)
+
+	assert.NoError(t, verifyCertChain([]*x509.Certificate{leaf, intermediate}, roots))
+	// Without the intermediate the leaf can't be chained to the root
+	assert.Error(t, verifyCertChain([]*x509.Certificate{leaf}, roots))
+	assert.Error(t, verifyCertChain(nil, roots))
+
+	untrustedRoots := x509.NewCertPool()
+	untrustedRoots.AddCert(otherRoot)
+	assert.Error(t, verifyCertChain([]*x509.Certificate{leaf, intermediate}, untrustedRoots))
+}
+
+func TestCheckIdentityValidity(t *testing.T) {
+	createCert := func(notBefore, notAfter time.Time) []byte {
+		key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		assert.NoError(t, err)
+		template := &x509.Certificate{
+			SerialNumber: big.NewInt(time.Now().UnixNano()),
+			NotBefore:    notBefore,
+			NotAfter:     notAfter,
+		}
+		raw, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+		assert.NoError(t, err)
+		return raw
+	}
+	now := time.Now()
+	valid := createCert(now.Add(-time.Hour), now.Add(time.Hour))
+	expired := createCert(now.Add(-time.Hour*2), now.Add(-time.Hour))
+	notYetValid := createCert(now.Add(time.Hour), now.Add(time.Hour*2))
+
+	assert.NoError(t, checkIdentityValidity(valid, now))
+	assert.Error(t, checkIdentityValidity(expired, now))
+	assert.Error(t, checkIdentityValidity(notYetValid, now))
+
+	// PEM encoded certificates and serialized MSP identities are checked too
+	pemExpired := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: expired})
+	assert.Error(t, checkIdentityValidity(pemExpired, now))
+	sID, err := pb.Marshal(&msp.SerializedIdentity{Mspid: "SampleOrg", IdBytes: pemExpired})
+	assert.NoError(t, err)
+	assert.Error(t, checkIdentityValidity(sID, now))
+	sID, err = pb.Marshal(&msp.SerializedIdentity{Mspid: "SampleOrg", IdBytes: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: valid})})
+	assert.NoError(t, err)
+	assert.NoError(t, checkIdentityValidity(sID, now))
+
+	// Identities that aren't X.509 certificates aren't checked
+	assert.NoError(t, checkIdentityValidity([]byte("localhost:5611"), now))
+}
+
+func TestGenerateCertificatesWithOptions(t *testing.T) {
+	defer os.Remove("key3.pem")
+	defer os.Remove("cert3.pem")
+
+	opts := certOptions{
+		validity:   time.Hour,
+		keyType:    "RSA",
+		keySize:    2048,
+		commonName: "peer0",
+		altNames:   []string{"peer0.org1", "127.0.0.1"},
+	}
+	assert.NoError(t, generateCertificatesWithOptions("key3.pem", "cert3.pem", opts))
+	cert, err := tls.LoadX509KeyPair("cert3.pem", "key3.pem")
+	assert.NoError(t, err)
+	x509Cert, err := x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, x509.RSA, x509Cert.PublicKeyAlgorithm)
+	assert.Equal(t, "peer0", x509Cert.Subject.CommonName)
+	assert.Equal(t, []string{"peer0.org1"}, x509Cert.DNSNames)
+	assert.Len(t, x509Cert.IPAddresses, 1)
+	assert.WithinDuration(t, time.Now().Add(time.Hour), x509Cert.NotAfter, time.Minute)
+	assert.True(t, x509Cert.NotBefore.Before(time.Now()))
+
+	// Certificates are valid for a year by default
+	opts = certOptions{keySize: 384}
+	assert.NoError(t, generateCertificatesWithOptions("key3.pem", "cert3.pem", opts))
+	cert, err = tls.LoadX509KeyPair("cert3.pem", "key3.pem")
+	assert.NoError(t, err)
+	x509Cert, err = x509.ParseCertificate(cert.Certificate[0])
+	assert.NoError(t, err)
+	assert.Equal(t, elliptic.P384(), x509Cert.PublicKey.(*ecdsa.PublicKey).Curve)
+	assert.WithinDuration(t, time.Now().Add(defCertValidity), x509Cert.NotAfter, time.Minute)
+	assert.True(t, x509Cert.NotBefore.Before(time.Now()))
+
+	assert.Error(t, generateCertificatesWithOptions("key3.pem", "cert3.pem", certOptions{keyType: "DSA"}))
+	assert.Error(t, generateCertificatesWithOptions("key3.pem", "cert3.pem", certOptions{keySize: 128}))
+}
@@ -0,0 +1,80 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+)
+
+// deadPeerDebouncer decides when peers that failed are reported as presumed dead:
+// once they failed a number of consecutive times, or kept failing for a period of time,
+// whichever comes first. Without either, peers are reported as soon as they fail
+type deadPeerDebouncer struct {
+	sync.Mutex
+	threshold int
+	window    time.Duration
+	failures  map[string]*peerFailures
+}
+
+type peerFailures struct {
+	count int
+	since time.Time
+}
+
+func newDeadPeerDebouncer(threshold int, window time.Duration) *deadPeerDebouncer {
+	if threshold <= 0 {
+		threshold = 1
+	}
+	return &deadPeerDebouncer{
+		threshold: threshold,
+		window:    window,
+		failures:  make(map[string]*peerFailures),
+	}
+}
+
+// failed records a failure of the given peer at the given time,
+// and returns whether the peer should be reported as presumed dead
+func (d *deadPeerDebouncer) failed(pkiID common.PKIidType, now time.Time) bool {
+	d.Lock()
+	defer d.Unlock()
+	f, exists := d.failures[string(pkiID)]
+	if !exists {
+		f = &peerFailures{since: now}
+		d.failures[string(pkiID)] = f
+	}
+	f.count++
+	// Each criterion only applies if it's configured beyond reporting immediately
+	countExceeded := d.threshold > 1 && f.count >= d.threshold
+	windowExceeded := d.window > 0 && now.Sub(f.since) >= d.window
+	immediate := d.threshold <= 1 && d.window <= 0
+	if !countExceeded && !windowExceeded && !immediate {
+		return false
+	}
+	// Once reported, the peer needs to fail again as many times to be reported again
+	delete(d.failures, string(pkiID))
+	return true
+}
+
+// succeeded resets the failures of the given peer
+func (d *deadPeerDebouncer) succeeded(pkiID common.PKIidType) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.failures, string(pkiID))
+}
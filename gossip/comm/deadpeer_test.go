@@ -0,0 +1,64 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeadPeerDebouncer(t *testing.T) {
+	p1 := common.PKIidType("p1")
+	p2 := common.PKIidType("p2")
+	now := time.Now()
+
+	// By default, peers are reported as soon as they fail
+	d := newDeadPeerDebouncer(1, 0)
+	assert.True(t, d.failed(p1, now))
+	assert.True(t, d.failed(p1, now))
+
+	// Peers are reported once they fail a number of consecutive times
+	d = newDeadPeerDebouncer(3, 0)
+	assert.False(t, d.failed(p1, now))
+	assert.False(t, d.failed(p1, now))
+	assert.False(t, d.failed(p2, now))
+	assert.True(t, d.failed(p1, now))
+	// A success resets the failures
+	d.succeeded(p2)
+	assert.False(t, d.failed(p2, now))
+	assert.False(t, d.failed(p2, now))
+	assert.True(t, d.failed(p2, now))
+
+	// Peers are reported once they keep failing for a period of time
+	d = newDeadPeerDebouncer(1, time.Second)
+	assert.False(t, d.failed(p1, now))
+	assert.False(t, d.failed(p1, now.Add(time.Millisecond*500)))
+	assert.True(t, d.failed(p1, now.Add(time.Second)))
+	assert.False(t, d.failed(p1, now.Add(time.Second*2)))
+
+	// Whichever comes first
+	d = newDeadPeerDebouncer(2, time.Second)
+	assert.False(t, d.failed(p1, now))
+	assert.True(t, d.failed(p1, now))
+	assert.False(t, d.failed(p2, now))
+	d.succeeded(p2)
+	assert.False(t, d.failed(p2, now))
+	assert.True(t, d.failed(p2, now.Add(time.Second)))
+}
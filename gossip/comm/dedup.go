@@ -0,0 +1,74 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"sync/atomic"
+
+	proto "github.com/hyperledger/fabric/protos/gossip"
+)
+
+// msgDedup remembers the digests of the most recently received messages,
+// and detects messages that were already received
+type msgDedup struct {
+	sync.Mutex
+	duplicates uint64
+	size       int
+	order      *list.List
+	digests    map[string]*list.Element
+}
+
+func newMsgDedup(size int) *msgDedup {
+	return &msgDedup{
+		size:    size,
+		order:   list.New(),
+		digests: make(map[string]*list.Element),
+	}
+}
+
+// isDuplicate returns whether an envelope with the same payload was recently seen,
+// and remembers the envelope otherwise. A dedup with a non-positive size is disabled
+func (d *msgDedup) isDuplicate(envelope *proto.Envelope) bool {
+	if d.size <= 0 || envelope == nil {
+		return false
+	}
+	h := sha256.Sum256(envelope.Payload)
+	digest := string(h[:])
+
+	d.Lock()
+	defer d.Unlock()
+	if e, exists := d.digests[digest]; exists {
+		d.order.MoveToFront(e)
+		atomic.AddUint64(&d.duplicates, 1)
+		return true
+	}
+	d.digests[digest] = d.order.PushFront(digest)
+	if d.order.Len() > d.size {
+		oldest := d.order.Back()
+		d.order.Remove(oldest)
+		delete(d.digests, oldest.Value.(string))
+	}
+	return false
+}
+
+// duplicateCount returns the number of duplicate messages detected
+func (d *msgDedup) duplicateCount() uint64 {
+	return atomic.LoadUint64(&d.duplicates)
+}
@@ -0,0 +1,46 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgDedup(t *testing.T) {
+	t.Parallel()
+	dedup := newMsgDedup(2)
+	env := func(payload string) *proto.Envelope {
+		return &proto.Envelope{Payload: []byte(payload)}
+	}
+
+	assert.False(t, dedup.isDuplicate(env("a")))
+	assert.False(t, dedup.isDuplicate(env("b")))
+	assert.True(t, dedup.isDuplicate(env("a")))
+	// "b" is the least recently seen, so it's evicted
+	assert.False(t, dedup.isDuplicate(env("c")))
+	assert.False(t, dedup.isDuplicate(env("b")))
+	assert.Equal(t, uint64(1), dedup.duplicateCount())
+
+	// A dedup with a non-positive size is disabled
+	dedup = newMsgDedup(0)
+	assert.False(t, dedup.isDuplicate(env("a")))
+	assert.False(t, dedup.isDuplicate(env("a")))
+	assert.Equal(t, uint64(0), dedup.duplicateCount())
+}
@@ -23,21 +23,41 @@ import (
 	"github.com/hyperledger/fabric/gossip/common"
 )
 
+// defDemuxBuffSize is the default buffer size of the channels of a ChannelDeMultiplexer
+const defDemuxBuffSize = 10
+
 // ChannelDeMultiplexer is a struct that can receive channel registrations (AddChannel)
 // and publications (DeMultiplex) and it broadcasts the publications to registrations
 // according to their predicate
 type ChannelDeMultiplexer struct {
-	channels []*channel
-	lock     *sync.RWMutex
-	closed   int32
+	dropped      uint64 // accessed atomically, kept first for 64-bit alignment
+	channels     []*channel
+	lock         *sync.RWMutex
+	closed       int32
+	buffSize     int
+	dropWhenFull bool
 }
 
 // NewChannelDemultiplexer creates a new ChannelDeMultiplexer
 func NewChannelDemultiplexer() *ChannelDeMultiplexer {
+	return NewChannelDemultiplexerWithBuffer(defDemuxBuffSize, false)
+}
+
+// NewChannelDemultiplexerWithBuffer creates a new ChannelDeMultiplexer whose channels have
+// the given buffer size. If dropWhenFull is set, messages published to channels that are full
+// are dropped instead of waiting for the channels to be consumed, so that a stuck subscriber
+// can't hold up the publisher and the other subscribers. A non-positive size is replaced
+// by the default size
+func NewChannelDemultiplexerWithBuffer(size int, dropWhenFull bool) *ChannelDeMultiplexer {
+	if size <= 0 {
+		size = defDemuxBuffSize
+	}
 	return &ChannelDeMultiplexer{
-		channels: make([]*channel, 0),
-		lock:     &sync.RWMutex{},
-		closed:   int32(0),
+		channels:     make([]*channel, 0),
+		lock:         &sync.RWMutex{},
+		closed:       int32(0),
+		buffSize:     size,
+		dropWhenFull: dropWhenFull,
 	}
 }
 
@@ -69,29 +89,108 @@ func (m *ChannelDeMultiplexer) Close() {
 func (m *ChannelDeMultiplexer) AddChannel(predicate common.MessageAcceptor) chan interface{} {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	ch := &channel{ch: make(chan interface{}, 10), pred: predicate}
+	ch := &channel{ch: make(chan interface{}, m.buffSize), pred: predicate}
 	m.channels = append(m.channels, ch)
 	return ch.ch
 }
 
+// Count returns the number of channels registered via AddChannel
+func (m *ChannelDeMultiplexer) Count() int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	return len(m.channels)
+}
+
+// BufferSize returns the buffer size of the registered channels
+func (m *ChannelDeMultiplexer) BufferSize() int {
+	return m.buffSize
+}
+
+// Dropped returns the number of messages that were dropped because
+// the channels they were published to were full
+func (m *ChannelDeMultiplexer) Dropped() uint64 {
+	return atomic.LoadUint64(&m.dropped)
+}
+
+// Pending returns the number of messages waiting to be consumed
+// in each registered channel, in the order the channels were registered
+func (m *ChannelDeMultiplexer) Pending() []int {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	pending := make([]int, len(m.channels))
+	for i, ch := range m.channels {
+		pending[i] = len(ch.ch)
+	}
+	return pending
+}
+
+// Matches returns the indices of the registered channels, in the order they were registered,
+// whose predicates hold for the given message. The message isn't published to them.
+// Predicates that panic are considered not to hold
+func (m *ChannelDeMultiplexer) Matches(msg interface{}) []int {
+	m.lock.RLock()
+	channels := m.channels
+	m.lock.RUnlock()
+
+	var matches []int
+	for i, ch := range channels {
+		if ch.holds(msg) {
+			matches = append(matches, i)
+		}
+	}
+	return matches
+}
+
+// holds returns whether the predicate of the channel holds for the
+// given message, and false if the predicate panics
+func (ch *channel) holds(msg interface{}) (holds bool) {
+	defer func() {
+		if recover() != nil {
+			holds = false
+		}
+	}()
+	return ch.pred(msg)
+}
+
 // DeMultiplex broadcasts the message to all channels that were returned
 // by AddChannel calls and that hold the respected predicates.
+// Channels that are full are waited for, unless messages to them are dropped
 func (m *ChannelDeMultiplexer) DeMultiplex(msg interface{}) {
+	m.deMultiplex(msg)
+}
+
+// deMultiplex broadcasts the message like DeMultiplex does, and returns whether it was
+// handed to all channels whose predicates hold for it, rather than dropped by any of them
+func (m *ChannelDeMultiplexer) deMultiplex(msg interface{}) (delivered bool) {
 	defer func() {
-		recover()
+		if recover() != nil {
+			delivered = false
+		}
 	}() // recover from sending on a closed channel
 
 	if m.isClosed() {
-		return
+		return false
 	}
 
 	m.lock.RLock()
 	channels := m.channels
 	m.lock.RUnlock()
 
+	delivered = true
 	for _, ch := range channels {
-		if ch.pred(msg) {
+		if !ch.pred(msg) {
+			continue
+		}
+		if !m.dropWhenFull {
 			ch.ch <- msg
+			continue
+		}
+		select {
+		case ch.ch <- msg:
+		default:
+			atomic.AddUint64(&m.dropped, 1)
+			delivered = false
 		}
 	}
+	return delivered
 }
@@ -16,10 +16,73 @@ limitations under the License.
 
 package comm
 
-import "testing"
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestChannelDeMultiplexer_Close(t *testing.T) {
 	demux := NewChannelDemultiplexer()
 	demux.Close()
 	demux.DeMultiplex("msg")
+	assert.False(t, demux.deMultiplex("msg"))
+}
+
+func TestChannelDeMultiplexer_Count(t *testing.T) {
+	demux := NewChannelDemultiplexer()
+	assert.Equal(t, 0, demux.Count())
+	assert.Empty(t, demux.Pending())
+
+	evens := demux.AddChannel(func(o interface{}) bool {
+		return o.(int)%2 == 0
+	})
+	demux.AddChannel(func(o interface{}) bool {
+		return true
+	})
+	assert.Equal(t, 2, demux.Count())
+
+	for i := 0; i < 4; i++ {
+		demux.DeMultiplex(i)
+	}
+	assert.Equal(t, []int{2, 4}, demux.Pending())
+	<-evens
+	assert.Equal(t, []int{1, 4}, demux.Pending())
+}
+
+func TestChannelDeMultiplexer_Matches(t *testing.T) {
+	demux := NewChannelDemultiplexer()
+	assert.Empty(t, demux.Matches(1))
+
+	demux.AddChannel(func(o interface{}) bool {
+		return o.(int)%2 == 0
+	})
+	demux.AddChannel(func(o interface{}) bool {
+		return true
+	})
+	demux.AddChannel(func(o interface{}) bool {
+		return o.(string) != ""
+	})
+	assert.Equal(t, []int{0, 1}, demux.Matches(2))
+	assert.Equal(t, []int{1}, demux.Matches(3))
+	// Matching doesn't publish the message
+	assert.Equal(t, []int{0, 0, 0}, demux.Pending())
+}
+
+func TestChannelDeMultiplexer_DropWhenFull(t *testing.T) {
+	assert.Equal(t, defDemuxBuffSize, NewChannelDemultiplexerWithBuffer(0, true).BufferSize())
+
+	demux := NewChannelDemultiplexerWithBuffer(2, true)
+	assert.Equal(t, 2, demux.BufferSize())
+	stuck := demux.AddChannel(func(o interface{}) bool {
+		return true
+	})
+	// Only messages that weren't dropped are reported as delivered
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, i < 2, demux.deMultiplex(i))
+	}
+	assert.Equal(t, []int{2}, demux.Pending())
+	assert.Equal(t, uint64(3), demux.Dropped())
+	assert.Equal(t, 0, <-stuck)
+	assert.Equal(t, 1, <-stuck)
 }
@@ -0,0 +1,110 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/util"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const gossipServiceName = "gossip.Gossip"
+
+// healthServer reports the serving status of the gossip service
+// according to the standard gRPC health checking protocol
+type healthServer struct {
+	c *commImpl
+}
+
+// Check returns SERVING if the instance is serving and isn't stopping,
+// and NOT_SERVING otherwise. An empty service name refers to the whole server
+func (h *healthServer) Check(ctx context.Context, req *healthpb.HealthCheckRequest) (*healthpb.HealthCheckResponse, error) {
+	if req.Service != "" && req.Service != gossipServiceName {
+		return nil, grpc.Errorf(codes.NotFound, "unknown service")
+	}
+	status := healthpb.HealthCheckResponse_NOT_SERVING
+	if !h.c.isStopping() && h.c.Serving() {
+		status = healthpb.HealthCheckResponse_SERVING
+	}
+	return &healthpb.HealthCheckResponse{Status: status}, nil
+}
+
+// startHealthSweep periodically pings all peers this instance has connected to,
+// and disconnects peers that don't respond. The pings of each sweep are spread
+// randomly across the interval to avoid pinging all peers at once
+func (c *commImpl) startHealthSweep(interval time.Duration) {
+	c.stopWG.Add(1)
+	go func() {
+		defer c.stopWG.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.sweepHealth(interval)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+func (c *commImpl) sweepHealth(interval time.Duration) {
+	if c.isStopping() {
+		return
+	}
+	for _, conn := range c.connStore.connections() {
+		// Only connections this instance has created have a client to ping with
+		if conn.cl == nil {
+			continue
+		}
+		c.stopWG.Add(1)
+		go func(conn *connection, jitter time.Duration) {
+			defer c.stopWG.Done()
+			select {
+			case <-time.After(jitter):
+			case <-c.done:
+				return
+			}
+			c.checkHealth(conn)
+		}(conn, time.Duration(rand.Int63n(int64(interval))))
+	}
+}
+
+func (c *commImpl) checkHealth(conn *connection) {
+	if conn.toDie() {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), util.GetDurationOrDefault("peer.gossip.connTimeout", defConnTimeout))
+	defer cancel()
+	_, err := conn.cl.Ping(ctx, &proto.Empty{})
+	if err == nil {
+		return
+	}
+	// Make sure the connection wasn't replaced in the meantime
+	if current, exists := c.connStore.existingConnection(conn.pkiID); !exists || current != conn {
+		return
+	}
+	c.logger.Warning(conn.pkiID, "didn't respond to a health check:", err, ", disconnecting")
+	c.disconnect(conn.pkiID, HealthCheckFailure)
+}
@@ -0,0 +1,81 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthCheck(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(11101, naiveSec)
+	inst := comm1.(*commImpl)
+	<-inst.Ready()
+	h := &healthServer{c: inst}
+
+	check := func(service string) healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: service})
+		assert.NoError(t, err)
+		return resp.Status
+	}
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check(""))
+	assert.Equal(t, healthpb.HealthCheckResponse_SERVING, check(gossipServiceName))
+	_, err := h.Check(context.Background(), &healthpb.HealthCheckRequest{Service: "foo"})
+	assert.Error(t, err)
+
+	comm1.Stop()
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(""))
+	assert.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, check(gossipServiceName))
+}
+
+func TestHealthSweep(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	inst1 := comm1.(*commImpl)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer2)
+	<-m2
+
+	// comm2 is alive, so it should pass the health check
+	conn, _ := inst1.connStore.existingConnection(peer2.PKIID)
+	inst1.checkHealth(conn)
+	select {
+	case <-comm1.PresumedDead():
+		assert.Fail(t, "No peer should have been presumed dead")
+	default:
+	}
+	assert.Equal(t, 1, inst1.connStore.connNum())
+
+	comm2.Stop()
+	inst1.sweepHealth(time.Millisecond * 10)
+	select {
+	case pkiID := <-comm1.PresumedDead():
+		assert.Equal(t, peer2.PKIID, pkiID)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Stopped peer should have been presumed dead")
+	}
+	assert.Equal(t, 0, inst1.connStore.connNum())
+	assert.Equal(t, uint64(1), inst1.ClosedConnections()[HealthCheckFailure])
+}
@@ -0,0 +1,70 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/util"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+)
+
+// sendHeartbeats sends a heartbeat to all connected peers, and disconnects
+// peers that nothing was received from within the given alive timeout.
+// Only peers that were seen sending heartbeats are disconnected, as peers
+// that don't send them might just have nothing to send.
+// A non-positive alive timeout means peers are never disconnected
+func (c *commImpl) sendHeartbeats(aliveTimeout time.Duration) {
+	if c.isStopping() {
+		return
+	}
+	heartbeat := createHeartbeatMsg()
+	for _, conn := range c.connStore.connections() {
+		// While paused, nothing is read from remote peers, so they can't be told apart from dead ones
+		if aliveTimeout > 0 && conn.sendsHeartbeats() && !c.IsPaused() && time.Since(conn.lastReceived()) > aliveTimeout {
+			c.logger.Warning("Nothing was received from", conn.pkiID, "in", aliveTimeout, ", disconnecting")
+			c.disconnect(conn.pkiID, HeartbeatTimeout)
+			continue
+		}
+		pkiID := conn.pkiID
+		conn.send(heartbeat, func(err error) {
+			c.logger.Debug("Failed sending heartbeat to", pkiID, ":", err)
+		}, NormalPriority)
+	}
+}
+
+func (c *commImpl) periodicallySendHeartbeats(interval time.Duration, aliveTimeout time.Duration) {
+	defer c.stopWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.sendHeartbeats(aliveTimeout)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+func createHeartbeatMsg() *proto.SignedGossipMessage {
+	return (&proto.GossipMessage{
+		Tag:     proto.GossipMessage_EMPTY,
+		Nonce:   util.RandomUInt64(),
+		Content: &proto.GossipMessage_Empty{Empty: &proto.Empty{}},
+	}).NoopSign()
+}
@@ -0,0 +1,84 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHeartbeats(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst1 := comm1.(*commImpl)
+
+	heartbeats := comm2.Accept(func(o interface{}) bool {
+		return o.(proto.ReceivedMessage).GetGossipMessage().GetEmpty() != nil
+	})
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer2)
+	<-m2
+
+	// The connection is alive, so a heartbeat should be sent
+	inst1.sendHeartbeats(time.Minute)
+	select {
+	case <-heartbeats:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a heartbeat")
+	}
+
+	// Make the connection look as if nothing was received from it for a while
+	conn, _ := inst1.connStore.existingConnection(peer2.PKIID)
+	silence := func() {
+		atomic.StoreInt64(&conn.lastRecv, int64(time.Since(conn.created)-time.Minute))
+	}
+	silence()
+
+	// comm2 never sent a heartbeat, so it might just have nothing to send
+	inst1.sendHeartbeats(time.Second)
+	assert.Equal(t, 1, inst1.connStore.connNum())
+
+	// Once comm2 sends heartbeats, it's expected to keep sending them
+	comm2.(*commImpl).sendHeartbeats(0)
+	waitFor(t, conn.sendsHeartbeats, "comm1 didn't receive a heartbeat")
+	silence()
+	inst1.sendHeartbeats(time.Second)
+	select {
+	case pkiID := <-comm1.PresumedDead():
+		assert.Equal(t, peer2.PKIID, pkiID)
+	default:
+		assert.Fail(t, "Silent peer should have been presumed dead")
+	}
+	assert.Equal(t, 0, inst1.connStore.connNum())
+	assert.Equal(t, uint64(1), inst1.ClosedConnections()[HeartbeatTimeout])
+}
+
+func TestHeartbeatMsg(t *testing.T) {
+	t.Parallel()
+	m1, m2 := createHeartbeatMsg(), createHeartbeatMsg()
+	assert.NotNil(t, m1.GetEmpty())
+	assert.Equal(t, proto.GossipMessage_EMPTY, m1.Tag)
+	assert.Empty(t, m1.Channel, "Heartbeats must not be mistaken for acknowledgements")
+	assert.NotEqual(t, m1.Envelope.Payload, m2.Envelope.Payload)
+}
@@ -0,0 +1,53 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import "time"
+
+// startIdleEviction periodically closes connections that no message other than
+// heartbeats and acknowledgements was sent or received over within the idle timeout.
+// Evicted connections are established again once a message is sent to their peers
+func (c *commImpl) startIdleEviction(idleTimeout time.Duration) {
+	c.stopWG.Add(1)
+	go func() {
+		defer c.stopWG.Done()
+		ticker := time.NewTicker(idleTimeout / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.evictIdle(idleTimeout)
+			case <-c.done:
+				return
+			}
+		}
+	}()
+}
+
+// evictIdle closes the connections that have been idle for longer than the idle timeout
+func (c *commImpl) evictIdle(idleTimeout time.Duration) {
+	if c.isStopping() {
+		return
+	}
+	for _, conn := range c.connStore.connections() {
+		if time.Since(conn.lastActiveTime()) <= idleTimeout {
+			continue
+		}
+		c.logger.Debug("Connection to", conn.pkiID, "was idle for", idleTimeout, ", closing it")
+		c.connStore.removeConn(conn, IdleEvict)
+	}
+}
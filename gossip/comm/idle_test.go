@@ -0,0 +1,72 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdleEviction(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst1 := comm1.(*commImpl)
+
+	reasons := make(chan CloseReason, 10)
+	inst1.SetConnectionStateCallback(func(pkiID common.PKIidType, state ConnectionState, reason CloseReason) {
+		if state == ConnectionClosed {
+			reasons <- reason
+		}
+	})
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer2)
+	<-m2
+	conn, exists := inst1.connStore.existingConnection(peer2.PKIID)
+	assert.True(t, exists)
+
+	// A connection that was recently used isn't evicted
+	inst1.evictIdle(time.Minute)
+	_, exists = inst1.connStore.existingConnection(peer2.PKIID)
+	assert.True(t, exists)
+
+	// Heartbeats don't make a connection active
+	atomic.StoreInt64(&conn.lastActive, int64(time.Since(conn.created)-time.Hour))
+	inst1.sendHeartbeats(0)
+	inst1.evictIdle(time.Minute)
+	_, exists = inst1.connStore.existingConnection(peer2.PKIID)
+	assert.False(t, exists)
+	select {
+	case reason := <-reasons:
+		assert.Equal(t, IdleEvict, reason)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Evicting an idle connection wasn't reported")
+	}
+	assert.Equal(t, uint64(1), inst1.ClosedConnections()[IdleEvict])
+	assert.Equal(t, "IdleEvict", IdleEvict.String())
+
+	// Sending to the peer again establishes a new connection
+	comm1.Send(createGossipMsg(), peer2)
+	<-m2
+}
@@ -0,0 +1,27 @@
+// +build !linux,!darwin
+
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import "net"
+
+// listenWithBacklog creates a TCP listener on the given address.
+// Setting the backlog isn't supported on this platform, so the OS default is used
+func listenWithBacklog(address string, backlog int) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
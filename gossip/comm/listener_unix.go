@@ -0,0 +1,92 @@
+// +build linux darwin
+
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// listenWithBacklog creates a TCP listener on the given address
+// with the given size of the queue of pending connections
+func listenWithBacklog(address string, backlog int) (net.Listener, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	family := syscall.AF_INET6
+	if ip4 := addr.IP.To4(); ip4 != nil && !addr.IP.IsUnspecified() {
+		family = syscall.AF_INET
+	}
+
+	fd, err := syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	if err != nil && family == syscall.AF_INET6 && len(addr.IP) == 0 {
+		// IPv6 isn't available, fall back to listening on all IPv4 addresses
+		family = syscall.AF_INET
+		fd, err = syscall.Socket(family, syscall.SOCK_STREAM, 0)
+	}
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	syscall.CloseOnExec(fd)
+
+	if err := bindAndListen(fd, family, addr, backlog); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+
+	f := os.NewFile(uintptr(fd), "gossip-listener")
+	defer f.Close()
+	return net.FileListener(f)
+}
+
+func bindAndListen(fd int, family int, addr *net.TCPAddr, backlog int) error {
+	if err := syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_REUSEADDR, 1); err != nil {
+		return os.NewSyscallError("setsockopt", err)
+	}
+
+	var sa syscall.Sockaddr
+	if family == syscall.AF_INET {
+		sa4 := &syscall.SockaddrInet4{Port: addr.Port}
+		if ip4 := addr.IP.To4(); ip4 != nil {
+			copy(sa4.Addr[:], ip4)
+		}
+		sa = sa4
+	} else {
+		if len(addr.IP) == 0 || addr.IP.IsUnspecified() {
+			// Accept IPv4 connections as well, like net.Listen does
+			if err := syscall.SetsockoptInt(fd, syscall.IPPROTO_IPV6, syscall.IPV6_V6ONLY, 0); err != nil {
+				return os.NewSyscallError("setsockopt", err)
+			}
+		}
+		sa6 := &syscall.SockaddrInet6{Port: addr.Port}
+		copy(sa6.Addr[:], addr.IP.To16())
+		sa = sa6
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		return os.NewSyscallError("bind", err)
+	}
+	if err := syscall.Listen(fd, backlog); err != nil {
+		return os.NewSyscallError("listen", err)
+	}
+	return nil
+}
@@ -0,0 +1,302 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+)
+
+var defLatencyBuckets = []time.Duration{
+	time.Millisecond * 10,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 250,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 2,
+	time.Second * 5,
+}
+
+// defQueueWaitBuckets are finer than defLatencyBuckets,
+// as messages usually wait in send buffers briefly
+var defQueueWaitBuckets = []time.Duration{
+	time.Millisecond,
+	time.Millisecond * 5,
+	time.Millisecond * 10,
+	time.Millisecond * 50,
+	time.Millisecond * 100,
+	time.Millisecond * 500,
+	time.Second,
+	time.Second * 5,
+}
+
+// LatencyHistogram is a snapshot of a histogram of durations
+type LatencyHistogram struct {
+	// Buckets are the upper bounds of the buckets
+	Buckets []time.Duration
+	// Counts holds the number of observations per bucket.
+	// It has an extra last element for observations greater than all bounds
+	Counts []uint64
+	// Count is the total number of observations
+	Count uint64
+	// Sum is the sum of all observations
+	Sum time.Duration
+}
+
+type latencyHistogram struct {
+	sync.Mutex
+	buckets []time.Duration
+	counts  []uint64
+	count   uint64
+	sum     time.Duration
+}
+
+func newLatencyHistogram(buckets []time.Duration) *latencyHistogram {
+	return &latencyHistogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.buckets) && d > h.buckets[i] {
+		i++
+	}
+	h.Lock()
+	defer h.Unlock()
+	h.counts[i]++
+	h.count++
+	h.sum += d
+}
+
+func (h *latencyHistogram) snapshot() LatencyHistogram {
+	h.Lock()
+	defer h.Unlock()
+	counts := make([]uint64, len(h.counts))
+	copy(counts, h.counts)
+	return LatencyHistogram{
+		Buckets: h.buckets,
+		Counts:  counts,
+		Count:   h.count,
+		Sum:     h.sum,
+	}
+}
+
+// ConnectionStats holds the number of bytes transferred over connections
+type ConnectionStats struct {
+	// BytesSent is the number of bytes sent to remote peers
+	BytesSent uint64
+	// BytesReceived is the number of bytes received from remote peers
+	BytesReceived uint64
+	// Tags are the tags of the connection, if the stats are of a single connection
+	Tags map[string]string
+	// Age is the time since the connection was established, if the stats are of a single connection
+	Age time.Duration
+	// Idle is the time since a message was last received, if the stats are of a single connection
+	Idle time.Duration
+	// Direction is which side initiated the connection, if the stats are of a single connection
+	Direction ConnectionDirection
+	// ProtocolVersion is the version of the gossip protocol negotiated
+	// with the remote peer, if the stats are of a single connection
+	ProtocolVersion uint32
+}
+
+type byteCounters struct {
+	sent     uint64
+	received uint64
+}
+
+func (bc *byteCounters) addSent(n int) {
+	atomic.AddUint64(&bc.sent, uint64(n))
+}
+
+func (bc *byteCounters) addReceived(n int) {
+	atomic.AddUint64(&bc.received, uint64(n))
+}
+
+func (bc *byteCounters) snapshot() ConnectionStats {
+	return ConnectionStats{
+		BytesSent:     atomic.LoadUint64(&bc.sent),
+		BytesReceived: atomic.LoadUint64(&bc.received),
+	}
+}
+
+// envelopeSize returns the size of the marshaled contents of the envelope,
+// without marshaling it again
+func envelopeSize(envelope *proto.Envelope) int {
+	if envelope == nil {
+		return 0
+	}
+	size := len(envelope.Payload) + len(envelope.Signature)
+	if secret := envelope.SecretEnvelope; secret != nil {
+		size += len(secret.Payload) + len(secret.Signature)
+	}
+	return size
+}
+
+// DuplicatesDropped returns the number of received messages that were
+// dropped because they were recently received
+func (c *commImpl) DuplicatesDropped() uint64 {
+	return c.dedup.duplicateCount()
+}
+
+// DroppedPublications returns the number of received messages that weren't
+// published to subscriptions because their channels were full
+func (c *commImpl) DroppedPublications() uint64 {
+	return c.msgPublisher.Dropped()
+}
+
+// ExpiredMessages returns the number of messages that were dropped
+// because their deadline passed before they were sent
+func (c *commImpl) ExpiredMessages() uint64 {
+	return c.connStore.expiredCount()
+}
+
+// UndeliveredMessages returns the number of messages that were
+// dropped because writing to the stream of their connection failed
+func (c *commImpl) UndeliveredMessages() uint64 {
+	return c.connStore.undeliveredCount()
+}
+
+// SendPanics returns the number of sends that panicked and were recovered from
+func (c *commImpl) SendPanics() uint64 {
+	return atomic.LoadUint64(&c.sendPanics)
+}
+
+// HandshakeTimeouts returns the number of authentication handshakes
+// in which the remote peer didn't send its connection message in time
+func (c *commImpl) HandshakeTimeouts() uint64 {
+	return atomic.LoadUint64(&c.handshakeTimeouts)
+}
+
+// HandshakeFailures returns the number of authentication handshakes
+// that failed for reasons other than timing out
+func (c *commImpl) HandshakeFailures() uint64 {
+	return atomic.LoadUint64(&c.handshakeFailures)
+}
+
+// DroppedSends returns the number of messages that were dropped
+// because too many sends were in progress
+func (c *commImpl) DroppedSends() uint64 {
+	return atomic.LoadUint64(&c.droppedSends)
+}
+
+// GetConnectionStats returns the number of bytes transferred over the connection
+// to the given peer, its age, direction and protocol version, and whether there is a connection to it
+func (c *commImpl) GetConnectionStats(pkiID common.PKIidType) (ConnectionStats, bool) {
+	conn, exists := c.connStore.existingConnection(pkiID)
+	if !exists {
+		return ConnectionStats{}, false
+	}
+	stats := conn.bytes.snapshot()
+	stats.Tags = conn.getTags()
+	stats.Age = time.Since(conn.created)
+	stats.Idle = time.Since(conn.lastReceived())
+	stats.Direction = conn.direction
+	if conn.info != nil {
+		stats.ProtocolVersion = conn.info.ProtocolVersion
+	}
+	return stats, true
+}
+
+// ConnectionStatsByTag returns the number of bytes transferred over the current
+// connections that have the given tag, summed up per value of the tag
+func (c *commImpl) ConnectionStatsByTag(key string) map[string]ConnectionStats {
+	statsByValue := make(map[string]ConnectionStats)
+	for _, conn := range c.connStore.connections() {
+		value, exists := conn.getTags()[key]
+		if !exists {
+			continue
+		}
+		connStats := conn.bytes.snapshot()
+		stats := statsByValue[value]
+		stats.BytesSent += connStats.BytesSent
+		stats.BytesReceived += connStats.BytesReceived
+		statsByValue[value] = stats
+	}
+	return statsByValue
+}
+
+// TotalConnectionStats returns the number of bytes transferred over
+// all connections, including connections that were already closed
+func (c *commImpl) TotalConnectionStats() ConnectionStats {
+	return c.connStore.totalStats()
+}
+
+// ConnectionUtilization returns the number of connections relative to
+// peer.gossip.maxConnections, or 0 if it isn't configured
+func (c *commImpl) ConnectionUtilization() float64 {
+	return c.connStore.Utilization()
+}
+
+// CapacityWarnings returns the number of times the connection
+// utilization reached a high-water mark
+func (c *commImpl) CapacityWarnings() uint64 {
+	return c.connStore.capacityWarningCount()
+}
+
+// ClosedConnections returns the number of connections that were closed,
+// broken down by the reason of the close
+func (c *commImpl) ClosedConnections() map[CloseReason]uint64 {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	closedConns := make(map[CloseReason]uint64, len(c.closedConns))
+	for reason, count := range c.closedConns {
+		closedConns[reason] = count
+	}
+	return closedConns
+}
+
+// ConnectionLatency returns a histogram of the time it took to establish and
+// authenticate connections in the given direction
+func (c *commImpl) ConnectionLatency(direction ConnectionDirection) LatencyHistogram {
+	return c.connLatency[direction].snapshot()
+}
+
+// SendQueueWait returns a histogram of the time messages waited in the send
+// buffers of connections until they were written to the stream. Long waits
+// indicate that either the remote peers or this peer are bottlenecks
+func (c *commImpl) SendQueueWait() LatencyHistogram {
+	return c.connStore.sendQueueWait()
+}
+
+// DroppedEvents returns the number of events that were dropped
+// because the events channel was full
+func (c *commImpl) DroppedEvents() uint64 {
+	return atomic.LoadUint64(&c.droppedEvents)
+}
+
+// IdentityChanges returns the number of handshakes in which a remote peer presented
+// an identity different from the one previously associated with its PKI-ID
+func (c *commImpl) IdentityChanges() uint64 {
+	return atomic.LoadUint64(&c.identityChanges)
+}
+
+// TransportStats returns statistics of the gRPC streams and RPCs of the instance,
+// which are only recorded if peer.gossip.grpcStats is set and no stats handler was set
+func (c *commImpl) TransportStats() TransportStats {
+	if c.stats == nil {
+		return TransportStats{}
+	}
+	return c.stats.recorder.snapshot()
+}
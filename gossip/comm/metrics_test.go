@@ -0,0 +1,174 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyHistogram(t *testing.T) {
+	t.Parallel()
+	h := newLatencyHistogram([]time.Duration{time.Millisecond, time.Second})
+	h.observe(time.Microsecond)
+	h.observe(time.Millisecond)
+	h.observe(time.Millisecond * 2)
+	h.observe(time.Minute)
+
+	snapshot := h.snapshot()
+	assert.Equal(t, []uint64{2, 1, 1}, snapshot.Counts)
+	assert.Equal(t, uint64(4), snapshot.Count)
+	assert.Equal(t, time.Minute+time.Millisecond*3+time.Microsecond, snapshot.Sum)
+
+	// Snapshots aren't affected by later observations
+	h.observe(time.Minute)
+	assert.Equal(t, []uint64{2, 1, 1}, snapshot.Counts)
+}
+
+func TestConnectionLatency(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newCommInstance(10681, naiveSec)
+	comm2, _ := newCommInstance(10682, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), remotePeer(10682))
+	<-m2
+
+	assert.Equal(t, uint64(1), comm1.(*commImpl).ConnectionLatency(Outbound).Count)
+	assert.Equal(t, uint64(0), comm1.(*commImpl).ConnectionLatency(Inbound).Count)
+	assert.Equal(t, uint64(1), comm2.(*commImpl).ConnectionLatency(Inbound).Count)
+	assert.Equal(t, uint64(0), comm2.(*commImpl).ConnectionLatency(Outbound).Count)
+}
+
+func TestCloseReasons(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	type stateChange struct {
+		state  ConnectionState
+		reason CloseReason
+	}
+	listen := func(c Comm) chan stateChange {
+		changes := make(chan stateChange, 10)
+		c.(*commImpl).SetConnectionStateCallback(func(pkiID common.PKIidType, state ConnectionState, reason CloseReason) {
+			changes <- stateChange{state: state, reason: reason}
+		})
+		return changes
+	}
+	waitForChange := func(changes chan stateChange) stateChange {
+		select {
+		case change := <-changes:
+			return change
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "Didn't get a connection state change in a timely manner")
+			return stateChange{}
+		}
+	}
+	changes1 := listen(comm1)
+	changes2 := listen(comm2)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer2)
+	<-m2
+	assert.Equal(t, stateChange{state: ConnectionEstablished}, waitForChange(changes1))
+	assert.Equal(t, stateChange{state: ConnectionEstablished}, waitForChange(changes2))
+
+	// comm1 closes the connection, so comm2 should see the remote side closing it
+	comm1.CloseConn(peer2)
+	assert.Equal(t, stateChange{state: ConnectionClosed, reason: LocalStop}, waitForChange(changes1))
+	assert.Equal(t, stateChange{state: ConnectionClosed, reason: RemoteEOF}, waitForChange(changes2))
+	assert.Equal(t, map[CloseReason]uint64{LocalStop: 1}, comm1.(*commImpl).ClosedConnections())
+	assert.Equal(t, map[CloseReason]uint64{RemoteEOF: 1}, comm2.(*commImpl).ClosedConnections())
+	assert.Equal(t, "RemoteEOF", RemoteEOF.String())
+}
+
+func TestConnectionStats(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	_, exists := comm1.(*commImpl).GetConnectionStats(comm2.GetPKIid())
+	assert.False(t, exists)
+
+	m2 := comm2.Accept(acceptAll)
+	msg := createGossipMsg()
+	comm1.Send(msg, peer2)
+	<-m2
+
+	size := uint64(envelopeSize(msg.Envelope))
+	stats1, exists := comm1.(*commImpl).GetConnectionStats(comm2.GetPKIid())
+	assert.True(t, exists)
+	assert.Equal(t, size, stats1.BytesSent)
+	stats2, exists := comm2.(*commImpl).GetConnectionStats(comm1.GetPKIid())
+	assert.True(t, exists)
+	assert.Equal(t, size, stats2.BytesReceived)
+	assert.True(t, stats2.Age > 0)
+	assert.True(t, stats2.Idle <= stats2.Age)
+	assert.Equal(t, Outbound, stats1.Direction)
+	assert.Equal(t, Inbound, stats2.Direction)
+	assert.Equal(t, ProtocolVersion, stats1.ProtocolVersion)
+	assert.Equal(t, ProtocolVersion, stats2.ProtocolVersion)
+	assert.Equal(t, []ConnectedPeer{{PKIID: comm2.GetPKIid(), Direction: Outbound}}, comm1.(*commImpl).ConnectedPeers())
+	assert.Equal(t, []ConnectedPeer{{PKIID: comm1.GetPKIid(), Direction: Inbound}}, comm2.(*commImpl).ConnectedPeers())
+
+	// Tags are attached to the connection, and stats are aggregated by them
+	comm1.(*commImpl).TagConnection(comm2.GetPKIid(), map[string]string{"role": "seed", "org": "org1"})
+	comm1.(*commImpl).TagConnection(comm2.GetPKIid(), map[string]string{"role": "leader"})
+	stats1, _ = comm1.(*commImpl).GetConnectionStats(comm2.GetPKIid())
+	assert.Equal(t, map[string]string{"role": "leader", "org": "org1"}, stats1.Tags)
+	assert.True(t, stats1.Age > 0)
+	assert.Equal(t, map[string]ConnectionStats{"org1": {BytesSent: size}}, comm1.(*commImpl).ConnectionStatsByTag("org"))
+	assert.Empty(t, comm1.(*commImpl).ConnectionStatsByTag("region"))
+
+	// Totals include connections that were closed
+	comm1.CloseConn(peer2)
+	assert.Equal(t, ConnectionStats{BytesSent: size}, comm1.(*commImpl).TotalConnectionStats())
+}
+
+func TestSendQueueWait(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	assert.Equal(t, uint64(0), comm1.(*commImpl).SendQueueWait().Count)
+	m2 := comm2.Accept(acceptAll)
+	for i := 0; i < 3; i++ {
+		comm1.Send(createGossipMsg(), peer2)
+	}
+	for i := 0; i < 3; i++ {
+		<-m2
+	}
+
+	if !waitFor(t, func() bool { return comm1.(*commImpl).SendQueueWait().Count >= 3 }, "Time messages waited in the send buffer wasn't recorded") {
+		return
+	}
+	queueWait := comm1.(*commImpl).SendQueueWait()
+	assert.Equal(t, defQueueWaitBuckets, queueWait.Buckets)
+	assert.True(t, queueWait.Sum > 0)
+}
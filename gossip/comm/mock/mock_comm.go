@@ -17,11 +17,15 @@ limitations under the License.
 package mock
 
 import (
+	"bytes"
+	"time"
+
 	"github.com/hyperledger/fabric/gossip/api"
 	"github.com/hyperledger/fabric/gossip/comm"
 	"github.com/hyperledger/fabric/gossip/common"
 	"github.com/hyperledger/fabric/gossip/util"
 	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
 )
 
 // Mock which aims to simulate socket
@@ -141,6 +145,23 @@ func (mock *commMock) GetPKIid() common.PKIidType {
 	return common.PKIidType(mock.id)
 }
 
+// SelfIdentity returns a copy of this instance's identity
+func (mock *commMock) SelfIdentity() api.PeerIdentityType {
+	return api.PeerIdentityType(mock.id)
+}
+
+// SendWithCallback sends a message to remote peers, and invokes the
+// given callback once per peer with the fate of the message
+func (mock *commMock) SendWithCallback(msg *proto.SignedGossipMessage, cb comm.SendCallback, peers ...*comm.RemotePeer) {
+	mock.Send(msg, peers...)
+	if cb == nil {
+		return
+	}
+	for _, peer := range peers {
+		go cb(peer, nil)
+	}
+}
+
 // Send sends a message to remote peers
 func (mock *commMock) Send(msg *proto.SignedGossipMessage, peers ...*comm.RemotePeer) {
 	for _, peer := range peers {
@@ -153,6 +174,116 @@ func (mock *commMock) Send(msg *proto.SignedGossipMessage, peers ...*comm.Remote
 	}
 }
 
+// SendWithPriority sends a message to remote peers with the given priority
+func (mock *commMock) SendWithPriority(msg *proto.SignedGossipMessage, priority comm.Priority, peers ...*comm.RemotePeer) {
+	mock.Send(msg, peers...)
+}
+
+// SendWithDeadline sends a message to remote peers
+func (mock *commMock) SendWithDeadline(msg *proto.SignedGossipMessage, deadline time.Time, peers ...*comm.RemotePeer) {
+	mock.Send(msg, peers...)
+}
+
+// SendToSubset sends a message to the first k candidates
+func (mock *commMock) SendToSubset(msg *proto.SignedGossipMessage, k int, candidates []*comm.RemotePeer) {
+	if k < len(candidates) {
+		candidates = candidates[:k]
+	}
+	mock.Send(msg, candidates...)
+}
+
+// SendWithAck sends a message to a remote peer
+func (mock *commMock) SendWithAck(ctx context.Context, msg *proto.SignedGossipMessage, peer *comm.RemotePeer) error {
+	mock.Send(msg, peer)
+	return nil
+}
+
+// SendWithContext sends a message to remote peers
+func (mock *commMock) SendWithContext(ctx context.Context, msg *proto.SignedGossipMessage, peers ...*comm.RemotePeer) {
+	mock.Send(msg, peers...)
+}
+
+// SendRaw sends an already signed and serialized envelope to remote peers
+func (mock *commMock) SendRaw(env *proto.Envelope, peers ...*comm.RemotePeer) {
+	msg, err := env.ToGossipMessage()
+	if err != nil {
+		logger.Warning("Failed converting envelope to a message:", err)
+		return
+	}
+	mock.Send(msg, peers...)
+}
+
+// Forward sends a received message to remote peers, skipping the peer it was received from
+func (mock *commMock) Forward(received proto.ReceivedMessage, peers ...*comm.RemotePeer) {
+	var forwardTo []*comm.RemotePeer
+	for _, peer := range peers {
+		if info := received.GetConnectionInfo(); info != nil && bytes.Equal(info.ID, peer.PKIID) {
+			continue
+		}
+		forwardTo = append(forwardTo, peer)
+	}
+	mock.Send(received.GetGossipMessage(), forwardTo...)
+}
+
+// SendByPKIID sends a message to remote peers over the connections that already
+// exist to them. Peers that there is no connection to are skipped
+func (mock *commMock) SendByPKIID(msg *proto.SignedGossipMessage, pkiIDs ...common.PKIidType) {
+	for _, pkiID := range pkiIDs {
+		// The PKI-ID of a mocked peer is its id
+		if _, exists := mock.members[string(pkiID)]; !exists {
+			continue
+		}
+		mock.Send(msg, &comm.RemotePeer{Endpoint: string(pkiID), PKIID: pkiID})
+	}
+}
+
+// SendSync sends a message to a remote peer, bypassing the send buffer,
+// and returns once the message was written to the stream or the context expired
+func (mock *commMock) SendSync(ctx context.Context, msg *proto.SignedGossipMessage, peer *comm.RemotePeer) error {
+	mock.Send(msg, peer)
+	return nil
+}
+
+// WaitForConnection blocks until a connection to the given remote peer
+// is established, or until the context expires
+func (mock *commMock) WaitForConnection(ctx context.Context, peer *comm.RemotePeer) error {
+	return nil
+}
+
+// Flush blocks until the messages buffered for sending to the given
+// remote peer were written to its stream, or the context expired
+func (mock *commMock) Flush(ctx context.Context, peer *comm.RemotePeer) error {
+	return nil
+}
+
+// Connect starts establishing a connection to the given remote peer,
+// and returns a handle of the connection
+func (mock *commMock) Connect(peer *comm.RemotePeer) (comm.ConnHandle, error) {
+	ready := make(chan struct{})
+	close(ready)
+	return &connHandleMock{ready: ready, info: &proto.ConnectionInfo{ID: peer.PKIID}}, nil
+}
+
+type connHandleMock struct {
+	ready chan struct{}
+	info  *proto.ConnectionInfo
+}
+
+func (h *connHandleMock) Ready() <-chan struct{} {
+	return h.ready
+}
+
+func (h *connHandleMock) Err() error {
+	return nil
+}
+
+func (h *connHandleMock) ConnectionInfo() *proto.ConnectionInfo {
+	return h.info
+}
+
+func (h *connHandleMock) Close() {
+}
+
 // Probe probes a remote node and returns nil if its responsive,
 // and an error if it's not.
 func (mock *commMock) Probe(peer *comm.RemotePeer) error {
@@ -165,6 +296,19 @@ func (mock *commMock) Handshake(peer *comm.RemotePeer) (api.PeerIdentityType, er
 	return nil, nil
 }
 
+// HandshakeCached behaves like Handshake, but if the PKI-ID of the peer
+// listening on the remote endpoint is already known, the identity
+// is returned without performing a handshake
+func (mock *commMock) HandshakeCached(peer *comm.RemotePeer) (api.PeerIdentityType, error) {
+	return mock.Handshake(peer)
+}
+
+// ResolvePKIID returns the PKI-ID of the peer that was recently found
+// to be listening on the given endpoint, and whether it was found
+func (mock *commMock) ResolvePKIID(endpoint string) (common.PKIidType, bool) {
+	return nil, false
+}
+
 // Accept returns a dedicated read-only channel for messages sent by other nodes that match a certain predicate.
 // Each message from the channel can be used to send a reply back to the sender
 func (mock *commMock) Accept(accept common.MessageAcceptor) <-chan proto.ReceivedMessage {
@@ -173,6 +317,30 @@ func (mock *commMock) Accept(accept common.MessageAcceptor) <-chan proto.Receive
 	return ch
 }
 
+// AcceptBuffered behaves like Accept, but the returned channel
+// buffers up to the given number of messages
+func (mock *commMock) AcceptBuffered(accept common.MessageAcceptor, size int) <-chan proto.ReceivedMessage {
+	ch := make(chan proto.ReceivedMessage, size)
+	mock.acceptors = append(mock.acceptors, &channelMock{accept, ch})
+	return ch
+}
+
+// AcceptWithConnInfo behaves like Accept, but the predicate is given the received message
+// along with the information about the connection it was received from
+func (mock *commMock) AcceptWithConnInfo(accept comm.ConnMessageAcceptor) <-chan proto.ReceivedMessage {
+	return mock.Accept(func(o interface{}) bool {
+		msg, isReceivedMsg := o.(proto.ReceivedMessage)
+		return isReceivedMsg && accept(msg)
+	})
+}
+
+// AcceptWithReplay behaves like Accept, but the returned channel first receives
+// the matching messages out of the last n messages that were received
+func (mock *commMock) AcceptWithReplay(accept common.MessageAcceptor, n int) <-chan proto.ReceivedMessage {
+	// Received messages aren't retained, so there is nothing to replay
+	return mock.Accept(accept)
+}
+
 // PresumedDead returns a read-only channel for node endpoints that are suspected to be offline
 func (mock *commMock) PresumedDead() <-chan common.PKIidType {
 	return mock.deadChannel
@@ -183,6 +351,26 @@ func (mock *commMock) CloseConn(peer *comm.RemotePeer) {
 	// NOOP
 }
 
+// CloseConnGracefully closes a connection to a certain endpoint
+// after waiting for the buffered messages to be sent
+func (mock *commMock) CloseConnGracefully(peer *comm.RemotePeer, timeout time.Duration) {
+	// NOOP
+}
+
+// CloseConnSync closes a connection to a certain endpoint
+// and waits for it to stop being serviced
+func (mock *commMock) CloseConnSync(peer *comm.RemotePeer) error {
+	// NOOP
+	return nil
+}
+
+// CloseConnSyncWithContext closes a connection to a certain endpoint
+// and waits for it to stop being serviced, or for the context to expire
+func (mock *commMock) CloseConnSyncWithContext(ctx context.Context, peer *comm.RemotePeer) error {
+	// NOOP
+	return nil
+}
+
 // Stop stops the module
 func (mock *commMock) Stop() {
 	logger.Debug("Stopping communication module, closing all accepting channels.")
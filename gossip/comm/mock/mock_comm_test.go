@@ -49,7 +49,7 @@ func TestMockComm(t *testing.T) {
 			StartSeqNum: 1,
 			EndSeqNum:   3,
 		}},
-	}).NoopSign(), &comm.RemotePeer{"first", common.PKIidType("first")})
+	}).NoopSign(), &comm.RemotePeer{Endpoint: "first", PKIID: common.PKIidType("first")})
 
 	msg := <-msgCh
 
@@ -78,7 +78,7 @@ func TestMockComm_PingPong(t *testing.T) {
 			&proto.DataMessage{
 				&proto.Payload{1, "", []byte("Ping")},
 			}},
-	}).NoopSign(), &comm.RemotePeer{"peerB", common.PKIidType("peerB")})
+	}).NoopSign(), &comm.RemotePeer{Endpoint: "peerB", PKIID: common.PKIidType("peerB")})
 
 	msg := <-rcvChB
 	dataMsg := msg.GetGossipMessage().GetDataMsg()
@@ -20,14 +20,26 @@ import (
 	"sync"
 
 	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
 )
 
 // ReceivedMessageImpl is an implementation of ReceivedMessage
 type ReceivedMessageImpl struct {
 	*proto.SignedGossipMessage
-	lock     sync.Locker
-	conn     *connection
-	connInfo *proto.ConnectionInfo
+	lock       sync.Locker
+	conn       *connection
+	connInfo   *proto.ConnectionInfo
+	remoteAddr string
+	ctx        context.Context
+}
+
+// Context returns a context that carries the trace context
+// the remote peer propagated along with the message
+func (m *ReceivedMessageImpl) Context() context.Context {
+	if m.ctx == nil {
+		return context.Background()
+	}
+	return m.ctx
 }
 
 // GetSourceEnvelope Returns the Envelope the ReceivedMessage was
@@ -38,7 +50,7 @@ func (m *ReceivedMessageImpl) GetSourceEnvelope() *proto.Envelope {
 
 // Respond sends a msg to the source that sent the ReceivedMessageImpl
 func (m *ReceivedMessageImpl) Respond(msg *proto.GossipMessage) {
-	m.conn.send(msg.NoopSign(), func(e error) {})
+	m.conn.send(msg.NoopSign(), func(e error) {}, NormalPriority)
 }
 
 // GetGossipMessage returns the inner GossipMessage
@@ -51,3 +63,67 @@ func (m *ReceivedMessageImpl) GetGossipMessage() *proto.SignedGossipMessage {
 func (m *ReceivedMessageImpl) GetConnectionInfo() *proto.ConnectionInfo {
 	return m.connInfo
 }
+
+// RemoteAddress returns the address of the remote peer
+// the message was received from
+func (m *ReceivedMessageImpl) RemoteAddress() string {
+	return m.remoteAddr
+}
+
+// RemoteCertHash returns the hash of the TLS certificate of the remote peer
+// the message was received from, or nil if the session isn't over TLS
+func (m *ReceivedMessageImpl) RemoteCertHash() []byte {
+	if m.connInfo == nil {
+		return nil
+	}
+	return m.connInfo.TLSCertHash
+}
+
+// msgRing retains the most recently received messages
+type msgRing struct {
+	sync.Mutex
+	msgs []*ReceivedMessageImpl
+	next int
+	full bool
+}
+
+func newMsgRing(size int) *msgRing {
+	if size < 0 {
+		size = 0
+	}
+	return &msgRing{msgs: make([]*ReceivedMessageImpl, size)}
+}
+
+func (r *msgRing) add(msg *ReceivedMessageImpl) {
+	if len(r.msgs) == 0 {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.msgs[r.next] = msg
+	r.next = (r.next + 1) % len(r.msgs)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// last returns the last n messages that were added, from the oldest to the newest
+func (r *msgRing) last(n int) []*ReceivedMessageImpl {
+	r.Lock()
+	defer r.Unlock()
+	count := r.next
+	if r.full {
+		count = len(r.msgs)
+	}
+	if n > count {
+		n = count
+	}
+	if n <= 0 {
+		return nil
+	}
+	res := make([]*ReceivedMessageImpl, 0, n)
+	for i := n; i > 0; i-- {
+		res = append(res, r.msgs[(r.next-i+len(r.msgs))%len(r.msgs)])
+	}
+	return res
+}
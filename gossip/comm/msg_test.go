@@ -0,0 +1,50 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMsgRing(t *testing.T) {
+	t.Parallel()
+	msgs := make([]*ReceivedMessageImpl, 5)
+	for i := range msgs {
+		msgs[i] = &ReceivedMessageImpl{SignedGossipMessage: createGossipMsg()}
+	}
+
+	ring := newMsgRing(3)
+	assert.Empty(t, ring.last(3))
+	ring.add(msgs[0])
+	ring.add(msgs[1])
+	assert.Equal(t, msgs[:2], ring.last(3))
+	assert.Equal(t, msgs[1:2], ring.last(1))
+
+	// The oldest messages are overwritten once the ring is full
+	ring.add(msgs[2])
+	ring.add(msgs[3])
+	ring.add(msgs[4])
+	assert.Equal(t, msgs[2:], ring.last(10))
+	assert.Equal(t, msgs[3:], ring.last(2))
+
+	// A ring of size 0 retains nothing
+	ring = newMsgRing(0)
+	ring.add(msgs[0])
+	assert.Empty(t, ring.last(1))
+}
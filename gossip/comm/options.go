@@ -0,0 +1,218 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"crypto/x509"
+
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"google.golang.org/grpc"
+)
+
+// SetEndpointResolver sets a resolver that translates endpoints of remote peers
+// into addresses to dial, right before dialing them
+func (c *commImpl) SetEndpointResolver(resolver EndpointResolver) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.resolver = resolver
+}
+
+// SetDialer sets the function that gRPC connections to remote peers are created with.
+// A nil function restores grpc.Dial
+func (c *commImpl) SetDialer(dialer dialFunc) {
+	if dialer == nil {
+		dialer = grpc.Dial
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.dialer = dialer
+}
+
+func (c *commImpl) SetDialOpts(opts ...grpc.DialOption) {
+	if len(opts) == 0 {
+		c.logger.Warning("Given an empty set of grpc.DialOption, aborting")
+		return
+	}
+	c.opts = opts
+}
+
+// SetStatsHandler sets the handler that is given the events of the gRPC streams and
+// RPCs of the instance, instead of the one that records TransportStats.
+// A nil handler restores the latter. Has no effect unless peer.gossip.grpcStats is set
+func (c *commImpl) SetStatsHandler(handler StatsHandler) {
+	if c.stats == nil {
+		c.logger.Warning("gRPC stats are disabled, not setting a stats handler")
+		return
+	}
+	c.stats.setHandler(handler)
+}
+
+// SetTLSRootCAs sets the root certificate pool that TLS certificate chains
+// presented by remote peers are verified against during the handshake.
+// A nil pool disables chain verification
+func (c *commImpl) SetTLSRootCAs(roots *x509.CertPool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tlsRootCAs = roots
+}
+
+// SetPeerWeight sets the function that weighs peers when selecting a subset
+// of them to send to. A nil function makes the selection uniform
+func (c *commImpl) SetPeerWeight(weight PeerWeight) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.peerWeight = weight
+}
+
+func (c *commImpl) getPeerWeight() PeerWeight {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.peerWeight
+}
+
+// SetMessageCodec sets the codec that messages are encoded into envelopes and decoded
+// from envelopes with. Remote peers must use a matching codec, and it must be set
+// before connections are established
+func (c *commImpl) SetMessageCodec(codec MessageCodec) {
+	if codec == nil {
+		codec = defaultCodec
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.codec = codec
+}
+
+func (c *commImpl) getCodec() MessageCodec {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.codec
+}
+
+// SetUndeliveredHandler sets a handler that is given the messages that were sent
+// to a remote peer but weren't delivered because writing to its stream failed,
+// so that they can be sent elsewhere
+func (c *commImpl) SetUndeliveredHandler(handler UndeliveredHandler) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.undelivered = handler
+}
+
+// SetSendOverflowPolicy sets what is done with messages that are sent to a remote peer
+// while the send buffer of its connection is full. Messages are dropped by default
+func (c *commImpl) SetSendOverflowPolicy(policy OverflowPolicy) {
+	c.connStore.setOverflowPolicy(policy)
+}
+
+// SetDuplicateConnPolicy sets what is done when a remote peer that is already
+// connected connects again from a different host. New connections are rejected
+// by default, while connections from the same host always replace old connections
+func (c *commImpl) SetDuplicateConnPolicy(policy DuplicateConnPolicy) {
+	c.connStore.setDuplicateConnPolicy(policy)
+}
+
+// SetOrgConnectionLimit limits the number of connections to peers of each organization,
+// as classified by the given classifier. Connections of an organization that reached
+// the limit are rejected, while peers of other organizations remain connectable.
+// A nil classifier or a non-positive limit removes the limit
+func (c *commImpl) SetOrgConnectionLimit(orgOf OrgClassifier, maxPerOrg int) {
+	c.connStore.setOrgConnectionLimit(orgOf, maxPerOrg)
+}
+
+// SetSkipHandshakePredicate sets a predicate that decides, per remote address,
+// whether to skip verifying the TLS-bound signature of the remote peer.
+// The handshake is skipped anyway if skipHandshake is configured globally
+func (c *commImpl) SetSkipHandshakePredicate(pred SkipHandshakePredicate) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.skipHandshakePred = pred
+}
+
+func (c *commImpl) shouldSkipHandshake(remoteAddress string) bool {
+	if c.skipHandshake {
+		return true
+	}
+	c.lock.RLock()
+	pred := c.skipHandshakePred
+	c.lock.RUnlock()
+	return pred != nil && pred(remoteAddress)
+}
+
+// SetHandshakeSigner sets the signer used to sign the TLS certificate hash
+// sent to remote peers during the handshake, instead of the identity mapper.
+// Signatures of remote peers are still verified by the identity mapper
+func (c *commImpl) SetHandshakeSigner(signer proto.Signer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.handshakeSigner = signer
+}
+
+func (c *commImpl) getHandshakeSigner() proto.Signer {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if c.handshakeSigner != nil {
+		return c.handshakeSigner
+	}
+	return func(msg []byte) ([]byte, error) {
+		return c.idMapper.Sign(msg)
+	}
+}
+
+// SetOverloadPredicate sets a predicate that decides whether the node is too
+// loaded to accept new streams from remote peers. Streams that are opened while
+// it holds are rejected, while existing connections are unaffected.
+// A nil predicate accepts all streams, which is the default
+func (c *commImpl) SetOverloadPredicate(pred OverloadPredicate) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.overloaded = pred
+}
+
+// isOverloaded returns whether new streams should be rejected because the node is overloaded
+func (c *commImpl) isOverloaded() bool {
+	c.lock.RLock()
+	overloaded := c.overloaded
+	c.lock.RUnlock()
+	return overloaded != nil && overloaded()
+}
+
+// SetRecvBuffSize sets the size of the receive buffer of connections tagged with the
+// given key and value. If a connection has several such tags, the largest size applies.
+// A non-positive size removes the size set for the tag. The receive buffer can't grow
+// beyond the largest size that was set when the connection was established
+func (c *commImpl) SetRecvBuffSize(key, value string, size int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if size <= 0 {
+		delete(c.recvBuffSizes, connTag{key: key, value: value})
+		return
+	}
+	c.recvBuffSizes[connTag{key: key, value: value}] = size
+}
+
+// SetConnectionHighWaterMarks sets the connection utilization levels, as fractions
+// of peer.gossip.maxConnections, that a warning is logged upon reaching
+func (c *commImpl) SetConnectionHighWaterMarks(marks ...float64) {
+	c.connStore.setHighWaterMarks(marks...)
+}
+
+// SetConnectionStateCallback sets a callback that is invoked whenever
+// a connection to a remote peer is established or closed
+func (c *commImpl) SetConnectionStateCallback(cb ConnectionStateCallback) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.connStateCallback = cb
+}
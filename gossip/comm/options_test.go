@@ -0,0 +1,265 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/identity"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+)
+
+func TestEndpointResolver(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	comm1.(*commImpl).SetEndpointResolver(func(endpoint string) (string, error) {
+		if endpoint == "peer2" {
+			return peer2.Endpoint, nil
+		}
+		return "", errors.New("unknown peer")
+	})
+
+	assert.NoError(t, comm1.Probe(&RemotePeer{Endpoint: "peer2"}))
+	_, err := comm1.Handshake(&RemotePeer{Endpoint: "peer2", PKIID: peer2.PKIID})
+	assert.NoError(t, err)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), &RemotePeer{Endpoint: "peer2", PKIID: peer2.PKIID})
+	select {
+	case <-m2:
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message sent to a resolved endpoint")
+	}
+
+	err = comm1.Probe(&RemotePeer{Endpoint: "peer3"})
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unknown peer")
+}
+
+func TestOrgConnectionLimit(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	comm3, _ := newEphemeralCommInstance(t, naiveSec)
+	comm4, peer4 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+	defer comm4.Stop()
+
+	// comm2 is in orgA, while comm3 and comm4 are in orgB
+	comm1.(*commImpl).SetOrgConnectionLimit(func(identity api.PeerIdentityType) string {
+		if string(identity) == peer2.Endpoint {
+			return "orgA"
+		}
+		return "orgB"
+	}, 1)
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), peer1)
+	<-m1
+	comm3.Send(createGossipMsg(), peer1)
+	<-m1
+
+	// orgB is saturated, so comm4 is rejected
+	comm4.Send(createGossipMsg(), peer1)
+	select {
+	case <-m1:
+		assert.Fail(t, "A peer of a saturated organization shouldn't have connected")
+	case <-time.After(time.Second):
+	}
+	assert.Equal(t, 2, comm1.(*commImpl).connStore.connNum())
+	assert.False(t, comm1.(*commImpl).connStore.hasConnection(peer4.PKIID))
+
+	// Rejected peers are told to retry later
+	_, err := comm1.(*commImpl).connStore.onConnected(newRecordingStream(), &proto.ConnectionInfo{
+		ID:       peer4.PKIID,
+		Identity: api.PeerIdentityType(peer4.PKIID),
+	})
+	assert.Equal(t, codes.ResourceExhausted, grpc.Code(err))
+
+	// The limit applies to connections comm1 creates too
+	_, err = comm1.(*commImpl).connStore.getConnection(peer4)
+	assert.Equal(t, errOrgConnLimit, err)
+}
+
+func TestHandshakeSigner(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, _ := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+
+	var signatures uint32
+	comm1.(*commImpl).SetHandshakeSigner(func(msg []byte) ([]byte, error) {
+		atomic.AddUint32(&signatures, 1)
+		return naiveSec.Sign(msg)
+	})
+	_, err := comm2.Handshake(peer1)
+	assert.NoError(t, err)
+	assert.NotZero(t, atomic.LoadUint32(&signatures))
+
+	// Signatures are still verified by the identity mapper of the remote peer
+	comm1.(*commImpl).SetHandshakeSigner(func(msg []byte) ([]byte, error) {
+		return []byte("bad signature"), nil
+	})
+	_, err = comm2.Handshake(peer1)
+	assert.Error(t, err)
+}
+
+func TestMessageCodec(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	comm3, _ := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+	codec1, codec2 := &xorCodec{}, &xorCodec{}
+	comm1.(*commImpl).SetMessageCodec(codec1)
+	comm2.(*commImpl).SetMessageCodec(codec2)
+
+	m2 := comm2.Accept(acceptAll)
+	msg := createGossipMsg()
+	comm1.Send(msg, peer2)
+	select {
+	case m := <-m2:
+		assert.Equal(t, msg.Nonce, m.GetGossipMessage().Nonce)
+	case <-time.After(time.Second * 5):
+		assert.Fail(t, "Didn't receive a message")
+	}
+	// The connection message and the gossip message were decoded by comm2's codec
+	assert.Equal(t, int32(2), atomic.LoadInt32(&codec2.decoded))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&codec1.decoded))
+
+	// A peer with a different codec can't even complete the handshake
+	_, err := comm3.Handshake(peer1)
+	assert.Error(t, err)
+}
+
+func TestOverloadPredicate(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, _ := newEphemeralCommInstance(t, naiveSec)
+	comm3, _ := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), peer1)
+	<-m1
+
+	var overloaded int32
+	comm1.(*commImpl).SetOverloadPredicate(func() bool {
+		return atomic.LoadInt32(&overloaded) == 1
+	})
+	atomic.StoreInt32(&overloaded, 1)
+
+	// New streams are rejected, while existing connections are unaffected
+	_, err := comm3.Handshake(peer1)
+	assert.Error(t, err)
+	comm2.Send(createGossipMsg(), peer1)
+	select {
+	case <-m1:
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Message over an existing connection wasn't received")
+	}
+
+	atomic.StoreInt32(&overloaded, 0)
+	_, err = comm3.Handshake(peer1)
+	assert.NoError(t, err)
+}
+
+func TestDuplicateConnPolicy(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	inst1 := comm1.(*commImpl)
+	m1 := comm1.Accept(acceptAll)
+	// All instances have the same identity, and connect from different hosts
+	newMovedInstance := func() Comm {
+		inst, err := NewCommInstanceWithServer(freePort(t), identity.NewIdentityMapper(naiveSec), []byte("moved"))
+		if err != nil {
+			t.Fatal("Failed creating a comm instance:", err)
+		}
+		return inst
+	}
+	comm2 := newMovedInstance()
+	defer comm2.Stop()
+	comm3 := newMovedInstance()
+	defer comm3.Stop()
+	comm4 := newMovedInstance()
+	defer comm4.Stop()
+	comm5 := newMovedInstance()
+	defer comm5.Stop()
+	fromOtherHost := WithLocalAddr(&net.TCPAddr{IP: net.ParseIP("127.0.0.2")})
+	remotePeerFromOtherHost := &RemotePeer{Endpoint: peer1.Endpoint, PKIID: peer1.PKIID, DialOpts: []grpc.DialOption{fromOtherHost}}
+
+	comm2.Send(createGossipMsg(), peer1)
+	select {
+	case <-m1:
+	case <-time.After(time.Second * 3):
+		assert.Fail(t, "Didn't receive a message")
+	}
+
+	// The connection from the other host is rejected by default
+	comm3.Send(createGossipMsg(), remotePeerFromOtherHost)
+	select {
+	case <-m1:
+		assert.Fail(t, "Message over a rejected connection was received")
+	case <-time.After(time.Second):
+	}
+
+	// replacedBy sends a message from the given instance, and checks its connection
+	// replaced the old connection, and outlived the cleanup of the old connection
+	replacedBy := func(comm Comm, peer *RemotePeer, host string) {
+		comm.Send(createGossipMsg(), peer)
+		select {
+		case <-m1:
+		case <-time.After(time.Second * 3):
+			assert.Fail(t, "Didn't receive a message")
+		}
+		// Once the stream of the old connection ends, only the stream of the new connection remains
+		waitFor(t, func() bool { return atomic.LoadInt32(&inst1.activeStreams) == 1 }, "Stream of the replaced connection didn't end")
+		conn, exists := inst1.connStore.existingConnection(common.PKIidType("moved"))
+		assert.True(t, exists, "Connection that replaced the old connection was closed")
+		if exists {
+			assert.Equal(t, host, remoteHost(conn.getStream()))
+		}
+	}
+
+	// A connection from the same host replaces the old connection
+	replacedBy(comm4, peer1, "127.0.0.1")
+
+	// Once the policy says so, a connection from the other host replaces the old connection too
+	inst1.SetDuplicateConnPolicy(ReplaceOldConnection)
+	replacedBy(comm5, remotePeerFromOtherHost, "127.0.0.2")
+}
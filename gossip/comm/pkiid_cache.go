@@ -0,0 +1,97 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+)
+
+// pkiIDCache maps endpoints to the PKI-IDs and identities of the peers
+// that were found to be listening on them, for a limited period of time
+type pkiIDCache struct {
+	sync.RWMutex
+	ttl     time.Duration
+	entries map[string]*pkiIDCacheEntry
+}
+
+type pkiIDCacheEntry struct {
+	pkiID      common.PKIidType
+	identity   api.PeerIdentityType
+	expiration time.Time
+}
+
+func newPKIidCache(ttl time.Duration) *pkiIDCache {
+	return &pkiIDCache{
+		ttl:     ttl,
+		entries: make(map[string]*pkiIDCacheEntry),
+	}
+}
+
+func (pc *pkiIDCache) put(endpoint string, pkiID common.PKIidType, identity api.PeerIdentityType) {
+	if pc.ttl <= 0 || endpoint == "" || len(pkiID) == 0 {
+		return
+	}
+	pc.Lock()
+	defer pc.Unlock()
+	pc.entries[normalizeEndpoint(endpoint)] = &pkiIDCacheEntry{
+		pkiID:      pkiID,
+		identity:   identity,
+		expiration: time.Now().Add(pc.ttl),
+	}
+}
+
+func (pc *pkiIDCache) get(endpoint string) (common.PKIidType, bool) {
+	pkiID, _, exists := pc.lookup(endpoint)
+	return pkiID, exists
+}
+
+// lookup returns the PKI-ID and the identity of the peer listening on the given endpoint
+func (pc *pkiIDCache) lookup(endpoint string) (common.PKIidType, api.PeerIdentityType, bool) {
+	endpoint = normalizeEndpoint(endpoint)
+	pc.RLock()
+	entry, exists := pc.entries[endpoint]
+	pc.RUnlock()
+	if !exists {
+		return nil, nil, false
+	}
+	if time.Now().After(entry.expiration) {
+		pc.Lock()
+		// Make sure the entry wasn't replaced in the meantime
+		if pc.entries[endpoint] == entry {
+			delete(pc.entries, endpoint)
+		}
+		pc.Unlock()
+		return nil, nil, false
+	}
+	return entry.pkiID, entry.identity, true
+}
+
+// invalidate removes all endpoints that map to the given PKI-ID
+func (pc *pkiIDCache) invalidate(pkiID common.PKIidType) {
+	pc.Lock()
+	defer pc.Unlock()
+	for endpoint, entry := range pc.entries {
+		if bytes.Equal(entry.pkiID, pkiID) {
+			delete(pc.entries, endpoint)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPKIidCache(t *testing.T) {
+	t.Parallel()
+	cache := newPKIidCache(time.Millisecond * 500)
+	cache.put("localhost:7051", common.PKIidType("p1"), api.PeerIdentityType("id1"))
+	cache.put("::1:7052", common.PKIidType("p2"), api.PeerIdentityType("id2"))
+
+	pkiID, exists := cache.get("localhost:7051")
+	assert.True(t, exists)
+	assert.Equal(t, common.PKIidType("p1"), pkiID)
+	pkiID, identity, exists := cache.lookup("[::1]:7052")
+	assert.True(t, exists)
+	assert.Equal(t, common.PKIidType("p2"), pkiID)
+	assert.Equal(t, api.PeerIdentityType("id2"), identity)
+
+	cache.invalidate(common.PKIidType("p1"))
+	_, exists = cache.get("localhost:7051")
+	assert.False(t, exists)
+
+	time.Sleep(time.Second)
+	_, exists = cache.get("[::1]:7052")
+	assert.False(t, exists)
+	assert.Empty(t, cache.entries)
+
+	// A cache with a non-positive TTL is disabled
+	cache = newPKIidCache(0)
+	cache.put("localhost:7051", common.PKIidType("p1"), api.PeerIdentityType("id1"))
+	_, exists = cache.get("localhost:7051")
+	assert.False(t, exists)
+}
@@ -0,0 +1,112 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"bufio"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"google.golang.org/grpc"
+)
+
+// WithProxy returns a dial option that makes connections to remote peers
+// go through the HTTP proxy at the given URL, which is asked to tunnel them
+// with an HTTP CONNECT request. TLS to the remote peers is established over
+// the tunnel as usual. Credentials in the URL are sent to the proxy
+func WithProxy(proxyURL string) grpc.DialOption {
+	return grpc.WithDialer(func(addr string, timeout time.Duration) (net.Conn, error) {
+		return dialThroughProxy(proxyURL, addr, timeout)
+	})
+}
+
+// WithLocalAddr returns a dial option that makes connections to remote
+// peers originate from the given local address, e.g. in order to pin the
+// network interface they egress on multi-homed hosts. Since both install
+// a dialer, it can't be combined with WithProxy
+func WithLocalAddr(addr net.Addr) grpc.DialOption {
+	return grpc.WithDialer(func(target string, timeout time.Duration) (net.Conn, error) {
+		dialer := &net.Dialer{Timeout: timeout, LocalAddr: addr}
+		return dialer.Dial("tcp", target)
+	})
+}
+
+// dialThroughProxy connects to the given address through the HTTP proxy at the given URL
+func dialThroughProxy(proxyURL string, addr string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid proxy URL %s: %v", proxyURL, err)
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("Invalid proxy URL %s: only http://host:port proxies are supported", proxyURL)
+	}
+	conn, err := net.DialTimeout("tcp", u.Host, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("Failed connecting to proxy %s: %v", u.Host, err)
+	}
+	if timeout > 0 {
+		conn.SetDeadline(time.Now().Add(timeout))
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		credentials := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err = req.Write(conn); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed sending CONNECT request to proxy %s: %v", u.Host, err)
+	}
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed reading CONNECT response from proxy %s: %v", u.Host, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, fmt.Errorf("Proxy %s refused to connect to %s: %s", u.Host, addr, resp.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		// The remote peer sent data along with the response of the proxy
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn is a connection whose first bytes were already read into a buffer
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,76 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"bytes"
+	"errors"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+)
+
+// Revalidate re-checks the identities of all connected peers against the
+// identity mapper, and disconnects from peers whose identities were removed from it,
+// e.g. because they were revoked, were replaced, or are no longer within their validity period.
+// Unlike a handshake, it doesn't take references to the identities
+func (c *commImpl) Revalidate() {
+	if c.isStopping() {
+		return
+	}
+	for _, conn := range c.connStore.connections() {
+		if conn.info == nil {
+			continue
+		}
+		if err := c.revalidateIdentity(conn.pkiID, conn.info.Identity); err != nil {
+			c.logger.Warning("Identity of", conn.pkiID, "is no longer valid:", err, ", disconnecting")
+			c.disconnect(conn.pkiID, AuthFailure)
+		}
+	}
+}
+
+// revalidateIdentity returns an error if the identity mapper no longer holds the
+// given identity for the given PKI-ID, or if the identity is an X.509 certificate
+// that is no longer within its validity period
+func (c *commImpl) revalidateIdentity(pkiID common.PKIidType, peerIdentity api.PeerIdentityType) error {
+	stored, err := c.idMapper.Get(pkiID)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(stored, peerIdentity) {
+		return errors.New("identity was replaced")
+	}
+	if c.skipIDExpiration {
+		return nil
+	}
+	return checkIdentityValidity(peerIdentity, time.Now())
+}
+
+func (c *commImpl) periodicallyRevalidate(interval time.Duration) {
+	defer c.stopWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.Revalidate()
+		case <-c.done:
+			return
+		}
+	}
+}
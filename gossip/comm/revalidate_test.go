@@ -0,0 +1,81 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevalidate(t *testing.T) {
+	t.Parallel()
+	sec := &revokingSecProvider{revoked: make(map[string]struct{})}
+	comm1, _ := newEphemeralCommInstance(t, sec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	inst1 := comm1.(*commImpl)
+	identity2 := api.PeerIdentityType(peer2.Endpoint)
+
+	m2 := comm2.Accept(acceptAll)
+	comm1.Send(createGossipMsg(), peer2)
+	<-m2
+
+	// Nothing was revoked, so nothing should be presumed dead
+	inst1.Revalidate()
+	select {
+	case <-comm1.PresumedDead():
+		assert.Fail(t, "No peer should have been presumed dead")
+	default:
+	}
+
+	// Revalidating doesn't take references to the identities
+	idMapper := inst1.idMapper
+	inst1.Revalidate()
+	idMapper.Release(peer2.PKIID)
+	_, err := idMapper.Get(peer2.PKIID)
+	assert.Error(t, err, "Revalidating shouldn't have taken a reference to the identity")
+	assert.NoError(t, idMapper.Put(peer2.PKIID, identity2))
+
+	// Revoked identities are removed from the identity mapper, and then revalidated
+	sec.revoke(identity2)
+	idMapper.ListInvalidIdentities(func(api.PeerIdentityType) bool { return true })
+	inst1.Revalidate()
+	select {
+	case pkiID := <-comm1.PresumedDead():
+		assert.Equal(t, peer2.PKIID, pkiID)
+	default:
+		assert.Fail(t, "Revoked peer should have been presumed dead")
+	}
+	assert.Equal(t, 0, inst1.connStore.connNum())
+}
+
+func TestRevalidateIdentity(t *testing.T) {
+	t.Parallel()
+	comm1, _ := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	inst1 := comm1.(*commImpl)
+
+	pkiID := common.PKIidType("peer")
+	assert.Error(t, inst1.revalidateIdentity(pkiID, api.PeerIdentityType("peer")), "Unknown identities aren't valid")
+	assert.NoError(t, inst1.idMapper.Put(pkiID, api.PeerIdentityType("peer")))
+	assert.NoError(t, inst1.revalidateIdentity(pkiID, api.PeerIdentityType("peer")))
+	assert.Error(t, inst1.revalidateIdentity(pkiID, api.PeerIdentityType("other")), "Replaced identities aren't valid")
+}
@@ -0,0 +1,326 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	pb "github.com/golang/protobuf/proto"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+)
+
+// StatsHandler is notified of the events of the gRPC streams and RPCs of an instance.
+// It stands in for the stats.Handler of later gRPC versions, which the vendored gRPC
+// predates along with client interceptors. Server streams and RPCs are observed by
+// interceptors of the gRPC server the instance creates, and client streams and RPCs
+// by the gossip clients the instance creates. Handlers are invoked synchronously
+type StatsHandler interface {
+	// HandleRPC handles an event of a stream or RPC
+	HandleRPC(ctx context.Context, stats *RPCStats)
+}
+
+// RPCEvent denotes what happened in a gRPC stream or RPC
+type RPCEvent int
+
+const (
+	// RPCBegin means the stream or RPC began
+	RPCBegin RPCEvent = iota
+	// RPCInPayload means a message was received
+	RPCInPayload
+	// RPCOutPayload means a message was sent
+	RPCOutPayload
+	// RPCEnd means the stream or RPC ended
+	RPCEnd
+)
+
+func (e RPCEvent) String() string {
+	switch e {
+	case RPCBegin:
+		return "Begin"
+	case RPCInPayload:
+		return "InPayload"
+	case RPCOutPayload:
+		return "OutPayload"
+	case RPCEnd:
+		return "End"
+	default:
+		return "Unknown"
+	}
+}
+
+// RPCStats describes an event of a gRPC stream or RPC
+type RPCStats struct {
+	// Event is what happened
+	Event RPCEvent
+	// Client is whether this instance initiated the stream or RPC
+	Client bool
+	// Method is the full name of the method of the stream or RPC
+	Method string
+	// Length is the marshaled size of the message, in RPCInPayload and RPCOutPayload events
+	Length int
+	// Duration is how long the stream or RPC lasted, in RPCEnd events
+	Duration time.Duration
+	// Error is the error the stream or RPC ended with, in RPCEnd events
+	Error error
+}
+
+// TransportStats holds statistics of the gRPC streams and RPCs of an instance
+type TransportStats struct {
+	// Active is the number of streams and RPCs in progress
+	Active int64
+	// Started is the number of streams and RPCs that began
+	Started uint64
+	// MessagesSent is the number of messages sent in streams and RPCs
+	MessagesSent uint64
+	// MessagesReceived is the number of messages received in streams and RPCs
+	MessagesReceived uint64
+	// BytesSent is the marshaled size of the messages sent
+	BytesSent uint64
+	// BytesReceived is the marshaled size of the messages received
+	BytesReceived uint64
+	// Durations is a histogram of how long the streams and RPCs that ended lasted
+	Durations LatencyHistogram
+}
+
+// transportRecorder is the default stats handler, which records TransportStats
+type transportRecorder struct {
+	active           int64 // accessed atomically, kept first for 64-bit alignment
+	started          uint64
+	messagesSent     uint64
+	messagesReceived uint64
+	bytesSent        uint64
+	bytesReceived    uint64
+	durations        *latencyHistogram
+}
+
+func (r *transportRecorder) HandleRPC(_ context.Context, s *RPCStats) {
+	switch s.Event {
+	case RPCBegin:
+		atomic.AddInt64(&r.active, 1)
+		atomic.AddUint64(&r.started, 1)
+	case RPCInPayload:
+		atomic.AddUint64(&r.messagesReceived, 1)
+		atomic.AddUint64(&r.bytesReceived, uint64(s.Length))
+	case RPCOutPayload:
+		atomic.AddUint64(&r.messagesSent, 1)
+		atomic.AddUint64(&r.bytesSent, uint64(s.Length))
+	case RPCEnd:
+		atomic.AddInt64(&r.active, -1)
+		r.durations.observe(s.Duration)
+	}
+}
+
+func (r *transportRecorder) snapshot() TransportStats {
+	return TransportStats{
+		Active:           atomic.LoadInt64(&r.active),
+		Started:          atomic.LoadUint64(&r.started),
+		MessagesSent:     atomic.LoadUint64(&r.messagesSent),
+		MessagesReceived: atomic.LoadUint64(&r.messagesReceived),
+		BytesSent:        atomic.LoadUint64(&r.bytesSent),
+		BytesReceived:    atomic.LoadUint64(&r.bytesReceived),
+		Durations:        r.durations.snapshot(),
+	}
+}
+
+// statsHub hands the events of the streams and RPCs of an instance to the
+// handler the instance was given, or to the default handler otherwise
+type statsHub struct {
+	sync.RWMutex
+	handler  StatsHandler
+	recorder *transportRecorder
+}
+
+func newStatsHub() *statsHub {
+	return &statsHub{recorder: &transportRecorder{durations: newLatencyHistogram(defLatencyBuckets)}}
+}
+
+func (h *statsHub) setHandler(handler StatsHandler) {
+	h.Lock()
+	defer h.Unlock()
+	h.handler = handler
+}
+
+func (h *statsHub) HandleRPC(ctx context.Context, s *RPCStats) {
+	h.RLock()
+	handler := h.handler
+	h.RUnlock()
+	if handler == nil {
+		h.recorder.HandleRPC(ctx, s)
+		return
+	}
+	handler.HandleRPC(ctx, s)
+}
+
+// messageSize returns the marshaled size of the given message
+func messageSize(m interface{}) int {
+	if msg, isProto := m.(pb.Message); isProto {
+		return pb.Size(msg)
+	}
+	return 0
+}
+
+// rpcTracker reports the events of a single stream or RPC
+type rpcTracker struct {
+	ctx     context.Context
+	handler StatsHandler
+	client  bool
+	method  string
+	begin   time.Time
+	endOnce sync.Once
+}
+
+func beginRPC(ctx context.Context, handler StatsHandler, client bool, method string) *rpcTracker {
+	t := &rpcTracker{ctx: ctx, handler: handler, client: client, method: method, begin: time.Now()}
+	t.report(&RPCStats{Event: RPCBegin})
+	return t
+}
+
+func (t *rpcTracker) report(s *RPCStats) {
+	s.Client = t.client
+	s.Method = t.method
+	t.handler.HandleRPC(t.ctx, s)
+}
+
+func (t *rpcTracker) payload(event RPCEvent, m interface{}) {
+	t.report(&RPCStats{Event: event, Length: messageSize(m)})
+}
+
+// end reports the stream or RPC ended, only the first time it's called
+func (t *rpcTracker) end(err error) {
+	t.endOnce.Do(func() {
+		t.report(&RPCStats{Event: RPCEnd, Duration: time.Since(t.begin), Error: err})
+	})
+}
+
+// statsStreamInterceptor reports the events of the streams the server serves to the given handler
+func statsStreamInterceptor(handler StatsHandler) grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, h grpc.StreamHandler) error {
+		t := beginRPC(ss.Context(), handler, false, info.FullMethod)
+		err := h(srv, &statsServerStream{ServerStream: ss, tracker: t})
+		t.end(err)
+		return err
+	}
+}
+
+// statsUnaryInterceptor reports the events of the RPCs the server serves to the given handler
+func statsUnaryInterceptor(handler StatsHandler) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, h grpc.UnaryHandler) (interface{}, error) {
+		t := beginRPC(ctx, handler, false, info.FullMethod)
+		t.payload(RPCInPayload, req)
+		resp, err := h(ctx, req)
+		if err == nil {
+			t.payload(RPCOutPayload, resp)
+		}
+		t.end(err)
+		return resp, err
+	}
+}
+
+type statsServerStream struct {
+	grpc.ServerStream
+	tracker *rpcTracker
+}
+
+func (s *statsServerStream) SendMsg(m interface{}) error {
+	err := s.ServerStream.SendMsg(m)
+	if err == nil {
+		s.tracker.payload(RPCOutPayload, m)
+	}
+	return err
+}
+
+func (s *statsServerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil {
+		s.tracker.payload(RPCInPayload, m)
+	}
+	return err
+}
+
+// statsClient reports the events of the streams and RPCs it initiates to its handler
+type statsClient struct {
+	proto.GossipClient
+	handler StatsHandler
+}
+
+func (cl *statsClient) GossipStream(ctx context.Context, opts ...grpc.CallOption) (proto.Gossip_GossipStreamClient, error) {
+	t := beginRPC(ctx, cl.handler, true, "/gossip.Gossip/GossipStream")
+	stream, err := cl.GossipClient.GossipStream(ctx, opts...)
+	if err != nil {
+		t.end(err)
+		return nil, err
+	}
+	return &statsClientStream{Gossip_GossipStreamClient: stream, tracker: t}, nil
+}
+
+func (cl *statsClient) Ping(ctx context.Context, in *proto.Empty, opts ...grpc.CallOption) (*proto.Empty, error) {
+	t := beginRPC(ctx, cl.handler, true, "/gossip.Gossip/Ping")
+	t.payload(RPCOutPayload, in)
+	out, err := cl.GossipClient.Ping(ctx, in, opts...)
+	if err == nil {
+		t.payload(RPCInPayload, out)
+	}
+	t.end(err)
+	return out, err
+}
+
+// statsClientStream reports the stream ended once sending or receiving
+// on it fails, or once this side of it is closed, whichever comes first
+type statsClientStream struct {
+	proto.Gossip_GossipStreamClient
+	tracker *rpcTracker
+}
+
+func (s *statsClientStream) Send(envelope *proto.Envelope) error {
+	err := s.Gossip_GossipStreamClient.Send(envelope)
+	if err != nil {
+		s.tracker.end(err)
+		return err
+	}
+	s.tracker.payload(RPCOutPayload, envelope)
+	return nil
+}
+
+func (s *statsClientStream) Recv() (*proto.Envelope, error) {
+	envelope, err := s.Gossip_GossipStreamClient.Recv()
+	if err != nil {
+		s.tracker.end(err)
+		return nil, err
+	}
+	s.tracker.payload(RPCInPayload, envelope)
+	return envelope, nil
+}
+
+func (s *statsClientStream) CloseSend() error {
+	err := s.Gossip_GossipStreamClient.CloseSend()
+	s.tracker.end(nil)
+	return err
+}
+
+// newGossipClient creates a gossip client over the given connection,
+// which reports its streams and RPCs if gRPC stats are enabled
+func (c *commImpl) newGossipClient(cc *grpc.ClientConn) proto.GossipClient {
+	cl := proto.NewGossipClient(cc)
+	if c.stats == nil {
+		return cl
+	}
+	return &statsClient{GossipClient: cl, handler: c.stats}
+}
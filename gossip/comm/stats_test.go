@@ -0,0 +1,195 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/identity"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type statsRecorder struct {
+	sync.Mutex
+	events []RPCStats
+}
+
+func (r *statsRecorder) HandleRPC(_ context.Context, s *RPCStats) {
+	r.Lock()
+	defer r.Unlock()
+	r.events = append(r.events, *s)
+}
+
+// count returns the number of recorded events of the given kind, side and method
+func (r *statsRecorder) count(event RPCEvent, client bool, method string) int {
+	r.Lock()
+	defer r.Unlock()
+	n := 0
+	for _, s := range r.events {
+		if s.Event == event && s.Client == client && s.Method == method {
+			n++
+		}
+	}
+	return n
+}
+
+func TestTransportStats(t *testing.T) {
+	t.Parallel()
+	// The server side of comm1 is observed by the interceptors of its gRPC server
+	port := freePort(t)
+	hub := newStatsHub()
+	srv, lsnr, dialOpts, _, tlsCert, err := newGRPCLayer(port, nil, grpcLayerOptions{stats: hub})
+	assert.NoError(t, err)
+	defer srv.Stop()
+	comm1, err := NewCommInstance(srv, tlsCert.cert, identity.NewIdentityMapper(naiveSec), []byte(fmt.Sprintf("localhost:%d", port)), dialOpts)
+	assert.NoError(t, err)
+	defer comm1.Stop()
+	comm1.(*commImpl).stats = hub
+	go srv.Serve(lsnr)
+
+	// The client side of comm2 is observed by the gossip clients it creates
+	comm2, _ := newEphemeralCommInstance(t, naiveSec)
+	comm2.(*commImpl).stats = newStatsHub()
+	rec := &statsRecorder{}
+	comm2.(*commImpl).SetStatsHandler(rec)
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), remotePeer(port))
+	select {
+	case <-m1:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Didn't receive a message in time")
+	}
+
+	stats := comm1.(*commImpl).TransportStats()
+	assert.Equal(t, uint64(2), stats.Started)
+	assert.Equal(t, int64(1), stats.Active)
+	// The ping, the handshake message and the gossip message
+	assert.True(t, stats.MessagesReceived >= 3)
+	assert.True(t, stats.BytesReceived > 0)
+	// The ping response and the handshake message
+	assert.True(t, stats.MessagesSent >= 2)
+	assert.True(t, stats.BytesSent > 0)
+	assert.Equal(t, uint64(1), stats.Durations.Count)
+
+	assert.Equal(t, 1, rec.count(RPCBegin, true, "/gossip.Gossip/Ping"))
+	assert.Equal(t, 1, rec.count(RPCEnd, true, "/gossip.Gossip/Ping"))
+	assert.Equal(t, 1, rec.count(RPCBegin, true, "/gossip.Gossip/GossipStream"))
+	assert.True(t, rec.count(RPCOutPayload, true, "/gossip.Gossip/GossipStream") >= 2)
+	assert.True(t, rec.count(RPCInPayload, true, "/gossip.Gossip/GossipStream") >= 1)
+	assert.Equal(t, 0, rec.count(RPCEnd, true, "/gossip.Gossip/GossipStream"))
+	// comm2 was given a handler of its own, so nothing was recorded by default
+	assert.Equal(t, uint64(0), comm2.(*commImpl).TransportStats().Started)
+
+	// Once comm2 goes away, the streams of both sides end
+	comm2.Stop()
+	waitFor(t, func() bool {
+		return rec.count(RPCEnd, true, "/gossip.Gossip/GossipStream") == 1
+	}, "Client stream didn't end")
+	waitFor(t, func() bool {
+		return comm1.(*commImpl).TransportStats().Active == 0
+	}, "Server stream didn't end")
+	assert.Equal(t, uint64(2), comm1.(*commImpl).TransportStats().Durations.Count)
+}
+
+func TestTransportStatsDisabled(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, _ := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	rec := &statsRecorder{}
+	comm2.(*commImpl).SetStatsHandler(rec)
+
+	m1 := comm1.Accept(acceptAll)
+	comm2.Send(createGossipMsg(), peer1)
+	select {
+	case <-m1:
+	case <-time.After(time.Second * 5):
+		t.Fatal("Didn't receive a message in time")
+	}
+	assert.Equal(t, TransportStats{}, comm1.(*commImpl).TransportStats())
+	assert.Equal(t, TransportStats{}, comm2.(*commImpl).TransportStats())
+	assert.Empty(t, rec.events)
+	_, isStatsClient := comm2.(*commImpl).newGossipClient(nil).(*statsClient)
+	assert.False(t, isStatsClient)
+}
+
+func TestStatsHubHandler(t *testing.T) {
+	t.Parallel()
+	hub := newStatsHub()
+	ctx := context.Background()
+	hub.HandleRPC(ctx, &RPCStats{Event: RPCBegin})
+	hub.HandleRPC(ctx, &RPCStats{Event: RPCOutPayload, Length: 10})
+
+	// A handler replaces the default one
+	rec := &statsRecorder{}
+	hub.setHandler(rec)
+	hub.HandleRPC(ctx, &RPCStats{Event: RPCInPayload, Length: 5})
+	assert.Len(t, rec.events, 1)
+	assert.Equal(t, uint64(0), hub.recorder.snapshot().MessagesReceived)
+
+	// A nil handler restores it
+	hub.setHandler(nil)
+	hub.HandleRPC(ctx, &RPCStats{Event: RPCEnd, Duration: time.Millisecond})
+	assert.Len(t, rec.events, 1)
+	stats := hub.recorder.snapshot()
+	assert.Equal(t, uint64(1), stats.Started)
+	assert.Equal(t, int64(0), stats.Active)
+	assert.Equal(t, uint64(1), stats.MessagesSent)
+	assert.Equal(t, uint64(10), stats.BytesSent)
+	assert.Equal(t, uint64(1), stats.Durations.Count)
+}
+
+func TestStatsClientStreamEndsOnce(t *testing.T) {
+	t.Parallel()
+	rec := &statsRecorder{}
+	tracker := beginRPC(context.Background(), rec, true, "/gossip.Gossip/GossipStream")
+	stream := &statsClientStream{Gossip_GossipStreamClient: &failingClientStream{}, tracker: tracker}
+	envelope := &proto.Envelope{Payload: []byte{1, 2, 3}}
+	assert.Error(t, stream.Send(envelope))
+	_, err := stream.Recv()
+	assert.Error(t, err)
+	stream.CloseSend()
+	assert.Equal(t, 1, rec.count(RPCBegin, true, "/gossip.Gossip/GossipStream"))
+	assert.Equal(t, 1, rec.count(RPCEnd, true, "/gossip.Gossip/GossipStream"))
+	assert.Equal(t, 0, rec.count(RPCOutPayload, true, "/gossip.Gossip/GossipStream"))
+	assert.Equal(t, 0, rec.count(RPCInPayload, true, "/gossip.Gossip/GossipStream"))
+	assert.Equal(t, "End", rec.events[1].Event.String())
+	assert.Error(t, rec.events[1].Error)
+}
+
+type failingClientStream struct {
+	proto.Gossip_GossipStreamClient
+}
+
+func (*failingClientStream) Send(*proto.Envelope) error {
+	return fmt.Errorf("failed sending")
+}
+
+func (*failingClientStream) Recv() (*proto.Envelope, error) {
+	return nil, fmt.Errorf("failed receiving")
+}
+
+func (*failingClientStream) CloseSend() error {
+	return nil
+}
@@ -0,0 +1,191 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"errors"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+)
+
+var errNoConnection = errors.New("Connection store returned no connection")
+
+// Connection is a connection to a remote peer. Connections are created
+// and serviced by comm, and are opaque to connection stores
+type Connection struct {
+	conn *connection
+}
+
+// ConnectionStore holds the connections to remote peers, and decides when connections
+// are created, replaced and closed. Custom stores are built on top of the default
+// store of a comm instance, which creates and services the connections.
+// Enumerating the connections, their statistics and the policies of the instance
+// are served by the default store, so custom stores must keep their connections
+// in the default store they wrap, rather than hold connections of their own
+type ConnectionStore interface {
+	// GetConnection returns the connection to the given peer, and creates it if it doesn't exist
+	GetConnection(peer *RemotePeer) (*Connection, error)
+
+	// OnConnected registers a connection that a remote peer initiated. It returns nil if the
+	// connection is rejected, along with the error to end the stream with, if any
+	OnConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) (*Connection, error)
+
+	// CloseConn closes the connection to the given peer
+	CloseConn(peer *RemotePeer, reason CloseReason)
+
+	// CloseByPKIid closes the connection to the peer with the given PKI-ID
+	CloseByPKIid(pkiID common.PKIidType, reason CloseReason)
+
+	// RemoveConn closes the given connection, and removes it from the store unless
+	// it was already replaced by another connection to the same peer.
+	// It's invoked once the stream of the connection ends
+	RemoveConn(conn *Connection, reason CloseReason)
+
+	// ExistingConnection returns the connection to the peer with the given PKI-ID,
+	// if it exists, without creating it
+	ExistingConnection(pkiID common.PKIidType) (*Connection, bool)
+
+	// ConnNum returns the number of connections in the store
+	ConnNum() int
+
+	// Shutdown closes all connections, and makes the store stop creating new ones
+	Shutdown()
+}
+
+// ConnectionStoreFactory creates the connection store of a comm instance
+// out of the default connection store of the instance
+type ConnectionStoreFactory func(defaultStore ConnectionStore) ConnectionStore
+
+func wrapConn(conn *connection) *Connection {
+	if conn == nil {
+		return nil
+	}
+	return &Connection{conn: conn}
+}
+
+func (c *Connection) unwrap() *connection {
+	if c == nil {
+		return nil
+	}
+	return c.conn
+}
+
+// defaultConnStore exposes the default connection store as a ConnectionStore
+type defaultConnStore struct {
+	cs *connectionStore
+}
+
+func (s *defaultConnStore) GetConnection(peer *RemotePeer) (*Connection, error) {
+	conn, err := s.cs.getConnection(peer)
+	return wrapConn(conn), err
+}
+
+func (s *defaultConnStore) OnConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) (*Connection, error) {
+	conn, err := s.cs.onConnected(serverStream, connInfo)
+	return wrapConn(conn), err
+}
+
+func (s *defaultConnStore) CloseConn(peer *RemotePeer, reason CloseReason) {
+	s.cs.closeConn(peer, reason)
+}
+
+func (s *defaultConnStore) CloseByPKIid(pkiID common.PKIidType, reason CloseReason) {
+	s.cs.closeByPKIid(pkiID, reason)
+}
+
+func (s *defaultConnStore) RemoveConn(conn *Connection, reason CloseReason) {
+	if conn.unwrap() != nil {
+		s.cs.removeConn(conn.unwrap(), reason)
+	}
+}
+
+func (s *defaultConnStore) ExistingConnection(pkiID common.PKIidType) (*Connection, bool) {
+	conn, exists := s.cs.existingConnection(pkiID)
+	return wrapConn(conn), exists
+}
+
+func (s *defaultConnStore) ConnNum() int {
+	return s.cs.connNum()
+}
+
+func (s *defaultConnStore) Shutdown() {
+	s.cs.shutdown()
+}
+
+// customConnStore routes the operations of a ConnectionStore to a custom store,
+// and the rest of the operations to the default store beneath it
+type customConnStore struct {
+	*connectionStore
+	custom ConnectionStore
+}
+
+func newCustomConnStore(cs *connectionStore, newStore ConnectionStoreFactory) *customConnStore {
+	return &customConnStore{
+		connectionStore: cs,
+		custom:          newStore(&defaultConnStore{cs: cs}),
+	}
+}
+
+func (s *customConnStore) getConnection(peer *RemotePeer) (*connection, error) {
+	conn, err := s.custom.GetConnection(peer)
+	if err != nil {
+		return nil, err
+	}
+	if conn.unwrap() == nil {
+		return nil, errNoConnection
+	}
+	return conn.unwrap(), nil
+}
+
+func (s *customConnStore) onConnected(serverStream proto.Gossip_GossipStreamServer, connInfo *proto.ConnectionInfo) (*connection, error) {
+	conn, err := s.custom.OnConnected(serverStream, connInfo)
+	return conn.unwrap(), err
+}
+
+func (s *customConnStore) closeConn(peer *RemotePeer, reason CloseReason) {
+	s.custom.CloseConn(peer, reason)
+}
+
+func (s *customConnStore) closeByPKIid(pkiID common.PKIidType, reason CloseReason) {
+	s.custom.CloseByPKIid(pkiID, reason)
+}
+
+func (s *customConnStore) removeConn(conn *connection, reason CloseReason) {
+	s.custom.RemoveConn(wrapConn(conn), reason)
+}
+
+func (s *customConnStore) existingConnection(pkiID common.PKIidType) (*connection, bool) {
+	conn, exists := s.custom.ExistingConnection(pkiID)
+	if conn.unwrap() == nil {
+		return nil, false
+	}
+	return conn.unwrap(), exists
+}
+
+func (s *customConnStore) hasConnection(pkiID common.PKIidType) bool {
+	_, exists := s.existingConnection(pkiID)
+	return exists
+}
+
+func (s *customConnStore) connNum() int {
+	return s.custom.ConnNum()
+}
+
+func (s *customConnStore) shutdown() {
+	s.custom.Shutdown()
+}
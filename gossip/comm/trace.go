@@ -0,0 +1,84 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"time"
+
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
+)
+
+// SendWithContext sends a message to remote peers, and propagates the trace context
+// of ctx to them in the metadata of the envelope the message is sent in.
+// Without a trace propagator, it behaves like Send
+func (c *commImpl) SendWithContext(ctx context.Context, msg *proto.SignedGossipMessage, peers ...*RemotePeer) {
+	tracer := c.getTracePropagator()
+	if tracer == nil {
+		c.Send(msg, peers...)
+		return
+	}
+	md := tracer.Inject(ctx)
+	if len(md) == 0 {
+		c.Send(msg, peers...)
+		return
+	}
+	if c.isStopping() || c.observer || len(peers) == 0 {
+		return
+	}
+
+	if c.shouldLogMessage(&c.sentMsgs) {
+		c.logger.Debug("Entering, sending", msg, "to ", len(peers), "peers with trace context")
+	}
+
+	env, err := c.getCodec().Encode(msg)
+	if err != nil {
+		c.logger.Warning("Failed encoding", msg, ":", err)
+		return
+	}
+	// The envelope might be shared with other sends, so attach the metadata to a copy of it
+	traced := *env
+	traced.Metadata = md
+	for _, peer := range peers {
+		c.goSend(peer, &traced, NormalPriority, time.Time{}, nil)
+	}
+}
+
+// SetTracePropagator sets the propagator that trace context is sent to
+// and received from remote peers with. A nil propagator disables it
+func (c *commImpl) SetTracePropagator(tracer TracePropagator) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.tracer = tracer
+}
+
+func (c *commImpl) getTracePropagator() TracePropagator {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.tracer
+}
+
+// traceContext returns a context that carries the trace context
+// the remote peer propagated in the metadata of the given envelope
+func (c *commImpl) traceContext(env *proto.Envelope) context.Context {
+	tracer := c.getTracePropagator()
+	md := env.GetMetadata()
+	if tracer == nil || len(md) == 0 {
+		return context.Background()
+	}
+	return tracer.Extract(context.Background(), md)
+}
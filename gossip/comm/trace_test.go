@@ -0,0 +1,100 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/context"
+)
+
+type traceIDKey struct{}
+
+type testPropagator struct{}
+
+func (testPropagator) Inject(ctx context.Context) map[string]string {
+	traceID, _ := ctx.Value(traceIDKey{}).(string)
+	if traceID == "" {
+		return nil
+	}
+	return map[string]string{"trace-id": traceID}
+}
+
+func (testPropagator) Extract(ctx context.Context, md map[string]string) context.Context {
+	if traceID, exists := md["trace-id"]; exists {
+		return context.WithValue(ctx, traceIDKey{}, traceID)
+	}
+	return ctx
+}
+
+func TestSendWithContext(t *testing.T) {
+	t.Parallel()
+	comm1, peer1 := newEphemeralCommInstance(t, naiveSec)
+	comm2, peer2 := newEphemeralCommInstance(t, naiveSec)
+	comm3, _ := newEphemeralCommInstance(t, naiveSec)
+	defer comm1.Stop()
+	defer comm2.Stop()
+	defer comm3.Stop()
+	comm1.(*commImpl).SetTracePropagator(testPropagator{})
+	comm2.(*commImpl).SetTracePropagator(testPropagator{})
+
+	recv := func(ch <-chan proto.ReceivedMessage) *ReceivedMessageImpl {
+		select {
+		case m := <-ch:
+			return m.(*ReceivedMessageImpl)
+		case <-time.After(time.Second * 5):
+			assert.Fail(t, "Didn't receive a message")
+			return &ReceivedMessageImpl{}
+		}
+	}
+
+	// Each message carries the trace context it was sent with,
+	// including messages sent over an existing connection
+	m2 := comm2.Accept(acceptAll)
+	msg := createGossipMsg()
+	comm1.SendWithContext(context.WithValue(context.Background(), traceIDKey{}, "1234"), msg, peer2)
+	assert.Equal(t, "1234", recv(m2).Context().Value(traceIDKey{}))
+	comm1.SendWithContext(context.WithValue(context.Background(), traceIDKey{}, "5678"), createGossipMsg(), peer2)
+	assert.Equal(t, "5678", recv(m2).Context().Value(traceIDKey{}))
+	comm1.Send(createGossipMsg(), peer2)
+	assert.Nil(t, recv(m2).Context().Value(traceIDKey{}))
+	// The envelope of the message isn't modified
+	assert.Empty(t, msg.Envelope.Metadata)
+
+	// Without a trace propagator, the message is sent without trace context
+	m1 := comm1.Accept(acceptAll)
+	comm3.SendWithContext(context.WithValue(context.Background(), traceIDKey{}, "1234"), createGossipMsg(), peer1)
+	assert.Nil(t, recv(m1).Context().Value(traceIDKey{}))
+}
+
+func TestTraceContext(t *testing.T) {
+	t.Parallel()
+	inst := &commImpl{lock: &sync.RWMutex{}}
+	env := &proto.Envelope{Metadata: map[string]string{"trace-id": "1234"}}
+
+	// Without a trace propagator, the metadata is ignored
+	assert.Nil(t, inst.traceContext(env).Value(traceIDKey{}))
+
+	inst.SetTracePropagator(testPropagator{})
+	assert.Equal(t, "1234", inst.traceContext(env).Value(traceIDKey{}))
+	assert.Nil(t, inst.traceContext(&proto.Envelope{}).Value(traceIDKey{}))
+	assert.Nil(t, inst.traceContext(nil).Value(traceIDKey{}))
+}
@@ -0,0 +1,39 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+const (
+	// BaselineProtocolVersion is the version of the gossip protocol
+	// that peers which don't advertise their version speak
+	BaselineProtocolVersion uint32 = 1
+	// ProtocolVersion is the version of the gossip protocol this peer speaks
+	ProtocolVersion uint32 = 1
+)
+
+// negotiateProtocolVersion returns the version of the gossip protocol to use with a remote
+// peer that advertised the given version in its connection message, which is the latest
+// version both this peer and the remote peer speak. The connection message is signed
+// during the handshake, so the version can't be tampered with on the way
+func negotiateProtocolVersion(remote uint32) uint32 {
+	if remote == 0 {
+		remote = BaselineProtocolVersion
+	}
+	if remote < ProtocolVersion {
+		return remote
+	}
+	return ProtocolVersion
+}
@@ -0,0 +1,31 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	// Peers that don't advertise a version speak the baseline version
+	assert.Equal(t, BaselineProtocolVersion, negotiateProtocolVersion(0))
+	// The latest version both peers speak is used
+	assert.Equal(t, uint32(1), negotiateProtocolVersion(1))
+	assert.Equal(t, ProtocolVersion, negotiateProtocolVersion(1000))
+}
@@ -0,0 +1,145 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/hyperledger/fabric/gossip/api"
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/identity"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// targetPKIidKey is the metadata key of the PKI-ID of
+// the remote peer a stream is opened to
+const targetPKIidKey = "gossip-target-pkiid"
+
+// VirtualServer is a gRPC server that is shared by several comm instances,
+// each with its own PKI-ID, which is meant for simulating many peers in a
+// single process. Streams are routed to instances by the PKI-ID the remote
+// peer expects to connect to, so instances that share a server must only be
+// connected to by remote peers that know their PKI-IDs. The PKI-ID the stream
+// is routed by isn't authenticated, so instances reject remote peers whose
+// signed connection messages name another PKI-ID
+type VirtualServer struct {
+	lock      sync.RWMutex
+	srv       *grpc.Server
+	lsnr      net.Listener
+	dialOpt   grpc.DialOption
+	certHash  []byte
+	instances map[string]*commImpl
+}
+
+// NewVirtualServer creates a gRPC server listening on the given port,
+// that comm instances created by NewInstance share
+func NewVirtualServer(port int) (*VirtualServer, error) {
+	srv, lsnr, dialOpt, certHash, _, err := createGRPCLayer(port, nil)
+	if err != nil {
+		return nil, err
+	}
+	vs := &VirtualServer{
+		srv:       srv,
+		lsnr:      lsnr,
+		dialOpt:   dialOpt,
+		certHash:  certHash,
+		instances: make(map[string]*commImpl),
+	}
+	proto.RegisterGossipServer(srv, vs)
+	go srv.Serve(lsnr)
+	return vs, nil
+}
+
+// NewInstance creates a comm instance with the given identity that shares the server
+func (vs *VirtualServer) NewInstance(idMapper identity.Mapper, peerIdentity api.PeerIdentityType, dialOpts ...grpc.DialOption) (Comm, error) {
+	dialOpts = append(dialOpts, vs.dialOpt)
+	commInst, err := NewCommInstanceWithServer(-1, idMapper, peerIdentity, dialOpts...)
+	if err != nil {
+		return nil, err
+	}
+	inst := commInst.(*commImpl)
+	inst.selfCertHash = vs.certHash
+
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	if existing, exists := vs.instances[string(inst.PKIID)]; exists && !existing.isStopping() {
+		inst.Stop()
+		return nil, fmt.Errorf("An instance with PKI-ID %v already shares the server", inst.PKIID)
+	}
+	vs.instances[string(inst.PKIID)] = inst
+	return inst, nil
+}
+
+// GossipStream routes the stream to the instance the remote peer opened it to
+func (vs *VirtualServer) GossipStream(stream proto.Gossip_GossipStreamServer) error {
+	inst, err := vs.target(stream.Context())
+	if err != nil {
+		return err
+	}
+	return inst.GossipStream(stream)
+}
+
+// Ping responds to pings, as long as the server is serving
+func (vs *VirtualServer) Ping(context.Context, *proto.Empty) (*proto.Empty, error) {
+	return &proto.Empty{}, nil
+}
+
+// Stop stops the server. Instances that share it aren't stopped
+func (vs *VirtualServer) Stop() {
+	vs.srv.Stop()
+}
+
+// target returns the instance whose PKI-ID the given stream context carries
+func (vs *VirtualServer) target(ctx context.Context) (*commImpl, error) {
+	md, ok := metadata.FromContext(ctx)
+	if !ok || len(md[targetPKIidKey]) == 0 {
+		return nil, errors.New("Stream doesn't carry the PKI-ID of its target")
+	}
+	pkiID, err := hex.DecodeString(md[targetPKIidKey][0])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed PKI-ID of the target of the stream: %v", err)
+	}
+
+	vs.lock.Lock()
+	defer vs.lock.Unlock()
+	inst, exists := vs.instances[string(pkiID)]
+	if exists && inst.isStopping() {
+		delete(vs.instances, string(pkiID))
+		exists = false
+	}
+	if !exists {
+		return nil, fmt.Errorf("No instance with PKI-ID %v shares the server", common.PKIidType(pkiID))
+	}
+	return inst, nil
+}
+
+// streamContext returns the context to open a stream to the remote peer with the given
+// PKI-ID with, which carries the PKI-ID if it's known, in case the remote peer shares
+// its server with other instances
+func (c *commImpl) streamContext(target common.PKIidType) context.Context {
+	if len(target) == 0 {
+		return context.Background()
+	}
+	return metadata.NewContext(context.Background(), metadata.Pairs(targetPKIidKey, hex.EncodeToString(target)))
+}
@@ -0,0 +1,101 @@
+/*
+Copyright IBM Corp. 2017 All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+		 http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package comm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/gossip/common"
+	"github.com/hyperledger/fabric/gossip/identity"
+	proto "github.com/hyperledger/fabric/protos/gossip"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVirtualServer(t *testing.T) {
+	t.Parallel()
+	vs, err := NewVirtualServer(11241)
+	assert.NoError(t, err)
+	defer vs.Stop()
+
+	peers := []string{"peer1", "peer2", "peer3"}
+	instances := make([]Comm, len(peers))
+	msgs := make([]<-chan proto.ReceivedMessage, len(peers))
+	for i, id := range peers {
+		instances[i], err = vs.NewInstance(identity.NewIdentityMapper(naiveSec), []byte(id))
+		assert.NoError(t, err)
+		defer instances[i].Stop()
+		msgs[i] = instances[i].Accept(acceptAll)
+	}
+	_, err = vs.NewInstance(identity.NewIdentityMapper(naiveSec), []byte("peer1"))
+	assert.Error(t, err)
+
+	virtualPeer := func(id string) *RemotePeer {
+		return &RemotePeer{Endpoint: "localhost:11241", PKIID: common.PKIidType(id)}
+	}
+
+	// Each instance only receives the messages sent to it
+	instances[0].Send(createGossipMsg(), virtualPeer("peer2"))
+	instances[2].Send(createGossipMsg(), virtualPeer("peer2"), virtualPeer("peer1"))
+	expected := []int{1, 2, 0}
+	for i := range peers {
+		for j := 0; j < expected[i]; j++ {
+			select {
+			case m := <-msgs[i]:
+				assert.True(t, m.GetConnectionInfo().IsAuthenticated())
+			case <-time.After(time.Second * 5):
+				t.Fatalf("%s didn't receive a message", peers[i])
+			}
+		}
+	}
+	select {
+	case <-msgs[2]:
+		t.Fatal("peer3 received a message that wasn't sent to it")
+	case <-time.After(time.Millisecond * 500):
+	}
+
+	identity, err := instances[0].Handshake(virtualPeer("peer3"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("peer3"), []byte(identity))
+
+	// Streams to instances that don't share the server are rejected
+	_, err = instances[0].Handshake(virtualPeer("peer4"))
+	assert.Error(t, err)
+	instances[1].Stop()
+	_, err = instances[0].Handshake(virtualPeer("peer2"))
+	assert.Error(t, err)
+
+	// A stream that is routed to an instance other than the one named in the
+	// connection message of the remote peer is rejected by the instance
+	inst := instances[0].(*commImpl)
+	cc, err := inst.dial("localhost:11241")
+	assert.NoError(t, err)
+	defer cc.Close()
+	stream, err := proto.NewGossipClient(cc).GossipStream(inst.streamContext(common.PKIidType("peer3")))
+	assert.NoError(t, err)
+	_, err = inst.authenticateRemotePeer(stream, common.PKIidType("peer2"))
+	if err == nil {
+		inst.idMapper.Release(common.PKIidType("peer3"))
+	}
+	peer3 := instances[2].(*commImpl)
+	deadline := time.Now().Add(time.Second * 5)
+	for peer3.HandshakeFailures() == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.Equal(t, uint64(1), peer3.HandshakeFailures())
+	assert.False(t, peer3.connStore.hasConnection(inst.PKIID))
+}
@@ -52,6 +52,10 @@ type Mapper interface {
 	// Verify verifies a signed message
 	Verify(vkID, signature, message []byte) error
 
+	// VerifyWithIdentity verifies a message signed by the given identity,
+	// which doesn't need to be associated with its pkiID in the mapper
+	VerifyWithIdentity(peerIdentity api.PeerIdentityType, signature, message []byte) error
+
 	// GetPKIidOfCert returns the PKI-ID of a certificate
 	GetPKIidOfCert(api.PeerIdentityType) common.PKIidType
 
@@ -59,6 +63,11 @@ type Mapper interface {
 	// peer identities have been revoked, expired or haven't been used
 	// for a long time
 	ListInvalidIdentities(isSuspected api.PeerSuspector) []common.PKIidType
+
+	// Release notifies the mapper that the identity of the given pkiID is no
+	// longer referenced by the caller. Each call releases the reference taken by
+	// a single Put, and the identity is removed once all references are released
+	Release(pkiID common.PKIidType)
 }
 
 // identityMapperImpl is a struct that implements Mapper
@@ -97,7 +106,11 @@ func (is *identityMapperImpl) Put(pkiID common.PKIidType, identity api.PeerIdent
 
 	is.Lock()
 	defer is.Unlock()
-	is.pkiID2Cert[string(id)] = newStoredIdentity(identity)
+	stored := newStoredIdentity(identity)
+	if prev, exists := is.pkiID2Cert[string(id)]; exists {
+		stored.refs += prev.refs
+	}
+	is.pkiID2Cert[string(id)] = stored
 	return nil
 }
 
@@ -128,6 +141,15 @@ func (is *identityMapperImpl) Verify(vkID, signature, message []byte) error {
 	return is.mcs.Verify(cert, signature, message)
 }
 
+// VerifyWithIdentity verifies a message signed by the given identity,
+// which doesn't need to be associated with its pkiID in the mapper
+func (is *identityMapperImpl) VerifyWithIdentity(peerIdentity api.PeerIdentityType, signature, message []byte) error {
+	if peerIdentity == nil {
+		return errors.New("identity is nil")
+	}
+	return is.mcs.Verify(peerIdentity, signature, message)
+}
+
 // GetPKIidOfCert returns the PKI-ID of a certificate
 func (is *identityMapperImpl) GetPKIidOfCert(identity api.PeerIdentityType) common.PKIidType {
 	return is.mcs.GetPKIidOfCert(identity)
@@ -149,6 +171,21 @@ func (is *identityMapperImpl) ListInvalidIdentities(isSuspected api.PeerSuspecto
 	return revokedIds
 }
 
+// Release releases a reference to the identity of the given pkiID,
+// and removes the identity once it's no longer referenced
+func (is *identityMapperImpl) Release(pkiID common.PKIidType) {
+	is.Lock()
+	defer is.Unlock()
+	storedIdentity, exists := is.pkiID2Cert[string(pkiID)]
+	if !exists {
+		return
+	}
+	storedIdentity.refs--
+	if storedIdentity.refs <= 0 {
+		delete(is.pkiID2Cert, string(pkiID))
+	}
+}
+
 // validateIdentities returns a list of identities that have been revoked, expired or haven't been
 // used for a long time
 func (is *identityMapperImpl) validateIdentities(isSuspected api.PeerSuspector) []common.PKIidType {
@@ -174,12 +211,14 @@ func (is *identityMapperImpl) validateIdentities(isSuspected api.PeerSuspector)
 type storedIdentity struct {
 	lastAccessTime int64
 	peerIdentity   api.PeerIdentityType
+	refs           int // number of Put calls not yet released, guarded by the lock of the mapper
 }
 
 func newStoredIdentity(identity api.PeerIdentityType) *storedIdentity {
 	return &storedIdentity{
 		lastAccessTime: time.Now().UnixNano(),
 		peerIdentity:   identity,
+		refs:           1,
 	}
 }
 
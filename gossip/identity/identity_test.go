@@ -122,6 +122,36 @@ func TestVerify(t *testing.T) {
 	assert.Error(t, idStore.Verify(pkiID2, signed, []byte("bla bla")))
 }
 
+func TestVerifyWithIdentity(t *testing.T) {
+	idStore := NewIdentityMapper(msgCryptoService)
+	identity := api.PeerIdentityType("yacovm")
+	signed, err := idStore.Sign([]byte("bla bla"))
+	assert.NoError(t, err)
+	// The identity doesn't need to be in the mapper, and isn't put in it
+	assert.NoError(t, idStore.VerifyWithIdentity(identity, signed, []byte("bla bla")))
+	assert.Error(t, idStore.VerifyWithIdentity(identity, signed, []byte("bla")))
+	assert.Error(t, idStore.VerifyWithIdentity(nil, signed, []byte("bla bla")))
+	_, err = idStore.Get(msgCryptoService.GetPKIidOfCert(identity))
+	assert.Error(t, err)
+}
+
+func TestRelease(t *testing.T) {
+	idStore := NewIdentityMapper(msgCryptoService)
+	identity := []byte("yacovm")
+	pkiID := msgCryptoService.GetPKIidOfCert(api.PeerIdentityType(identity))
+	assert.NoError(t, idStore.Put(pkiID, identity))
+	assert.NoError(t, idStore.Put(pkiID, identity))
+	// The identity is kept as long as a Put wasn't released
+	idStore.Release(pkiID)
+	_, err := idStore.Get(pkiID)
+	assert.NoError(t, err)
+	idStore.Release(pkiID)
+	_, err = idStore.Get(pkiID)
+	assert.Error(t, err)
+	// Releasing an unknown identity is a no-op
+	idStore.Release(pkiID)
+}
+
 func TestListInvalidIdentities(t *testing.T) {
 	idStore := NewIdentityMapper(msgCryptoService)
 	identity := []byte("yacovm")
@@ -340,6 +340,12 @@ type ConnectionInfo struct {
 	ID       common.PKIidType
 	Auth     *AuthInfo
 	Identity api.PeerIdentityType
+	// TLSCertHash is the hash of the TLS certificate the remote peer
+	// presented for the session, or nil if the session isn't over TLS
+	TLSCertHash []byte
+	// ProtocolVersion is the version of the gossip protocol negotiated
+	// with the remote peer during the handshake
+	ProtocolVersion uint32
 }
 
 func (connInfo *ConnectionInfo) IsAuthenticated() bool {
@@ -33,6 +33,7 @@ It has these top-level messages:
 	Empty
 	RemoteStateRequest
 	RemoteStateResponse
+	Ack
 */
 package gossip
 
@@ -116,11 +117,13 @@ func (GossipMessage_Tag) EnumDescriptor() ([]byte, []int) { return fileDescripto
 // Envelope contains a marshalled
 // GossipMessage and a signature over it.
 // It may also contain a SecretEnvelope
-// which is a marshalled Secret
+// which is a marshalled Secret, and metadata
+// that isn't covered by the signature
 type Envelope struct {
-	Payload        []byte          `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
-	Signature      []byte          `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
-	SecretEnvelope *SecretEnvelope `protobuf:"bytes,3,opt,name=secretEnvelope" json:"secretEnvelope,omitempty"`
+	Payload        []byte            `protobuf:"bytes,1,opt,name=payload,proto3" json:"payload,omitempty"`
+	Signature      []byte            `protobuf:"bytes,2,opt,name=signature,proto3" json:"signature,omitempty"`
+	SecretEnvelope *SecretEnvelope   `protobuf:"bytes,3,opt,name=secretEnvelope" json:"secretEnvelope,omitempty"`
+	Metadata       map[string]string `protobuf:"bytes,4,rep,name=metadata" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key" protobuf_val:"bytes,2,opt,name=value"`
 }
 
 func (m *Envelope) Reset()                    { *m = Envelope{} }
@@ -135,6 +138,13 @@ func (m *Envelope) GetSecretEnvelope() *SecretEnvelope {
 	return nil
 }
 
+func (m *Envelope) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 // SecretEnvelope is a marshalled Secret
 // and a signature over it.
 // The signature should be validated by the peer
@@ -269,6 +279,7 @@ type GossipMessage struct {
 	//	*GossipMessage_StateResponse
 	//	*GossipMessage_LeadershipMsg
 	//	*GossipMessage_PeerIdentity
+	//	*GossipMessage_Ack
 	Content isGossipMessage_Content `protobuf_oneof:"content"`
 }
 
@@ -332,6 +343,9 @@ type GossipMessage_LeadershipMsg struct {
 type GossipMessage_PeerIdentity struct {
 	PeerIdentity *PeerIdentity `protobuf:"bytes,21,opt,name=peer_identity,json=peerIdentity,oneof"`
 }
+type GossipMessage_Ack struct {
+	Ack *Ack `protobuf:"bytes,22,opt,name=ack,oneof"`
+}
 
 func (*GossipMessage_AliveMsg) isGossipMessage_Content()         {}
 func (*GossipMessage_MemReq) isGossipMessage_Content()           {}
@@ -350,6 +364,7 @@ func (*GossipMessage_StateRequest) isGossipMessage_Content()     {}
 func (*GossipMessage_StateResponse) isGossipMessage_Content()    {}
 func (*GossipMessage_LeadershipMsg) isGossipMessage_Content()    {}
 func (*GossipMessage_PeerIdentity) isGossipMessage_Content()     {}
+func (*GossipMessage_Ack) isGossipMessage_Content()              {}
 
 func (m *GossipMessage) GetContent() isGossipMessage_Content {
 	if m != nil {
@@ -477,6 +492,13 @@ func (m *GossipMessage) GetPeerIdentity() *PeerIdentity {
 	return nil
 }
 
+func (m *GossipMessage) GetAck() *Ack {
+	if x, ok := m.GetContent().(*GossipMessage_Ack); ok {
+		return x.Ack
+	}
+	return nil
+}
+
 // XXX_OneofFuncs is for the internal use of the proto package.
 func (*GossipMessage) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer) error, func(msg proto.Message, tag, wire int, b *proto.Buffer) (bool, error), func(msg proto.Message) (n int), []interface{}) {
 	return _GossipMessage_OneofMarshaler, _GossipMessage_OneofUnmarshaler, _GossipMessage_OneofSizer, []interface{}{
@@ -497,6 +519,7 @@ func (*GossipMessage) XXX_OneofFuncs() (func(msg proto.Message, b *proto.Buffer)
 		(*GossipMessage_StateResponse)(nil),
 		(*GossipMessage_LeadershipMsg)(nil),
 		(*GossipMessage_PeerIdentity)(nil),
+		(*GossipMessage_Ack)(nil),
 	}
 }
 
@@ -589,6 +612,11 @@ func _GossipMessage_OneofMarshaler(msg proto.Message, b *proto.Buffer) error {
 		if err := b.EncodeMessage(x.PeerIdentity); err != nil {
 			return err
 		}
+	case *GossipMessage_Ack:
+		b.EncodeVarint(22<<3 | proto.WireBytes)
+		if err := b.EncodeMessage(x.Ack); err != nil {
+			return err
+		}
 	case nil:
 	default:
 		return fmt.Errorf("GossipMessage.Content has unexpected type %T", x)
@@ -735,6 +763,14 @@ func _GossipMessage_OneofUnmarshaler(msg proto.Message, tag, wire int, b *proto.
 		err := b.DecodeMessage(msg)
 		m.Content = &GossipMessage_PeerIdentity{msg}
 		return true, err
+	case 22: // content.ack
+		if wire != proto.WireBytes {
+			return true, proto.ErrInternalBadWireType
+		}
+		msg := new(Ack)
+		err := b.DecodeMessage(msg)
+		m.Content = &GossipMessage_Ack{msg}
+		return true, err
 	default:
 		return false, nil
 	}
@@ -829,6 +865,11 @@ func _GossipMessage_OneofSizer(msg proto.Message) (n int) {
 		n += proto.SizeVarint(21<<3 | proto.WireBytes)
 		n += proto.SizeVarint(uint64(s))
 		n += s
+	case *GossipMessage_Ack:
+		s := proto.Size(x.Ack)
+		n += proto.SizeVarint(22<<3 | proto.WireBytes)
+		n += proto.SizeVarint(uint64(s))
+		n += s
 	case nil:
 	default:
 		panic(fmt.Sprintf("proto: unexpected type %T in oneof", x))
@@ -901,9 +942,11 @@ func (*StateInfoPullRequest) Descriptor() ([]byte, []int) { return fileDescripto
 // Whenever a peer connects to another peer, it handshakes
 // with it by sending this message that proves its identity
 type ConnEstablish struct {
-	PkiId []byte `protobuf:"bytes,1,opt,name=pki_id,json=pkiId,proto3" json:"pki_id,omitempty"`
-	Cert  []byte `protobuf:"bytes,2,opt,name=cert,proto3" json:"cert,omitempty"`
-	Hash  []byte `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	PkiId           []byte `protobuf:"bytes,1,opt,name=pki_id,json=pkiId,proto3" json:"pki_id,omitempty"`
+	Cert            []byte `protobuf:"bytes,2,opt,name=cert,proto3" json:"cert,omitempty"`
+	Hash            []byte `protobuf:"bytes,3,opt,name=hash,proto3" json:"hash,omitempty"`
+	ProtocolVersion uint32 `protobuf:"varint,4,opt,name=protocol_version,json=protocolVersion" json:"protocol_version,omitempty"`
+	TargetPkiId     []byte `protobuf:"bytes,5,opt,name=target_pki_id,json=targetPkiId,proto3" json:"target_pki_id,omitempty"`
 }
 
 func (m *ConnEstablish) Reset()                    { *m = ConnEstablish{} }
@@ -1167,6 +1210,17 @@ func (m *RemoteStateResponse) GetPayloads() []*Payload {
 	return nil
 }
 
+// Ack acknowledges that the message
+// with the given nonce was handled
+type Ack struct {
+	Nonce uint64 `protobuf:"varint,1,opt,name=nonce" json:"nonce,omitempty"`
+}
+
+func (m *Ack) Reset()                    { *m = Ack{} }
+func (m *Ack) String() string            { return proto.CompactTextString(m) }
+func (*Ack) ProtoMessage()               {}
+func (*Ack) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{24} }
+
 func init() {
 	proto.RegisterType((*Envelope)(nil), "gossip.Envelope")
 	proto.RegisterType((*SecretEnvelope)(nil), "gossip.SecretEnvelope")
@@ -1192,6 +1246,7 @@ func init() {
 	proto.RegisterType((*Empty)(nil), "gossip.Empty")
 	proto.RegisterType((*RemoteStateRequest)(nil), "gossip.RemoteStateRequest")
 	proto.RegisterType((*RemoteStateResponse)(nil), "gossip.RemoteStateResponse")
+	proto.RegisterType((*Ack)(nil), "gossip.Ack")
 	proto.RegisterEnum("gossip.PullMsgType", PullMsgType_name, PullMsgType_value)
 	proto.RegisterEnum("gossip.GossipMessage_Tag", GossipMessage_Tag_name, GossipMessage_Tag_value)
 }
@@ -1341,90 +1396,98 @@ var _Gossip_serviceDesc = grpc.ServiceDesc{
 func init() { proto.RegisterFile("gossip/message.proto", fileDescriptor0) }
 
 var fileDescriptor0 = []byte{
-	// 1352 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x09, 0x6e, 0x88, 0x02, 0xff, 0xb4, 0x57, 0xdd, 0x6f, 0xe3, 0x44,
-	0x10, 0x8f, 0x9b, 0x4f, 0x4f, 0x3e, 0x9a, 0x6e, 0x7b, 0x60, 0xca, 0x71, 0xaa, 0x2c, 0xee, 0x54,
-	0xe8, 0x91, 0x9e, 0x7a, 0x80, 0x4e, 0x3a, 0x81, 0x94, 0x36, 0xa1, 0x09, 0x5c, 0xd2, 0xca, 0xcd,
-	0x09, 0x8e, 0x17, 0x6b, 0x13, 0x6f, 0x1d, 0x73, 0xf6, 0xda, 0xf5, 0x6e, 0x0e, 0xfa, 0x08, 0x8f,
-	0x3c, 0xf0, 0xcc, 0x9f, 0x8b, 0xbc, 0x6b, 0x3b, 0x76, 0xdd, 0x9e, 0xd4, 0x93, 0x78, 0xf3, 0x7c,
-	0xfc, 0x66, 0x66, 0x67, 0x67, 0x67, 0xc6, 0xb0, 0x63, 0xfb, 0x8c, 0x39, 0xc1, 0xa1, 0x47, 0x18,
-	0xc3, 0x36, 0xe9, 0x05, 0xa1, 0xcf, 0x7d, 0x54, 0x93, 0x5c, 0xfd, 0x2f, 0x05, 0x1a, 0x43, 0xfa,
-	0x8e, 0xb8, 0x7e, 0x40, 0x90, 0x06, 0xf5, 0x00, 0x5f, 0xbb, 0x3e, 0xb6, 0x34, 0x65, 0x4f, 0xd9,
-	0x6f, 0x19, 0x09, 0x89, 0x1e, 0x82, 0xca, 0x1c, 0x9b, 0x62, 0xbe, 0x0a, 0x89, 0xb6, 0x21, 0x64,
-	0x6b, 0x06, 0xfa, 0x1e, 0x3a, 0x8c, 0x2c, 0x42, 0xc2, 0x13, 0x4b, 0x5a, 0x79, 0x4f, 0xd9, 0x6f,
-	0x1e, 0x7d, 0xd4, 0x93, 0x5e, 0x7a, 0x17, 0x39, 0xa9, 0x71, 0x43, 0x5b, 0x1f, 0x41, 0x27, 0xaf,
-	0xf1, 0xa1, 0x91, 0xe8, 0x7d, 0xa8, 0x49, 0x4b, 0xe8, 0x29, 0x74, 0x1d, 0xca, 0x49, 0x48, 0xb1,
-	0x3b, 0xa4, 0x56, 0xe0, 0x3b, 0x94, 0x0b, 0x53, 0xea, 0xa8, 0x64, 0x14, 0x24, 0xc7, 0x2a, 0xd4,
-	0x17, 0x3e, 0xe5, 0x84, 0x72, 0xfd, 0x5f, 0x15, 0xda, 0xa7, 0x22, 0xec, 0x89, 0xcc, 0x18, 0xda,
-	0x81, 0x2a, 0xf5, 0xe9, 0x82, 0x08, 0x7c, 0xc5, 0x90, 0x44, 0x14, 0xe2, 0x62, 0x89, 0x29, 0x25,
-	0x6e, 0x1c, 0x46, 0x42, 0xa2, 0x03, 0x28, 0x73, 0x6c, 0x8b, 0x1c, 0x74, 0x8e, 0x3e, 0x49, 0x72,
-	0x90, 0xb3, 0xd9, 0x9b, 0x61, 0xdb, 0x88, 0xb4, 0xd0, 0x73, 0x50, 0xb1, 0xeb, 0xbc, 0x23, 0xa6,
-	0xc7, 0x6c, 0xad, 0x2a, 0xd2, 0xb6, 0x93, 0x40, 0xfa, 0x91, 0x20, 0x46, 0x8c, 0x4a, 0x46, 0x43,
-	0x28, 0x4e, 0x98, 0x8d, 0xbe, 0x86, 0xba, 0x47, 0x3c, 0x33, 0x24, 0x57, 0x5a, 0x4d, 0x40, 0x52,
-	0x2f, 0x13, 0xe2, 0xcd, 0x49, 0xc8, 0x96, 0x4e, 0x60, 0x90, 0xab, 0x15, 0x61, 0x7c, 0x54, 0x32,
-	0x6a, 0x1e, 0xf1, 0x0c, 0x72, 0x85, 0xbe, 0x49, 0x50, 0x4c, 0xab, 0x0b, 0xd4, 0xee, 0x6d, 0x28,
-	0x16, 0xf8, 0x94, 0x91, 0x14, 0xc6, 0xd0, 0x33, 0x68, 0x58, 0x98, 0x63, 0x11, 0x60, 0x43, 0xe0,
-	0xb6, 0x13, 0xdc, 0x00, 0x73, 0xbc, 0x8e, 0xaf, 0x1e, 0xa9, 0x45, 0xe1, 0x1d, 0x40, 0x75, 0x49,
-	0x5c, 0xd7, 0xd7, 0xd4, 0xbc, 0xba, 0x4c, 0xc1, 0x28, 0x12, 0x8d, 0x4a, 0x86, 0xd4, 0x41, 0x87,
-	0xb1, 0x79, 0xcb, 0xb1, 0x35, 0x10, 0xfa, 0x28, 0x6b, 0x7e, 0xe0, 0xd8, 0xf2, 0x14, 0xc2, 0xfa,
-	0xc0, 0xb1, 0xd3, 0x78, 0xa2, 0xd3, 0x37, 0x8b, 0xf1, 0xac, 0xcf, 0x2d, 0x10, 0xf2, 0xe0, 0x4d,
-	0x81, 0x58, 0x05, 0x16, 0xe6, 0x44, 0x6b, 0x15, 0xbd, 0xbc, 0x16, 0x92, 0x51, 0xc9, 0x00, 0x2b,
-	0xa5, 0xd0, 0x63, 0xa8, 0x12, 0x2f, 0xe0, 0xd7, 0x5a, 0x5b, 0x00, 0xda, 0x09, 0x60, 0x18, 0x31,
-	0xa3, 0x03, 0x08, 0x29, 0x3a, 0x80, 0xca, 0xc2, 0xa7, 0x54, 0xeb, 0x08, 0xad, 0x07, 0x89, 0xd6,
-	0x89, 0x4f, 0xe9, 0x90, 0x71, 0x3c, 0x77, 0x1d, 0xb6, 0x1c, 0x95, 0x0c, 0xa1, 0x84, 0x8e, 0x00,
-	0x18, 0xc7, 0x9c, 0x98, 0x0e, 0xbd, 0xf4, 0xb5, 0x4d, 0x01, 0xd9, 0x4a, 0x9f, 0x49, 0x24, 0x19,
-	0xd3, 0xcb, 0x28, 0x3b, 0x2a, 0x4b, 0x08, 0x74, 0x0c, 0x1d, 0x89, 0x61, 0x14, 0x07, 0x6c, 0xe9,
-	0x73, 0xad, 0x9b, 0xbf, 0xf4, 0x14, 0x77, 0x11, 0x2b, 0x8c, 0x4a, 0x46, 0x5b, 0x40, 0x12, 0x06,
-	0x9a, 0xc0, 0xf6, 0xda, 0xaf, 0x19, 0xac, 0x5c, 0x57, 0xe4, 0x6f, 0x4b, 0x18, 0x7a, 0x58, 0x30,
-	0x74, 0xbe, 0x72, 0xdd, 0x75, 0x22, 0xbb, 0xec, 0x06, 0x1f, 0xf5, 0x41, 0xda, 0x8f, 0x8c, 0x44,
-	0x4a, 0x1a, 0xca, 0x17, 0x94, 0x41, 0x3c, 0x9f, 0x13, 0x61, 0x6e, 0x6d, 0xa6, 0xc5, 0x32, 0x34,
-	0x1a, 0x24, 0xa7, 0x0a, 0xe3, 0x92, 0xd3, 0xb6, 0x85, 0x8d, 0x4f, 0x6f, 0xb5, 0x91, 0x56, 0x65,
-	0x9b, 0x65, 0x19, 0x51, 0x6e, 0x5c, 0x82, 0x2d, 0x59, 0xbc, 0xa2, 0x44, 0x77, 0xf2, 0xb9, 0x79,
-	0x95, 0x4a, 0xd7, 0x85, 0xda, 0x5e, 0x43, 0xa2, 0x72, 0x7d, 0x09, 0xed, 0x80, 0x90, 0xd0, 0x74,
-	0x2c, 0x42, 0xb9, 0xc3, 0xaf, 0xb5, 0x07, 0xf9, 0x67, 0x78, 0x4e, 0x48, 0x38, 0x8e, 0x65, 0xd1,
-	0x31, 0x82, 0x0c, 0xad, 0x9b, 0x50, 0x9e, 0x61, 0x1b, 0xb5, 0x41, 0x7d, 0x3d, 0x1d, 0x0c, 0x7f,
-	0x18, 0x4f, 0x87, 0x83, 0x6e, 0x09, 0xa9, 0x50, 0x1d, 0x4e, 0xce, 0x67, 0x6f, 0xba, 0x0a, 0x6a,
-	0x41, 0xe3, 0xcc, 0x38, 0x35, 0xcf, 0xa6, 0xaf, 0xde, 0x74, 0x37, 0x22, 0xbd, 0x93, 0x51, 0x7f,
-	0x2a, 0xc9, 0x32, 0xea, 0x42, 0x4b, 0x90, 0xfd, 0xe9, 0xc0, 0x3c, 0x33, 0x4e, 0xbb, 0x15, 0xb4,
-	0x09, 0x4d, 0xa9, 0x60, 0x08, 0x46, 0x35, 0xdb, 0x9a, 0xfe, 0x51, 0x40, 0x4d, 0xaf, 0x08, 0xed,
-	0x42, 0xc3, 0x23, 0x1c, 0x47, 0x05, 0x1b, 0x37, 0xc9, 0x94, 0x46, 0x3d, 0x50, 0xb9, 0xe3, 0x11,
-	0xc6, 0xb1, 0x17, 0x88, 0xf6, 0xd4, 0x3c, 0xea, 0x66, 0x8f, 0x33, 0x73, 0x3c, 0x62, 0xac, 0x55,
-	0xd0, 0x03, 0xa8, 0x05, 0x6f, 0x1d, 0xd3, 0xb1, 0x44, 0xd7, 0x6a, 0x19, 0xd5, 0xe0, 0xad, 0x33,
-	0xb6, 0xd0, 0x23, 0x80, 0xb8, 0xa9, 0x4d, 0xfa, 0x27, 0x5a, 0x45, 0x88, 0x32, 0x1c, 0xbd, 0x0f,
-	0x5b, 0x85, 0xda, 0x43, 0x4f, 0xa1, 0x41, 0x5c, 0xe2, 0x11, 0xca, 0x99, 0xa6, 0xec, 0x95, 0xb3,
-	0xae, 0xd3, 0x09, 0x90, 0x6a, 0xe8, 0xdf, 0xc2, 0xce, 0x6d, 0x55, 0x77, 0xc3, 0xb5, 0x52, 0x70,
-	0x3d, 0x85, 0x76, 0xee, 0x85, 0x65, 0x8e, 0xa0, 0x64, 0x8f, 0x80, 0xa0, 0xb2, 0x20, 0x21, 0x8f,
-	0x7b, 0xb4, 0xf8, 0x8e, 0x78, 0x4b, 0xcc, 0x96, 0xf1, 0x59, 0xc5, 0xb7, 0xfe, 0x1a, 0x5a, 0xd9,
-	0x7b, 0xbe, 0x8f, 0xb9, 0xec, 0x45, 0x94, 0xf3, 0x17, 0xa1, 0x7b, 0xd0, 0xcc, 0x34, 0xa5, 0xbb,
-	0x47, 0x89, 0x25, 0xda, 0x1c, 0xd3, 0x36, 0xf6, 0xca, 0xfb, 0xaa, 0x91, 0x90, 0xa8, 0x07, 0x0d,
-	0x8f, 0xd9, 0x26, 0xbf, 0x8e, 0x67, 0x6a, 0x67, 0xdd, 0xeb, 0xa2, 0x64, 0x4d, 0x98, 0x3d, 0xbb,
-	0x0e, 0x88, 0x51, 0xf7, 0xe4, 0x87, 0xee, 0x43, 0x33, 0xd3, 0x64, 0xef, 0x70, 0x97, 0x8d, 0x77,
-	0xa3, 0x50, 0x38, 0xf7, 0x73, 0xf8, 0x07, 0xc0, 0xba, 0x7f, 0xde, 0xe1, 0xef, 0x73, 0xa8, 0xc4,
-	0xbe, 0x6e, 0x2f, 0x86, 0xca, 0x07, 0x79, 0x76, 0xa5, 0x67, 0x39, 0x1f, 0xfe, 0xf7, 0xc4, 0xbe,
-	0x90, 0xf7, 0x98, 0xac, 0x04, 0x5f, 0xe4, 0xf7, 0x93, 0xe6, 0xd1, 0x66, 0x8a, 0x96, 0xec, 0x74,
-	0x61, 0xd1, 0x7f, 0x84, 0x7a, 0xcc, 0x43, 0x1f, 0x43, 0x9d, 0x91, 0x2b, 0x93, 0xae, 0xbc, 0x38,
-	0xcc, 0x1a, 0x23, 0x57, 0xd3, 0x95, 0x97, 0x16, 0x64, 0x74, 0x1b, 0xaa, 0x2c, 0xc8, 0x88, 0x97,
-	0xa9, 0x28, 0xf1, 0xad, 0xff, 0xad, 0x40, 0x2b, 0xbb, 0x14, 0xa0, 0x1e, 0x80, 0x97, 0xce, 0xee,
-	0x38, 0x94, 0x4e, 0x7e, 0xaa, 0x1b, 0x19, 0x8d, 0x7b, 0xf7, 0x85, 0x5d, 0x68, 0xa4, 0x5d, 0x51,
-	0x3e, 0xff, 0x94, 0xd6, 0xff, 0x54, 0x60, 0xab, 0xd0, 0x5d, 0xef, 0x7a, 0x37, 0xf7, 0x75, 0xfc,
-	0x18, 0x3a, 0x0e, 0x33, 0x2d, 0xb2, 0x70, 0x71, 0x88, 0xb9, 0xe3, 0x53, 0x91, 0x87, 0x86, 0xd1,
-	0x76, 0xd8, 0x60, 0xcd, 0xd4, 0x8f, 0xa1, 0x91, 0xa0, 0xd1, 0x67, 0x00, 0x0e, 0x5d, 0x44, 0xd9,
-	0x9d, 0x93, 0x30, 0x4e, 0xb0, 0xea, 0xd0, 0xc5, 0x54, 0x30, 0xb2, 0xc9, 0xdf, 0xc8, 0x26, 0x5f,
-	0xbf, 0x84, 0xad, 0xc2, 0xd6, 0x84, 0x5e, 0x42, 0x97, 0x11, 0xf7, 0x52, 0x8c, 0xcb, 0xd0, 0x93,
-	0x11, 0x28, 0xf9, 0xb0, 0xd3, 0xfa, 0xdd, 0x8c, 0x34, 0xc7, 0x6b, 0xc5, 0xa8, 0x18, 0xdf, 0x52,
-	0xff, 0x77, 0x2a, 0x8a, 0xae, 0x65, 0x48, 0x42, 0x9f, 0x03, 0x2a, 0xee, 0x59, 0xe8, 0x09, 0x54,
-	0xc5, 0x5a, 0x77, 0x67, 0xab, 0x94, 0x62, 0xf1, 0x88, 0x08, 0xb6, 0xde, 0xf3, 0x88, 0x08, 0xb6,
-	0xf4, 0x9f, 0xa1, 0x26, 0x7d, 0x44, 0x37, 0x47, 0x72, 0x7b, 0xaf, 0x91, 0xd2, 0xef, 0x6d, 0x00,
-	0xb7, 0x4f, 0x02, 0xbd, 0x0e, 0x55, 0xb1, 0xf6, 0xe8, 0xbf, 0x00, 0x2a, 0x0e, 0x77, 0xa4, 0x8b,
-	0x7d, 0x20, 0xe4, 0x66, 0xbe, 0xbe, 0x9b, 0x82, 0x79, 0x21, 0x8b, 0xfc, 0x11, 0x34, 0x09, 0xb5,
-	0xcc, 0xfc, 0x25, 0xa8, 0x84, 0x5a, 0x52, 0xae, 0x1f, 0xc3, 0xf6, 0x2d, 0x23, 0x1f, 0x1d, 0x40,
-	0x23, 0x7e, 0x4a, 0xc9, 0x38, 0x29, 0xbc, 0xb5, 0x54, 0xe1, 0xcb, 0xef, 0xa0, 0x99, 0x79, 0xbe,
-	0x37, 0xa7, 0x72, 0x1b, 0xd4, 0xe3, 0x57, 0x67, 0x27, 0x3f, 0x99, 0x93, 0x8b, 0xd3, 0xae, 0x12,
-	0x0d, 0xdf, 0xf1, 0x60, 0x38, 0x9d, 0x8d, 0x67, 0x6f, 0x04, 0x67, 0xe3, 0xe8, 0x37, 0xa8, 0xc9,
-	0xf6, 0x89, 0x5e, 0x40, 0x4b, 0x7e, 0x5d, 0xf0, 0x90, 0x60, 0x0f, 0x15, 0x12, 0xbe, 0x5b, 0xe0,
-	0xe8, 0xa5, 0x7d, 0xe5, 0x99, 0x82, 0x9e, 0x40, 0xe5, 0xdc, 0xa1, 0x36, 0xca, 0xaf, 0x8b, 0xbb,
-	0x79, 0x52, 0x2f, 0x1d, 0x7f, 0xf5, 0xeb, 0x81, 0xed, 0xf0, 0xe5, 0x6a, 0xde, 0x5b, 0xf8, 0xde,
-	0xe1, 0xf2, 0x3a, 0x20, 0xa1, 0x4b, 0x2c, 0x9b, 0x84, 0x87, 0x97, 0x78, 0x1e, 0x3a, 0x8b, 0x43,
-	0xf1, 0xa3, 0xc6, 0x0e, 0x25, 0x6c, 0x5e, 0x13, 0xe4, 0xf3, 0xff, 0x02, 0x00, 0x00, 0xff, 0xff,
-	0xd6, 0x2d, 0x62, 0x5a, 0xcf, 0x0d, 0x00, 0x00,
+	// 1474 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xb4, 0x56, 0x5b, 0x73, 0xdb, 0x44,
+	0x14, 0xb6, 0xe2, 0xab, 0x8e, 0x2f, 0x71, 0x36, 0x69, 0x11, 0x69, 0x29, 0x19, 0x0d, 0xed, 0xa4,
+	0xa4, 0x38, 0x9d, 0x14, 0x98, 0x4e, 0x3b, 0x30, 0xe3, 0xc4, 0x26, 0x0e, 0xd4, 0x4e, 0x46, 0x49,
+	0x81, 0xf2, 0xa2, 0xd9, 0x58, 0x1b, 0x59, 0x44, 0x5a, 0x29, 0xda, 0x75, 0xc0, 0x8f, 0xbc, 0xf2,
+	0xc0, 0x3f, 0xe0, 0x87, 0xf0, 0xdb, 0x78, 0x61, 0xb4, 0x2b, 0xc9, 0x52, 0xec, 0x74, 0x26, 0x9d,
+	0xe1, 0x6d, 0xcf, 0xe5, 0x3b, 0xb7, 0x3d, 0x7b, 0xf6, 0xc0, 0x86, 0xed, 0x33, 0xe6, 0x04, 0xbb,
+	0x1e, 0x61, 0x0c, 0xdb, 0xa4, 0x13, 0x84, 0x3e, 0xf7, 0x51, 0x45, 0x72, 0xf5, 0x7f, 0x15, 0xa8,
+	0xf5, 0xe9, 0x35, 0x71, 0xfd, 0x80, 0x20, 0x0d, 0xaa, 0x01, 0x9e, 0xb9, 0x3e, 0xb6, 0x34, 0x65,
+	0x4b, 0xd9, 0x6e, 0x18, 0x09, 0x89, 0x1e, 0x82, 0xca, 0x1c, 0x9b, 0x62, 0x3e, 0x0d, 0x89, 0xb6,
+	0x22, 0x64, 0x73, 0x06, 0xfa, 0x16, 0x5a, 0x8c, 0x8c, 0x43, 0xc2, 0x13, 0x4b, 0x5a, 0x71, 0x4b,
+	0xd9, 0xae, 0xef, 0xdd, 0xef, 0x48, 0x2f, 0x9d, 0xd3, 0x9c, 0xd4, 0xb8, 0xa1, 0x8d, 0x5e, 0x41,
+	0xcd, 0x23, 0x1c, 0x5b, 0x98, 0x63, 0xad, 0xb4, 0x55, 0xdc, 0xae, 0xef, 0x3d, 0x4a, 0x90, 0x89,
+	0x4e, 0x67, 0x18, 0x2b, 0xf4, 0x29, 0x0f, 0x67, 0x46, 0xaa, 0xbf, 0xf9, 0x1a, 0x9a, 0x39, 0x11,
+	0x6a, 0x43, 0xf1, 0x92, 0xcc, 0x44, 0x02, 0xaa, 0x11, 0x1d, 0xd1, 0x06, 0x94, 0xaf, 0xb1, 0x3b,
+	0x95, 0x81, 0xab, 0x86, 0x24, 0x5e, 0xad, 0xbc, 0x54, 0xf4, 0x01, 0xb4, 0xf2, 0xa1, 0x7d, 0x68,
+	0x09, 0xf4, 0x2e, 0x54, 0xa4, 0x25, 0xf4, 0x0c, 0xda, 0x0e, 0xe5, 0x24, 0xa4, 0xd8, 0xed, 0x53,
+	0x2b, 0xf0, 0x1d, 0xca, 0x65, 0x30, 0x83, 0x82, 0xb1, 0x20, 0xd9, 0x57, 0xa1, 0x3a, 0xf6, 0x29,
+	0x27, 0x94, 0xeb, 0xff, 0xa8, 0xd0, 0x3c, 0x14, 0x59, 0x0f, 0xe5, 0x55, 0x45, 0x81, 0x53, 0x9f,
+	0x8e, 0x89, 0xc0, 0x97, 0x0c, 0x49, 0x44, 0x21, 0x8e, 0x27, 0x98, 0x52, 0xe2, 0xc6, 0x61, 0x24,
+	0x24, 0xda, 0x81, 0x22, 0xc7, 0xb6, 0x28, 0x7e, 0x6b, 0xef, 0xe3, 0xa4, 0x84, 0x39, 0x9b, 0x9d,
+	0x33, 0x6c, 0x1b, 0x91, 0x16, 0x7a, 0x01, 0x2a, 0x76, 0x9d, 0x6b, 0x62, 0x7a, 0xcc, 0xd6, 0xca,
+	0xe2, 0xbe, 0x36, 0x12, 0x48, 0x37, 0x12, 0xc4, 0x88, 0x41, 0xc1, 0xa8, 0x09, 0xc5, 0x21, 0xb3,
+	0xd1, 0x97, 0x50, 0xf5, 0x88, 0x67, 0x86, 0xe4, 0x4a, 0xab, 0x08, 0x48, 0xea, 0x65, 0x48, 0xbc,
+	0x73, 0x12, 0xb2, 0x89, 0x13, 0x18, 0xe4, 0x6a, 0x4a, 0x18, 0x1f, 0x14, 0x8c, 0x8a, 0x47, 0x3c,
+	0x83, 0x5c, 0xa1, 0xaf, 0x12, 0x14, 0xd3, 0xaa, 0x02, 0xb5, 0xb9, 0x0c, 0xc5, 0x02, 0x9f, 0x32,
+	0x92, 0xc2, 0x18, 0x7a, 0x0e, 0xb5, 0xe8, 0x5a, 0x45, 0x80, 0x35, 0x81, 0x5b, 0x4f, 0x70, 0x3d,
+	0xcc, 0xf1, 0x3c, 0xbe, 0x6a, 0xa4, 0x16, 0x85, 0xb7, 0x03, 0xe5, 0x09, 0x71, 0x5d, 0x5f, 0x53,
+	0xf3, 0xea, 0xb2, 0x04, 0x83, 0x48, 0x34, 0x28, 0x18, 0x52, 0x07, 0xed, 0xc6, 0xe6, 0x2d, 0xc7,
+	0xd6, 0x40, 0xe8, 0xa3, 0xac, 0xf9, 0x9e, 0x63, 0xcb, 0x2c, 0x84, 0xf5, 0x9e, 0x63, 0xa7, 0xf1,
+	0x44, 0xd9, 0xd7, 0x17, 0xe3, 0x99, 0xe7, 0x2d, 0x10, 0x32, 0xf1, 0xba, 0x40, 0x4c, 0x03, 0x0b,
+	0x73, 0xa2, 0x35, 0x16, 0xbd, 0xbc, 0x15, 0x92, 0x41, 0xc1, 0x00, 0x2b, 0xa5, 0xd0, 0x63, 0x28,
+	0x13, 0x2f, 0xe0, 0x33, 0xad, 0x29, 0x00, 0xcd, 0xf4, 0x31, 0x44, 0xcc, 0x28, 0x01, 0x21, 0x45,
+	0x3b, 0x50, 0x1a, 0xfb, 0x94, 0x6a, 0x2d, 0xa1, 0x75, 0x2f, 0xd1, 0x3a, 0xf0, 0x29, 0xed, 0x33,
+	0x8e, 0xcf, 0x5d, 0x87, 0x4d, 0x06, 0x05, 0x43, 0x28, 0xa1, 0x3d, 0x00, 0xc6, 0x31, 0x27, 0xa6,
+	0x43, 0x2f, 0x7c, 0x6d, 0x55, 0x40, 0xd6, 0xd2, 0xf7, 0x19, 0x49, 0x8e, 0xe8, 0x45, 0x54, 0x1d,
+	0x95, 0x25, 0x04, 0xda, 0x87, 0x96, 0xc4, 0x30, 0x8a, 0x03, 0x36, 0xf1, 0xb9, 0xd6, 0xce, 0x5f,
+	0x7a, 0x8a, 0x3b, 0x8d, 0x15, 0x06, 0x05, 0xa3, 0x29, 0x20, 0x09, 0x03, 0x0d, 0x61, 0x7d, 0xee,
+	0xd7, 0x0c, 0xa6, 0xae, 0x2b, 0xea, 0xb7, 0x26, 0x0c, 0x3d, 0x5c, 0x30, 0x74, 0x32, 0x75, 0xdd,
+	0x79, 0x21, 0xdb, 0xec, 0x06, 0x1f, 0x75, 0x41, 0xda, 0x37, 0x43, 0xa9, 0xa4, 0xa1, 0x7c, 0x43,
+	0x19, 0xc4, 0xf3, 0x39, 0x11, 0xe6, 0xe6, 0x66, 0x1a, 0x2c, 0x43, 0xa3, 0x5e, 0x92, 0x55, 0x18,
+	0xb7, 0x9c, 0xb6, 0x2e, 0x6c, 0x3c, 0x58, 0x6a, 0x23, 0xed, 0xca, 0x26, 0xcb, 0x32, 0xa2, 0xda,
+	0xb8, 0x04, 0x5b, 0xb2, 0x79, 0x45, 0x8b, 0x6e, 0xe4, 0x6b, 0xf3, 0x26, 0x95, 0xce, 0x1b, 0xb5,
+	0x39, 0x87, 0x44, 0xed, 0xfa, 0x1a, 0x9a, 0x01, 0x21, 0xa1, 0xe9, 0x58, 0x84, 0x72, 0x87, 0xcf,
+	0xb4, 0x7b, 0xf9, 0x67, 0x78, 0x42, 0x48, 0x78, 0x14, 0xcb, 0xa2, 0x34, 0x82, 0x0c, 0x8d, 0x3e,
+	0x85, 0x22, 0x1e, 0x5f, 0x6a, 0xf7, 0x05, 0xa4, 0x9e, 0xbe, 0xdc, 0xf1, 0xe5, 0xa0, 0x60, 0x44,
+	0x12, 0xdd, 0x84, 0xe2, 0x19, 0xb6, 0x51, 0x13, 0xd4, 0xb7, 0xa3, 0x5e, 0xff, 0xbb, 0xa3, 0x51,
+	0xbf, 0xd7, 0x2e, 0x20, 0x15, 0xca, 0xfd, 0xe1, 0xc9, 0xd9, 0xbb, 0xb6, 0x82, 0x1a, 0x50, 0x3b,
+	0x36, 0x0e, 0xcd, 0xe3, 0xd1, 0x9b, 0x77, 0xed, 0x95, 0x48, 0xef, 0x60, 0xd0, 0x1d, 0x49, 0xb2,
+	0x88, 0xda, 0xd0, 0x10, 0x64, 0x77, 0xd4, 0x33, 0x8f, 0x8d, 0xc3, 0x76, 0x09, 0xad, 0x42, 0x5d,
+	0x2a, 0x18, 0x82, 0x51, 0xce, 0xce, 0xae, 0xbf, 0x14, 0x50, 0xd3, 0x3b, 0x44, 0x9b, 0x99, 0x79,
+	0x2e, 0xa7, 0x68, 0x4a, 0xa3, 0x0e, 0xa8, 0xdc, 0xf1, 0x08, 0xe3, 0xd8, 0x0b, 0xc4, 0xfc, 0xaa,
+	0xef, 0xb5, 0xb3, 0xf9, 0x9e, 0x39, 0x1e, 0x31, 0xe6, 0x2a, 0xe8, 0x1e, 0x54, 0x82, 0x4b, 0xc7,
+	0x74, 0x2c, 0x31, 0xd6, 0x1a, 0x46, 0x39, 0xb8, 0x74, 0x8e, 0x2c, 0xf4, 0x08, 0x20, 0x9e, 0x7a,
+	0xc3, 0xee, 0x81, 0x56, 0x12, 0xa2, 0x0c, 0x47, 0xef, 0xc2, 0xda, 0x42, 0x73, 0xa2, 0x67, 0x50,
+	0x23, 0x2e, 0xf1, 0x08, 0xe5, 0x4c, 0x53, 0xb6, 0x8a, 0x59, 0xd7, 0xe9, 0xdf, 0x94, 0x6a, 0xe8,
+	0x5f, 0xc3, 0xc6, 0xb2, 0xb6, 0xbc, 0xe1, 0x5a, 0x59, 0x70, 0xfd, 0xb7, 0x02, 0xcd, 0xdc, 0x1b,
+	0xcc, 0xe4, 0xa0, 0x64, 0x73, 0x40, 0x50, 0x1a, 0x93, 0x90, 0xc7, 0x53, 0x5c, 0x9c, 0x23, 0xde,
+	0x04, 0xb3, 0x49, 0x9c, 0xac, 0x38, 0xa3, 0xa7, 0xd0, 0x16, 0x9f, 0xf6, 0xd8, 0x77, 0xcd, 0x6b,
+	0x12, 0x32, 0xc7, 0xa7, 0x22, 0xe3, 0xa6, 0xb1, 0x9a, 0xf0, 0x7f, 0x94, 0x6c, 0xa4, 0x43, 0x93,
+	0xe3, 0xd0, 0x26, 0xdc, 0x8c, 0x1d, 0x96, 0x85, 0x9d, 0xba, 0x64, 0x9e, 0x44, 0x6e, 0xf5, 0xb7,
+	0xd0, 0xc8, 0x36, 0xd6, 0x5d, 0xa2, 0xcb, 0x5e, 0x6c, 0x31, 0x7f, 0xb1, 0xba, 0x07, 0xf5, 0xcc,
+	0x14, 0xbc, 0xfd, 0xef, 0xb2, 0xc4, 0x5c, 0x65, 0xda, 0xca, 0x56, 0x71, 0x5b, 0x35, 0x12, 0x12,
+	0x75, 0xa0, 0xe6, 0x31, 0xdb, 0xe4, 0xb3, 0x78, 0x7b, 0x68, 0xcd, 0x87, 0x6b, 0x54, 0xfc, 0x21,
+	0xb3, 0xcf, 0x66, 0x01, 0x31, 0xaa, 0x9e, 0x3c, 0xe8, 0x3e, 0xd4, 0x33, 0x53, 0xfd, 0x16, 0x77,
+	0xd9, 0x78, 0x57, 0x16, 0x1a, 0xf1, 0x6e, 0x0e, 0x7f, 0x07, 0x98, 0x0f, 0xec, 0x5b, 0xfc, 0x7d,
+	0x06, 0xa5, 0xd8, 0xd7, 0xf2, 0xe6, 0x2a, 0x7d, 0x90, 0x67, 0x17, 0x60, 0xfe, 0x21, 0xfd, 0xef,
+	0x85, 0x7d, 0x29, 0xef, 0x31, 0xd9, 0x41, 0x9e, 0xe6, 0x17, 0xa2, 0xfa, 0xde, 0x6a, 0x8a, 0x96,
+	0xec, 0x74, 0x43, 0xd2, 0xbf, 0x87, 0x6a, 0xcc, 0x43, 0x1f, 0x41, 0x95, 0x91, 0x2b, 0x93, 0x4e,
+	0xbd, 0x38, 0xcc, 0x0a, 0x23, 0x57, 0xa3, 0xa9, 0x97, 0xf6, 0xb7, 0x5c, 0xc5, 0xc4, 0x39, 0xe2,
+	0x65, 0x3a, 0x4a, 0x9c, 0xf5, 0x3f, 0x15, 0x68, 0x64, 0xb7, 0x10, 0xd4, 0x01, 0xf0, 0xd2, 0x65,
+	0x21, 0x0e, 0xa5, 0x95, 0x5f, 0x23, 0x8c, 0x8c, 0xc6, 0x9d, 0xe7, 0xcc, 0x26, 0xd4, 0xd2, 0x31,
+	0x2c, 0xc7, 0x49, 0x4a, 0xeb, 0x7f, 0x28, 0xb0, 0xb6, 0x30, 0xce, 0x6f, 0x7b, 0x37, 0x77, 0x75,
+	0xfc, 0x18, 0x5a, 0x0e, 0x33, 0x2d, 0x32, 0x76, 0x71, 0x88, 0x79, 0xf4, 0xb6, 0xa3, 0x3a, 0xd4,
+	0x8c, 0xa6, 0xc3, 0x7a, 0x73, 0xa6, 0xbe, 0x0f, 0xb5, 0x04, 0x8d, 0x3e, 0x01, 0x70, 0xe8, 0x38,
+	0xaa, 0xee, 0x39, 0x09, 0xe3, 0x02, 0xab, 0x0e, 0x1d, 0x8f, 0x04, 0x23, 0x5b, 0xfc, 0x95, 0x6c,
+	0xf1, 0xf5, 0x0b, 0x58, 0x5b, 0x58, 0xd3, 0xd0, 0x6b, 0x68, 0x33, 0xe2, 0x5e, 0x88, 0xff, 0x39,
+	0xf4, 0x64, 0x04, 0xca, 0x96, 0xb2, 0xb4, 0x7f, 0x57, 0x23, 0xcd, 0xa3, 0xb9, 0x62, 0xd4, 0x8c,
+	0x97, 0xd4, 0xff, 0x8d, 0x8a, 0xa6, 0x6b, 0x18, 0x92, 0xd0, 0xcf, 0x01, 0x2d, 0x2e, 0x76, 0xe8,
+	0x09, 0x94, 0xc5, 0x1e, 0x79, 0xeb, 0xe8, 0x95, 0x62, 0xf1, 0x88, 0x08, 0xb6, 0xde, 0xf3, 0x88,
+	0x08, 0xb6, 0xf4, 0x9f, 0xa0, 0x22, 0x7d, 0x44, 0x37, 0x47, 0x72, 0x8b, 0xb6, 0x91, 0xd2, 0xef,
+	0x1d, 0x00, 0xcb, 0x7f, 0x16, 0xbd, 0x0a, 0x65, 0xb1, 0x67, 0xe9, 0x3f, 0x03, 0x5a, 0xdc, 0x26,
+	0xa2, 0x09, 0xcb, 0x38, 0x0e, 0xb9, 0x99, 0xef, 0xef, 0xba, 0x60, 0x9e, 0xca, 0x26, 0x7f, 0x04,
+	0x75, 0x42, 0x2d, 0x33, 0x7f, 0x09, 0x2a, 0xa1, 0x96, 0x94, 0xeb, 0xfb, 0xb0, 0xbe, 0x64, 0xc7,
+	0x40, 0x3b, 0x50, 0x8b, 0x9f, 0x52, 0xf2, 0x3d, 0x2d, 0xbc, 0xb5, 0x54, 0x41, 0x7f, 0x00, 0xc5,
+	0xee, 0xf8, 0x72, 0xf9, 0x34, 0xf8, 0xfc, 0x1b, 0xa8, 0x67, 0xde, 0xf6, 0xcd, 0x15, 0xa0, 0x09,
+	0xea, 0xfe, 0x9b, 0xe3, 0x83, 0x1f, 0xcc, 0xe1, 0xe9, 0x61, 0x5b, 0x89, 0x7e, 0xfa, 0xa3, 0x5e,
+	0x7f, 0x74, 0x76, 0x74, 0xf6, 0x4e, 0x70, 0x56, 0xf6, 0x7e, 0x85, 0x8a, 0x9c, 0xad, 0xe8, 0x25,
+	0x34, 0xe4, 0xe9, 0x94, 0x87, 0x04, 0x7b, 0x68, 0xe1, 0x36, 0x36, 0x17, 0x38, 0x7a, 0x61, 0x5b,
+	0x79, 0xae, 0xa0, 0x27, 0x50, 0x3a, 0x71, 0xa8, 0x8d, 0xf2, 0xcb, 0xeb, 0x66, 0x9e, 0xd4, 0x0b,
+	0xfb, 0x5f, 0xfc, 0xb2, 0x63, 0x3b, 0x7c, 0x32, 0x3d, 0xef, 0x8c, 0x7d, 0x6f, 0x77, 0x32, 0x0b,
+	0x48, 0xe8, 0x12, 0xcb, 0x26, 0xe1, 0xee, 0x05, 0x3e, 0x0f, 0x9d, 0xf1, 0xae, 0xf8, 0xe2, 0xd8,
+	0xae, 0x84, 0x9d, 0x57, 0x04, 0xf9, 0xe2, 0xbf, 0x01, 0x00, 0xd9, 0x23, 0x1a, 0x5b, 0xd6, 0x0e,
+	0x00, 0x00,
 }